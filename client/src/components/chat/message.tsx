@@ -73,9 +73,9 @@ export function MessageComponent({
         onClick={() => onUserClick?.(message.username)}
       >
         <Avatar className="w-10 h-10 mt-1">
-          {(message.avatar_url || getUserAvatarUrl?.(message.username)) && (
+          {(message.avatar || message.avatar_url || getUserAvatarUrl?.(message.username)) && (
             <AvatarImage
-              src={message.avatar_url || getUserAvatarUrl?.(message.username)}
+              src={message.avatar || message.avatar_url || getUserAvatarUrl?.(message.username)}
               alt={message.username}
             />
           )}
@@ -14,6 +14,11 @@ export interface DMWebSocketMessage {
   message_status?: "sent" | "delivered" | "read";
   is_read?: boolean;
   is_delivered?: boolean;
+  read_at?: string;
+  edited?: boolean;
+  edited_at?: string;
+  unread_count?: number;
+  retry_after_ms?: number;
 }
 
 interface DMMessage {
@@ -34,6 +39,13 @@ interface UseDMWebSocketOptions {
     messageId: string,
     status: "delivered" | "read"
   ) => void;
+  onMessageEdited?: (
+    messageId: string,
+    content: string,
+    editedAt: string
+  ) => void;
+  onMessageDeleted?: (messageId: string) => void;
+  onUnreadCount?: (count: number) => void;
 }
 
 export function useDMWebSocket(options: UseDMWebSocketOptions = {}) {
@@ -45,6 +57,7 @@ export function useDMWebSocket(options: UseDMWebSocketOptions = {}) {
   const wsRef = useRef<WebSocket | null>(null);
   const reconnectTimeoutRef = useRef<NodeJS.Timeout | null>(null);
   const reconnectAttempts = useRef(0);
+  const retryAfterMs = useRef<number | null>(null); // Server's reconnect hint, if it sent one
   const maxReconnectAttempts = 5;
   const optionsRef = useRef(options);
 
@@ -82,6 +95,9 @@ export function useDMWebSocket(options: UseDMWebSocketOptions = {}) {
         setIsConnected(true);
         setConnectionStatus("connected");
         reconnectAttempts.current = 0;
+        // DM sockets never join a channel; listing DMs identifies the session
+        // so the server doesn't close it with join_timeout
+        ws.send(JSON.stringify({ type: "list_dms" }));
       };
 
       ws.onmessage = (event) => {
@@ -124,7 +140,7 @@ export function useDMWebSocket(options: UseDMWebSocketOptions = {}) {
               }
               break;
 
-            case "dm_message_read":
+            case "dm_read":
               if (message.sender_id === session.user?.id) {
                 // Our message was read
                 optionsRef.current.onMessageStatusUpdate?.(
@@ -134,6 +150,30 @@ export function useDMWebSocket(options: UseDMWebSocketOptions = {}) {
               }
               break;
 
+            case "dm_message_edited":
+              optionsRef.current.onMessageEdited?.(
+                message.message_id || "",
+                message.content || "",
+                message.edited_at || ""
+              );
+              break;
+
+            case "dm_message_deleted":
+              optionsRef.current.onMessageDeleted?.(message.message_id || "");
+              break;
+
+            case "list_dms":
+              break;
+
+            case "reconnect":
+              // The server is going away or full; wait as long as it asks
+              retryAfterMs.current = message.retry_after_ms ?? null;
+              break;
+
+            case "dm_unread":
+              optionsRef.current.onUnreadCount?.(message.unread_count ?? 0);
+              break;
+
             default:
               console.log("Unknown DM WebSocket message type:", message.type);
           }
@@ -158,10 +198,12 @@ export function useDMWebSocket(options: UseDMWebSocketOptions = {}) {
           reconnectAttempts.current < maxReconnectAttempts &&
           wsRef.current === null // Only reconnect if no new connection was created
         ) {
-          const delay = Math.min(
+          const backoff = Math.min(
             1000 * Math.pow(2, reconnectAttempts.current),
             30000
           );
+          const delay = Math.max(backoff, retryAfterMs.current ?? 0);
+          retryAfterMs.current = null;
           console.log(
             `Attempting to reconnect DM WebSocket in ${delay}ms (attempt ${
               reconnectAttempts.current + 1
@@ -262,7 +304,7 @@ export function useDMWebSocket(options: UseDMWebSocketOptions = {}) {
       }
 
       const message: DMWebSocketMessage = {
-        type: "dm_message_read",
+        type: "mark_read",
         message_id: messageId,
         sender_id: senderId,
       };
@@ -276,11 +318,62 @@ export function useDMWebSocket(options: UseDMWebSocketOptions = {}) {
     []
   );
 
+  const editDMMessage = useCallback((messageId: string, content: string) => {
+    if (!wsRef.current || wsRef.current.readyState !== WebSocket.OPEN) {
+      return;
+    }
+
+    const message: DMWebSocketMessage = {
+      type: "dm_edit",
+      message_id: messageId,
+      content,
+    };
+
+    try {
+      wsRef.current.send(JSON.stringify(message));
+    } catch (error) {
+      console.error("Error editing DM message:", error);
+    }
+  }, []);
+
+  const deleteDMMessage = useCallback((messageId: string) => {
+    if (!wsRef.current || wsRef.current.readyState !== WebSocket.OPEN) {
+      return;
+    }
+
+    const message: DMWebSocketMessage = {
+      type: "dm_delete",
+      message_id: messageId,
+    };
+
+    try {
+      wsRef.current.send(JSON.stringify(message));
+    } catch (error) {
+      console.error("Error deleting DM message:", error);
+    }
+  }, []);
+
+  // Ask for the unread DM count; the answer arrives via onUnreadCount
+  const requestUnreadCount = useCallback(() => {
+    if (!wsRef.current || wsRef.current.readyState !== WebSocket.OPEN) {
+      return;
+    }
+
+    try {
+      wsRef.current.send(JSON.stringify({ type: "dm_unread" }));
+    } catch (error) {
+      console.error("Error requesting unread DM count:", error);
+    }
+  }, []);
+
   return {
     isConnected,
     connectionStatus,
     sendDMMessage,
     sendTypingIndicator,
     markMessageAsRead,
+    editDMMessage,
+    deleteDMMessage,
+    requestUnreadCount,
   };
 }
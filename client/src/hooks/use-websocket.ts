@@ -11,8 +11,18 @@ export interface Message {
   edited?: boolean; // ✅ NEW: Added edited field
   edited_at?: string; // ✅ NEW: Added edited_at field
   avatar_url?: string; // ✅ NEW: Added avatar_url field
+  avatar?: string; // Author's avatar URL as sent by the server
 }
 
+export interface ChannelSummary {
+  id: string;
+  name: string;
+  last_activity?: string; // When the newest message was posted
+}
+
+// Newest server protocol this hook understands; 2 sends history as one frame
+const PROTOCOL_VERSION = 2;
+
 export type ConnectionStatus =
   | "connecting"
   | "connected"
@@ -33,6 +43,7 @@ interface UseWebSocketProps {
   onMessageDeleted?: (messageId: string) => void; // ✅ NEW: Added callback for message deletions
   onFriendRequest?: (senderUsername: string) => void; // ✅ NEW: Added callback for friend requests
   onFriendRequestAccepted?: (accepterUsername: string) => void; // ✅ NEW: Added callback for friend request acceptance
+  onChannelList?: (channels: ChannelSummary[]) => void; // The user's channels, sent on connect
 }
 
 export function useWebSocket({
@@ -49,6 +60,7 @@ export function useWebSocket({
   onMessageDeleted,
   onFriendRequest,
   onFriendRequestAccepted,
+  onChannelList,
 }: UseWebSocketProps) {
   const ws = useRef<WebSocket | null>(null);
   const [isConnected, setIsConnected] = useState(false);
@@ -69,7 +81,7 @@ export function useWebSocket({
     }
 
     ws.current = new WebSocket(
-      `ws://localhost:8000/ws?token=${encodeURIComponent(accessToken)}`
+      `ws://localhost:8000/ws?token=${encodeURIComponent(accessToken)}&protocol=${PROTOCOL_VERSION}`
     );
 
     ws.current.onopen = () => {
@@ -84,6 +96,10 @@ export function useWebSocket({
         timestamp: new Date().toISOString(),
       };
       ws.current?.send(JSON.stringify(joinMessage));
+
+      if (onChannelList) {
+        ws.current?.send(JSON.stringify({ type: "list_channels" }));
+      }
     };
 
     ws.current.onclose = () => {
@@ -96,9 +112,18 @@ export function useWebSocket({
         const data = JSON.parse(event.data);
 
         switch (data.type) {
+          case "hello":
+            // Protocol version and features negotiated for this connection
+            break;
           case "message":
             onMessage(data);
             break;
+          case "history":
+            // A page of history, oldest first
+            if (data.messages) {
+              data.messages.forEach((message: Message) => onMessage(message));
+            }
+            break;
           case "message_edited":
             if (onMessageEdited) {
               onMessageEdited(data);
@@ -109,12 +134,25 @@ export function useWebSocket({
               onMessageDeleted(data.id);
             }
             break;
+          case "messages_purged":
+            // Moderator purge: remove each deleted message
+            if (onMessageDeleted && data.ids) {
+              data.ids.forEach((id: string) => onMessageDeleted(id));
+            }
+            break;
           case "user_joined":
             onUserJoined(data.username);
             break;
           case "user_left":
             onUserLeft(data.username);
             break;
+          case "user_kicked":
+          case "user_banned":
+            // A moderator removed the user from the channel
+            if (data.username) {
+              onUserLeft(data.username);
+            }
+            break;
           case "typing":
             onTyping(data.username);
             break;
@@ -139,6 +177,11 @@ export function useWebSocket({
               onFriendRequestAccepted(data.accepter_username);
             }
             break;
+          case "list_channels":
+            if (onChannelList && data.channels) {
+              onChannelList(data.channels);
+            }
+            break;
           default:
             console.log("Unknown event:", data);
         }
@@ -259,6 +302,13 @@ export function useWebSocket({
     }
   };
 
+  // Leave the current channel without joining another
+  const leaveChannel = () => {
+    if (ws.current && isConnected) {
+      ws.current.send(JSON.stringify({ type: "leave", channel }));
+    }
+  };
+
   const editMessage = (messageId: string, newContent: string) => {
     if (ws.current && isConnected) {
       ws.current.send(
@@ -291,6 +341,7 @@ export function useWebSocket({
     sendTyping,
     sendStopTyping,
     switchChannel,
+    leaveChannel,
     editMessage,
     deleteMessage,
   };
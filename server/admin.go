@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Announcement levels, so clients can style a system message
+const (
+	announcementInfo    = "info"
+	announcementWarning = "warning"
+)
+
+// announcementRequest is the body of POST /admin/broadcast
+type announcementRequest struct {
+	Content string `json:"content"`
+	Level   string `json:"level"` // info (the default) or warning
+}
+
+// handleAdminBroadcast pushes an operator announcement (a maintenance notice
+// and the like) to every connected client, whatever channel they are in.
+// Guarded by the ADMIN_TOKEN bearer token. Announcements aren't persisted;
+// clients that connect afterwards never see them.
+func handleAdminBroadcast(w http.ResponseWriter, r *http.Request, messages chan<- Message, adminToken string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		http.Error(w, "invalid admin token", http.StatusUnauthorized)
+		return
+	}
+
+	var req announcementRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "body must be JSON with content and level", http.StatusBadRequest)
+		return
+	}
+	req.Content = strings.TrimSpace(req.Content)
+	if req.Content == "" || utf8.RuneCountInString(req.Content) > maxMessageLen {
+		http.Error(w, fmt.Sprintf("content must be non-empty and at most %d characters", maxMessageLen), http.StatusBadRequest)
+		return
+	}
+	switch req.Level {
+	case "":
+		req.Level = announcementInfo
+	case announcementInfo, announcementWarning:
+	default:
+		http.Error(w, "level must be info or warning", http.StatusBadRequest)
+		return
+	}
+
+	announcement := &WSMessage{
+		Type:      "system",
+		Content:   req.Content,
+		Level:     req.Level,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	select {
+	case messages <- Message{Type: AdminBroadcast, Announcement: announcement}:
+	case <-r.Context().Done():
+		return
+	}
+	logInfof("admin broadcast (%s) from %s: %q", req.Level, r.RemoteAddr, req.Content)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func adminRequest(method, token, body string) *http.Request {
+	r := httptest.NewRequest(method, "/admin/broadcast", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestAdminBroadcastReachesEveryone(t *testing.T) {
+	chat := startTestChat(t)
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("random")
+	carol := chat.dial(t, "carol") // In no channel at all
+
+	w := httptest.NewRecorder()
+	handleAdminBroadcast(w, adminRequest("POST", "secret", `{"content":"  restarting at noon ","level":"warning"}`), chat.messages, "secret")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202", w.Code)
+	}
+	for name, conn := range map[string]*testConn{"alice": alice, "bob": bob, "carol": carol} {
+		got := conn.next("system")
+		if got.Content != "restarting at noon" || got.Level != announcementWarning || got.Channel != "" {
+			t.Errorf("%s got %+v, want the trimmed warning", name, got)
+		}
+	}
+}
+
+func TestAdminBroadcastRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		want   int
+	}{
+		{"GET", "GET", "secret", "", http.StatusMethodNotAllowed},
+		{"no token", "POST", "", `{"content":"hi"}`, http.StatusUnauthorized},
+		{"wrong token", "POST", "secre", `{"content":"hi"}`, http.StatusUnauthorized},
+		{"not JSON", "POST", "secret", "hi", http.StatusBadRequest},
+		{"blank content", "POST", "secret", `{"content":"   "}`, http.StatusBadRequest},
+		{"content too long", "POST", "secret", `{"content":"` + strings.Repeat("a", maxMessageLen+1) + `"}`, http.StatusBadRequest},
+		{"unknown level", "POST", "secret", `{"content":"hi","level":"critical"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := make(chan Message, 1)
+			w := httptest.NewRecorder()
+			handleAdminBroadcast(w, adminRequest(tt.method, tt.token, tt.body), messages, "secret")
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+			if len(messages) != 0 {
+				t.Errorf("rejected request was broadcast: %+v", <-messages)
+			}
+		})
+	}
+
+	// The default level is info
+	messages := make(chan Message, 1)
+	handleAdminBroadcast(httptest.NewRecorder(), adminRequest("POST", "secret", `{"content":"hi"}`), messages, "secret")
+	select {
+	case got := <-messages:
+		if got.Announcement.Level != announcementInfo {
+			t.Errorf("got level %q, want info", got.Announcement.Level)
+		}
+	default:
+		t.Error("announcement without a level wasn't broadcast")
+	}
+}
@@ -1,19 +1,157 @@
 package main
 
 import (
+	"compress/flate"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 )
 
-const port = "8000"
+// defaultPort is used when PORT isn't set
+const defaultPort = "8000"
+
+// defaultHistoryConcurrency is how many history fetches may run at once
+const defaultHistoryConcurrency = 32
+
+// Per-user chat message rate limit (token bucket)
+const (
+	messageRatePerSecond = 5
+	messageRateBurst     = 10
+)
+
+// defaultHistoryLimit is how many messages a history page holds when the client
+// doesn't ask for a number; HISTORY_LIMIT overrides it
+const defaultHistoryLimit = 50
+
+// maxHistoryLimit caps the page size a client (WebSocket or REST) may ask for
+const maxHistoryLimit = 200
+
+// historyPageSize is the configured default page size, set from HISTORY_LIMIT
+var historyPageSize = defaultHistoryLimit
+
+// historyLimit returns the page size for a history request: the requested
+// count capped at maxHistoryLimit, or the default when none (or a
+// non-positive one) was given
+func historyLimit(requested int) int {
+	if requested <= 0 {
+		return historyPageSize
+	}
+	return min(requested, maxHistoryLimit)
+}
+
+// maxJumpRadius caps how many messages a jump_to request may load on each side
+const maxJumpRadius = 100
+
+// maxMessageLen caps message content, counted in runes so multibyte text isn't penalized
+const maxMessageLen = 4000
+
+// maxPurgeIDs caps how many message IDs one purge request may name
+const maxPurgeIDs = 100
+
+// maxProfileIDs caps how many users one get_profile request may look up
+const maxProfileIDs = 50
+
+// typingTimeout is how long a typing indicator lasts without a refresh
+const typingTimeout = 6 * time.Second
+
+// joinTimeout is how long a registered session may idle before joining a
+// channel (or identifying as a DM session with list_dms) before it's closed
+const joinTimeout = 30 * time.Second
+
+// tokenCheckInterval is how often a session's token is re-validated so an
+// expired or revoked one ends the session; 0 turns checks off. Set from
+// TOKEN_CHECK_INTERVAL in main.
+var tokenCheckInterval = 10 * time.Minute
+
+// tokenCheckDelay is tokenCheckInterval give or take 10%, so sessions that
+// connected together don't all re-validate together
+func tokenCheckDelay() time.Duration {
+	spread := int64(tokenCheckInterval / 5)
+	return tokenCheckInterval - tokenCheckInterval/10 + time.Duration(rand.Int63n(spread+1))
+}
+
+// shutdownGrace bounds how long shutdown waits for in-flight work
+const shutdownGrace = 10 * time.Second
+
+// Reconnect hints: how long clients are told to wait before reconnecting
+// after a shutdown or a capacity rejection. Each client gets up to as much
+// again in jitter, so they don't all come back at once.
+const (
+	shutdownRetryAfter = 5 * time.Second
+	capacityRetryAfter = 10 * time.Second
+)
+
+// Message auditing: when auditMessages is on (MESSAGE_AUDIT), the IP and user
+// agent of the connection each channel message came in on are stored in
+// message_audit. trustProxyHeaders (TRUST_PROXY) takes the IP from
+// X-Forwarded-For, for deployments behind a proxy that appends to it.
+var (
+	auditMessages     bool
+	trustProxyHeaders bool
+)
+
+// maxUserAgentLen caps the stored user agent; real ones are far shorter
+const maxUserAgentLen = 512
+
+// connOrigin captures the audit metadata of a WebSocket request, or nothing
+// when auditing is off
+func connOrigin(r *http.Request) messageOrigin {
+	if !auditMessages {
+		return messageOrigin{}
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if trustProxyHeaders {
+		// Only the last entry, appended by our proxy, can be trusted; the
+		// client can put anything before it. Garbage keeps the socket address.
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			entries := strings.Split(fwd[len(fwd)-1], ",")
+			if last := strings.TrimSpace(entries[len(entries)-1]); net.ParseIP(last) != nil {
+				ip = last
+			}
+		}
+	}
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLen {
+		ua = strings.ToValidUTF8(ua[:maxUserAgentLen], "")
+	}
+	return messageOrigin{IP: ip, UserAgent: ua}
+}
+
+// maxConnections caps open WebSocket connections, counting ones still
+// authenticating; 0 means no cap. Set from MAX_CONNECTIONS in main.
+var maxConnections int
+
+// maxFrameBytes caps an incoming WebSocket message; a client that sends more is
+// disconnected with message_too_large. Set from MAX_FRAME_BYTES in main.
+var maxFrameBytes int64 = 64 << 10
+
+// Keepalive: ping every pingPeriod and drop connections silent for pongWait
+const (
+	pingPeriod = 30 * time.Second
+	pongWait   = 60 * time.Second
+	writeWait  = 10 * time.Second
+)
 
 func min(a, b int) int {
 	if a < b {
@@ -22,10 +160,48 @@ func min(a, b int) int {
 	return b
 }
 
+// wsCompressionLevel is the deflate level for connections that negotiated
+// permessage-deflate. Each frame is compressed on its own (no context
+// takeover), so small frames gain little: a 50-message history of typical chat
+// lines measured about 16 KB as plain frames and 12.6 KB deflated, roughly a
+// fifth less. BestSpeed gets nearly all of that for the least CPU.
+const wsCompressionLevel = flate.BestSpeed
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow connections from any origin
+		return true // Allow connections from any origin; main narrows this via ALLOWED_ORIGINS
 	},
+	// Only used when the client offers it; clients that don't get plain frames
+	EnableCompression: true,
+}
+
+// originChecker builds a CheckOrigin func from a comma-separated allowlist of
+// origins such as "https://chat.example.com". An empty list or "*" allows any
+// origin. Requests without an Origin header come from non-browser clients,
+// which can't be driven cross-site, so they're allowed.
+func originChecker(allowlist string) func(r *http.Request) bool {
+	allowed := map[string]bool{}
+	for _, origin := range strings.Split(allowlist, ",") {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		if origin == "*" {
+			return func(r *http.Request) bool { return true }
+		}
+		if origin != "" {
+			allowed[origin] = true
+		}
+	}
+	if len(allowed) == 0 {
+		return func(r *http.Request) bool { return true }
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowed[strings.ToLower(origin)] {
+			return true
+		}
+		logWarnf("rejected WebSocket connection from origin %q", origin)
+		return false
+	}
 }
 
 type MessageType int
@@ -42,6 +218,16 @@ const (
 	DMStopTyping
 	DMMessageRead
 	DMMessageDelivered
+	DBNotification // Postgres NOTIFY payload routed into the server loop
+	ServerShutdown // Process is exiting; notify and close every client
+	TypingExpired  // A typing indicator went unrefreshed for typingTimeout
+	JoinTimeout    // A session went joinTimeout without joining
+	TokenCheck     // A session's token is due for re-validation
+	TokenChecked   // A re-validation finished; Err says how it went
+	TokenRefreshed // A refresh_token validation finished; Err says how it went
+	SeenFlush      // A channel's batch of seen receipts is due to be written
+	SeenCounted    // A flushed batch was written and counted; SeenCounts holds the result
+	AdminBroadcast // Operator announcement from POST /admin/broadcast, for every client
 )
 
 // Incoming raw message wrapper
@@ -52,29 +238,171 @@ type Message struct {
 	Username string
 	UserID   string
 	Token    string
+	SessionID string // Per-tab session identifier supplied by the client
+	Ctx      context.Context // Cancelled when the connection closes
+	Cancel   context.CancelFunc // Cancels Ctx, for ClientConnected
+	Notification interface{} // Decoded payload for DBNotification
+	Done     chan struct{}   // Closed by the server loop once a ServerShutdown is handled
+	Typing   *typingEntry    // Indicator whose timer fired, for TypingExpired
+	Avatar   string          // Avatar URL from the validated profile, for ClientConnected
+	User     *authUser       // Identity validated in handleWebSocket, for ClientConnected
+	Protocol int             // Negotiated protocol version, for ClientConnected
+	Origin   messageOrigin   // Connection's IP and user agent when auditing is on, for ClientConnected
+	SuppressEcho bool        // Session asked for suppress_echo, for ClientConnected
+	Err      error           // Outcome of validating Token, for TokenChecked and TokenRefreshed
+	ChannelID string         // Channel whose receipts to flush or broadcast, for SeenFlush and SeenCounted
+	SeenCounts map[string]int // Message ID -> readers, for SeenCounted
+	Announcement *WSMessage  // System message to deliver, for AdminBroadcast
+}
+
+// profileBroadcast is a profile_updated frame bound for everyone in channels,
+// posted back into the server loop once the user's channels have been looked up
+type profileBroadcast struct {
+	frame    WSMessage
+	channels map[string]bool
+}
+
+// mentionDelivery is a mention frame for the users it resolved to, posted back
+// into the server loop once the lookups behind it are done
+type mentionDelivery struct {
+	frame   WSMessage
+	userIDs []string
+}
+
+// typingKey identifies one user's typing indicator in a channel
+type typingKey struct {
+	channelID string
+	username  string
+}
+
+// typingEntry is a live typing indicator; its timer clears it if not refreshed
+type typingEntry struct {
+	key     typingKey
+	session *Client // Session that is typing
+	timer   *time.Timer
+}
+
+// lockedConn serializes writes to a connection; gorilla/websocket allows only
+// one concurrent writer, and history replay writes from its own goroutine
+type lockedConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *lockedConn) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteJSON(v)
+}
+
+func (c *lockedConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
 }
 
 // Each connected client
 type Client struct {
-	Conn       *websocket.Conn
+	Conn       *lockedConn
 	Username   string
 	ChannelID  string        // ✅ FIX: Track which channel the client is in
 	UserID     string        // Supabase auth user id
 	Token      string        // Access token (validated)
+	SessionID  string        // Distinguishes tabs/devices of the same user
+	Ctx        context.Context // Cancelled on disconnect; aborts in-flight Supabase calls
+	cancel     context.CancelFunc // Cancels Ctx; called by the read loop and by dropClient
+	memberOf   map[string]bool // Channels this session has been verified a member of
+	Status     string          // Presence shown to others: "online", "away" or "offline"
+	joinTimer  *time.Timer     // Closes the session if it never joins; nil once it has
+	tokenTimer *time.Timer     // Fires the next token re-validation; nil when checks are off
+	tokenCheckedAt time.Time   // When Token was last validated: at connect, refresh_token or a check
+	Avatar     string          // Avatar URL from the profile; empty when unset
+	Protocol   int             // Negotiated protocol version; see protocol.go
+	Origin     messageOrigin   // Stored with each message for audit; empty unless MESSAGE_AUDIT is on
+	// SuppressEcho (opt-in, suppress_echo query param) is for clients that render
+	// their own messages optimistically: the session's ack then carries the
+	// full stored message and the broadcast skips it. The ack is the only copy
+	// it gets, so it should send a client_id to match the ack to its draft;
+	// without one it can't tell which draft was confirmed.
+	SuppressEcho bool
+}
+
+// pinger keeps a connection alive with periodic pings until done is closed.
+// WriteControl is safe alongside other writers, so it needs no lockedConn.
+func pinger(conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				conn.Close() // Unblocks the read loop, which reports the disconnect
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// reconnectHint builds a reconnect frame telling the client to wait at least
+// base, plus random jitter up to base, before reconnecting
+func reconnectHint(base time.Duration) WSMessage {
+	wait := base + time.Duration(rand.Int63n(int64(base)+1))
+	return WSMessage{Type: "reconnect", RetryAfterMs: int(wait / time.Millisecond)}
+}
+
+// closeWithReason sends a close frame with code and reason, then closes the
+// connection. The frame goes out with WriteControl, which is safe alongside
+// other writers; a peer that's already gone just gets the Close.
+func closeWithReason(conn *websocket.Conn, code int, reason string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	conn.Close()
+}
+
+// sessionKey identifies one client session; a user may hold several at once
+func sessionKey(userID, sessionID string) string {
+	return userID + "/" + sessionID
+}
+
+// userSessions maps a user ID to every live session of that user
+type userSessions map[string][]*Client
+
+func (u userSessions) add(c *Client) {
+	u[c.UserID] = append(u[c.UserID], c)
+}
+
+func (u userSessions) remove(c *Client) {
+	sessions := u[c.UserID]
+	for i, session := range sessions {
+		if session == c {
+			sessions = append(sessions[:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(u, c.UserID)
+	} else {
+		u[c.UserID] = sessions
+	}
 }
 
 // WebSocket JSON format
 type WSMessage struct {
 	Type             string   `json:"type"`
 	Username         string   `json:"username,omitempty"`
+	Avatar           string   `json:"avatar,omitempty"` // Author's avatar URL; omitted when they have none
 	Content          string   `json:"content,omitempty"`
 	Channel          string   `json:"channel,omitempty"`   // ✅ FIX: Added channel field
 	Users            []string `json:"users,omitempty"`
 	Timestamp        string   `json:"timestamp,omitempty"` // ✅ FIX: Added timestamp field
 	ID               string   `json:"id,omitempty"`        // ✅ FIX: Added ID field
 	ReplyTo          string   `json:"reply_to,omitempty"`  // ✅ NEW: Added reply_to field
+	ReplySnippet     string   `json:"reply_snippet,omitempty"` // Start of the replied-to message, for thread context
 	Edited           bool     `json:"edited,omitempty"`    // ✅ NEW: Added edited field
 	EditedAt         string   `json:"edited_at,omitempty"` // ✅ NEW: Added edited_at field
+	Deleted          bool     `json:"deleted,omitempty"`   // Tombstone of a soft-deleted message
+	Soft             bool     `json:"soft,omitempty"`      // message_deleted left a tombstone rather than removing the row
 	SenderUsername   string   `json:"sender_username,omitempty"` // For friend request notifications
 	AccepterUsername string   `json:"accepter_username,omitempty"` // For friend request accepted notifications
 	
@@ -86,6 +414,294 @@ type WSMessage struct {
 	IsRead           bool     `json:"is_read,omitempty"`
 	IsDelivered      bool     `json:"is_delivered,omitempty"`
 	MessageStatus    string   `json:"message_status,omitempty"` // "sent", "delivered", "read"
+	MessageType      string   `json:"message_type,omitempty"`   // DM attachment kind: "text", "image", "file"
+	FileURL          string   `json:"file_url,omitempty"`       // Attachment location for image/file DMs
+	ReadAt           string   `json:"read_at,omitempty"`        // When a DM was read, for dm_read receipts
+
+	ClientTime       string   `json:"client_time,omitempty"` // Echoed in time responses for RTT/offset estimates
+	Before           string   `json:"before,omitempty"`      // History cursor: load messages older than this timestamp
+	BeforeID         string   `json:"before_id,omitempty"`   // History cursor tiebreak: with before, also load messages at that timestamp with a lower ID
+	Resume           string   `json:"resume,omitempty"`      // join/switch_channel: last message ID the client already has
+	Limit            int      `json:"limit,omitempty"`       // join/switch_channel/load_history: messages per page, capped at maxHistoryLimit
+	Batch            bool     `json:"batch,omitempty"`       // join/switch_channel: send history as one history frame instead of a frame per message
+	Protocol         int      `json:"protocol,omitempty"`    // hello: protocol version negotiated for this session
+	Features         []string `json:"features,omitempty"`    // hello: what this session's protocol version provides
+	Sessions         int      `json:"sessions,omitempty"`    // whoami: the user's live sessions, this one included
+	ClientID         string   `json:"client_id,omitempty"`   // Sender's idempotency key, echoed so optimistic messages can be reconciled
+	Token            string   `json:"token,omitempty"`       // refresh_token: the new access token; never sent to clients
+
+	// Reaction fields
+	Emoji            string         `json:"emoji,omitempty"`
+	Reactions        map[string]int `json:"reactions,omitempty"` // Emoji -> count for reaction_updated
+	SeenCounts       map[string]int `json:"seen_counts,omitempty"` // seen_counts: message ID -> readers other than the author
+
+	// Jump-to-message fields
+	Radius           int         `json:"radius,omitempty"`   // Messages to load on each side of the target
+	Target           bool        `json:"target,omitempty"`   // Marks the requested message in a jump_to page
+	Messages         []WSMessage `json:"messages,omitempty"` // Page of messages for jump_to/load_history/load_dm_history/thread responses
+	HasMore          bool        `json:"has_more,omitempty"` // history/load_history: older messages exist beyond this page; thread: more replies
+	Cursor           string      `json:"cursor,omitempty"`   // history/load_history/load_dm_history: before value for the next older page
+	CursorID         string      `json:"cursor_id,omitempty"` // history/load_history/load_dm_history: before_id value for the next older page
+
+	Conversations    []dmConversation `json:"conversations,omitempty"` // DM threads for list_dms responses
+	UnreadCount      *int             `json:"unread_count,omitempty"`  // Unread DMs across all threads, for dm_unread responses
+	Channels         []userChannel    `json:"channels,omitempty"`      // The user's channels for list_channels responses
+	ChannelInfo      *channelInfo     `json:"channel_info,omitempty"`  // Name, topic and so on, for channel_info on join
+
+	// Presence fields
+	Status           string            `json:"status,omitempty"`   // set_status request / presence_update value
+	Statuses         map[string]string `json:"statuses,omitempty"` // Username -> status alongside user_list
+	OnlineCount      *int              `json:"online_count,omitempty"` // Distinct users in the channel, on user_joined/user_left/channel_count
+	SlowModeSeconds  *int              `json:"slow_mode_seconds,omitempty"` // set_slow_mode request / slow_mode_updated value
+	RetryAfter       int               `json:"retry_after,omitempty"`       // Seconds to wait, on slow_mode errors
+	RetryAfterMs     int               `json:"retry_after_ms,omitempty"`    // reconnect: milliseconds to wait before reconnecting
+	Level            string            `json:"level,omitempty"`             // system: "info" or "warning", for styling
+
+	// Moderation fields
+	TargetUserID     string   `json:"target_user_id,omitempty"` // purge: remove everything this user posted in the channel / kick, ban: user to remove
+	IDs              []string `json:"ids,omitempty"`            // purge: messages to remove / messages_purged: messages removed
+
+	// Profile lookup fields
+	UserID           string             `json:"user_id,omitempty"`  // get_profile: one user to look up
+	UserIDs          []string           `json:"user_ids,omitempty"` // get_profile: several users to look up
+	Profiles         map[string]profile `json:"profiles,omitempty"` // profile: user ID -> username and avatar; unknown IDs are left out
+	PreviousUsername string             `json:"previous_username,omitempty"` // profile_updated: the user's name before the change
+
+	Error            *ErrorPayload `json:"error,omitempty"` // Structured reason on error frames
+}
+
+// wireTimeFormat is the one timestamp format clients see: RFC3339 in UTC with
+// millisecond precision, so timestamps from any source sort as strings too
+const wireTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// normalizeTimestamp reformats an RFC3339 timestamp (PostgREST emits them
+// with microseconds and "+00:00") into wireTimeFormat. Empty or unparseable
+// values pass through unchanged.
+func normalizeTimestamp(ts string) string {
+	if ts == "" {
+		return ts
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return ts
+	}
+	return t.UTC().Format(wireTimeFormat)
+}
+
+// MarshalJSON writes the timestamp fields in wireTimeFormat. Every outbound
+// frame is encoded through here, whether it's history, a live message or an
+// event stamped with time.Now().
+func (m WSMessage) MarshalJSON() ([]byte, error) {
+	type wsMessage WSMessage // Same fields without this method, so no recursion
+	m.Timestamp = normalizeTimestamp(m.Timestamp)
+	m.EditedAt = normalizeTimestamp(m.EditedAt)
+	m.ReadAt = normalizeTimestamp(m.ReadAt)
+	if len(m.Channels) > 0 {
+		channels := make([]userChannel, len(m.Channels)) // Copy; the caller's slice stays as it was
+		for i, ch := range m.Channels {
+			ch.LastActivity = normalizeTimestamp(ch.LastActivity)
+			channels[i] = ch
+		}
+		m.Channels = channels
+	}
+	if len(m.Conversations) > 0 {
+		conversations := make([]dmConversation, len(m.Conversations))
+		for i, c := range m.Conversations {
+			if c.LastMessageAt != nil {
+				at := normalizeTimestamp(*c.LastMessageAt)
+				c.LastMessageAt = &at
+			}
+			conversations[i] = c
+		}
+		m.Conversations = conversations
+	}
+	if m.ChannelInfo != nil {
+		info := *m.ChannelInfo
+		info.CreatedAt = normalizeTimestamp(info.CreatedAt)
+		m.ChannelInfo = &info
+	}
+	return json.Marshal(wsMessage(m))
+}
+
+// derefString returns the pointed-to string, or "" for a nil pointer
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// deletedPlaceholder stands in for the content of a soft-deleted message
+const deletedPlaceholder = "[message deleted]"
+
+// messageFromDB builds the outbound WSMessage for a stored channel message so
+// live broadcasts and history replay carry the same edited/reply/deleted state
+func messageFromDB(msg dbMessage, msgType string, author profile) WSMessage {
+	content := msg.Content
+	if msg.Deleted {
+		content = deletedPlaceholder
+	}
+	if msg.System && msgType == "message" {
+		msgType = "system" // Moderator notices render as system lines, in history too
+	}
+	return WSMessage{
+		Type:      msgType,
+		Username:  author.Username,
+		Avatar:    author.AvatarURL,
+		Content:   content,
+		Channel:   msg.ChannelID,
+		Timestamp: msg.CreatedAt,
+		ID:        msg.ID,
+		ReplyTo:   derefString(msg.ReplyTo),
+		Edited:    msg.Edited,
+		EditedAt:  derefString(msg.EditedAt),
+		Deleted:   msg.Deleted,
+	}
+}
+
+// dmMessageFromDB builds the outbound WSMessage for a stored DM, as replayed
+// by load_dm_history
+func dmMessageFromDB(msg dmMessage, sender profile) WSMessage {
+	status := "sent"
+	if msg.ReadByRecipient {
+		status = "read"
+	}
+	return WSMessage{
+		Type:             "dm_message",
+		MessageID:        msg.ID,
+		DMConversationID: msg.DMConversationID,
+		SenderID:         msg.SenderID,
+		Username:         sender.Username,
+		Avatar:           sender.AvatarURL,
+		Content:          msg.Content,
+		Timestamp:        msg.CreatedAt,
+		ReplyTo:          derefString(msg.ReplyTo),
+		MessageType:      msg.MessageType,
+		FileURL:          derefString(msg.FileURL),
+		MessageStatus:    status,
+		ReadAt:           derefString(msg.ReadAt),
+		Edited:           msg.Edited,
+		EditedAt:         derefString(msg.EditedAt),
+		Deleted:          msg.Deleted,
+	}
+}
+
+// replySnippetLen is how many runes of a parent message accompany a reply
+const replySnippetLen = 100
+
+// replySnippets maps the parents replied to by the given messages to a short
+// prefix of their content, in one batch. Parents from other channels are left
+// out so a reply can't be used to peek into a channel the reader isn't in.
+func replySnippets(ctx context.Context, sb *SupabaseClient, messages []dbMessage) map[string]string {
+	parentIDs := make(map[string]bool)
+	for _, msg := range messages {
+		if msg.ReplyTo != nil && *msg.ReplyTo != "" {
+			parentIDs[*msg.ReplyTo] = true
+		}
+	}
+	snippets := make(map[string]string)
+	if len(parentIDs) == 0 {
+		return snippets
+	}
+
+	ids := make([]string, 0, len(parentIDs))
+	for id := range parentIDs {
+		ids = append(ids, id)
+	}
+	parents, err := sb.GetMessagesByIDs(ctx, ids)
+	if err != nil {
+		logWarnf("failed to fetch reply parents: %v", err)
+		return snippets
+	}
+
+	channelID := messages[0].ChannelID
+	for _, parent := range parents {
+		if parent.ChannelID != channelID {
+			continue
+		}
+		snippets[parent.ID] = replySnippet(parent)
+	}
+	return snippets
+}
+
+// replySnippet is the prefix of parent's content shown alongside a reply
+func replySnippet(parent dbMessage) string {
+	if parent.Deleted {
+		return deletedPlaceholder
+	}
+	runes := []rune(parent.Content)
+	if len(runes) > replySnippetLen {
+		return string(runes[:replySnippetLen]) + "…"
+	}
+	return parent.Content
+}
+
+// resolveProfiles maps the authors of the given messages to their profiles,
+// falling back to "unknown" and no avatar when a profile can't be resolved
+func resolveProfiles(ctx context.Context, sb *SupabaseClient, messages []dbMessage) map[string]profile {
+	userIDs := make(map[string]bool)
+	for _, msg := range messages {
+		userIDs[msg.UserID] = true
+	}
+
+	userIDList := make([]string, 0, len(userIDs))
+	for userID := range userIDs {
+		userIDList = append(userIDList, userID)
+	}
+
+	profiles, err := sb.GetProfiles(ctx, userIDList)
+	if err != nil {
+		logWarnf("failed to fetch profiles for messages: %v", err)
+		profiles = make(map[string]profile)
+	}
+	for _, userID := range userIDList {
+		if profiles[userID].Username == "" {
+			profiles[userID] = profile{Username: "unknown"}
+		}
+	}
+	return profiles
+}
+
+// channelHistory loads the history sent on join: only messages newer than
+// resume when the client names one it already has, otherwise the latest limit.
+// An unknown resume ID (deleted, or from another channel) gets the full page.
+// hasMore reports whether older messages exist; after a resume they always do,
+// the resume message itself if nothing else. Reads run as the user behind
+// userToken when user-scoped requests are on.
+func channelHistory(ctx context.Context, sb *SupabaseClient, channelID, resume string, limit int, userToken string) (messages []dbMessage, hasMore bool, err error) {
+	if resume != "" {
+		messages, err := sb.GetChannelMessagesAfter(ctx, channelID, resume, limit, userToken)
+		if !errors.Is(err, ErrNotFound) {
+			return messages, err == nil, err
+		}
+	}
+	return sb.GetChannelMessages(ctx, channelID, limit, userToken)
+}
+
+// oldestCursor returns the load_history cursor for the page before messages
+// (oldest first): the raw created_at and the id of the oldest one, so rows
+// sharing its timestamp aren't skipped. created_at isn't normalized like
+// Timestamp, since cutting it to milliseconds could skip rows too.
+func oldestCursor(messages []dbMessage) (before, beforeID string) {
+	if len(messages) == 0 {
+		return "", ""
+	}
+	return messages[0].CreatedAt, messages[0].ID
+}
+
+// pinsUpdate builds the pins_updated frame carrying channelID's full pinned
+// list, so clients can replace their pinned bar wholesale
+func pinsUpdate(ctx context.Context, sb *SupabaseClient, channelID string) (WSMessage, error) {
+	pinned, err := sb.GetPinnedMessages(ctx, channelID)
+	if err != nil {
+		return WSMessage{}, err
+	}
+	profiles := resolveProfiles(ctx, sb, pinned)
+	update := WSMessage{Type: "pins_updated", Channel: channelID, Messages: make([]WSMessage, 0, len(pinned))}
+	for _, msg := range pinned {
+		update.Messages = append(update.Messages, messageFromDB(msg, "message", profiles[msg.UserID]))
+	}
+	return update, nil
 }
 
 // generateID creates a random ID string similar to client-side generation
@@ -98,410 +714,1621 @@ func generateID() string {
 	return string(result)
 }
 
-func server(messages chan Message, sb *SupabaseClient) {
-	clients := map[string]*Client{}
-	userClients := map[string]*Client{} // Map user ID to client for notifications
+func server(messages chan Message, sb *SupabaseClient, push PushNotifier, history *historyLimiter, filter *contentFilter) {
+	clients := map[string]*Client{}  // Session key -> client
+	userClients := userSessions{}    // User ID -> all live sessions, for targeted delivery
+	limiter := newRateLimiter(messageRatePerSecond, messageRateBurst)
+	slow := newSlowMode(slowModeCacheTTL)
+	seen := newSeenReceipts(seenCacheTTL)
+	broadcast := newRecentIDs(recentBroadcastTTL) // Channel messages this loop has sent out
+	typing := map[typingKey]*typingEntry{}
+
+	// dropDead is declared ahead of the helpers that broadcast, since dropping
+	// a session broadcasts in turn (stop_typing, user_left); it's defined with
+	// dropClient below
+	var dropDead func(dead []*Client)
+
+	// inChannel reports whether a session of userID other than except is in channelID
+	inChannel := func(userID, channelID string, except *Client) bool {
+		for _, session := range userClients[userID] {
+			if session != except && session.ChannelID == channelID {
+				return true
+			}
+		}
+		return false
+	}
+
+	// channelUsers lists the distinct usernames present in channelID, leaving out excludeUserID
+	channelUsers := func(channelID, excludeUserID string) []string {
+		users := []string{}
+		seen := map[string]bool{}
+		for _, client := range clients {
+			if client.Username != "" && client.ChannelID == channelID && client.UserID != excludeUserID && !seen[client.UserID] {
+				seen[client.UserID] = true
+				users = append(users, client.Username)
+			}
+		}
+		return users
+	}
+
+	// channelCount returns how many distinct users have a session in channelID,
+	// not counting the session except (which is on its way out)
+	channelCount := func(channelID string, except *Client) *int {
+		seen := map[string]bool{}
+		for _, client := range clients {
+			if client != except && client.ChannelID == channelID {
+				seen[client.UserID] = true
+			}
+		}
+		n := len(seen)
+		return &n
+	}
+
+	// onlineUsers maps the usernames channelUsers would list to their presence status
+	onlineUsers := func(channelID, excludeUserID string) map[string]string {
+		statuses := map[string]string{}
+		for _, client := range clients {
+			if client.Username != "" && client.ChannelID == channelID && client.UserID != excludeUserID {
+				statuses[client.Username] = client.Status
+			}
+		}
+		return statuses
+	}
+
+	// stopTyping clears an indicator and tells the rest of its channel
+	stopTyping := func(e *typingEntry) {
+		e.timer.Stop()
+		delete(typing, e.key)
+		stopMsg := WSMessage{Type: "stop_typing", Username: e.key.username, Channel: e.key.channelID}
+		var dead []*Client
+		for _, client := range clients {
+			if client != e.session && client.ChannelID == e.key.channelID {
+				if err := client.Conn.WriteJSON(stopMsg); err != nil {
+					logErrorf("failed to send stop_typing to %s: %s", client.Conn.RemoteAddr(), err)
+					dead = append(dead, client)
+				}
+			}
+		}
+		dropDead(dead)
+	}
+
+	// stopSessionTyping clears the indicator c owns in its current channel, if any
+	stopSessionTyping := func(c *Client) {
+		if e := typing[typingKey{c.ChannelID, c.Username}]; e != nil && e.session == c {
+			stopTyping(e)
+		}
+	}
+
+	// markJoined cancels c's join deadline; the session has shown what it's for
+	markJoined := func(c *Client) {
+		if c.joinTimer != nil {
+			c.joinTimer.Stop()
+			c.joinTimer = nil
+		}
+	}
+
+	// applyProfile gives userID's live sessions a new username and avatar, so
+	// what they send from now on carries them
+	applyProfile := func(userID, username, avatar string) {
+		for _, c := range userClients[userID] {
+			stopSessionTyping(c) // The indicator is keyed by the old name
+			c.Username, c.Avatar = username, avatar
+		}
+	}
+
+	// scheduleTokenCheck arms c's next token re-validation. Like the join
+	// deadline, the timer posts back into the loop, which owns c.
+	scheduleTokenCheck := func(c *Client) {
+		if tokenCheckInterval <= 0 {
+			return
+		}
+		conn, userID, sessionID := c.Conn.Conn, c.UserID, c.SessionID
+		c.tokenTimer = time.AfterFunc(tokenCheckDelay(), func() {
+			messages <- Message{Type: TokenCheck, Conn: conn, UserID: userID, SessionID: sessionID}
+		})
+	}
+
+	// stopTokenCheck cancels c's pending re-validation, if any
+	stopTokenCheck := func(c *Client) {
+		if c.tokenTimer != nil {
+			c.tokenTimer.Stop()
+			c.tokenTimer = nil
+		}
+	}
+
+	// slowModeCooldown returns channelID's slow-mode cooldown, re-reading it
+	// once the cached value goes stale. A failed read keeps the stale value.
+	slowModeCooldown := func(c *Client, channelID string) time.Duration {
+		now := time.Now()
+		cooldown, fresh := slow.Cooldown(channelID, now)
+		if fresh {
+			return cooldown
+		}
+		settings, err := sb.GetChannelSettings(c.Ctx, channelID)
+		if err != nil {
+			logWarnf("failed to load slow mode for %s: %v", channelID, err)
+			return cooldown
+		}
+		cooldown = 0
+		if len(settings) > 0 {
+			cooldown = time.Duration(settings[0].SlowModeSeconds) * time.Second
+		}
+		slow.SetCooldown(channelID, cooldown, now)
+		return cooldown
+	}
+
+	// readReceiptsOn reports whether channelID records seen receipts, re-reading
+	// the setting once the cached value goes stale. A failed read keeps the
+	// stale value (off if there is none).
+	readReceiptsOn := func(c *Client, channelID string) bool {
+		now := time.Now()
+		on, fresh := seen.Enabled(channelID, now)
+		if fresh {
+			return on
+		}
+		settings, err := sb.GetChannelSettings(c.Ctx, channelID)
+		if err != nil {
+			logWarnf("failed to load read receipts setting for %s: %v", channelID, err)
+			return on
+		}
+		on = len(settings) > 0 && settings[0].ReadReceipts
+		seen.SetEnabled(channelID, on, now)
+		return on
+	}
+
+	// sendToDMParticipants delivers frame to every live session of both people
+	// in DM conversation dmID, resolving them from the database
+	sendToDMParticipants := func(ctx context.Context, dmID string, frame WSMessage) error {
+		user1, user2, err := sb.GetDMParticipants(ctx, dmID)
+		if err != nil {
+			return err
+		}
+		for _, userID := range []string{user1, user2} {
+			var dead []*Client
+			for _, client := range userClients[userID] {
+				if err := client.Conn.WriteJSON(frame); err != nil {
+					logErrorf("failed to send %s to %s: %v", frame.Type, client.Conn.RemoteAddr(), err)
+					dead = append(dead, client)
+				}
+			}
+			dropDead(dead)
+		}
+		return nil
+	}
+
+	// isMember checks channel membership, remembering positive answers on the
+	// session so messages don't cost a DB round-trip each. Fails closed.
+	isMember := func(c *Client, channelID string) bool {
+		if c.memberOf[channelID] {
+			return true
+		}
+		ok, err := sb.IsChannelMember(c.Ctx, channelID, c.UserID)
+		if err != nil {
+			logErrorf("failed to check membership of %s in %s: %v", c.UserID, channelID, err)
+			return false
+		}
+		if ok {
+			if c.memberOf == nil {
+				c.memberOf = make(map[string]bool)
+			}
+			c.memberOf[channelID] = true
+		}
+		return ok
+	}
+
+	// lookupChannel fetches channelID's metadata for a join. A channel that
+	// doesn't exist is answered with channel_not_found and ok is false; if the
+	// lookup merely fails, the join goes ahead without metadata.
+	lookupChannel := func(c *Client, channelID string) (info *channelInfo, ok bool) {
+		info, err := sb.GetChannel(c.Ctx, channelID)
+		if errors.Is(err, ErrNotFound) {
+			sendError(c.Conn, ErrCodeChannelNotFound, "", WSMessage{Channel: channelID})
+			return nil, false
+		}
+		if err != nil {
+			logWarnf("failed to fetch channel %s: %v", channelID, err)
+			return nil, true
+		}
+		return info, true
+	}
+
+	// isBanned checks whether c's user is banned from channelID. Fails closed,
+	// like isMember.
+	isBanned := func(c *Client, channelID string) bool {
+		banned, err := sb.IsBanned(c.Ctx, channelID, c.UserID)
+		if err != nil {
+			logErrorf("failed to check ban of %s in %s: %v", c.UserID, channelID, err)
+			return true
+		}
+		return banned
+	}
+
+	// sendChannelHistory replays channelID's recent history (or only what's new
+	// since resume), up to limit messages, and its pinned list to author. With
+	// batch the page goes out as one history frame rather than a message frame
+	// each. Meant to run on its own goroutine, so token is passed in rather than
+	// read from author, which refresh_token may change meanwhile; the limiter
+	// bounds how many fetch at once.
+	sendChannelHistory := func(author *Client, token, channelID, resume string, limit int, batch bool) {
+		if channelID == "" {
+			return // Not in a channel; nothing to replay
+		}
+		if !history.Acquire() {
+			logWarnf("history fetch for %s timed out waiting for a slot (queue depth %d)", author.Username, history.QueueDepth())
+			sendError(author.Conn, ErrCodeHistoryUnavailable, "", WSMessage{Channel: channelID})
+			return
+		}
+		defer history.Release()
+
+		messages, hasMore, err := channelHistory(author.Ctx, sb, channelID, resume, limit, token)
+		if err != nil {
+			logWarnf("failed to fetch message history for channel %s: %v", channelID, err)
+		} else if len(messages) > 0 {
+			profiles := resolveProfiles(author.Ctx, sb, messages)
+			snippets := replySnippets(author.Ctx, sb, messages)
+			page := make([]WSMessage, len(messages))
+			for i, msg := range messages {
+				page[i] = messageFromDB(msg, "message", profiles[msg.UserID])
+				page[i].ReplySnippet = snippets[page[i].ReplyTo]
+			}
+			if batch {
+				cursor, cursorID := oldestCursor(messages)
+				_ = author.Conn.WriteJSON(WSMessage{Type: "history", Channel: channelID, Messages: page, HasMore: hasMore, Cursor: cursor, CursorID: cursorID})
+			} else {
+				for _, historyMsg := range page {
+					_ = author.Conn.WriteJSON(historyMsg)
+				}
+			}
+			logInfof("sent %d historical messages to %s for channel %s", len(messages), author.Username, channelID)
+		}
+
+		if pins, err := pinsUpdate(author.Ctx, sb, channelID); err != nil {
+			logWarnf("failed to fetch pinned messages for channel %s: %v", channelID, err)
+		} else {
+			_ = author.Conn.WriteJSON(pins)
+		}
+	}
 
-	// Start listening for database notifications
+	// Start listening for database notifications; they're routed through the
+	// server loop since delivery needs the session registry it owns
 	notifications := sb.ListenForNotifications()
 	
 	go func() {
 		for notif := range notifications {
-			switch n := notif.(type) {
-			case FriendRequestNotification:
-				// Send friend request notification to target user
-				if client, exists := userClients[n.TargetUserID]; exists {
-					friendReqMsg := WSMessage{
-						Type:           "friend_request",
-						SenderUsername: n.SenderUsername,
-						Timestamp:      time.Now().Format(time.RFC3339),
-						ID:             generateID(),
+			messages <- Message{Type: DBNotification, Notification: notif}
+		}
+	}()
+
+	// announceLeave tells the rest of c's channel that c's user left it, unless
+	// another of their sessions is still there
+	announceLeave := func(c *Client) {
+		if c.Username == "" || c.ChannelID == "" || inChannel(c.UserID, c.ChannelID, c) {
+			return
+		}
+		leaveMsg := WSMessage{
+			Type: "user_left",
+			Username: c.Username,
+			Channel: c.ChannelID,
+			Timestamp: time.Now().Format(time.RFC3339),
+			ID: generateID(),
+			OnlineCount: channelCount(c.ChannelID, c),
+		}
+		jsonMsg, _ := json.Marshal(leaveMsg)
+		var dead []*Client
+		for _, client := range clients {
+			if client != c && client.ChannelID == c.ChannelID {
+				if err := client.Conn.WriteMessage(websocket.TextMessage, jsonMsg); err != nil {
+					logErrorf("failed to send user_left to %s: %s", client.Conn.RemoteAddr(), err)
+					dead = append(dead, client)
+				}
+			}
+		}
+		withFields(logFields{"user_id": c.UserID, "channel": c.ChannelID}).Infof("user %s left channel", c.Username)
+		dropDead(dead)
+	}
+
+	// dropClient removes a session from the registry and tells its channel the
+	// user left, if this was their last session there. It runs when the read
+	// loop reports a disconnect, and straight away when a write to the session
+	// fails, so later broadcasts don't keep hitting a dead connection; the
+	// read loop's report then finds nothing left to do.
+	dropClient := func(client *Client) {
+		key := sessionKey(client.UserID, client.SessionID)
+		if clients[key] != client {
+			return
+		}
+		delete(clients, key)
+		userClients.remove(client)
+		if client.cancel != nil {
+			client.cancel() // A dropped session's pending Supabase calls are wasted work
+		}
+		stopSessionTyping(client)
+		markJoined(client)
+		stopTokenCheck(client)
+		atomic.StoreInt64(&metrics.connections, int64(len(clients)))
+		atomic.StoreInt64(&metrics.connectedUsers, int64(len(userClients)))
+		if len(userClients[client.UserID]) == 0 {
+			limiter.Forget(client.UserID, time.Now())
+			slow.Forget(client.UserID)
+			// Off the loop, and not on the session's context: it's already cancelled
+			go func(userID string) {
+				if err := sb.UpdateLastSeen(context.Background(), userID); err != nil {
+					logWarnf("failed to update last_seen for %s: %v", userID, err)
+				}
+			}(client.UserID)
+		}
+		announceLeave(client)
+	}
+
+	// dropDead closes and drops sessions whose writes failed during a broadcast.
+	// Broadcasts collect them first, so the registry isn't reshaped mid-loop.
+	dropDead = func(dead []*Client) {
+		for _, client := range dead {
+			client.Conn.Close()
+			dropClient(client)
+		}
+	}
+
+	for {
+		msg := <-messages
+		switch msg.Type {
+		case ServerShutdown:
+			// Messages ahead of this one (and their Supabase writes) have already
+			// been handled, so it's safe to tell everyone and hang up
+			shutdownMsg := WSMessage{Type: "server_shutdown", Timestamp: time.Now().Format(time.RFC3339)}
+			for _, client := range clients {
+				_ = client.Conn.WriteJSON(shutdownMsg)
+				_ = client.Conn.WriteJSON(reconnectHint(shutdownRetryAfter))
+				closeWithReason(client.Conn.Conn, websocket.CloseGoingAway, "server shutting down")
+			}
+			logInfof("closed %d client connection(s) for shutdown", len(clients))
+			close(msg.Done)
+		case AdminBroadcast:
+			// Every session hears it, joined to a channel or not
+			var dead []*Client
+			for _, client := range clients {
+				if err := client.Conn.WriteJSON(msg.Announcement); err != nil {
+					logErrorf("failed to send announcement to %s: %s", client.Conn.RemoteAddr(), err)
+					dead = append(dead, client)
+				}
+			}
+			dropDead(dead)
+			logInfof("sent announcement to %d client(s)", len(clients))
+		case SeenFlush:
+			// Write the batch and count it off the loop, then post the counts back
+			channelID, receipts := msg.ChannelID, seen.Take(msg.ChannelID)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				ids, err := sb.MarkChannelMessagesSeen(ctx, channelID, receipts)
+				if err != nil {
+					logWarnf("failed to record seen receipts in %s: %v", channelID, err)
+					return
+				}
+				if len(ids) == 0 {
+					return
+				}
+				counts, err := sb.GetSeenCounts(ctx, ids)
+				if err != nil {
+					logWarnf("failed to fetch seen counts for %s: %v", channelID, err)
+					return
+				}
+				messages <- Message{Type: SeenCounted, ChannelID: channelID, SeenCounts: counts}
+			}()
+		case SeenCounted:
+			countsMsg := WSMessage{Type: "seen_counts", Channel: msg.ChannelID, SeenCounts: msg.SeenCounts}
+			var dead []*Client
+			for _, client := range clients {
+				if client.ChannelID == msg.ChannelID {
+					if err := client.Conn.WriteJSON(countsMsg); err != nil {
+						logErrorf("failed to send seen counts to %s: %s", client.Conn.RemoteAddr(), err)
+						dead = append(dead, client)
 					}
+				}
+			}
+			dropDead(dead)
+		case TokenCheck:
+			client, exists := clients[sessionKey(msg.UserID, msg.SessionID)]
+			if !exists || client.Conn.Conn != msg.Conn || client.tokenTimer == nil {
+				continue
+			}
+			client.tokenTimer = nil
+			if time.Since(client.tokenCheckedAt) < tokenCheckInterval/2 {
+				// Refreshed recently enough; look again an interval from now
+				scheduleTokenCheck(client)
+				continue
+			}
+			// Validate off the loop; the result comes back as TokenChecked
+			go func(ctx context.Context, conn *websocket.Conn, userID, sessionID, token string) {
+				user, err := sb.ValidateToken(ctx, token)
+				if err == nil && user.ID != userID {
+					err = fmt.Errorf("%w: token is for user %s", ErrInvalidToken, user.ID)
+				}
+				messages <- Message{Type: TokenChecked, Conn: conn, UserID: userID, SessionID: sessionID, Token: token, Err: err}
+			}(client.Ctx, client.Conn.Conn, client.UserID, client.SessionID, client.Token)
+		case TokenChecked:
+			client, exists := clients[sessionKey(msg.UserID, msg.SessionID)]
+			if !exists || client.Conn.Conn != msg.Conn {
+				continue
+			}
+			if errors.Is(msg.Err, ErrInvalidToken) && client.Token == msg.Token {
+				// Expired or revoked, and not refreshed while we checked
+				_ = client.Conn.WriteJSON(WSMessage{Type: "reauth_required"})
+				closeWithReason(client.Conn.Conn, websocket.ClosePolicyViolation, "reauth_required") // The read loop reports the disconnect
+				logInfof("closed session %s: %v", sessionKey(msg.UserID, msg.SessionID), msg.Err)
+				continue
+			}
+			if msg.Err == nil && client.Token == msg.Token {
+				client.tokenCheckedAt = time.Now()
+			} else if msg.Err != nil && !errors.Is(msg.Err, ErrInvalidToken) {
+				// Supabase unreachable or throttled says nothing about the token
+				logWarnf("token check for %s failed: %v", client.Username, msg.Err)
+			}
+			scheduleTokenCheck(client)
+		case TokenRefreshed:
+			client, exists := clients[sessionKey(msg.UserID, msg.SessionID)]
+			if !exists || client.Conn.Conn != msg.Conn {
+				continue
+			}
+			if msg.Err != nil && !errors.Is(msg.Err, ErrInvalidToken) {
+				// Throttled or unreachable says nothing about the token; the
+				// old one stays until the client retries
+				logWarnf("token refresh for %s failed: %v", client.Username, msg.Err)
+				sendError(client.Conn, ErrCodeFailedToRefreshToken, "", WSMessage{})
+				continue
+			}
+			if msg.Err != nil {
+				logWarnf("token refresh failed for %s: %v", client.UserID, msg.Err)
+				closeWithReason(client.Conn.Conn, websocket.ClosePolicyViolation, "reauth_required") // The read loop reports the disconnect
+				continue
+			}
+			client.Token = msg.Token
+			client.tokenCheckedAt = time.Now()
+			_ = client.Conn.WriteJSON(WSMessage{Type: "token_refreshed"})
+			logDebugf("refreshed token for %s", client.Username)
+		case JoinTimeout:
+			// Ignore deadlines for sessions that joined or were replaced since the timer fired
+			client, exists := clients[sessionKey(msg.UserID, msg.SessionID)]
+			if !exists || client.Conn.Conn != msg.Conn || client.joinTimer == nil {
+				continue
+			}
+			client.joinTimer = nil
+			closeWithReason(client.Conn.Conn, websocket.ClosePolicyViolation, "join_timeout") // The read loop reports the disconnect, which does the cleanup
+			logInfof("closed session %s: no join within %s", sessionKey(msg.UserID, msg.SessionID), joinTimeout)
+		case TypingExpired:
+			// Ignore timers that were superseded by a refresh or an explicit stop
+			if e := msg.Typing; typing[e.key] == e {
+				stopTyping(e)
+			}
+		case DBNotification:
+			switch n := msg.Notification.(type) {
+			case FriendRequestNotification:
+				// Send friend request notification to every session of the target user
+				friendReqMsg := WSMessage{
+					Type:           "friend_request",
+					SenderUsername: n.SenderUsername,
+					Timestamp:      time.Now().Format(time.RFC3339),
+					ID:             generateID(),
+				}
+				var dead []*Client
+				for _, client := range userClients[n.TargetUserID] {
 					if err := client.Conn.WriteJSON(friendReqMsg); err != nil {
-						log.Printf("Failed to send friend request notification to user %s: %v", n.TargetUserID, err)
+						logErrorf("failed to send friend request notification to user %s: %v", n.TargetUserID, err)
+						dead = append(dead, client)
 					}
 				}
+				dropDead(dead)
 			case FriendRequestAcceptedNotification:
-				// Send friend request accepted notification to target user
-				if client, exists := userClients[n.TargetUserID]; exists {
-					acceptedMsg := WSMessage{
-						Type:             "friend_request_accepted",
-						AccepterUsername: n.AccepterUsername,
-						Timestamp:        time.Now().Format(time.RFC3339),
-						ID:               generateID(),
-					}
+				// Send friend request accepted notification to every session of the target user
+				acceptedMsg := WSMessage{
+					Type:             "friend_request_accepted",
+					AccepterUsername: n.AccepterUsername,
+					Timestamp:        time.Now().Format(time.RFC3339),
+					ID:               generateID(),
+				}
+				var dead []*Client
+				for _, client := range userClients[n.TargetUserID] {
 					if err := client.Conn.WriteJSON(acceptedMsg); err != nil {
-						log.Printf("Failed to send friend request accepted notification to user %s: %v", n.TargetUserID, err)
+						logErrorf("failed to send friend request accepted notification to user %s: %v", n.TargetUserID, err)
+						dead = append(dead, client)
 					}
 				}
+				dropDead(dead)
+			case ProfileUpdatedNotification:
+				// A username or avatar changed, through update_profile or elsewhere.
+				// Sessions take it now; everyone sharing a channel with the user is
+				// told once those channels are known.
+				applyProfile(n.UserID, n.Username, n.AvatarURL)
+				go func(n ProfileUpdatedNotification) {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+					channelIDs, err := sb.GetUserChannelIDs(ctx, n.UserID)
+					if err != nil {
+						logWarnf("failed to list channels of %s for profile update: %v", n.UserID, err)
+						return
+					}
+					channels := make(map[string]bool, len(channelIDs))
+					for _, id := range channelIDs {
+						channels[id] = true
+					}
+					frame := WSMessage{Type: "profile_updated", UserID: n.UserID, Username: n.Username, PreviousUsername: n.PreviousUsername, Avatar: n.AvatarURL}
+					messages <- Message{Type: DBNotification, Notification: profileBroadcast{frame: frame, channels: channels}}
+				}(n)
+			case mentionDelivery:
+				for _, userID := range n.userIDs {
+					sessions := userClients[userID]
+					var dead []*Client
+					for _, client := range sessions {
+						if err := client.Conn.WriteJSON(n.frame); err != nil {
+							logErrorf("failed to send mention to user %s: %v", userID, err)
+							dead = append(dead, client)
+						}
+					}
+					dropDead(dead)
+					if len(sessions) == 0 {
+						notifyOffline(push, userID, PushPayload{
+							Type:           "mention",
+							Title:          n.frame.Username,
+							Body:           n.frame.Content,
+							SenderID:       n.frame.SenderID,
+							SenderUsername: n.frame.Username,
+							ChannelID:      n.frame.Channel,
+							MessageID:      n.frame.ID,
+						})
+					}
+				}
+			case profileBroadcast:
+				var dead []*Client
+				for _, client := range clients {
+					if n.channels[client.ChannelID] || client.UserID == n.frame.UserID {
+						if err := client.Conn.WriteJSON(n.frame); err != nil {
+							logErrorf("failed to send profile update to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
+						}
+					}
+				}
+				dropDead(dead)
+			case NewMessageNotification:
+				// A row inserted outside this server's WebSocket path (another
+				// instance, a bot, the REST API); ours were already broadcast
+				if broadcast.Seen(n.ID, time.Now()) {
+					continue
+				}
+				// Fetch and render off the loop, then come back to fan it out
+				go func(n NewMessageNotification) {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+					dbMsg, err := sb.GetMessage(ctx, n.ID)
+					if err != nil {
+						logWarnf("failed to fetch inserted message %s: %v", n.ID, err)
+						return
+					}
+					profiles := resolveProfiles(ctx, sb, []dbMessage{*dbMsg})
+					outMsg := messageFromDB(*dbMsg, "message", profiles[dbMsg.UserID])
+					outMsg.ReplySnippet = replySnippets(ctx, sb, []dbMessage{*dbMsg})[outMsg.ReplyTo]
+					messages <- Message{Type: DBNotification, Notification: outMsg}
+				}(n)
+			case WSMessage:
+				// An externally inserted message, rendered by the case above
+				if broadcast.Seen(n.ID, time.Now()) {
+					continue
+				}
+				broadcast.Record(n.ID, time.Now())
+				var dead []*Client
+				for _, client := range clients {
+					if client.ChannelID == n.Channel {
+						if err := client.Conn.WriteJSON(n); err != nil {
+							logErrorf("failed to send to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
+						}
+					}
+				}
+				dropDead(dead)
 			}
-		}
-	}()
 
-	// getUserList := func(channelID string) []string {
-	// 	// ✅ FIX: Return users only for the given channel
-	// 	users := []string{}
-	// 	for _, client := range clients {
-	// 		if client.Username != "" && client.ChannelID == channelID {
-	// 			users = append(users, client.Username)
-	// 		}
-	// 	}
-	// 	return users
-	// }
-
-	for {
-		msg := <-messages
-		switch msg.Type {
 		case ClientConnected:
 			addr := msg.Conn.RemoteAddr().String()
+			// Identity comes from the token validated in handleWebSocket
+			userID := msg.User.ID
+			key := sessionKey(userID, msg.SessionID)
+
+			// Check if this is a reconnection of the same session (from any address);
+			// other sessions of the same user (e.g. a second tab) stay connected
+			if existingClient := clients[key]; existingClient != nil {
+				logInfof("session %s reconnecting from %s, cleaning up old connection\n", key, addr)
+				closeWithReason(existingClient.Conn.Conn, websocket.ClosePolicyViolation, "session_replaced")
+				userClients.remove(existingClient)
+				markJoined(existingClient)
+				// The old socket's own disconnect is ignored as stale, so it leaves its channel here
+				stopSessionTyping(existingClient)
+				stopTokenCheck(existingClient)
+				announceLeave(existingClient)
+			}
 
-			// Connection should already be authenticated in handleWebSocket and user info stored in context
-			// For simplicity, we do token validation here using query params (since no context passing)
-			q := msg.Conn.RemoteAddr().String()
-			_ = q // placeholder (not used)
+			newClient := &Client{Conn: &lockedConn{Conn: msg.Conn}, Username: msg.Username, UserID: userID, Token: msg.Token, SessionID: msg.SessionID, Ctx: msg.Ctx, cancel: msg.Cancel, Status: "online", Avatar: msg.Avatar, Protocol: msg.Protocol, Origin: msg.Origin, SuppressEcho: msg.SuppressEcho}
+			// Presence is per user; a new tab picks up the status set from another
+			if sessions := userClients[userID]; len(sessions) > 0 {
+				newClient.Status = sessions[0].Status
+			}
+			// The deadline posts back into the loop, which owns the client registry
+			conn, sessionID := msg.Conn, msg.SessionID
+			newClient.joinTimer = time.AfterFunc(joinTimeout, func() {
+				messages <- Message{Type: JoinTimeout, Conn: conn, UserID: userID, SessionID: sessionID}
+			})
+			newClient.tokenCheckedAt = time.Now() // handleWebSocket just validated it
+			scheduleTokenCheck(newClient)
+			clients[key] = newClient
+			// Register the session for user-targeted delivery (DMs, notifications)
+			if userID != "" {
+				userClients.add(newClient)
+			}
+			atomic.StoreInt64(&metrics.connections, int64(len(clients)))
+			atomic.StoreInt64(&metrics.connectedUsers, int64(len(userClients)))
+			// Tell the client what it's talking to before anything else arrives
+			hello := WSMessage{Type: "hello", Protocol: newClient.Protocol, Features: protocolFeatures(newClient.Protocol), Timestamp: time.Now().Format(time.RFC3339)}
+			if err := newClient.Conn.WriteJSON(hello); err != nil {
+				logErrorf("failed to send hello to %s: %v", addr, err)
+			}
+			withFields(logFields{"user_id": userID, "conn": addr, "session": msg.SessionID}).Infof("connected to server: user=%s protocol=%d", msg.Username, msg.Protocol)
+
+		case ClientDisconnected:
+			key := sessionKey(msg.UserID, msg.SessionID)
+			client, exists := clients[key]
+			if !exists || client.Conn.Conn != msg.Conn {
+				// Stale connection already replaced by a reconnect of the same
+				// session, or dropped after a failed write
+				continue
+			}
+			dropClient(client)
+
+		case NewMessage:
+			authorAddr := msg.Conn.RemoteAddr().String()
+
+			author, exists := clients[sessionKey(msg.UserID, msg.SessionID)]
+			if !exists || author.Conn.Conn != msg.Conn {
+				continue
+			}
+
+			// Parse the JSON frame
+			var wsMsg WSMessage
+			if err := json.Unmarshal([]byte(msg.Text), &wsMsg); err != nil {
+				logWarnf("invalid message format: %v", err)
+				continue
+			}
+			countWSMessage(wsMsg.Type)
+			// Strip escape sequences and control characters before anything stores or logs content
+			wsMsg.Content = sanitizeContent(wsMsg.Content)
+			if err := validateWSMessage(&wsMsg); err != nil {
+				logDebugf("rejected payload from %s: %v", author.Username, err)
+				sendError(author.Conn, ErrCodeInvalidPayload, err.Error(), WSMessage{Channel: wsMsg.Channel, ID: wsMsg.ID, ClientID: wsMsg.ClientID})
+				continue
+			}
+			if wsMsg.Type != "refresh_token" {
+				wsMsg.Token = "" // Don't let a stray token ride along into a broadcast
+			}
+
+			if wsMsg.Type == "switch_channel" {
+                var info *channelInfo
+                if wsMsg.Channel != "" {
+                    var ok bool
+                    if info, ok = lookupChannel(author, wsMsg.Channel); !ok {
+                        continue
+                    }
+                }
+                if wsMsg.Channel != "" && isBanned(author, wsMsg.Channel) {
+                    sendError(author.Conn, ErrCodeBanned, "", WSMessage{Channel: wsMsg.Channel})
+                    continue
+                }
+                if wsMsg.Channel != "" && !isMember(author, wsMsg.Channel) {
+                    sendError(author.Conn, ErrCodeNotAMember, "", WSMessage{Channel: wsMsg.Channel})
+                    continue
+                }
+                if info != nil {
+                    _ = author.Conn.WriteJSON(WSMessage{Type: "channel_info", Channel: wsMsg.Channel, ChannelInfo: info})
+                }
+
+                logInfof("user %s switched from %s to %s\n",
+                    author.Username, author.ChannelID, wsMsg.Channel)
+                
+                // Notify old channel that user left (unless another of their sessions is still there)
+                announceLeave(author)
+                
+                // Update user's channel
+                stopSessionTyping(author)
+                author.ChannelID = wsMsg.Channel
+                if wsMsg.Channel != "" {
+                    markJoined(author)
+                }
+                
+                // Get existing users in new channel (excluding current user)
+                existingUsers := channelUsers(wsMsg.Channel, author.UserID)
+                
+                // Send user list to switching user
+                if len(existingUsers) > 0 {
+                    listMsg := WSMessage{
+                        Type: "user_list",
+                        Users: existingUsers,
+                        Statuses: onlineUsers(wsMsg.Channel, author.UserID),
+                        Channel: wsMsg.Channel,
+                    }
+                    listJsonMsg, _ := json.Marshal(listMsg)
+                    author.Conn.WriteMessage(websocket.TextMessage, listJsonMsg)
+                }
+                
+				// History is fetched off the server loop
+				go sendChannelHistory(author, author.Token, wsMsg.Channel, wsMsg.Resume, historyLimit(wsMsg.Limit), wsMsg.Batch || author.Protocol >= protocolBatched)
+                
+                // Notify new channel that user joined
+                joinMsg := WSMessage{
+                    Type: "user_joined",
+                    Username: author.Username,
+                    Channel: wsMsg.Channel,
+                    Timestamp: time.Now().Format(time.RFC3339),
+                    ID: generateID(),
+                    OnlineCount: channelCount(wsMsg.Channel, nil),
+                }
+                jsonJoinMsg, _ := json.Marshal(joinMsg)
+                var dead []*Client
+                for _, client := range clients {
+                    if client != author && client.ChannelID == wsMsg.Channel {
+                        if err := client.Conn.WriteMessage(websocket.TextMessage, jsonJoinMsg); err != nil {
+                            logErrorf("failed to send user_joined to %s: %s", client.Conn.RemoteAddr(), err)
+                            dead = append(dead, client)
+                        }
+                    }
+                }
+                dropDead(dead)
+                
+                continue
+            }
+
+			// Handle presence changes; status is per user, so every session follows
+			if wsMsg.Type == "set_status" {
+				if wsMsg.Status != "online" && wsMsg.Status != "away" && wsMsg.Status != "offline" {
+					sendError(author.Conn, ErrCodeInvalidStatus, "", WSMessage{})
+					continue
+				}
+
+				channels := map[string]bool{}
+				for _, session := range userClients[author.UserID] {
+					session.Status = wsMsg.Status
+					if session.ChannelID != "" {
+						channels[session.ChannelID] = true
+					}
+				}
+
+				presenceMsg := WSMessage{
+					Type:      "presence_update",
+					Username:  author.Username,
+					SenderID:  author.UserID,
+					Status:    wsMsg.Status,
+					Timestamp: time.Now().Format(time.RFC3339),
+				}
+				var dead []*Client
+				for _, client := range clients {
+					if channels[client.ChannelID] || client.UserID == author.UserID {
+						if err := client.Conn.WriteJSON(presenceMsg); err != nil {
+							logErrorf("failed to send presence update: %v", err)
+							dead = append(dead, client)
+						}
+					}
+				}
+				dropDead(dead)
+				continue
+			}
+
+			// Handle slow-mode changes: moderators only; the new value goes to the whole channel
+			if wsMsg.Type == "set_slow_mode" {
+				if wsMsg.SlowModeSeconds == nil || *wsMsg.SlowModeSeconds < 0 || *wsMsg.SlowModeSeconds > maxSlowModeSeconds {
+					sendError(author.Conn, ErrCodeInvalidPayload, fmt.Sprintf("slow_mode_seconds must be between 0 and %d", maxSlowModeSeconds), WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				ok, err := sb.isChannelModerator(author.Ctx, wsMsg.Channel, author.UserID)
+				if err != nil {
+					logErrorf("failed to check moderator role of %s in %s: %v", author.UserID, wsMsg.Channel, err)
+					sendError(author.Conn, ErrCodeFailedToSetSlowMode, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				if !ok {
+					sendError(author.Conn, ErrCodeNotAuthorized, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				if err := sb.SetSlowMode(author.Ctx, wsMsg.Channel, *wsMsg.SlowModeSeconds); err != nil {
+					logErrorf("failed to set slow mode for %s: %v", wsMsg.Channel, err)
+					sendError(author.Conn, ErrCodeFailedToSetSlowMode, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				slow.SetCooldown(wsMsg.Channel, time.Duration(*wsMsg.SlowModeSeconds)*time.Second, time.Now())
+
+				updateMsg := WSMessage{Type: "slow_mode_updated", Channel: wsMsg.Channel, SlowModeSeconds: wsMsg.SlowModeSeconds, Username: author.Username}
+				var dead []*Client
+				for _, client := range clients {
+					if client.ChannelID == wsMsg.Channel {
+						if err := client.Conn.WriteJSON(updateMsg); err != nil {
+							logErrorf("failed to send slow mode update to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
+						}
+					}
+				}
+				dropDead(dead)
+				logInfof("slow mode in %s set to %ds by %s", wsMsg.Channel, *wsMsg.SlowModeSeconds, author.Username)
+				continue
+			}
+
+			// Handle moderator notices: a persisted system line in one channel
+			if wsMsg.Type == "system_message" {
+				content := strings.TrimSpace(wsMsg.Content)
+				if utf8.RuneCountInString(content) > maxMessageLen {
+					sendError(author.Conn, ErrCodeMessageTooLong, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				ok, err := sb.isChannelModerator(author.Ctx, wsMsg.Channel, author.UserID)
+				if err != nil {
+					logErrorf("failed to check moderator role of %s in %s: %v", author.UserID, wsMsg.Channel, err)
+					sendError(author.Conn, ErrCodeFailedToPersist, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				if !ok {
+					sendError(author.Conn, ErrCodeNotAuthorized, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				dbMsg, err := sb.InsertSystemMessage(author.Ctx, wsMsg.Channel, author.UserID, content)
+				if err != nil {
+					logErrorf("failed to persist system message in %s: %v", wsMsg.Channel, err)
+					sendError(author.Conn, ErrCodeFailedToPersist, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+
+				systemMsg := messageFromDB(*dbMsg, "message", profile{Username: author.Username, AvatarURL: author.Avatar})
+				broadcast.Record(dbMsg.ID, time.Now())
+				var dead []*Client
+				for _, client := range clients {
+					if client.ChannelID == wsMsg.Channel || client == author {
+						if err := client.Conn.WriteJSON(systemMsg); err != nil {
+							logErrorf("failed to send system message to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
+						}
+					}
+				}
+				dropDead(dead)
+				logInfof("system message in %s by %s", wsMsg.Channel, author.Username)
+				continue
+			}
+
+			// Handle moderator purges: remove a user's messages or a list of IDs from one channel
+			if wsMsg.Type == "purge" {
+				if (wsMsg.TargetUserID == "") == (len(wsMsg.IDs) == 0) || len(wsMsg.IDs) > maxPurgeIDs {
+					sendError(author.Conn, ErrCodeInvalidPayload, fmt.Sprintf("purge needs either target_user_id or up to %d ids", maxPurgeIDs), WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				ok, err := sb.isChannelModerator(author.Ctx, wsMsg.Channel, author.UserID)
+				if err != nil {
+					logErrorf("failed to check moderator role of %s in %s: %v", author.UserID, wsMsg.Channel, err)
+					sendError(author.Conn, ErrCodeFailedToPurge, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				if !ok {
+					sendError(author.Conn, ErrCodeNotAuthorized, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+
+				var removed []string
+				if wsMsg.TargetUserID != "" {
+					removed, err = sb.DeleteMessagesByUser(author.Ctx, wsMsg.Channel, wsMsg.TargetUserID)
+				} else {
+					removed, err = sb.DeleteMessagesByIDs(author.Ctx, wsMsg.Channel, wsMsg.IDs)
+				}
+				if err != nil {
+					logErrorf("failed to purge messages in %s: %v", wsMsg.Channel, err)
+					sendError(author.Conn, ErrCodeFailedToPurge, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+
+				purgedMsg := WSMessage{Type: "messages_purged", Channel: wsMsg.Channel, IDs: removed}
+				var dead []*Client
+				for _, client := range clients {
+					if client.ChannelID == wsMsg.Channel || client == author {
+						if err := client.Conn.WriteJSON(purgedMsg); err != nil {
+							logErrorf("failed to send purge to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
+						}
+					}
+				}
+				dropDead(dead)
+				logInfof("%s purged %d message(s) from %s", author.Username, len(removed), wsMsg.Channel)
+				continue
+			}
+
+			// Handle kicks and bans: moderators disconnect a user's sessions in the
+			// channel; a ban also records it so the user can't join again
+			if wsMsg.Type == "kick" || wsMsg.Type == "ban" {
+				if wsMsg.TargetUserID == author.UserID {
+					sendError(author.Conn, ErrCodeInvalidPayload, "you can't remove yourself", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				ok, err := sb.isChannelModerator(author.Ctx, wsMsg.Channel, author.UserID)
+				if err != nil {
+					logErrorf("failed to check moderator role of %s in %s: %v", author.UserID, wsMsg.Channel, err)
+					sendError(author.Conn, ErrCodeFailedToModerate, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				if !ok {
+					sendError(author.Conn, ErrCodeNotAuthorized, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				// Moderators can't remove one another
+				targetMod, err := sb.isChannelModerator(author.Ctx, wsMsg.Channel, wsMsg.TargetUserID)
+				if err != nil {
+					logErrorf("failed to check moderator role of %s in %s: %v", wsMsg.TargetUserID, wsMsg.Channel, err)
+					sendError(author.Conn, ErrCodeFailedToModerate, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				if targetMod {
+					sendError(author.Conn, ErrCodeNotAuthorized, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+
+				reason, event := "kicked", "user_kicked"
+				if wsMsg.Type == "ban" {
+					if err := sb.BanUser(author.Ctx, wsMsg.Channel, wsMsg.TargetUserID, author.UserID); err != nil {
+						logErrorf("failed to ban %s from %s: %v", wsMsg.TargetUserID, wsMsg.Channel, err)
+						sendError(author.Conn, ErrCodeFailedToModerate, "", WSMessage{Channel: wsMsg.Channel})
+						continue
+					}
+					reason, event = "banned", "user_banned"
+				}
+
+				// The read loops report the disconnects, which do the usual cleanup
+				targetName := ""
+				for _, client := range userClients[wsMsg.TargetUserID] {
+					targetName = client.Username
+					if wsMsg.Type == "ban" {
+						delete(client.memberOf, wsMsg.Channel)
+					}
+					if client.ChannelID == wsMsg.Channel {
+						closeWithReason(client.Conn.Conn, websocket.ClosePolicyViolation, reason)
+					}
+				}
 
-			// Check if this is a reconnection (same IP)
-			if existingClient := clients[addr]; existingClient != nil {
-				log.Printf("\x1b[33mINFO\x1b[0m: client %s reconnecting, cleaning up old connection\n", addr)
-				existingClient.Conn.Close()
-				// Remove from userClients map if exists
-				if existingClient.UserID != "" {
-					delete(userClients, existingClient.UserID)
+				kickMsg := WSMessage{
+					Type:         event,
+					Channel:      wsMsg.Channel,
+					Username:     targetName,
+					TargetUserID: wsMsg.TargetUserID,
+					Timestamp:    time.Now().Format(time.RFC3339),
+				}
+				var dead []*Client
+				for _, client := range clients {
+					if client.UserID != wsMsg.TargetUserID && (client.ChannelID == wsMsg.Channel || client == author) {
+						if err := client.Conn.WriteJSON(kickMsg); err != nil {
+							logErrorf("failed to send %s to %s: %s", event, client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
+						}
+					}
 				}
+				dropDead(dead)
+				logInfof("%s %s %s from %s", author.Username, reason, wsMsg.TargetUserID, wsMsg.Channel)
+				continue
 			}
 
-			newClient := &Client{Conn: msg.Conn, Username: msg.Username, UserID: msg.UserID, Token: msg.Token}
-			clients[addr] = newClient
-			// Add to userClients map for notifications
-			if msg.UserID != "" {
-				userClients[msg.UserID] = newClient
+			// Handle online-count requests; counted here since the loop owns clients
+			if wsMsg.Type == "channel_count" {
+				if !isMember(author, wsMsg.Channel) {
+					sendError(author.Conn, ErrCodeNotAMember, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				_ = author.Conn.WriteJSON(WSMessage{Type: "channel_count", Channel: wsMsg.Channel, OnlineCount: channelCount(wsMsg.Channel, nil)})
+				continue
 			}
-			log.Printf("\x1b[32mINFO\x1b[0m: connected to server: %s user=%s id=%s\n", addr, msg.Username, msg.UserID)
 
-		case ClientDisconnected:
-			fullAddr := msg.Conn.RemoteAddr().String()
-			client, exists := clients[fullAddr]
-			if exists && client.Username != "" {
-				leaveMsg := WSMessage{
-					Type: "user_left",
-					Username: client.Username,
-					Channel: client.ChannelID, // ✅ FIX: include channel
-					Timestamp: time.Now().Format(time.RFC3339), // ✅ FIX: Add timestamp
-					ID: generateID(), // ✅ FIX: Add ID
+			// Handle seen receipts in channels that have them on. Receipts are
+			// queued and written in one insert per channel every seenFlushDelay,
+			// followed by one seen_counts frame; receipts for messages outside the
+			// channel are dropped then. Channels without receipts ignore them.
+			if wsMsg.Type == "seen" {
+				if !isMember(author, wsMsg.Channel) {
+					sendError(author.Conn, ErrCodeNotAMember, "", WSMessage{Channel: wsMsg.Channel})
+					continue
 				}
-				jsonMsg, _ := json.Marshal(leaveMsg)
-
-				// ✅ FIX: Notify only same-channel clients
-				for _, otherClient := range clients {
-					if otherClient != client && otherClient.ChannelID == client.ChannelID {
-						otherClient.Conn.WriteMessage(websocket.TextMessage, jsonMsg)
-					}
+				if !readReceiptsOn(author, wsMsg.Channel) {
+					continue
 				}
-				log.Printf("\x1b[32mINFO\x1b[0m: user %s left channel %s\n", client.Username, client.ChannelID)
-				
-				// Remove from userClients map
-				if client.UserID != "" {
-					delete(userClients, client.UserID)
+				if seen.Add(wsMsg.Channel, wsMsg.ID, author.UserID) {
+					channelID := wsMsg.Channel
+					time.AfterFunc(seenFlushDelay, func() {
+						messages <- Message{Type: SeenFlush, ChannelID: channelID}
+					})
 				}
+				continue
 			}
-			delete(clients, fullAddr)
-
-		case NewMessage:
-			authorAddr := msg.Conn.RemoteAddr().String()
 
-			author, exists := clients[authorAddr]
-			if !exists {
+			// Handle clock sync requests; only reveals the server's current time
+			if wsMsg.Type == "time" {
+				timeMsg := WSMessage{
+					Type:       "time",
+					Timestamp:  time.Now().UTC().Format(wireTimeFormat),
+					ClientTime: wsMsg.ClientTime,
+				}
+				_ = author.Conn.WriteJSON(timeMsg)
 				continue
 			}
 
-			// ✅ FIX: Parse JSON instead of raw text
-			var wsMsg WSMessage
-			if err := json.Unmarshal([]byte(msg.Text), &wsMsg); err != nil {
-				log.Println("Invalid message format:", err)
+			// Handle token refresh: swap in a new access token for the same user so
+			// long-lived sessions keep passing RLS. A token that doesn't validate,
+			// or belongs to someone else, ends the session.
+			if wsMsg.Type == "refresh_token" {
+				// Validate off the loop; the result comes back as TokenRefreshed
+				go func(ctx context.Context, conn *websocket.Conn, userID, sessionID, token string) {
+					user, err := sb.ValidateToken(ctx, token)
+					if err == nil && user.ID != userID {
+						err = fmt.Errorf("%w: token is for user %s", ErrInvalidToken, user.ID)
+					}
+					messages <- Message{Type: TokenRefreshed, Conn: conn, UserID: userID, SessionID: sessionID, Token: token, Err: err}
+				}(author.Ctx, author.Conn.Conn, author.UserID, author.SessionID, wsMsg.Token)
 				continue
 			}
 
-			if wsMsg.Type == "switch_channel" {
-                log.Printf("user %s switched from %s to %s\n",
-                    author.Username, author.ChannelID, wsMsg.Channel)
-                
-                // Notify old channel that user left
-                if author.ChannelID != "" {
-                    leaveMsg := WSMessage{
-                        Type: "user_left",
-                        Username: author.Username,
-                        Channel: author.ChannelID,
-                        Timestamp: time.Now().Format(time.RFC3339), // ✅ FIX: Add timestamp
-                        ID: generateID(), // ✅ FIX: Add ID
-                    }
-                    jsonLeaveMsg, _ := json.Marshal(leaveMsg)
-                    for _, client := range clients {
-                        if client != author && client.ChannelID == author.ChannelID {
-                            client.Conn.WriteMessage(websocket.TextMessage, jsonLeaveMsg)
-                        }
-                    }
-                }
-                
-                // Update user's channel
-                author.ChannelID = wsMsg.Channel
-                
-                // Get existing users in new channel (excluding current user)
-                existingUsers := []string{}
-                for _, client := range clients {
-                    if client.Username != "" && client.ChannelID == wsMsg.Channel && client != author {
-                        existingUsers = append(existingUsers, client.Username)
-                    }
-                }
-                
-                // Send user list to switching user
-                if len(existingUsers) > 0 {
-                    listMsg := WSMessage{
-                        Type: "user_list",
-                        Users: existingUsers,
-                        Channel: wsMsg.Channel,
-                    }
-                    listJsonMsg, _ := json.Marshal(listMsg)
-                    author.Conn.WriteMessage(websocket.TextMessage, listJsonMsg)
-                }
-                
-				// ✅ FIX: Send message history to switching user
-				if wsMsg.Channel != "" { // Only fetch if channel is not empty
-					messages, err := sb.GetChannelMessages(wsMsg.Channel, 50)
-					if err != nil {
-						log.Printf("\x1b[33mWARN\x1b[0m: failed to fetch message history for channel %s: %v", wsMsg.Channel, err)
-					} else if len(messages) > 0 {
-					// Get all unique user IDs from messages
-					userIDs := make(map[string]bool)
-					for _, msg := range messages {
-						userIDs[msg.UserID] = true
-					}
-					
-					// Convert to slice
-					userIDList := make([]string, 0, len(userIDs))
-					for userID := range userIDs {
-						userIDList = append(userIDList, userID)
-					}
-					
-					// Get usernames for all users
-					usernames, err := sb.GetProfiles(userIDList)
-					if err != nil {
-						log.Printf("\x1b[33mWARN\x1b[0m: failed to fetch usernames for message history: %v", err)
-						usernames = make(map[string]string) // fallback to empty map
-					}
-					
-					// Send each message as a history message
-					for _, msg := range messages {
-						username := usernames[msg.UserID]
-						if username == "" {
-							username = "unknown"
-						}
-						
-						historyMsg := WSMessage{
-							Type: "message",
-							Username: username,
-							Content: msg.Content,
-							Channel: wsMsg.Channel,
-							Timestamp: msg.CreatedAt,
-							ID: msg.ID,
-							ReplyTo: func() string { if msg.ReplyTo != nil { return *msg.ReplyTo } else { return "" } }(),
-							Edited: msg.Edited,
-							EditedAt: func() string { if msg.EditedAt != nil { return *msg.EditedAt } else { return "" } }(),
-						}
-						historyJsonMsg, _ := json.Marshal(historyMsg)
-						author.Conn.WriteMessage(websocket.TextMessage, historyJsonMsg)
+			// Handle username changes. The author's sessions hear back at once;
+			// everyone else (and the author again) through profile_updated.
+			if wsMsg.Type == "update_profile" {
+				updated, err := sb.UpdateProfile(author.Ctx, author.UserID, author.Token, strings.TrimSpace(wsMsg.Username))
+				if err != nil {
+					errCode := ErrCodeFailedToSaveProfile
+					switch {
+					case errors.Is(err, ErrUsernameTaken):
+						errCode = ErrCodeUsernameTaken
+					case errors.Is(err, ErrInvalidUsername):
+						errCode = ErrCodeInvalidUsername
+					default:
+						logErrorf("failed to update profile of %s: %v", author.UserID, err)
 					}
-					
-					log.Printf("\x1b[32mINFO\x1b[0m: sent %d historical messages to %s switching to channel %s", len(messages), author.Username, wsMsg.Channel)
+					sendError(author.Conn, errCode, "", WSMessage{})
+					continue
 				}
+				frame := WSMessage{Type: "profile_updated", UserID: author.UserID, Username: updated.Username, PreviousUsername: author.Username, Avatar: updated.AvatarURL}
+				applyProfile(author.UserID, updated.Username, updated.AvatarURL)
+				var dead []*Client
+				for _, client := range userClients[author.UserID] {
+					if err := client.Conn.WriteJSON(frame); err != nil {
+						logErrorf("failed to send profile update to %s: %s", client.Conn.RemoteAddr(), err)
+						dead = append(dead, client)
+					}
 				}
-                
-                // Notify new channel that user joined
-                joinMsg := WSMessage{
-                    Type: "user_joined",
-                    Username: author.Username,
-                    Channel: wsMsg.Channel,
-                    Timestamp: time.Now().Format(time.RFC3339), // ✅ FIX: Add timestamp
-                    ID: generateID(), // ✅ FIX: Add ID
-                }
-                jsonJoinMsg, _ := json.Marshal(joinMsg)
-                for _, client := range clients {
-                    if client != author && client.ChannelID == wsMsg.Channel {
-                        client.Conn.WriteMessage(websocket.TextMessage, jsonJoinMsg)
-                    }
-                }
-                
-                continue
-            }
+				dropDead(dead)
+				logInfof("user %s renamed %s to %s", author.UserID, frame.PreviousUsername, updated.Username)
+				continue
+			}
+
+			// Handle session info requests, so a client can confirm who it is
+			// connected as (after a token refresh, say)
+			if wsMsg.Type == "whoami" {
+				_ = author.Conn.WriteJSON(WSMessage{
+					Type:     "whoami",
+					UserID:   author.UserID,
+					Username: author.Username,
+					Channel:  author.ChannelID,
+					Sessions: len(userClients[author.UserID]),
+					Protocol: author.Protocol,
+				})
+				continue
+			}
 
 			// Handle typing events without rate limiting
 			if wsMsg.Type == "typing" || wsMsg.Type == "stop_typing" {
+				// Only for the channel the session is in, so indicators can't be
+				// planted elsewhere and are all cleared on leave or disconnect.
+				// A mismatch is usually a frame that crossed a channel switch.
+				if wsMsg.Channel != author.ChannelID {
+					continue
+				}
+				wsMsg.Username = author.Username
+				key := typingKey{author.ChannelID, author.Username}
+				if e := typing[key]; e != nil {
+					e.timer.Stop()
+					delete(typing, key)
+				}
+				if wsMsg.Type == "typing" {
+					// The timer posts back into the loop, which owns the typing map
+					e := &typingEntry{key: key, session: author}
+					e.timer = time.AfterFunc(typingTimeout, func() {
+						messages <- Message{Type: TypingExpired, Typing: e}
+					})
+					typing[key] = e
+				}
+
 				// Broadcast typing events to same channel only
+				var dead []*Client
 				for _, client := range clients {
 					if client != author && client.ChannelID == wsMsg.Channel {
-						client.Conn.WriteJSON(wsMsg)
+						if err := client.Conn.WriteJSON(wsMsg); err != nil {
+							logErrorf("failed to send typing to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
+						}
 					}
 				}
+				dropDead(dead)
 				continue
 			}
 
 			// Handle message editing
 			if wsMsg.Type == "edit_message" {
-				if wsMsg.ID == "" || strings.TrimSpace(wsMsg.Content) == "" {
-					log.Printf("\x1b[31mERROR\x1b[0m: edit_message missing ID or content")
+				if utf8.RuneCountInString(wsMsg.Content) > maxMessageLen {
+					sendError(author.Conn, ErrCodeMessageTooLong, "", WSMessage{ID: wsMsg.ID, Channel: wsMsg.Channel})
+					continue
+				}
+				// Edits go through the word filter too, or it could be bypassed
+				filtered, err := filter.Apply(wsMsg.Content)
+				if err != nil {
+					sendError(author.Conn, ErrCodeFiltered, "", WSMessage{ID: wsMsg.ID, Channel: wsMsg.Channel})
 					continue
 				}
+				wsMsg.Content = filtered
 				
 				// Update message in database
-				dbMsg, err := sb.UpdateMessage(wsMsg.ID, author.UserID, wsMsg.Content)
+				dbMsg, err := sb.UpdateMessage(author.Ctx, wsMsg.ID, author.UserID, wsMsg.Content, author.Token)
 				if err != nil {
-					log.Printf("\x1b[31mERROR\x1b[0m: failed to edit message: %v", err)
+					errCode := ErrCodeFailedToEdit
+					switch {
+					case errors.Is(err, ErrNotAuthorized):
+						errCode = ErrCodeNotAuthorized
+					case errors.Is(err, ErrNotFound):
+						errCode = ErrCodeNotFound
+					case errors.Is(err, ErrEditWindowExpired):
+						errCode = ErrCodeEditTooOld
+					default:
+						logErrorf("failed to edit message: %v", err)
+					}
 					// Send error back to author
-					errPayload := WSMessage{Type: "error", Content: "failed_to_edit", Channel: wsMsg.Channel}
-					_ = author.Conn.WriteJSON(errPayload)
+					sendError(author.Conn, errCode, "", WSMessage{Channel: wsMsg.Channel, ID: wsMsg.ID})
 					continue
 				}
 				
 				// Create edit broadcast message
-				editMsg := WSMessage{
-					Type: "message_edited",
-					Username: author.Username,
-					Content: dbMsg.Content,
-					Channel: wsMsg.Channel,
-					ID: dbMsg.ID,
-					Timestamp: dbMsg.CreatedAt,
-					Edited: dbMsg.Edited,
-					EditedAt: *dbMsg.EditedAt,
-				}
+				editMsg := messageFromDB(*dbMsg, "message_edited", profile{Username: author.Username, AvatarURL: author.Avatar})
 				
 				// Broadcast edit to all channel members
+				var dead []*Client
 				for _, client := range clients {
-					if client.ChannelID == wsMsg.Channel {
+					if client.ChannelID == editMsg.Channel {
 						err := client.Conn.WriteJSON(editMsg)
 						if err != nil {
-							log.Printf("\x1b[31mERROR\x1b[0m: failed to send edit to %s: %s", client.Conn.RemoteAddr(), err)
-							client.Conn.Close()
+							logErrorf("failed to send edit to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
 						}
 					}
 				}
+				dropDead(dead)
 				
-				log.Printf("\x1b[32mINFO\x1b[0m: message %s edited by %s", wsMsg.ID, author.Username)
+				logInfof("message %s edited by %s", wsMsg.ID, author.Username)
 				continue
 			}
 
 			// Handle message deletion
 			if wsMsg.Type == "delete_message" {
-				if wsMsg.ID == "" {
-					log.Printf("\x1b[31mERROR\x1b[0m: delete_message missing ID")
-					continue
+				// Authors soft-delete their own messages, leaving a tombstone so
+				// replies stay threaded; channel moderators remove others' outright
+				soft := true
+				dbMsg, err := sb.DeleteMessage(author.Ctx, wsMsg.ID, author.UserID, true, author.Token)
+				if errors.Is(err, ErrNotAuthorized) {
+					// Lookup failures surface as failed_to_delete; only a role
+					// check that says no leaves the not_authorized in place
+					if target, terr := sb.GetMessage(author.Ctx, wsMsg.ID); terr != nil {
+						err = fmt.Errorf("load message for moderator check: %w", terr)
+					} else if ok, merr := sb.isChannelModerator(author.Ctx, target.ChannelID, author.UserID); merr != nil {
+						err = fmt.Errorf("check moderator role: %w", merr)
+					} else if ok {
+						soft = false
+						dbMsg, err = sb.HardDeleteMessage(author.Ctx, wsMsg.ID)
+					}
 				}
-				
-				// Delete message from database
-				err := sb.DeleteMessage(wsMsg.ID, author.UserID)
 				if err != nil {
-					log.Printf("\x1b[31mERROR\x1b[0m: failed to delete message: %v", err)
+					errCode := ErrCodeFailedToDelete
+					switch {
+					case errors.Is(err, ErrNotAuthorized):
+						errCode = ErrCodeNotAuthorized
+					case errors.Is(err, ErrNotFound):
+						errCode = ErrCodeNotFound
+					default:
+						logErrorf("failed to delete message: %v", err)
+					}
 					// Send error back to author
-					errPayload := WSMessage{Type: "error", Content: "failed_to_delete", Channel: wsMsg.Channel}
-					_ = author.Conn.WriteJSON(errPayload)
+					sendError(author.Conn, errCode, "", WSMessage{Channel: wsMsg.Channel, ID: wsMsg.ID})
 					continue
 				}
 				
 				// Create delete broadcast message
 				deleteMsg := WSMessage{
 					Type: "message_deleted",
-					ID: wsMsg.ID,
-					Channel: wsMsg.Channel,
+					ID: dbMsg.ID,
+					Channel: dbMsg.ChannelID,
+					Soft: soft,
 				}
 				
 				// Broadcast deletion to all channel members
+				var dead []*Client
 				for _, client := range clients {
-					if client.ChannelID == wsMsg.Channel {
+					if client.ChannelID == deleteMsg.Channel {
 						err := client.Conn.WriteJSON(deleteMsg)
 						if err != nil {
-							log.Printf("\x1b[31mERROR\x1b[0m: failed to send delete to %s: %s", client.Conn.RemoteAddr(), err)
-							client.Conn.Close()
+							logErrorf("failed to send delete to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
 						}
 					}
 				}
+				dropDead(dead)
 				
-				log.Printf("\x1b[32mINFO\x1b[0m: message %s deleted by %s", wsMsg.ID, author.Username)
+				logInfof("message %s deleted by %s (soft=%t)", wsMsg.ID, author.Username, soft)
+				continue
+			}
+
+			// Handle reactions: persist, then broadcast the message's current counts
+			if wsMsg.Type == "add_reaction" || wsMsg.Type == "remove_reaction" {
+				// Resolve the message's channel server-side rather than trusting the client
+				target, err := sb.GetMessage(author.Ctx, wsMsg.ID)
+				if err != nil {
+					errCode := ErrCodeFailedToReact
+					if errors.Is(err, ErrNotFound) {
+						errCode = ErrCodeMessageNotFound
+					}
+					sendError(author.Conn, errCode, "", WSMessage{Channel: wsMsg.Channel, ID: wsMsg.ID})
+					continue
+				}
+				if !isMember(author, target.ChannelID) {
+					// Same answer as a missing message, so reactions don't leak which IDs exist
+					sendError(author.Conn, ErrCodeMessageNotFound, "", WSMessage{Channel: wsMsg.Channel, ID: wsMsg.ID})
+					continue
+				}
+
+				if wsMsg.Type == "add_reaction" {
+					err = sb.AddReaction(author.Ctx, wsMsg.ID, author.UserID, wsMsg.Emoji)
+				} else {
+					err = sb.RemoveReaction(author.Ctx, wsMsg.ID, author.UserID, wsMsg.Emoji)
+				}
+				if err != nil {
+					errCode := ErrCodeFailedToReact
+					switch {
+					case errors.Is(err, ErrEmojiNotAllowed):
+						errCode = ErrCodeEmojiNotAllowed
+					case errors.Is(err, ErrReactionLimitReached):
+						errCode = ErrCodeReactionLimitReached
+					default:
+						logErrorf("failed to %s: %v", wsMsg.Type, err)
+					}
+					sendError(author.Conn, errCode, "", WSMessage{Channel: target.ChannelID, ID: wsMsg.ID})
+					continue
+				}
+
+				reactions, err := sb.GetReactions(author.Ctx, []string{wsMsg.ID})
+				if err != nil {
+					logErrorf("failed to fetch reactions for %s: %v", wsMsg.ID, err)
+					continue
+				}
+
+				updateMsg := WSMessage{
+					Type: "reaction_updated",
+					ID: wsMsg.ID,
+					Channel: target.ChannelID,
+					Reactions: reactions[wsMsg.ID],
+				}
+				var dead []*Client
+				for _, client := range clients {
+					if client.ChannelID == target.ChannelID {
+						if err := client.Conn.WriteJSON(updateMsg); err != nil {
+							logErrorf("failed to send reaction update to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
+						}
+					}
+				}
+				dropDead(dead)
+				continue
+			}
+
+			// Handle pins: moderators only; every change re-sends the channel's pinned list
+			if wsMsg.Type == "pin_message" || wsMsg.Type == "unpin_message" {
+				channelID := wsMsg.Channel
+				if channelID == "" {
+					channelID = author.ChannelID
+				}
+				if channelID == "" {
+					sendError(author.Conn, ErrCodeInvalidPayload, wsMsg.Type+" needs a channel when not in one", WSMessage{ID: wsMsg.ID})
+					continue
+				}
+
+				var err error
+				if wsMsg.Type == "pin_message" {
+					err = sb.PinMessage(author.Ctx, channelID, wsMsg.ID, author.UserID)
+				} else {
+					err = sb.UnpinMessage(author.Ctx, channelID, wsMsg.ID, author.UserID)
+				}
+				if err != nil {
+					errCode := ErrCodeFailedToPin
+					switch {
+					case errors.Is(err, ErrNotAuthorized):
+						errCode = ErrCodeNotAuthorized
+					case errors.Is(err, ErrNotFound):
+						errCode = ErrCodeMessageNotFound
+					default:
+						logErrorf("failed to %s: %v", wsMsg.Type, err)
+					}
+					sendError(author.Conn, errCode, "", WSMessage{Channel: channelID, ID: wsMsg.ID})
+					continue
+				}
+
+				updateMsg, err := pinsUpdate(author.Ctx, sb, channelID)
+				if err != nil {
+					logErrorf("failed to fetch pinned messages for %s: %v", channelID, err)
+					continue
+				}
+				var dead []*Client
+				for _, client := range clients {
+					if client.ChannelID == channelID {
+						if err := client.Conn.WriteJSON(updateMsg); err != nil {
+							logErrorf("failed to send pins update to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
+						}
+					}
+				}
+				dropDead(dead)
+				logInfof("%s %s in %s by %s", wsMsg.Type, wsMsg.ID, channelID, author.Username)
+				continue
+			}
+
+			// Handle requests for older history (scrollback) before a timestamp cursor
+			if wsMsg.Type == "load_history" {
+				if !isMember(author, wsMsg.Channel) {
+					sendError(author.Conn, ErrCodeNotAMember, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+
+				go func(author *Client, token, channelID, before, beforeID string, limit int) {
+					if !history.Acquire() {
+						logWarnf("history fetch for %s timed out waiting for a slot (queue depth %d)", author.Username, history.QueueDepth())
+						sendError(author.Conn, ErrCodeHistoryUnavailable, "", WSMessage{Channel: channelID})
+						return
+					}
+					defer history.Release()
+
+					messages, hasMore, err := sb.GetChannelMessagesBefore(author.Ctx, channelID, before, beforeID, limit, token)
+					if err != nil {
+						logWarnf("failed to fetch history before %s for channel %s: %v", before, channelID, err)
+						sendError(author.Conn, ErrCodeHistoryUnavailable, "", WSMessage{Channel: channelID})
+						return
+					}
+
+					// One frame per page, oldest first; an empty page means the start of the channel
+					profiles := resolveProfiles(author.Ctx, sb, messages)
+					snippets := replySnippets(author.Ctx, sb, messages)
+					pageMsg := WSMessage{
+						Type: "load_history",
+						Channel: channelID,
+						Before: before,
+						BeforeID: beforeID,
+						Messages: make([]WSMessage, 0, len(messages)),
+						HasMore: hasMore,
+					}
+					pageMsg.Cursor, pageMsg.CursorID = oldestCursor(messages)
+					for _, msg := range messages {
+						historyMsg := messageFromDB(msg, "message", profiles[msg.UserID])
+						historyMsg.ReplySnippet = snippets[historyMsg.ReplyTo]
+						pageMsg.Messages = append(pageMsg.Messages, historyMsg)
+					}
+					if err := author.Conn.WriteJSON(pageMsg); err != nil {
+						logErrorf("failed to send history page to %s: %v", author.Username, err)
+					}
+				}(author, author.Token, wsMsg.Channel, wsMsg.Before, wsMsg.BeforeID, historyLimit(wsMsg.Limit))
+				continue
+			}
+
+			// Handle requests for older DM history before a timestamp cursor; only
+			// the conversation's two participants may read it
+			if wsMsg.Type == "load_dm_history" {
+				go func(author *Client, dmID, before, beforeID string, limit int) {
+					if !history.Acquire() {
+						logWarnf("DM history fetch for %s timed out waiting for a slot (queue depth %d)", author.Username, history.QueueDepth())
+						sendError(author.Conn, ErrCodeHistoryUnavailable, "", WSMessage{DMConversationID: dmID})
+						return
+					}
+					defer history.Release()
+
+					user1, user2, err := sb.GetDMParticipants(author.Ctx, dmID)
+					if err != nil || (author.UserID != user1 && author.UserID != user2) {
+						if err != nil && !errors.Is(err, ErrNotFound) {
+							logWarnf("failed to resolve DM participants for %s: %v", dmID, err)
+							sendError(author.Conn, ErrCodeHistoryUnavailable, "", WSMessage{DMConversationID: dmID})
+							return
+						}
+						sendError(author.Conn, ErrCodeNotAuthorized, "", WSMessage{DMConversationID: dmID})
+						return
+					}
+					messages, hasMore, err := sb.GetDMMessagesBefore(author.Ctx, dmID, before, beforeID, limit)
+					if err != nil {
+						logWarnf("failed to fetch DM history before %s for %s: %v", before, dmID, err)
+						sendError(author.Conn, ErrCodeHistoryUnavailable, "", WSMessage{DMConversationID: dmID})
+						return
+					}
+
+					// One frame per page, oldest first; an empty page means the start of the conversation
+					profiles, err := sb.GetProfiles(author.Ctx, []string{user1, user2})
+					if err != nil {
+						logWarnf("failed to fetch profiles for DM %s: %v", dmID, err)
+						profiles = make(map[string]profile)
+					}
+					pageMsg := WSMessage{
+						Type: "load_dm_history",
+						DMConversationID: dmID,
+						Before: before,
+						BeforeID: beforeID,
+						Messages: make([]WSMessage, 0, len(messages)),
+						HasMore: hasMore,
+					}
+					for _, msg := range messages {
+						pageMsg.Messages = append(pageMsg.Messages, dmMessageFromDB(msg, profiles[msg.SenderID]))
+					}
+					if len(messages) > 0 {
+						pageMsg.Cursor, pageMsg.CursorID = messages[0].CreatedAt, messages[0].ID // Raw, like oldestCursor
+					}
+					if err := author.Conn.WriteJSON(pageMsg); err != nil {
+						logErrorf("failed to send DM history page to %s: %v", author.Username, err)
+					}
+				}(author, wsMsg.DMConversationID, wsMsg.Before, wsMsg.BeforeID, historyLimit(wsMsg.Limit))
+				continue
+			}
+
+			// Handle jump-to-message requests (a page of messages around a target)
+			if wsMsg.Type == "jump_to" {
+				if !isMember(author, wsMsg.Channel) {
+					sendError(author.Conn, ErrCodeNotAMember, "", WSMessage{Channel: wsMsg.Channel, ID: wsMsg.ID})
+					continue
+				}
+
+				messages, targetIndex, err := sb.GetMessagesAround(author.Ctx, wsMsg.Channel, wsMsg.ID, min(wsMsg.Radius, maxJumpRadius), author.Token)
+				if err != nil {
+					errCode := ErrCodeFailedToJump
+					if errors.Is(err, ErrNotFound) {
+						// Target was deleted or belongs to another channel
+						errCode = ErrCodeMessageNotFound
+					} else {
+						logErrorf("failed to fetch messages around %s: %v", wsMsg.ID, err)
+					}
+					sendError(author.Conn, errCode, "", WSMessage{Channel: wsMsg.Channel, ID: wsMsg.ID})
+					continue
+				}
+
+				profiles := resolveProfiles(author.Ctx, sb, messages)
+				snippets := replySnippets(author.Ctx, sb, messages)
+				jumpMsg := WSMessage{
+					Type: "jump_to",
+					Channel: wsMsg.Channel,
+					ID: wsMsg.ID,
+					Messages: make([]WSMessage, 0, len(messages)),
+				}
+				for i, msg := range messages {
+					pageMsg := messageFromDB(msg, "message", profiles[msg.UserID])
+					pageMsg.Target = i == targetIndex
+					pageMsg.ReplySnippet = snippets[pageMsg.ReplyTo]
+					jumpMsg.Messages = append(jumpMsg.Messages, pageMsg)
+				}
+				if err := author.Conn.WriteJSON(jumpMsg); err != nil {
+					logErrorf("failed to send jump_to page to %s: %v", author.Username, err)
+				}
+				continue
+			}
+
+			// Handle thread requests: the root message and its direct replies. The
+			// root may be in any channel the user belongs to, not just the current one.
+			if wsMsg.Type == "get_thread" {
+				messages, hasMore, err := sb.GetThread(author.Ctx, wsMsg.ID, historyLimit(wsMsg.Limit), author.Token)
+				if err != nil {
+					errCode := ErrCodeFailedToLoadThread
+					if errors.Is(err, ErrNotFound) {
+						errCode = ErrCodeMessageNotFound
+					} else {
+						logErrorf("failed to fetch thread %s: %v", wsMsg.ID, err)
+					}
+					sendError(author.Conn, errCode, "", WSMessage{ID: wsMsg.ID})
+					continue
+				}
+				channelID := messages[0].ChannelID
+				if !isMember(author, channelID) {
+					// Same answer as a missing root, so threads don't leak which IDs exist
+					sendError(author.Conn, ErrCodeMessageNotFound, "", WSMessage{ID: wsMsg.ID})
+					continue
+				}
+
+				profiles := resolveProfiles(author.Ctx, sb, messages)
+				threadMsg := WSMessage{
+					Type: "thread",
+					Channel: channelID,
+					ID: wsMsg.ID,
+					Messages: make([]WSMessage, 0, len(messages)),
+					HasMore: hasMore,
+				}
+				for _, msg := range messages {
+					threadMsg.Messages = append(threadMsg.Messages, messageFromDB(msg, "message", profiles[msg.UserID]))
+				}
+				if err := author.Conn.WriteJSON(threadMsg); err != nil {
+					logErrorf("failed to send thread %s to %s: %v", wsMsg.ID, author.Username, err)
+				}
+				continue
+			}
+
+			// Handle leave: drop out of the current channel without joining another.
+			// A leave naming some other channel is stale (the session has moved on)
+			// and ignored.
+			if wsMsg.Type == "leave" {
+				if author.ChannelID == "" || (wsMsg.Channel != "" && wsMsg.Channel != author.ChannelID) {
+					continue
+				}
+				stopSessionTyping(author)
+				announceLeave(author)
+				author.ChannelID = ""
+				markJoined(author)
 				continue
 			}
 
 			// Handle join messages (channel join only; username enforced server-side)
 			if wsMsg.Type == "join" {
 				if author.Username == "" {
-					log.Printf("\x1b[31mERROR\x1b[0m: author with empty username tried to join")
+					logErrorf("author with empty username tried to join")
 					continue
 				}
-				author.ChannelID = wsMsg.Channel
-				// Get current user list BEFORE adding the new user
-				existingUsers := []string{}
-				for _, client := range clients {
-					if client.Username != "" && client.ChannelID == wsMsg.Channel && client != author {
-						existingUsers = append(existingUsers, client.Username)
+				var info *channelInfo
+				if wsMsg.Channel != "" {
+					var ok bool
+					if info, ok = lookupChannel(author, wsMsg.Channel); !ok {
+						continue
 					}
 				}
+				if wsMsg.Channel != "" && isBanned(author, wsMsg.Channel) {
+					sendError(author.Conn, ErrCodeBanned, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				if wsMsg.Channel != "" && !isMember(author, wsMsg.Channel) {
+					sendError(author.Conn, ErrCodeNotAMember, "", WSMessage{Channel: wsMsg.Channel})
+					continue
+				}
+				if info != nil {
+					_ = author.Conn.WriteJSON(WSMessage{Type: "channel_info", Channel: wsMsg.Channel, ChannelInfo: info})
+				}
+				// A repeat join for the channel the session is already in (common
+				// on flaky reconnects) only resyncs the session: peers aren't told
+				// about a second arrival
+				rejoin := wsMsg.Channel != "" && author.ChannelID == wsMsg.Channel
+				// Likewise a second session (tab, device) of a user already there:
+				// peers list users, not sessions
+				present := wsMsg.Channel != "" && inChannel(author.UserID, wsMsg.Channel, author)
+				if !rejoin {
+					stopSessionTyping(author)
+				}
+				author.ChannelID = wsMsg.Channel
+				if wsMsg.Channel != "" {
+					markJoined(author)
+				}
+				// Get current user list BEFORE adding the new user
+				existingUsers := channelUsers(wsMsg.Channel, author.UserID)
 				
 				// Send existing user list to new user (excluding themselves)
 				if len(existingUsers) > 0 {
 					listMsg := WSMessage{
 						Type: "user_list",
 						Users: existingUsers,
+						Statuses: onlineUsers(wsMsg.Channel, author.UserID),
 						Channel: wsMsg.Channel,
 					}
 					listJsonMsg, _ := json.Marshal(listMsg)
 					author.Conn.WriteMessage(websocket.TextMessage, listJsonMsg)
 				}
 				
-				// ✅ FIX: Send message history to new user
-				if wsMsg.Channel != "" { // Only fetch if channel is not empty
-					messages, err := sb.GetChannelMessages(wsMsg.Channel, 50)
-					if err != nil {
-						log.Printf("\x1b[33mWARN\x1b[0m: failed to fetch message history for channel %s: %v", wsMsg.Channel, err)
-					} else if len(messages) > 0 {
-					// Get all unique user IDs from messages
-					userIDs := make(map[string]bool)
-					for _, msg := range messages {
-						userIDs[msg.UserID] = true
-					}
-					
-					// Convert to slice
-					userIDList := make([]string, 0, len(userIDs))
-					for userID := range userIDs {
-						userIDList = append(userIDList, userID)
-					}
-					
-					// Get usernames for all users
-					usernames, err := sb.GetProfiles(userIDList)
-					if err != nil {
-						log.Printf("\x1b[33mWARN\x1b[0m: failed to fetch usernames for message history: %v", err)
-						usernames = make(map[string]string) // fallback to empty map
-					}
-					
-					// Send each message as a history message
-					for _, msg := range messages {
-						username := usernames[msg.UserID]
-						if username == "" {
-							username = "unknown"
-						}
-						
-						historyMsg := WSMessage{
-							Type: "message",
-							Username: username,
-							Content: msg.Content,
-							Channel: wsMsg.Channel,
-							Timestamp: msg.CreatedAt,
-							ID: msg.ID,
-							ReplyTo: func() string { if msg.ReplyTo != nil { return *msg.ReplyTo } else { return "" } }(),
-							Edited: msg.Edited,
-							EditedAt: func() string { if msg.EditedAt != nil { return *msg.EditedAt } else { return "" } }(),
-						}
-						historyJsonMsg, _ := json.Marshal(historyMsg)
-						author.Conn.WriteMessage(websocket.TextMessage, historyJsonMsg)
-					}
-					
-					log.Printf("\x1b[32mINFO\x1b[0m: sent %d historical messages to %s for channel %s", len(messages), author.Username, wsMsg.Channel)
+				// History is fetched off the server loop
+				go sendChannelHistory(author, author.Token, wsMsg.Channel, wsMsg.Resume, historyLimit(wsMsg.Limit), wsMsg.Batch || author.Protocol >= protocolBatched)
+
+				if rejoin {
+					logDebugf("user %s re-sent join for %s; resynced without announcing", author.Username, wsMsg.Channel)
+					continue
 				}
+				if present {
+					logDebugf("user %s joined %s from another session; already announced", author.Username, wsMsg.Channel)
+					continue
 				}
 				
 				// Notify others in the same channel that this user joined
@@ -511,41 +2338,95 @@ func server(messages chan Message, sb *SupabaseClient) {
 					Channel: wsMsg.Channel,
 					Timestamp: time.Now().Format(time.RFC3339),
 					ID: generateID(),
+					OnlineCount: channelCount(wsMsg.Channel, nil),
 				}
 				jsonMsg, _ := json.Marshal(joinMsg)
+				var dead []*Client
 				for _, client := range clients {
 					if client != author && client.ChannelID == wsMsg.Channel {
-						client.Conn.WriteMessage(websocket.TextMessage, jsonMsg)
+						if err := client.Conn.WriteMessage(websocket.TextMessage, jsonMsg); err != nil {
+							logErrorf("failed to send user_joined to %s: %s", client.Conn.RemoteAddr(), err)
+							dead = append(dead, client)
+						}
 					}
 				}
+				dropDead(dead)
 
-				log.Printf("\x1b[32mINFO\x1b[0m: user %s joined channel %s\n", wsMsg.Username, wsMsg.Channel)
+				withFields(logFields{"user_id": author.UserID, "channel": wsMsg.Channel}).Infof("user %s joined channel", author.Username)
 				continue // Don't process as regular message
 			}
 
 			// Handle DM messages
 			if wsMsg.Type == "dm_message" {
-				if strings.TrimSpace(wsMsg.Content) == "" || wsMsg.RecipientID == "" {
-					log.Printf("\x1b[31mERROR\x1b[0m: dm_message missing content or recipient_id")
+				messageType, err := validateDMAttachment(wsMsg.MessageType, wsMsg.FileURL)
+				if err != nil {
+					sendError(author.Conn, ErrCodeInvalidAttachment, "", WSMessage{RecipientID: wsMsg.RecipientID, DMConversationID: wsMsg.DMConversationID})
 					continue
 				}
-
-				// Create or get DM conversation
-				dmID, err := sb.CreateOrGetDMConversation(author.UserID, wsMsg.RecipientID, author.Token)
-				if err != nil {
-					log.Printf("\x1b[31mERROR\x1b[0m: failed to create/get DM conversation: %v", err)
+				wsMsg.MessageType = messageType
+				if messageType == "text" {
+					wsMsg.FileURL = "" // Text messages carry no file
+				}
+				if utf8.RuneCountInString(wsMsg.Content) > maxMessageLen {
+					sendError(author.Conn, ErrCodeMessageTooLong, "", WSMessage{RecipientID: wsMsg.RecipientID, DMConversationID: wsMsg.DMConversationID})
 					continue
 				}
 
+				// An existing conversation determines the recipient server-side;
+				// otherwise create or get one with the requested recipient
+				dmID := wsMsg.DMConversationID
+				if dmID != "" {
+					user1, user2, err := sb.GetDMParticipants(author.Ctx, dmID)
+					if err != nil {
+						logErrorf("failed to resolve DM participants for %s: %v", dmID, err)
+						sendError(author.Conn, ErrCodeFailedToSendDM, "", WSMessage{DMConversationID: dmID})
+						continue
+					}
+					switch author.UserID {
+					case user1:
+						wsMsg.RecipientID = user2
+					case user2:
+						wsMsg.RecipientID = user1
+					default:
+						sendError(author.Conn, ErrCodeNotAuthorized, "", WSMessage{DMConversationID: dmID})
+						continue
+					}
+				} else {
+					var err error
+					dmID, err = sb.CreateOrGetDMConversation(author.Ctx, author.UserID, wsMsg.RecipientID, author.Token)
+					if err != nil {
+						errCode := ErrCodeFailedToSendDM
+						switch {
+						case errors.Is(err, ErrNotAuthorized):
+							errCode = ErrCodeNotAuthorized
+						case errors.Is(err, ErrRateLimited):
+							errCode = ErrCodeRateLimited
+						default:
+							logErrorf("failed to create/get DM conversation: %v", err)
+						}
+						sendError(author.Conn, errCode, "", WSMessage{RecipientID: wsMsg.RecipientID})
+						continue
+					}
+				}
+
 				// Insert DM message to database
 				var replyTo *string
 				if wsMsg.ReplyTo != "" {
 					replyTo = &wsMsg.ReplyTo
 				}
 				
-				dbMsg, err := sb.InsertDMMessage(dmID, author.UserID, wsMsg.Content, replyTo)
+				dbMsg, err := sb.InsertDMMessage(author.Ctx, dmID, author.UserID, wsMsg.Content, replyTo, wsMsg.MessageType, wsMsg.FileURL)
 				if err != nil {
-					log.Printf("\x1b[31mERROR\x1b[0m: failed to persist DM message: %v", err)
+					errCode := ErrCodeFailedToSendDM
+					switch {
+					case errors.Is(err, ErrNotAuthorized):
+						errCode = ErrCodeNotAuthorized
+					case errors.Is(err, ErrRateLimited):
+						errCode = ErrCodeRateLimited
+					default:
+						logErrorf("failed to persist DM message: %v", err)
+					}
+					sendError(author.Conn, errCode, "", WSMessage{RecipientID: wsMsg.RecipientID, DMConversationID: dmID})
 					continue
 				}
 
@@ -560,158 +2441,475 @@ func server(messages chan Message, sb *SupabaseClient) {
 					Content:          wsMsg.Content,
 					Timestamp:        dbMsg.CreatedAt,
 					ReplyTo:          wsMsg.ReplyTo,
+					MessageType:      dbMsg.MessageType,
+					FileURL:          derefString(dbMsg.FileURL),
 					MessageStatus:    "sent",
 				}
 
-				// Send to sender (confirmation)
-				if err := author.Conn.WriteJSON(dmResponse); err != nil {
-					log.Printf("\x1b[31mERROR\x1b[0m: failed to send DM confirmation to sender: %v", err)
+				// Send to sender (confirmation), including their other sessions
+				var dead []*Client
+				for _, client := range userClients[author.UserID] {
+					if err := client.Conn.WriteJSON(dmResponse); err != nil {
+						logErrorf("failed to send DM confirmation to sender: %v", err)
+						dead = append(dead, client)
+					}
 				}
 
-				// Send to recipient if they're online
-				for _, client := range userClients {
-					if client.UserID == wsMsg.RecipientID {
-						dmResponse.MessageStatus = "delivered"
-						if err := client.Conn.WriteJSON(dmResponse); err != nil {
-							log.Printf("\x1b[31mERROR\x1b[0m: failed to send DM to recipient: %v", err)
-						} else {
-							log.Printf("\x1b[32mINFO\x1b[0m: DM delivered to user %s", wsMsg.RecipientID)
-						}
-						break
+				// Send to every session of the recipient if they're online
+				recipientSessions := userClients[wsMsg.RecipientID]
+				delivered := len(recipientSessions) > 0
+				dmResponse.MessageStatus = "delivered"
+				for _, client := range recipientSessions {
+					if err := client.Conn.WriteJSON(dmResponse); err != nil {
+						logErrorf("failed to send DM to recipient: %v", err)
+						dead = append(dead, client)
 					}
 				}
+				dropDead(dead)
+				if delivered {
+					logInfof("DM delivered to user %s", wsMsg.RecipientID)
+				}
+
+				// Recipient has no live connection; fall back to push
+				if !delivered {
+					notifyOffline(push, wsMsg.RecipientID, PushPayload{
+						Type:             "dm_message",
+						Title:            author.Username,
+						Body:             wsMsg.Content,
+						SenderID:         author.UserID,
+						SenderUsername:   author.Username,
+						DMConversationID: dmID,
+						MessageID:        dbMsg.ID,
+					})
+				}
+
+				continue
+			}
+
+			// List the user's DM threads for the sidebar
+			if wsMsg.Type == "list_dms" {
+				markJoined(author) // DM-only sessions identify themselves with list_dms
+				conversations, err := sb.GetDMConversations(author.Ctx, author.UserID, author.Token)
+				if err != nil {
+					logErrorf("failed to list DM conversations for %s: %v", author.UserID, err)
+					sendError(author.Conn, ErrCodeFailedToListDMs, "", WSMessage{})
+					continue
+				}
+				if err := author.Conn.WriteJSON(WSMessage{Type: "list_dms", Conversations: conversations}); err != nil {
+					logErrorf("failed to send DM list to %s: %v", author.Username, err)
+				}
+				continue
+			}
+
+			// Count the user's unread DMs for the inbox badge
+			if wsMsg.Type == "dm_unread" {
+				markJoined(author) // Like list_dms, this identifies a DM session
+				n, err := sb.GetUnreadDMCount(author.Ctx, author.UserID)
+				if err != nil {
+					logErrorf("failed to count unread DMs for %s: %v", author.UserID, err)
+					sendError(author.Conn, ErrCodeFailedToCountUnread, "", WSMessage{})
+					continue
+				}
+				if err := author.Conn.WriteJSON(WSMessage{Type: "dm_unread", UnreadCount: &n}); err != nil {
+					logErrorf("failed to send unread DM count to %s: %v", author.Username, err)
+				}
+				continue
+			}
+
+			// Look up usernames and avatars for users the client has no message from
+			if wsMsg.Type == "get_profile" {
+				userIDs := wsMsg.UserIDs
+				if wsMsg.UserID != "" {
+					userIDs = append(userIDs, wsMsg.UserID)
+				}
+				if len(userIDs) == 0 || len(userIDs) > maxProfileIDs {
+					sendError(author.Conn, ErrCodeInvalidPayload, fmt.Sprintf("get_profile needs user_id or up to %d user_ids", maxProfileIDs), WSMessage{})
+					continue
+				}
+				profiles, err := sb.GetProfiles(author.Ctx, userIDs)
+				if err != nil {
+					logErrorf("failed to fetch profiles for %s: %v", author.UserID, err)
+					sendError(author.Conn, ErrCodeFailedToLoadProfiles, "", WSMessage{})
+					continue
+				}
+				if err := author.Conn.WriteJSON(WSMessage{Type: "profile", Profiles: profiles}); err != nil {
+					logErrorf("failed to send profiles to %s: %v", author.Username, err)
+				}
+				continue
+			}
 
+			// List the user's channels for the sidebar
+			if wsMsg.Type == "list_channels" {
+				channels, err := sb.GetUserChannels(author.Ctx, author.UserID, author.Token)
+				if err != nil {
+					logErrorf("failed to list channels for %s: %v", author.UserID, err)
+					sendError(author.Conn, ErrCodeFailedToListChannels, "", WSMessage{})
+					continue
+				}
+				if err := author.Conn.WriteJSON(WSMessage{Type: "list_channels", Channels: channels}); err != nil {
+					logErrorf("failed to send channel list to %s: %v", author.Username, err)
+				}
 				continue
 			}
 
 			// Handle DM typing indicators
 			if wsMsg.Type == "dm_typing" || wsMsg.Type == "dm_stop_typing" {
-				if wsMsg.RecipientID == "" {
+				// Send to recipient's sessions if they're online
+				typingMsg := WSMessage{
+					Type:        wsMsg.Type,
+					SenderID:    author.UserID,
+					Username:    author.Username,
+					RecipientID: wsMsg.RecipientID,
+				}
+				var dead []*Client
+				for _, client := range userClients[wsMsg.RecipientID] {
+					if err := client.Conn.WriteJSON(typingMsg); err != nil {
+						logErrorf("failed to send typing indicator: %v", err)
+						dead = append(dead, client)
+					}
+				}
+				dropDead(dead)
+				continue
+			}
+
+			// Handle DM message read receipts ("dm_message_read" is the older name)
+			if wsMsg.Type == "mark_read" || wsMsg.Type == "dm_message_read" {
+				// Mark message as read in database; only the conversation's other
+				// participant may do so (checked by MarkDMMessageAsRead)
+				readRow, err := sb.MarkDMMessageAsRead(author.Ctx, wsMsg.MessageID, author.UserID)
+				if err != nil {
+					errCode := ErrCodeFailedToMarkRead
+					if errors.Is(err, ErrNotAuthorized) {
+						errCode = ErrCodeNotAuthorized
+					} else {
+						logErrorf("failed to mark DM as read: %v", err)
+					}
+					sendError(author.Conn, errCode, "", WSMessage{MessageID: wsMsg.MessageID})
 					continue
 				}
 
-				// Send to recipient if they're online
-				for _, client := range userClients {
-					if client.UserID == wsMsg.RecipientID {
-						typingMsg := WSMessage{
-							Type:        wsMsg.Type,
-							SenderID:    author.UserID,
-							Username:    author.Username,
-							RecipientID: wsMsg.RecipientID,
-						}
-						if err := client.Conn.WriteJSON(typingMsg); err != nil {
-							log.Printf("\x1b[31mERROR\x1b[0m: failed to send typing indicator: %v", err)
-						}
-						break
+				// Send read receipt to the sender's sessions if they're online;
+				// the sender comes from the stored row, not the client
+				readMsg := WSMessage{
+					Type:             "dm_read",
+					MessageID:        readRow.ID,
+					DMConversationID: readRow.DMConversationID,
+					RecipientID:      author.UserID,
+					SenderID:         readRow.SenderID,
+					ReadAt:           derefString(readRow.ReadAt),
+				}
+				var dead []*Client
+				for _, client := range userClients[readRow.SenderID] {
+					if err := client.Conn.WriteJSON(readMsg); err != nil {
+						logErrorf("failed to send read receipt: %v", err)
+						dead = append(dead, client)
 					}
 				}
+				dropDead(dead)
 				continue
 			}
 
-			// Handle DM message read receipts
-			if wsMsg.Type == "dm_message_read" {
-				if wsMsg.MessageID == "" {
+			// Handle DM edits; only the sender may edit, and both participants see it
+			if wsMsg.Type == "dm_edit" {
+				if utf8.RuneCountInString(wsMsg.Content) > maxMessageLen {
+					sendError(author.Conn, ErrCodeMessageTooLong, "", WSMessage{MessageID: wsMsg.MessageID})
 					continue
 				}
-
-				// Mark message as read in database
-				if err := sb.MarkDMMessageAsRead(wsMsg.MessageID, author.UserID); err != nil {
-					log.Printf("\x1b[31mERROR\x1b[0m: failed to mark DM as read: %v", err)
+				dbMsg, err := sb.UpdateDMMessage(author.Ctx, wsMsg.MessageID, author.UserID, wsMsg.Content)
+				if err != nil {
+					errCode := ErrCodeFailedToEdit
+					if errors.Is(err, ErrNotAuthorized) {
+						errCode = ErrCodeNotAuthorized
+					} else {
+						logErrorf("failed to edit DM %s: %v", wsMsg.MessageID, err)
+					}
+					sendError(author.Conn, errCode, "", WSMessage{MessageID: wsMsg.MessageID})
 					continue
 				}
 
-				// Send read receipt to sender if they're online
-				for _, client := range userClients {
-					if client.UserID == wsMsg.SenderID {
-						readMsg := WSMessage{
-							Type:        "dm_message_read",
-							MessageID:   wsMsg.MessageID,
-							RecipientID: author.UserID,
-							SenderID:    wsMsg.SenderID,
-						}
-						if err := client.Conn.WriteJSON(readMsg); err != nil {
-							log.Printf("\x1b[31mERROR\x1b[0m: failed to send read receipt: %v", err)
-						}
-						break
+				editMsg := WSMessage{
+					Type:             "dm_message_edited",
+					MessageID:        dbMsg.ID,
+					DMConversationID: dbMsg.DMConversationID,
+					SenderID:         dbMsg.SenderID,
+					Username:         author.Username,
+					Content:          dbMsg.Content,
+					Edited:           true,
+					EditedAt:         derefString(dbMsg.EditedAt),
+				}
+				if err := sendToDMParticipants(author.Ctx, dbMsg.DMConversationID, editMsg); err != nil {
+					logErrorf("failed to resolve DM participants for %s: %v", dbMsg.DMConversationID, err)
+				}
+				continue
+			}
+
+			// Handle DM deletes; like channel messages, only the sender may delete
+			// and the message is kept as a tombstone
+			if wsMsg.Type == "dm_delete" {
+				dbMsg, err := sb.DeleteDMMessage(author.Ctx, wsMsg.MessageID, author.UserID)
+				if err != nil {
+					errCode := ErrCodeFailedToDelete
+					if errors.Is(err, ErrNotAuthorized) {
+						errCode = ErrCodeNotAuthorized
+					} else {
+						logErrorf("failed to delete DM %s: %v", wsMsg.MessageID, err)
 					}
+					sendError(author.Conn, errCode, "", WSMessage{MessageID: wsMsg.MessageID})
+					continue
+				}
+
+				deleteMsg := WSMessage{
+					Type:             "dm_message_deleted",
+					MessageID:        dbMsg.ID,
+					DMConversationID: dbMsg.DMConversationID,
+					SenderID:         dbMsg.SenderID,
+					Deleted:          true,
+				}
+				if err := sendToDMParticipants(author.Ctx, dbMsg.DMConversationID, deleteMsg); err != nil {
+					logErrorf("failed to resolve DM participants for %s: %v", dbMsg.DMConversationID, err)
 				}
 				continue
 			}
 
-			// ✅ FIX: Only allow sending to same channel
-			// Skip empty messages
-			if strings.TrimSpace(wsMsg.Content) == "" {
+			// Only allow sending to same channel
+			if utf8.RuneCountInString(wsMsg.Content) > maxMessageLen {
+				sendError(author.Conn, ErrCodeMessageTooLong, "", WSMessage{Channel: wsMsg.Channel, ClientID: wsMsg.ClientID})
 				continue
 			}
-			
+
 			// Ensure an ID for broadcast (not persisted as DB ID)
 			if wsMsg.ID == "" { wsMsg.ID = generateID() }
+			// Display name comes from the validated profile, never the client
+			wsMsg.Username = author.Username
+			wsMsg.Avatar = author.Avatar
 
 			if author.UserID == "" {
-				log.Printf("\x1b[31mERROR\x1b[0m: missing user id on author; skipping message persist")
+				logErrorf("missing user id on author; skipping message persist")
+				continue
+			}
+
+			// Rate limit per user (shared across their sessions) before touching Supabase
+			if !limiter.Allow(author.UserID, time.Now()) {
+				sendError(author.Conn, ErrCodeRateLimited, "", WSMessage{Channel: wsMsg.Channel})
+				continue
+			}
+			if !isMember(author, wsMsg.Channel) {
+				sendError(author.Conn, ErrCodeNotAMember, "", WSMessage{Channel: wsMsg.Channel, ClientID: wsMsg.ClientID})
+				continue
+			}
+			if wait := slow.Remaining(wsMsg.Channel, author.UserID, slowModeCooldown(author, wsMsg.Channel), time.Now()); wait > 0 {
+				secs := retryAfterSeconds(wait)
+				sendError(author.Conn, ErrCodeSlowMode, fmt.Sprintf("Slow mode is on; wait %d more second(s).", secs), WSMessage{Channel: wsMsg.Channel, ClientID: wsMsg.ClientID, RetryAfter: secs})
+				continue
+			}
+			filtered, err := filter.Apply(wsMsg.Content)
+			if err != nil {
+				sendError(author.Conn, ErrCodeFiltered, "", WSMessage{Channel: wsMsg.Channel, ClientID: wsMsg.ClientID})
 				continue
 			}
+			wsMsg.Content = filtered
 			// Persist to Supabase (best-effort with retries)
 			var replyTo *string
+			var parent *dbMessage
 			if wsMsg.ReplyTo != "" {
+				// The parent must live in this channel, or a reply could quote
+				// (via its snippet) a message from a channel the author can't read
+				parent, err = sb.GetMessage(author.Ctx, wsMsg.ReplyTo)
+				if err != nil || parent.ChannelID != wsMsg.Channel {
+					if err != nil && !errors.Is(err, ErrNotFound) {
+						logWarnf("failed to fetch reply parent %s: %v", wsMsg.ReplyTo, err)
+					}
+					sendError(author.Conn, ErrCodeInvalidReply, "", WSMessage{Channel: wsMsg.Channel, ClientID: wsMsg.ClientID, ReplyTo: wsMsg.ReplyTo})
+					continue
+				}
 				replyTo = &wsMsg.ReplyTo
 			}
-			dbMsg, err := sb.InsertMessage(wsMsg.Channel, author.UserID, wsMsg.Content, replyTo)
+			// A client_id makes retries after a lost ack resolve to the original row
+			if len(wsMsg.ClientID) > 64 {
+				wsMsg.ClientID = ""
+			}
+			// The author gets exactly one of "ack" (persisted) or "error" (not persisted),
+			// both carrying client_id, before the message is broadcast. A retry of an
+			// already-stored client_id only gets its ack again; the original send
+			// did the broadcast.
+			dbMsg, existed, err := sb.InsertMessage(author.Ctx, wsMsg.Channel, author.UserID, wsMsg.Content, replyTo, wsMsg.ClientID, author.Origin, author.Token)
 			if err != nil {
-				log.Printf("\x1b[31mERROR\x1b[0m: failed to persist message: %v\n", err)
+				atomic.AddInt64(&metrics.persistFailures, 1)
+				withFields(logFields{"user_id": author.UserID, "channel": wsMsg.Channel, "conn": authorAddr}).Errorf("failed to persist message: %v", err)
 				// Optionally send error back only to author
-				errPayload := WSMessage{Type: "error", Content: "failed_to_persist", Channel: wsMsg.Channel}
-				_ = author.Conn.WriteJSON(errPayload)
+				sendError(author.Conn, ErrCodeFailedToPersist, "", WSMessage{Channel: wsMsg.Channel, ClientID: wsMsg.ClientID})
 				continue
 			}
 
 			// Replace outbound fields with DB authoritative data
 			wsMsg.ID = dbMsg.ID
 			wsMsg.Timestamp = dbMsg.CreatedAt
-			if dbMsg.ReplyTo != nil {
-				wsMsg.ReplyTo = *dbMsg.ReplyTo
+			wsMsg.ReplyTo = derefString(dbMsg.ReplyTo)
+			switch {
+			case parent != nil && parent.ID == wsMsg.ReplyTo:
+				wsMsg.ReplySnippet = replySnippet(*parent)
+			case wsMsg.ReplyTo != "":
+				// A retried client_id resolved to a row replying elsewhere
+				wsMsg.ReplySnippet = replySnippets(author.Ctx, sb, []dbMessage{*dbMsg})[wsMsg.ReplyTo]
+			default:
+				wsMsg.ReplySnippet = ""
 			}
 			wsMsg.Edited = dbMsg.Edited
 			if dbMsg.EditedAt != nil {
 				wsMsg.EditedAt = *dbMsg.EditedAt
 			}
+
+			if !existed {
+				atomic.AddInt64(&metrics.messagesPersisted, 1)
+				slow.Record(wsMsg.Channel, author.UserID, time.Now())
+			}
+
+			ack := WSMessage{Type: "ack", ID: dbMsg.ID, Timestamp: dbMsg.CreatedAt, Channel: wsMsg.Channel, ClientID: wsMsg.ClientID}
+			if author.SuppressEcho {
+				// The ack stands in for the broadcast, so it carries the whole message
+				ack = wsMsg
+				ack.Type = "ack"
+			}
+			if err := author.Conn.WriteJSON(ack); err != nil {
+				logWarnf("failed to ack message %s to %s: %v", dbMsg.ID, authorAddr, err)
+			}
+			if existed {
+				continue
+			}
 			
-			log.Printf("%s: %s", authorAddr, strings.TrimSpace(wsMsg.Content))
+			logDebugf("%s: %s", authorAddr, strings.TrimSpace(wsMsg.Content))
 
 			// Broadcast only to channel members
+			broadcast.Record(wsMsg.ID, time.Now())
+			var dead []*Client
 			for _, client := range clients {
-				if client.ChannelID == wsMsg.Channel {
+				if client.ChannelID == wsMsg.Channel && !(client == author && author.SuppressEcho) {
 					err := client.Conn.WriteJSON(wsMsg)
 					if err != nil {
-						log.Printf("\x1b[31mERROR\x1b[0m: failed to send to %s: %s\n", client.Conn.RemoteAddr(), err)
-						client.Conn.Close()
+						logErrorf("failed to send to %s: %s\n", client.Conn.RemoteAddr(), err)
+						dead = append(dead, client)
 					}
 				}
 			}
+			dropDead(dead)
+
+			// Notify @mentioned channel members wherever they are, or by push if
+			// offline. Resolving them takes three Supabase round trips, so that
+			// runs off the loop and the deliveries come back as a mentionDelivery.
+			if names := parseMentions(wsMsg.Content); len(names) > 0 {
+				mentionMsg := WSMessage{
+					Type:      "mention",
+					ID:        dbMsg.ID,
+					Channel:   wsMsg.Channel,
+					Username:  author.Username,
+					SenderID:  author.UserID,
+					Content:   wsMsg.Content,
+					Timestamp: dbMsg.CreatedAt,
+				}
+				// Not on the author's context: the mentions stand if they disconnect
+				go func(names []string, frame WSMessage) {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+					ids, err := sb.GetProfilesByUsername(ctx, names)
+					if err != nil {
+						logWarnf("failed to resolve mentions in %s: %v", frame.ID, err)
+						return
+					}
+					var candidates []string
+					for _, id := range ids {
+						if id != frame.SenderID {
+							candidates = append(candidates, id)
+						}
+					}
+					// Only members may learn about a message in the channel
+					mentioned, err := sb.FilterChannelMembers(ctx, frame.Channel, candidates)
+					if err != nil {
+						logWarnf("failed to check mentioned users for %s: %v", frame.ID, err)
+						return
+					}
+					if len(mentioned) == 0 {
+						return
+					}
+					if err := sb.InsertMentions(ctx, frame.ID, frame.Channel, frame.SenderID, mentioned); err != nil {
+						logWarnf("failed to record mentions for %s: %v", frame.ID, err)
+					}
+					messages <- Message{Type: DBNotification, Notification: mentionDelivery{frame: frame, userIDs: mentioned}}
+				}(names, mentionMsg)
+			}
 		}
 	}
 }
 
-func client(conn *websocket.Conn, messages chan Message) {
+// errFrameTooLarge is returned by readFrame for a message over maxFrameBytes
+var errFrameTooLarge = errors.New("message too large")
+
+// readFrame reads the next message, never buffering more than maxFrameBytes+1
+// bytes of it. Gorilla's SetReadLimit would bound it too, but closes with an
+// empty reason before the caller can say why.
+func readFrame(conn *websocket.Conn) ([]byte, error) {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	message, err := io.ReadAll(io.LimitReader(r, maxFrameBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(message)) > maxFrameBytes {
+		return nil, errFrameTooLarge
+	}
+	return message, nil
+}
+
+// client reads conn until it closes. cancel ends the session context; it's
+// called before the disconnect is reported, since the server loop may itself
+// be blocked in a Supabase call on that context.
+func client(conn *websocket.Conn, userID, sessionID string, cancel context.CancelFunc, messages chan Message) {
+	disconnect := func() {
+		cancel()
+		messages <- Message{
+			Type: ClientDisconnected,
+			Conn: conn,
+			UserID: userID,
+			SessionID: sessionID,
+		}
+	}
+
+	// A peer that stops answering pings trips the read deadline, which surfaces
+	// below as a read error and disconnects the session like any other
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go pinger(conn, done)
+
 	for {
-		_, message, err := conn.ReadMessage()
+		message, err := readFrame(conn)
+		if errors.Is(err, errFrameTooLarge) {
+			closeWithReason(conn, websocket.CloseMessageTooBig, "message_too_large")
+			logWarnf("closed session %s: message over %d bytes", sessionKey(userID, sessionID), maxFrameBytes)
+			disconnect()
+			return
+		}
 		if err != nil {
-			conn.Close()
-			messages <- Message{
-				Type: ClientDisconnected,
-				Conn: conn,
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// No pong within pongWait; say why in case the peer is still listening
+				closeWithReason(conn, websocket.CloseGoingAway, "idle_timeout")
+			} else {
+				conn.Close()
 			}
+			disconnect()
 			return
 		}
 
 		text := string(message)
 
 		if strings.TrimSpace(text) == ":quit" {
-			conn.Close()
-			messages <- Message{
-				Type: ClientDisconnected,
-				Conn: conn,
-			}
+			closeWithReason(conn, websocket.CloseNormalClosure, "")
+			disconnect()
 			return
 		}
 
@@ -719,6 +2917,8 @@ func client(conn *websocket.Conn, messages chan Message) {
 			Type: NewMessage,
 			Text: text,
 			Conn: conn,
+			UserID: userID,
+			SessionID: sessionID,
 		}
 	}
 }
@@ -726,44 +2926,201 @@ func client(conn *websocket.Conn, messages chan Message) {
 func handleWebSocket(w http.ResponseWriter, r *http.Request, messages chan Message, sb *SupabaseClient) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("\x1b[31mERROR\x1b[0m: could not upgrade connection: %s\n", err)
+		logErrorf("could not upgrade connection: %s\n", err)
+		return
+	}
+	conn.SetCompressionLevel(wsCompressionLevel) // No-op unless compression was negotiated
+
+	// Count the connection for as long as this handler runs, which is its
+	// whole life; the deferred decrement covers every way out, auth failures
+	// included. Over the cap it's turned away before a token validation is
+	// spent on it.
+	open := atomic.AddInt64(&metrics.openConnections, 1)
+	defer atomic.AddInt64(&metrics.openConnections, -1)
+	if maxConnections > 0 && open > int64(maxConnections) {
+		atomic.AddInt64(&metrics.rejectedAtCapacity, 1)
+		logWarnf("at capacity (%d connections), rejecting %s", maxConnections, conn.RemoteAddr())
+		_ = conn.WriteJSON(reconnectHint(capacityRetryAfter))
+		closeWithReason(conn, websocket.CloseTryAgainLater, "server_full")
 		return
 	}
 
 	// Authenticate via token (query param: token)
 	token := r.URL.Query().Get("token")
 	if token == "" {
-		log.Printf("\x1b[31mERROR\x1b[0m: missing token, closing connection")
-		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "auth required"))
-		conn.Close()
+		logErrorf("missing token, closing connection")
+		closeWithReason(conn, websocket.ClosePolicyViolation, "auth required")
 		return
 	}
-	log.Printf("\x1b[33mDEBUG\x1b[0m: received token: %s...", token[:min(20, len(token))])
-	user, err := sb.ValidateToken(token)
+	logDebugf("received token: %s...", token[:min(20, len(token))])
+	// The session context lives as long as the connection; cancelling it on
+	// disconnect aborts any Supabase request still running on its behalf
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	user, err := sb.ValidateToken(ctx, token)
+	if errors.Is(err, ErrRateLimited) {
+		// Upstream throttling says nothing about the token; ask the client to come back
+		logWarnf("token validation throttled: %v", err)
+		closeWithReason(conn, websocket.CloseTryAgainLater, "try_again_later")
+		return
+	}
+	if err != nil {
+		logErrorf("token validation failed: %v", err)
+		closeWithReason(conn, websocket.ClosePolicyViolation, "invalid token")
+		return
+	}
+
+	// Fetch profile (username and avatar) from Supabase; without one the
+	// session still connects, as "unknown"
+	profile, perr := sb.GetProfile(ctx, user.ID)
+	username, avatar := "unknown", ""
+	switch {
+	case perr == nil:
+		username, avatar = profile.Username, profile.AvatarURL
+	case errors.Is(perr, ErrDuplicateProfile):
+		logErrorf("profile data integrity problem: %v", perr)
+	case errors.Is(perr, ErrNotFound):
+		logWarnf("user %s has no profile", user.ID)
+	default:
+		logWarnf("failed to fetch profile for user %s: %v", user.ID, perr)
+	}
+
+	// Tabs pass a stable session_id so a reconnect replaces its own stale
+	// connection without disconnecting the user's other tabs
+	sessionID := r.URL.Query().Get("session_id")
+	if sessionID == "" || len(sessionID) > 64 {
+		sessionID = generateID()
+	}
+
+	// Clients name the newest protocol version they speak; see protocol.go
+	protocol := negotiateProtocol(r.URL.Query().Get("protocol"))
+	suppressEcho, _ := strconv.ParseBool(r.URL.Query().Get("suppress_echo")) // Anything but a true value keeps the echo
+
+	// The validated identity and token travel with the connect message; the
+	// server loop stores them on the Client, so later handlers act as this
+	// user without re-validating (and can send the token for RLS)
+	messages <- Message{Type: ClientConnected, Conn: conn, Username: username, Token: token, SessionID: sessionID, Ctx: ctx, Cancel: cancel, Avatar: avatar, User: user, Protocol: protocol, Origin: connOrigin(r), SuppressEcho: suppressEcho}
+
+	client(conn, user.ID, sessionID, cancel, messages)
+}
+
+// handleHealthz reports that the process is up
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether this instance can serve traffic: Supabase must
+// answer and, when configured, the notification listener must be connected
+func handleReadyz(w http.ResponseWriter, r *http.Request, sb *SupabaseClient) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	if err := sb.Ping(ctx); err != nil {
+		logWarnf("readiness check: supabase unreachable: %v", err)
+		http.Error(w, "supabase unreachable", http.StatusServiceUnavailable)
+		return
+	}
+	if sb.ListenerExpected() && !sb.ListenerConnected() {
+		http.Error(w, "notification listener not connected", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// handleChannelMessages serves GET /channels/{id}/messages?limit=&before= for
+// callers that want history without holding a WebSocket open. Responds with a
+// load_history frame, the same shape the WebSocket sends.
+func handleChannelMessages(w http.ResponseWriter, r *http.Request, sb *SupabaseClient) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/channels/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "messages" {
+		http.NotFound(w, r)
+		return
+	}
+	channelID := parts[0]
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	user, err := sb.ValidateToken(r.Context(), token)
+	var rateLimited *RateLimitedError
+	if errors.As(err, &rateLimited) {
+		if rateLimited.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(rateLimited.RetryAfter.Seconds()+0.5)))
+		}
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	member, err := sb.IsChannelMember(r.Context(), channelID, user.ID)
 	if err != nil {
-		log.Printf("\x1b[31mERROR\x1b[0m: token validation failed: %v", err)
-		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid token"))
-		conn.Close()
+		logErrorf("failed to check membership of %s in %s: %v", user.ID, channelID, err)
+		http.Error(w, "membership check failed", http.StatusInternalServerError)
+		return
+	}
+	if !member {
+		http.Error(w, "not a member of this channel", http.StatusForbidden)
 		return
 	}
 
-	// Fetch profile (username) from Supabase
-	profile, perr := sb.GetProfile(user.ID)
-	username := "unknown"
-	if perr != nil {
-		log.Printf("\x1b[33mWARN\x1b[0m: failed to fetch profile for user %s: %v", user.ID, perr)
-	} else if profile != nil {
-		username = profile.Username
+	limit := historyLimit(0)
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = historyLimit(n)
 	}
 
-	messages <- Message{Type: ClientConnected, Conn: conn, Username: username, UserID: user.ID, Token: token}
+	before, beforeID := r.URL.Query().Get("before"), r.URL.Query().Get("before_id")
+	var messages []dbMessage
+	var hasMore bool
+	if before != "" {
+		messages, hasMore, err = sb.GetChannelMessagesBefore(r.Context(), channelID, before, beforeID, limit, token)
+	} else {
+		messages, hasMore, err = sb.GetChannelMessages(r.Context(), channelID, limit, token)
+	}
+	if err != nil {
+		logWarnf("failed to fetch message history for channel %s: %v", channelID, err)
+		http.Error(w, "history unavailable", http.StatusBadGateway)
+		return
+	}
 
-	// Store user info in client map (after initial add)
-	// We don't have direct reference here; will attach on first join
-	// Simpler approach: inject a synthetic join message with username from profile if needed
-	_ = user // Future: use user info for presence
+	profiles := resolveProfiles(r.Context(), sb, messages)
+	snippets := replySnippets(r.Context(), sb, messages)
+	page := WSMessage{
+		Type: "load_history",
+		Channel: channelID,
+		Before: before,
+		BeforeID: beforeID,
+		Messages: make([]WSMessage, 0, len(messages)),
+		HasMore: hasMore,
+	}
+	page.Cursor, page.CursorID = oldestCursor(messages)
+	for _, msg := range messages {
+		historyMsg := messageFromDB(msg, "message", profiles[msg.UserID])
+		historyMsg.ReplySnippet = snippets[historyMsg.ReplyTo]
+		page.Messages = append(page.Messages, historyMsg)
+	}
 
-	client(conn, messages)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		logErrorf("failed to write history response: %v", err)
+	}
 }
 
 func main() {
@@ -771,6 +3128,12 @@ func main() {
   	if err != nil {
     log.Fatal("Error loading .env file")
   	}
+	if err := setLogLevel(os.Getenv("LOG_LEVEL")); err != nil {
+		log.Fatalf("LOG_LEVEL: %v", err)
+	}
+	if err := setLogFormat(os.Getenv("LOG_FORMAT")); err != nil {
+		log.Fatalf("LOG_FORMAT: %v", err)
+	}
 
 	supabaseURL := os.Getenv("SUPABASE_URL")
 	serviceKey := os.Getenv("SUPABASE_SERVICE_ROLE_KEY")
@@ -778,30 +3141,268 @@ func main() {
 	if supabaseURL == "" || serviceKey == "" {
 		log.Fatalf("SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY must be set in environment")
 	}
-	sb := NewSupabaseClient(supabaseURL, serviceKey)
+	// HTTP tuning for Supabase calls; a reconnect storm means thousands of concurrent auth/profile requests
+	opts := DefaultSupabaseOptions
+	if v := os.Getenv("SUPABASE_HTTP_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("SUPABASE_HTTP_TIMEOUT must be a positive duration, got %q", v)
+		}
+		opts.Timeout = d
+	}
+	if v := os.Getenv("SUPABASE_MAX_IDLE_CONNS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("SUPABASE_MAX_IDLE_CONNS must be a positive integer, got %q", v)
+		}
+		opts.MaxIdleConns = n
+	}
+	if v := os.Getenv("SUPABASE_MAX_CONNS_PER_HOST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("SUPABASE_MAX_CONNS_PER_HOST must be a positive integer, got %q", v)
+		}
+		opts.MaxConnsPerHost = n
+	}
+	sb, err := NewSupabaseClient(supabaseURL, serviceKey, opts)
+	if err != nil {
+		log.Fatalf("invalid Supabase configuration: %v", err)
+	}
+
+	// Optional read replica for history/profile reads; writes always go to the primary
+	if readURL := os.Getenv("SUPABASE_READ_URL"); readURL != "" {
+		if err := sb.SetReadReplica(readURL, os.Getenv("SUPABASE_READ_KEY")); err != nil {
+			log.Fatalf("invalid SUPABASE_READ_URL: %v", err)
+		}
+		logInfof("routing read queries to replica %s", readURL)
+	}
+
+	// Reaction limits: distinct emojis per message and an optional allowlist
+	maxReactions := defaultMaxDistinctReactions
+	if v := os.Getenv("REACTION_MAX_DISTINCT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("REACTION_MAX_DISTINCT must be a non-negative integer, got %q", v)
+		}
+		maxReactions = n
+	}
+	sb.SetReactionPolicy(maxReactions, os.Getenv("REACTION_ALLOWLIST"))
+
+	// Optional banned-word list for channel messages, masked or rejected
+	filter, err := newContentFilter(os.Getenv("WORD_FILTER"), os.Getenv("WORD_FILTER_MODE"))
+	if err != nil {
+		log.Fatalf("WORD_FILTER_MODE must be mask or reject, got %q", os.Getenv("WORD_FILTER_MODE"))
+	}
+
+	// Opt-in: run users' message reads and writes with their own token so
+	// Supabase RLS enforces membership and ownership too, not just the
+	// server's own checks
+	if v := os.Getenv("USER_SCOPED_REQUESTS"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("USER_SCOPED_REQUESTS must be a boolean, got %q", v)
+		}
+		sb.SetUserScoped(on)
+	}
+
+	// Optional message audit: store each message's IP and user agent
+	if v := os.Getenv("MESSAGE_AUDIT"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("MESSAGE_AUDIT must be a boolean, got %q", v)
+		}
+		auditMessages = on
+	}
+	if v := os.Getenv("TRUST_PROXY"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("TRUST_PROXY must be a boolean, got %q", v)
+		}
+		trustProxyHeaders = on
+	}
+
+	// Optional edit window: messages older than this can no longer be edited
+	if v := os.Getenv("EDIT_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("EDIT_WINDOW must be a non-negative duration, got %q", v)
+		}
+		sb.SetEditWindow(d)
+	}
+
+	// Write retries: attempts per write and the total time a write may spend retrying
+	var retryAttempts int
+	if v := os.Getenv("SUPABASE_RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("SUPABASE_RETRY_ATTEMPTS must be a positive integer, got %q", v)
+		}
+		retryAttempts = n
+	}
+	var retryMaxElapsed time.Duration
+	if v := os.Getenv("SUPABASE_RETRY_MAX_ELAPSED"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("SUPABASE_RETRY_MAX_ELAPSED must be a positive duration, got %q", v)
+		}
+		retryMaxElapsed = d
+	}
+	sb.SetRetryPolicy(retryAttempts, retryMaxElapsed)
 
 	// Setup notification listener if database URL is provided
 	if dbURL != "" {
+		sb.SetListenerStateHandler(func(connected bool) {
+			if connected {
+				logInfof("PostgreSQL notification listener connected")
+			} else {
+				logWarnf("PostgreSQL notification listener disconnected")
+			}
+		})
 		if err := sb.SetupNotificationListener(dbURL); err != nil {
-			log.Printf("\x1b[33mWARN\x1b[0m: Failed to setup notification listener: %v", err)
+			logWarnf("Failed to setup notification listener: %v", err)
 		} else {
-			log.Printf("\x1b[32mINFO\x1b[0m: PostgreSQL notification listener setup successful")
+			logInfof("PostgreSQL notification listener setup successful")
 		}
 	} else {
-		log.Printf("\x1b[33mWARN\x1b[0m: DATABASE_URL not set, friend request notifications will not work")
+		logWarnf("DATABASE_URL not set, friend request notifications will not work")
+	}
+
+	// Optional push delivery for users without a live connection
+	var push PushNotifier = noopPushNotifier{}
+	if pushURL := os.Getenv("PUSH_WEBHOOK_URL"); pushURL != "" {
+		push = NewWebhookPushNotifier(pushURL)
+		logInfof("offline push notifications enabled via webhook")
+	}
+
+	historyConcurrency := defaultHistoryConcurrency
+	if v := os.Getenv("HISTORY_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("HISTORY_CONCURRENCY must be a positive integer, got %q", v)
+		}
+		historyConcurrency = n
+	}
+	history := newHistoryLimiter(historyConcurrency, 5*time.Second)
+
+	if v := os.Getenv("HISTORY_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			log.Fatalf("HISTORY_LIMIT must be an integer from 1 to %d, got %q", maxHistoryLimit, v)
+		}
+		historyPageSize = n
+	}
+
+	upgrader.CheckOrigin = originChecker(os.Getenv("ALLOWED_ORIGINS"))
+
+	if v := os.Getenv("MAX_CONNECTIONS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("MAX_CONNECTIONS must be a non-negative integer, got %q", v)
+		}
+		maxConnections = n
+	}
+
+	if v := os.Getenv("MAX_FRAME_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			log.Fatalf("MAX_FRAME_BYTES must be a positive integer, got %q", v)
+		}
+		maxFrameBytes = n
+	}
+
+	if v := os.Getenv("TOKEN_CHECK_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("TOKEN_CHECK_INTERVAL must be a non-negative duration, got %q", v)
+		}
+		tokenCheckInterval = d
 	}
 
 	messages := make(chan Message)
-	go server(messages, sb)
+	go server(messages, sb, push, history, filter)
+
+	// Purge messages past each channel's retention window; 0 disables the job
+	retentionInterval := defaultRetentionInterval
+	if v := os.Getenv("RETENTION_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("RETENTION_INTERVAL must be a non-negative duration, got %q", v)
+		}
+		retentionInterval = d
+	}
+	retentionCtx, stopRetention := context.WithCancel(context.Background())
+	defer stopRetention()
+	if retentionInterval > 0 {
+		go runRetention(retentionCtx, sb, retentionInterval)
+	}
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		handleWebSocket(w, r, messages, sb)
 	})
+	http.HandleFunc("/channels/", func(w http.ResponseWriter, r *http.Request) {
+		handleChannelMessages(w, r, sb)
+	})
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		handleMetrics(w, r, history)
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		handleReadyz(w, r, sb)
+	})
+	// Announcements are only accepted when an operator token is configured
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		http.HandleFunc("/admin/broadcast", func(w http.ResponseWriter, r *http.Request) {
+			handleAdminBroadcast(w, r, messages, adminToken)
+		})
+	}
+
+	// Platforms that assign the port inject it as $PORT
+	port := defaultPort
+	if v := os.Getenv("PORT"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n <= 0 || n > 65535 {
+			log.Fatalf("PORT must be a port number, got %q", v)
+		}
+		port = v
+	}
+
+	logInfof("WebSocket server listening on port %s\n", port)
+	logInfof("Connect to ws://localhost:%s/ws\n", port)
+
+	srv := &http.Server{Addr: ":" + port}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logErrorf("could not start server: %s", err)
+			os.Exit(1)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	logInfof("received %s, shutting down", sig)
+	stopRetention()
 
-	log.Printf("\x1b[32mINFO\x1b[0m: WebSocket server listening on port %s\n", port)
-	log.Printf("\x1b[32mINFO\x1b[0m: Connect to ws://localhost:%s/ws\n", port)
+	// Stop accepting connections, then let the server loop finish whatever it's
+	// persisting before it notifies and closes the WebSocket clients
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logWarnf("HTTP server shutdown: %v", err)
+	}
+
+	done := make(chan struct{})
+	select {
+	case messages <- Message{Type: ServerShutdown, Done: done}:
+		select {
+		case <-done:
+		case <-ctx.Done():
+			logWarnf("timed out closing client connections")
+		}
+	case <-ctx.Done():
+		logWarnf("server loop busy; exiting without closing clients")
+	}
 
-	if err = http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("\x1b[31mERROR\x1b[0m: could not start server: %s\n", err)
+	if err := sb.Close(); err != nil {
+		logWarnf("failed to close notification listener: %v", err)
 	}
 }
@@ -0,0 +1,1020 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// messagesTable serves the messages rows PostgREST would: GETs by id=eq. and
+// author-scoped PATCHes and DELETEs (user_id=eq.) against the one row given
+func messagesTable(db *fakePostgREST, row dbMessage) {
+	db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") == "eq."+row.ID {
+			writeJSON(w, http.StatusOK, []dbMessage{row})
+			return
+		}
+		writeJSON(w, http.StatusOK, []dbMessage{})
+	})
+	ownRow := func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("id") != "eq."+row.ID || q.Get("user_id") != "eq."+row.UserID {
+			writeJSON(w, http.StatusOK, []dbMessage{})
+			return
+		}
+		deleted := row
+		deleted.Deleted, deleted.Content = true, ""
+		writeJSON(w, http.StatusOK, []dbMessage{deleted})
+	}
+	db.handle("PATCH", "/rest/v1/messages", ownRow)
+	db.handle("DELETE", "/rest/v1/messages", ownRow)
+}
+
+func TestDeleteMessageOnlyByAuthor(t *testing.T) {
+	chat := startTestChat(t)
+	messagesTable(chat.db, dbMessage{ID: "m1", ChannelID: "general", UserID: "alice", Content: "hi", CreatedAt: "2026-01-01T00:00:00Z"})
+
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+
+	bob.send(WSMessage{Type: "delete_message", ID: "m1", Channel: "general"})
+	if got := bob.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotAuthorized {
+		t.Fatalf("bob deleting alice's message: got %+v, want not_authorized error", got)
+	}
+
+	alice.send(WSMessage{Type: "delete_message", ID: "m1", Channel: "general"})
+	for name, conn := range map[string]*testConn{"alice": alice, "bob": bob} {
+		got := conn.next("message_deleted")
+		if got.ID != "m1" || got.Channel != "general" || !got.Soft {
+			t.Errorf("%s got message_deleted %+v, want a soft delete of m1 in general", name, got)
+		}
+	}
+	if n := len(chat.db.received("PATCH", "/rest/v1/messages")); n != 2 {
+		t.Errorf("got %d delete attempts, want 2", n)
+	}
+	bob.none("message_deleted", 100*time.Millisecond)
+}
+
+func TestDeleteMessageMissing(t *testing.T) {
+	chat := startTestChat(t)
+	messagesTable(chat.db, dbMessage{ID: "m1", ChannelID: "general", UserID: "alice"})
+
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	alice.send(WSMessage{Type: "delete_message", ID: "gone", Channel: "general"})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotFound || got.ID != "gone" {
+		t.Fatalf("got %+v, want not_found error for gone", got)
+	}
+}
+
+func TestModeratorHardDeletes(t *testing.T) {
+	chat := startTestChat(t)
+	messagesTable(chat.db, dbMessage{ID: "m1", ChannelID: "general", UserID: "alice"})
+	channelRoles(chat.db, map[string]string{"mod": "admin"})
+	chat.db.handle("DELETE", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice"}})
+	})
+
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	mod := chat.dial(t, "mod")
+	mod.join("general")
+
+	mod.send(WSMessage{Type: "delete_message", ID: "m1", Channel: "general"})
+	if got := alice.next("message_deleted"); got.ID != "m1" || got.Soft {
+		t.Fatalf("got message_deleted %+v, want a hard delete of m1", got)
+	}
+	deletes := chat.db.received("DELETE", "/rest/v1/messages")
+	if len(deletes) != 1 || deletes[0].Query.Has("user_id") {
+		t.Errorf("deletes %v, want one not scoped to the author", deletes)
+	}
+}
+
+func TestModeratorCheckFailureReportsFailedToDelete(t *testing.T) {
+	chat := startTestChat(t)
+	messagesTable(chat.db, dbMessage{ID: "m1", ChannelID: "general", UserID: "alice"})
+
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+
+	// The role lookup failing must not read as a plain "you can't"
+	chat.db.respond("GET", "/rest/v1/channel_members", http.StatusInternalServerError, `{"message":"boom"}`)
+	bob.send(WSMessage{Type: "delete_message", ID: "m1", Channel: "general"})
+	if got := bob.next("error"); got.Error == nil || got.Error.Code != ErrCodeFailedToDelete || got.ID != "m1" {
+		t.Fatalf("got %+v, want failed_to_delete for m1", got)
+	}
+	if n := len(chat.db.received("DELETE", "/rest/v1/messages")); n != 0 {
+		t.Errorf("got %d hard deletes, want none", n)
+	}
+}
+
+func TestMessageFromDBTombstone(t *testing.T) {
+	parent := "m0"
+	got := messageFromDB(dbMessage{ID: "m1", ChannelID: "general", ReplyTo: &parent, Deleted: true}, "message", profile{Username: "alice"})
+	if got.Content != deletedPlaceholder || !got.Deleted || got.ReplyTo != "m0" {
+		t.Errorf("got %+v, want a tombstone still replying to m0", got)
+	}
+}
+
+func TestReplacedSessionLeavesChannel(t *testing.T) {
+	chat := startTestChat(t)
+	alice := chat.dialSession(t, "alice", "tab1")
+	alice.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+
+	// The same tab reconnecting replaces the old socket, which never sends its own disconnect
+	chat.dialSession(t, "alice", "tab1").sync()
+	if got := bob.next("user_left"); got.Username != "alice" || got.Channel != "general" {
+		t.Fatalf("got user_left %+v, want alice leaving general", got)
+	}
+	bob.none("user_left", 100*time.Millisecond)
+}
+
+func TestTwoSessionsOneLeaves(t *testing.T) {
+	chat := startTestChat(t)
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+	tab1 := chat.dialSession(t, "alice", "tab1")
+	tab1.join("general")
+	tab2 := chat.dialSession(t, "alice", "tab2")
+	tab2.join("general")
+
+	carol := chat.dial(t, "carol")
+	carol.send(WSMessage{Type: "join", Channel: "general"})
+	users := carol.next("user_list").Users
+	sort.Strings(users)
+	if !slices.Equal(users, []string{"alice", "bob"}) {
+		t.Errorf("carol got user_list %v, want alice once and bob", users)
+	}
+
+	// Only the second tab closing takes alice out of the channel
+	tab1.conn.Close()
+	tab2.conn.Close()
+	if got := bob.next("user_left"); got.Username != "alice" {
+		t.Fatalf("got user_left %+v, want alice", got)
+	}
+	bob.none("user_left", 100*time.Millisecond)
+}
+
+func TestRepeatJoinResyncs(t *testing.T) {
+	chat := startTestChat(t)
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob.next("user_joined")
+	alice.send(WSMessage{Type: "typing", Channel: "general"})
+	bob.next("typing")
+
+	// The repeat join only resends alice's own view of the channel
+	alice.send(WSMessage{Type: "join", Channel: "general"})
+	if got := alice.next("user_list"); !slices.Equal(got.Users, []string{"bob"}) {
+		t.Errorf("got user_list %v on rejoin, want [bob]", got.Users)
+	}
+	// Peers see neither a second arrival nor the typing indicator cleared
+	bob.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		var msg WSMessage
+		if err := bob.conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		if msg.Type == "user_joined" || msg.Type == "stop_typing" {
+			t.Errorf("bob got %s after alice's repeat join", msg.Type)
+		}
+	}
+}
+
+func TestSecondSessionJoinNotAnnounced(t *testing.T) {
+	chat := startTestChat(t)
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob.next("user_joined")
+
+	// alice's second tab still gets its own view of the channel
+	tab := chat.dial(t, "alice")
+	tab.send(WSMessage{Type: "join", Channel: "general"})
+	if got := tab.next("user_list"); !slices.Contains(got.Users, "bob") {
+		t.Errorf("got user_list %v for the second session, want bob listed", got.Users)
+	}
+	bob.none("user_joined", 100*time.Millisecond)
+}
+
+func TestRetriedClientIDNotRebroadcast(t *testing.T) {
+	chat := startTestChat(t)
+	row := dbMessage{ID: "m1", ChannelID: "general", UserID: "alice", Content: "hi", CreatedAt: "2026-01-01T00:00:00Z"}
+	stored := false
+	chat.db.handle("POST", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		if stored {
+			http.Error(w, `{"code":"23505"}`, http.StatusConflict)
+			return
+		}
+		stored = true
+		writeJSON(w, http.StatusCreated, []dbMessage{row})
+	})
+	chat.db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("client_message_id") != "eq.c1" {
+			writeJSON(w, http.StatusOK, []dbMessage{})
+			return
+		}
+		writeJSON(w, http.StatusOK, []dbMessage{row})
+	})
+
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+
+	// The ack for the first send was lost, so alice sends it again
+	for i := 0; i < 2; i++ {
+		alice.send(WSMessage{Type: "message", Channel: "general", Content: "hi", ClientID: "c1"})
+		if got := alice.next("ack"); got.ID != "m1" || got.ClientID != "c1" {
+			t.Fatalf("send %d: alice got ack %+v, want m1 for c1", i+1, got)
+		}
+	}
+	if got := bob.next("message"); got.ID != "m1" {
+		t.Fatalf("bob got %+v, want m1", got)
+	}
+	bob.none("message", 100*time.Millisecond)
+}
+
+func TestNonMemberRejected(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("GET", "/rest/v1/channel_members", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("user_id") != "eq.alice" {
+			writeJSON(w, http.StatusOK, []any{})
+			return
+		}
+		writeJSON(w, http.StatusOK, []map[string]string{{"user_id": "alice"}})
+	})
+	chat.db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []dbMessage{{ID: "m1", ChannelID: "private", UserID: "alice", Content: "hi", CreatedAt: "2026-01-01T00:00:00Z"}})
+	})
+
+	mallory := chat.dial(t, "mallory")
+	for _, msg := range []WSMessage{
+		{Type: "join", Channel: "private"},
+		{Type: "load_history", Channel: "private", Before: "2026-01-02T00:00:00Z"},
+		{Type: "jump_to", Channel: "private", ID: "m1"},
+		{Type: "message", Channel: "private", Content: "hi"},
+	} {
+		mallory.send(msg)
+		if got := mallory.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotAMember {
+			t.Errorf("%s by a non-member: got %+v, want not_a_member", msg.Type, got)
+		}
+	}
+	// Reactions and threads are answered as if the message didn't exist
+	for _, msg := range []WSMessage{
+		{Type: "add_reaction", ID: "m1", Emoji: "👍"},
+		{Type: "get_thread", ID: "m1"},
+	} {
+		mallory.send(msg)
+		if got := mallory.next("error"); got.Error == nil || got.Error.Code != ErrCodeMessageNotFound {
+			t.Errorf("%s by a non-member: got %+v, want message_not_found", msg.Type, got)
+		}
+	}
+	if n := len(chat.db.received("POST", "/rest/v1/messages")); n != 0 {
+		t.Errorf("got %d inserts from a non-member, want 0", n)
+	}
+}
+
+func TestMessageLengthCountsRunes(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("POST", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice", CreatedAt: "2026-01-01T00:00:00Z"}})
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+
+	// 4000 two-byte runes are 8000 bytes, but within the limit
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: strings.Repeat("é", maxMessageLen)})
+	alice.next("ack")
+
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: strings.Repeat("é", maxMessageLen+1), ClientID: "c2"})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeMessageTooLong || got.ClientID != "c2" {
+		t.Fatalf("got %+v, want message_too_long error for c2", got)
+	}
+	if n := len(chat.db.received("POST", "/rest/v1/messages")); n != 1 {
+		t.Errorf("got %d inserts, want only the message within the limit", n)
+	}
+}
+
+func TestTypingStopsOnDisconnect(t *testing.T) {
+	chat := startTestChat(t)
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+
+	// A dropped connection and a replaced one both clear the indicator
+	alice := chat.dialSession(t, "alice", "tab1")
+	alice.join("general")
+	alice.send(WSMessage{Type: "typing", Channel: "general"})
+	bob.next("typing")
+	chat.dialSession(t, "alice", "tab1").sync()
+	if got := bob.next("stop_typing"); got.Username != "alice" {
+		t.Fatalf("replaced session: got stop_typing %+v, want alice", got)
+	}
+
+	carol := chat.dial(t, "carol")
+	carol.join("general")
+	carol.send(WSMessage{Type: "typing", Channel: "general"})
+	bob.next("typing")
+	carol.conn.Close()
+	if got := bob.next("stop_typing"); got.Username != "carol" {
+		t.Fatalf("closed session: got stop_typing %+v, want carol", got)
+	}
+}
+
+func TestTypingOnlyInJoinedChannel(t *testing.T) {
+	chat := startTestChat(t)
+	bob := chat.dial(t, "bob")
+	bob.join("random")
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+
+	// Typing for a channel alice isn't in reaches nobody there
+	alice.send(WSMessage{Type: "typing", Channel: "random"})
+	alice.sync()
+	bob.none("typing", 100*time.Millisecond)
+}
+
+func TestOriginChecker(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowlist string
+		origin    string
+		want      bool
+	}{
+		{"exact match", "https://chat.example.com", "https://chat.example.com", true},
+		{"one of several", "https://a.example.com, https://chat.example.com", "https://chat.example.com", true},
+		{"case-insensitive", "https://Chat.Example.com/", "https://chat.example.com", true},
+		{"other origin", "https://chat.example.com", "https://evil.example.com", false},
+		{"other scheme", "https://chat.example.com", "http://chat.example.com", false},
+		{"subdomain", "https://example.com", "https://chat.example.com", false},
+		{"wildcard", "*", "https://evil.example.com", true},
+		{"wildcard among others", "https://chat.example.com,*", "https://evil.example.com", true},
+		{"empty list", "", "https://evil.example.com", true},
+		{"no origin header", "https://chat.example.com", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := originChecker(tt.allowlist)(r); got != tt.want {
+				t.Errorf("originChecker(%q) for %q = %t, want %t", tt.allowlist, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroadcastUsesProfileUsername(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("POST", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice", Content: "hi", CreatedAt: "2026-01-01T00:00:00Z"}})
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: "hi", Username: "bob"})
+	if got := bob.next("message"); got.Username != "alice" {
+		t.Errorf("broadcast username = %q, want alice's profile name, not the one the client sent", got.Username)
+	}
+}
+
+func TestMessageSanitizedBeforeInsert(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("POST", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice", Content: "hi", CreatedAt: "2026-01-01T00:00:00Z"}})
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: "\x1b[31mhi\x00\x1b[0m"})
+	alice.next("ack")
+	inserts := chat.db.received("POST", "/rest/v1/messages")
+	if len(inserts) != 1 || !strings.Contains(inserts[0].Body, `"content":"hi"`) {
+		t.Fatalf("insert bodies %v, want content stored as hi", inserts)
+	}
+}
+
+func TestReplyMustStayInChannel(t *testing.T) {
+	chat := startTestChat(t)
+	parents := map[string]dbMessage{
+		"p1": {ID: "p1", ChannelID: "general", UserID: "bob"},
+		"p2": {ID: "p2", ChannelID: "secret", UserID: "bob"},
+	}
+	chat.db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := parents[strings.TrimPrefix(r.URL.Query().Get("id"), "eq.")]; ok {
+			writeJSON(w, http.StatusOK, []dbMessage{p})
+			return
+		}
+		writeJSON(w, http.StatusOK, []dbMessage{})
+	})
+	chat.db.handle("POST", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		parent := "p1"
+		writeJSON(w, http.StatusCreated, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice", ReplyTo: &parent, CreatedAt: "2026-01-01T00:00:00Z"}})
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: "same channel", ReplyTo: "p1", ClientID: "c1"})
+	if got := alice.next("ack"); got.ClientID != "c1" {
+		t.Fatalf("got ack %+v, want c1", got)
+	}
+	for _, parent := range []string{"p2", "missing"} {
+		alice.send(WSMessage{Type: "message", Channel: "general", Content: "elsewhere", ReplyTo: parent, ClientID: "c-" + parent})
+		if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeInvalidReply || got.ClientID != "c-"+parent {
+			t.Errorf("reply to %s: got %+v, want invalid_reply error", parent, got)
+		}
+	}
+	inserts := chat.db.received("POST", "/rest/v1/messages")
+	if len(inserts) != 1 || !strings.Contains(inserts[0].Body, `"reply_to":"p1"`) {
+		t.Errorf("inserts %v, want only the reply to p1", inserts)
+	}
+}
+
+func TestReplySnippetFromParent(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("id") {
+			writeJSON(w, http.StatusOK, []dbMessage{{ID: "p1", ChannelID: "general", UserID: "bob", Content: "hello there"}})
+			return
+		}
+		writeJSON(w, http.StatusOK, []dbMessage{}) // History replay on join
+	})
+	chat.db.handle("POST", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		parent := "p1"
+		writeJSON(w, http.StatusCreated, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice", ReplyTo: &parent, CreatedAt: "2026-01-01T00:00:00Z"}})
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: "hi", ReplyTo: "p1", ClientID: "c1"})
+	if got := bob.next("message"); got.ReplyTo != "p1" || got.ReplySnippet != "hello there" {
+		t.Fatalf("got %+v, want a reply to p1 quoting it", got)
+	}
+	// The parent was already loaded to check its channel; don't fetch it again
+	var lookups int
+	for _, req := range chat.db.received("GET", "/rest/v1/messages") {
+		if req.Query.Has("id") {
+			lookups++
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("got %d parent lookups, want 1", lookups)
+	}
+}
+
+func TestJoinAndSwitchReplayHistory(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		// Newest first, as the history query orders them
+		switch r.URL.Query().Get("channel_id") {
+		case "eq.general":
+			writeJSON(w, http.StatusOK, []dbMessage{
+				{ID: "g2", ChannelID: "general", UserID: "carol", Content: "second", CreatedAt: "2026-01-01T00:00:02Z"},
+				{ID: "g1", ChannelID: "general", UserID: "bob", Content: "first", CreatedAt: "2026-01-01T00:00:01Z"},
+			})
+		case "eq.random":
+			writeJSON(w, http.StatusOK, []dbMessage{{ID: "r1", ChannelID: "random", UserID: "bob", Content: "hello", CreatedAt: "2026-01-01T00:00:03Z"}})
+		default:
+			writeJSON(w, http.StatusOK, []dbMessage{})
+		}
+	})
+	alice := chat.dial(t, "alice")
+
+	alice.send(WSMessage{Type: "join", Channel: "general"})
+	for _, want := range []WSMessage{{ID: "g1", Username: "bob"}, {ID: "g2", Username: "carol"}} {
+		if got := alice.next("message"); got.ID != want.ID || got.Username != want.Username || got.Channel != "general" {
+			t.Fatalf("join history: got %+v, want %s by %s", got, want.ID, want.Username)
+		}
+	}
+	alice.next("pins_updated")
+
+	// Switching replays the new channel's history the same way
+	alice.send(WSMessage{Type: "switch_channel", Channel: "random"})
+	if got := alice.next("message"); got.ID != "r1" || got.Username != "bob" || got.Channel != "random" {
+		t.Fatalf("switch_channel history: got %+v, want r1 by bob", got)
+	}
+	alice.next("pins_updated")
+}
+
+func TestDMSendErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		createStatus int // get_or_create_dm
+		insertStatus int // dm_messages insert
+		want         ErrorCode
+	}{
+		{"conversation forbidden", http.StatusForbidden, 0, ErrCodeNotAuthorized},
+		{"conversation fails", http.StatusInternalServerError, 0, ErrCodeFailedToSendDM},
+		{"insert forbidden", http.StatusOK, http.StatusForbidden, ErrCodeNotAuthorized},
+		{"insert throttled", http.StatusOK, http.StatusTooManyRequests, ErrCodeRateLimited},
+		{"insert fails", http.StatusOK, http.StatusBadRequest, ErrCodeFailedToSendDM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat := startTestChat(t)
+			if tt.createStatus == http.StatusOK {
+				chat.db.respond("POST", "/rest/v1/rpc/get_or_create_dm", http.StatusOK, `"dm1"`)
+			} else {
+				chat.db.respond("POST", "/rest/v1/rpc/get_or_create_dm", tt.createStatus, `{}`)
+			}
+			chat.db.respond("POST", "/rest/v1/dm_messages", tt.insertStatus, `{}`)
+			alice := chat.dial(t, "alice")
+
+			alice.send(WSMessage{Type: "dm_message", RecipientID: "bob", Content: "hi"})
+			if got := alice.next("error"); got.Error == nil || got.Error.Code != tt.want || got.RecipientID != "bob" {
+				t.Errorf("got %+v, want %s error for bob", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurge(t *testing.T) {
+	chat := startTestChat(t)
+	channelRoles(chat.db, map[string]string{"mod": "admin"})
+	chat.db.respond("DELETE", "/rest/v1/messages", http.StatusOK, `[{"id":"m1"},{"id":"m2"}]`)
+
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	mod := chat.dial(t, "mod")
+	mod.join("general")
+
+	alice.send(WSMessage{Type: "purge", Channel: "general", TargetUserID: "mod"})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotAuthorized {
+		t.Fatalf("purge by a member: got %+v, want not_authorized", got)
+	}
+
+	mod.send(WSMessage{Type: "purge", Channel: "general", TargetUserID: "alice"})
+	if got := alice.next("messages_purged"); len(got.IDs) != 2 || got.IDs[0] != "m1" || got.IDs[1] != "m2" {
+		t.Fatalf("got messages_purged %+v, want m1 and m2", got)
+	}
+	deletes := chat.db.received("DELETE", "/rest/v1/messages")
+	if len(deletes) != 1 {
+		t.Fatalf("got %d deletes, want 1", len(deletes))
+	}
+	if q := deletes[0].Query; q.Get("channel_id") != "eq.general" || q.Get("user_id") != "eq.alice" {
+		t.Errorf("delete filters %v, want alice's messages in general", q)
+	}
+}
+
+func TestDMEditOnlyBySender(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.respond("GET", "/rest/v1/direct_messages", http.StatusOK, `[{"participant1_id":"alice","participant2_id":"bob"}]`)
+	chat.db.handle("PATCH", "/rest/v1/dm_messages", func(w http.ResponseWriter, r *http.Request) {
+		// d1 is alice's; the sender filter matches nothing for anyone else
+		if r.URL.Query().Get("sender_id") != "eq.alice" {
+			writeJSON(w, http.StatusOK, []dmMessage{})
+			return
+		}
+		var patch struct {
+			Content string `json:"content"`
+		}
+		json.NewDecoder(r.Body).Decode(&patch)
+		writeJSON(w, http.StatusOK, []dmMessage{{ID: "d1", DMConversationID: "dm1", SenderID: "alice", Content: patch.Content, Edited: true}})
+	})
+	alice := chat.dial(t, "alice")
+	bob := chat.dial(t, "bob")
+
+	bob.send(WSMessage{Type: "dm_edit", MessageID: "d1", Content: "not mine"})
+	if got := bob.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotAuthorized || got.MessageID != "d1" {
+		t.Fatalf("bob editing alice's DM: got %+v, want not_authorized", got)
+	}
+
+	alice.send(WSMessage{Type: "dm_edit", MessageID: "d1", Content: "fixed"})
+	for _, c := range []*testConn{alice, bob} {
+		if got := c.next("dm_message_edited"); got.MessageID != "d1" || got.Content != "fixed" || !got.Edited {
+			t.Errorf("got dm_message_edited %+v, want d1 edited to fixed", got)
+		}
+	}
+}
+
+func TestDMDeleteOnlyBySender(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.respond("GET", "/rest/v1/direct_messages", http.StatusOK, `[{"participant1_id":"alice","participant2_id":"bob"}]`)
+	chat.db.handle("PATCH", "/rest/v1/dm_messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sender_id") != "eq.alice" {
+			writeJSON(w, http.StatusOK, []dmMessage{})
+			return
+		}
+		writeJSON(w, http.StatusOK, []dmMessage{{ID: "d1", DMConversationID: "dm1", SenderID: "alice", Deleted: true}})
+	})
+	alice := chat.dial(t, "alice")
+	bob := chat.dial(t, "bob")
+
+	bob.send(WSMessage{Type: "dm_delete", MessageID: "d1"})
+	if got := bob.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotAuthorized || got.MessageID != "d1" {
+		t.Fatalf("bob deleting alice's DM: got %+v, want not_authorized", got)
+	}
+
+	alice.send(WSMessage{Type: "dm_delete", MessageID: "d1"})
+	for _, c := range []*testConn{alice, bob} {
+		if got := c.next("dm_message_deleted"); got.MessageID != "d1" || !got.Deleted {
+			t.Errorf("got dm_message_deleted %+v, want d1 deleted", got)
+		}
+	}
+	// The delete leaves a tombstone rather than removing the row
+	patches := chat.db.received("PATCH", "/rest/v1/dm_messages")
+	if last := patches[len(patches)-1]; !strings.Contains(last.Body, `"deleted":true`) || last.Query.Get("deleted") != "is.false" {
+		t.Errorf("delete sent %s with %v, want a soft delete of a live message", last.Body, last.Query)
+	}
+}
+
+func TestWSMessageNormalizesTimestamps(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"2026-10-16T12:00:00.123456+00:00", "2026-10-16T12:00:00.123Z"}, // PostgREST
+		{"2026-10-16T14:00:00+02:00", "2026-10-16T12:00:00.000Z"},        // time.RFC3339, local zone
+		{"2026-10-16T12:00:00Z", "2026-10-16T12:00:00.000Z"},
+		{"", ""},
+		{"yesterday", "yesterday"},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(WSMessage{Type: "message", Timestamp: tt.in, EditedAt: tt.in, ReadAt: tt.in})
+		if err != nil {
+			t.Fatalf("marshal %q: %v", tt.in, err)
+		}
+		var got map[string]any
+		json.Unmarshal(b, &got)
+		for _, field := range []string{"timestamp", "edited_at", "read_at"} {
+			if v, _ := got[field].(string); v != tt.want {
+				t.Errorf("%s %q marshalled as %q, want %q", field, tt.in, v, tt.want)
+			}
+		}
+	}
+
+	// Nested messages, such as history pages, are normalized too
+	b, _ := json.Marshal(WSMessage{Type: "history", Messages: []WSMessage{{Timestamp: "2026-10-16T12:00:00.5+00:00"}}})
+	if !strings.Contains(string(b), `"2026-10-16T12:00:00.500Z"`) {
+		t.Errorf("history page marshalled as %s, want its message's timestamp normalized", b)
+	}
+
+	lastAt := "2026-10-16T12:00:00.25+00:00"
+	conversations := []dmConversation{{DMID: "dm1", LastMessageAt: &lastAt}, {DMID: "dm2"}}
+	b, _ = json.Marshal(WSMessage{Type: "list_dms", Conversations: conversations})
+	if !strings.Contains(string(b), `"last_message_at":"2026-10-16T12:00:00.250Z"`) || !strings.Contains(string(b), `"last_message_at":null`) {
+		t.Errorf("DM list marshalled as %s, want last_message_at normalized and null kept", b)
+	}
+	if lastAt != "2026-10-16T12:00:00.25+00:00" {
+		t.Errorf("marshalling changed the caller's conversation to %q", lastAt)
+	}
+
+	info := &channelInfo{ID: "general", Name: "general", CreatedAt: "2026-10-16T12:00:00+00:00"}
+	b, _ = json.Marshal(WSMessage{Type: "channel_info", ChannelInfo: info})
+	if !strings.Contains(string(b), `"created_at":"2026-10-16T12:00:00.000Z"`) {
+		t.Errorf("channel_info marshalled as %s, want created_at normalized", b)
+	}
+	if info.CreatedAt != "2026-10-16T12:00:00+00:00" {
+		t.Errorf("marshalling changed the caller's channel info to %q", info.CreatedAt)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	chat := startTestChat(t)
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+	tab1 := chat.dialSession(t, "alice", "tab1")
+	tab1.join("general")
+	tab2 := chat.dialSession(t, "alice", "tab2")
+	tab2.join("general")
+	carol := chat.dial(t, "carol")
+	carol.join("general")
+	tab1.send(WSMessage{Type: "typing", Channel: "general"})
+	bob.next("typing")
+
+	// A stale leave for a channel the session already left is ignored, and
+	// alice's other tab keeps her in the channel
+	tab1.send(WSMessage{Type: "leave", Channel: "random"})
+	tab1.send(WSMessage{Type: "leave", Channel: "general"})
+	if got := bob.next("stop_typing"); got.Username != "alice" {
+		t.Errorf("got stop_typing %+v, want alice's", got)
+	}
+	tab1.sync()
+	carol.none("user_left", 100*time.Millisecond)
+	tab2.send(WSMessage{Type: "leave"})
+	if got := bob.next("user_left"); got.Username != "alice" || got.Channel != "general" {
+		t.Fatalf("got user_left %+v, want alice leaving general", got)
+	}
+
+	// Having left, alice no longer gets the channel's messages
+	chat.db.respond("POST", "/rest/v1/messages", http.StatusCreated, `[{"id":"m1","channel_id":"general","user_id":"bob","content":"hi"}]`)
+	bob.send(WSMessage{Type: "message", Channel: "general", Content: "hi"})
+	bob.next("message")
+	tab2.none("message", 100*time.Millisecond)
+}
+
+func TestReconnectHintJitter(t *testing.T) {
+	base := 100 * time.Millisecond
+	for i := 0; i < 50; i++ {
+		got := reconnectHint(base)
+		if got.Type != "reconnect" || got.RetryAfterMs < 100 || got.RetryAfterMs > 200 {
+			t.Fatalf("got %+v, want a reconnect frame waiting 100-200ms", got)
+		}
+	}
+}
+
+func TestGetProfile(t *testing.T) {
+	chat := startTestChat(t)
+	alice := chat.dial(t, "alice")
+
+	alice.send(WSMessage{Type: "get_profile", UserID: "bob", UserIDs: []string{"carol"}})
+	got := alice.next("profile")
+	if len(got.Profiles) != 2 || got.Profiles["bob"].Username != "bob" || got.Profiles["carol"].Username != "carol" {
+		t.Errorf("got profiles %+v, want bob and carol", got.Profiles)
+	}
+
+	alice.send(WSMessage{Type: "get_profile"})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeInvalidPayload {
+		t.Errorf("got %+v for get_profile without IDs, want invalid_payload", got.Error)
+	}
+}
+
+func TestLoadHistoryHasMore(t *testing.T) {
+	// Newest first, as the page query orders them
+	rows := `[
+		{"id":"m3","channel_id":"general","user_id":"bob","content":"three","created_at":"2026-01-01T00:00:03.123456Z"},
+		{"id":"m2","channel_id":"general","user_id":"bob","content":"two","created_at":"2026-01-01T00:00:02.123456Z"},
+		{"id":"m1","channel_id":"general","user_id":"bob","content":"one","created_at":"2026-01-01T00:00:01.123456Z"}]`
+	exact := `[
+		{"id":"m3","channel_id":"general","user_id":"bob","content":"three","created_at":"2026-01-01T00:00:03.123456Z"},
+		{"id":"m2","channel_id":"general","user_id":"bob","content":"two","created_at":"2026-01-01T00:00:02.123456Z"}]`
+	tests := []struct {
+		name    string
+		rows    string
+		hasMore bool
+	}{
+		{name: "one row past the page", rows: rows, hasMore: true},
+		{name: "exactly a page", rows: exact, hasMore: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat := startTestChat(t)
+			chat.db.respond("GET", "/rest/v1/messages", http.StatusOK, tt.rows)
+			alice := chat.dial(t, "alice")
+
+			// The batched replay on join reports has_more like load_history does
+			alice.send(WSMessage{Type: "join", Channel: "general", Batch: true, Limit: 2})
+			if got := alice.next("history"); len(got.Messages) != 2 || got.HasMore != tt.hasMore {
+				t.Errorf("got history of %d with has_more %v, want 2 with %v", len(got.Messages), got.HasMore, tt.hasMore)
+			}
+
+			alice.send(WSMessage{Type: "load_history", Channel: "general", Before: "2026-01-01T00:00:04Z", Limit: 2})
+			got := alice.next("load_history")
+			if len(got.Messages) != 2 || got.Messages[0].ID != "m2" || got.Messages[1].ID != "m3" {
+				t.Fatalf("got page %+v, want m2 and m3", got.Messages)
+			}
+			// The cursor is the oldest message's raw created_at, not its millisecond timestamp
+			if got.HasMore != tt.hasMore || got.Cursor != "2026-01-01T00:00:02.123456Z" || got.CursorID != "m2" {
+				t.Errorf("got has_more %v, cursor %q/%q; want %v and m2's raw created_at", got.HasMore, got.Cursor, got.CursorID, tt.hasMore)
+			}
+			reqs := chat.db.received("GET", "/rest/v1/messages")
+			if limit := reqs[len(reqs)-1].Query.Get("limit"); limit != "3" {
+				t.Errorf("page query limit = %s, want one past the page size", limit)
+			}
+		})
+	}
+}
+
+func TestConnOrigin(t *testing.T) {
+	t.Cleanup(func() { auditMessages, trustProxyHeaders = false, false })
+	tests := []struct {
+		audit, trustProxy bool
+		forwarded         []string // X-Forwarded-For headers, in order
+		want              messageOrigin
+	}{
+		{false, false, nil, messageOrigin{}},
+		{true, false, []string{"203.0.113.7"}, messageOrigin{IP: "10.0.0.1", UserAgent: "chat-test/1.0"}},
+		{true, true, nil, messageOrigin{IP: "10.0.0.1", UserAgent: "chat-test/1.0"}},
+		{true, true, []string{"203.0.113.7"}, messageOrigin{IP: "203.0.113.7", UserAgent: "chat-test/1.0"}},
+		// A client-supplied entry comes first; the proxy appends the real one
+		{true, true, []string{"198.51.100.1, 203.0.113.7"}, messageOrigin{IP: "203.0.113.7", UserAgent: "chat-test/1.0"}},
+		{true, true, []string{"198.51.100.1", "2001:db8::7"}, messageOrigin{IP: "2001:db8::7", UserAgent: "chat-test/1.0"}},
+		{true, true, []string{"203.0.113.7, not-an-ip"}, messageOrigin{IP: "10.0.0.1", UserAgent: "chat-test/1.0"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = "10.0.0.1:5555"
+		r.Header.Set("User-Agent", "chat-test/1.0")
+		for _, fwd := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", fwd)
+		}
+		auditMessages, trustProxyHeaders = tt.audit, tt.trustProxy
+		if got := connOrigin(r); got != tt.want {
+			t.Errorf("audit %t, trust proxy %t, forwarded %q: got %+v, want %+v", tt.audit, tt.trustProxy, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestSuppressEcho(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.respond("POST", "/rest/v1/messages", http.StatusCreated, `[{"id":"m1","channel_id":"general","user_id":"alice","content":"hi","created_at":"2026-01-01T00:00:00Z"}]`)
+	alice := chat.dialRaw(t, "alice", url.Values{"suppress_echo": {"true"}})
+	alice.next("hello")
+	alice.join("general")
+	tab := chat.dial(t, "alice")
+	tab.join("general")
+
+	// The ack carries the whole stored message in place of the echo
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: "hi", ClientID: "c1"})
+	if got := alice.next("ack"); got.ID != "m1" || got.ClientID != "c1" || got.Content != "hi" || got.Username != "alice" {
+		t.Errorf("got ack %+v, want the full message m1 for c1", got)
+	}
+	// alice's other session still gets the normal frame
+	if got := tab.next("message"); got.ID != "m1" {
+		t.Errorf("other session got %+v, want m1", got)
+	}
+	alice.none("message", 100*time.Millisecond)
+}
+
+func TestJoinChannelInfo(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("GET", "/rest/v1/channels", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") != "eq.general" {
+			writeJSON(w, http.StatusOK, []channelInfo{})
+			return
+		}
+		topic := "Anything goes"
+		writeJSON(w, http.StatusOK, []channelInfo{{ID: "general", Name: "General", Description: &topic}})
+	})
+	alice := chat.dial(t, "alice")
+
+	alice.send(WSMessage{Type: "join", Channel: "general"})
+	got := alice.next("channel_info")
+	if got.ChannelInfo == nil || got.ChannelInfo.Name != "General" || got.ChannelInfo.Description == nil || *got.ChannelInfo.Description != "Anything goes" {
+		t.Errorf("got channel_info %+v, want general's name and topic", got.ChannelInfo)
+	}
+
+	for _, typ := range []string{"join", "switch_channel"} {
+		alice.send(WSMessage{Type: typ, Channel: "nope"})
+		if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeChannelNotFound || got.Channel != "nope" {
+			t.Errorf("%s to an unknown channel: got %+v, want channel_not_found", typ, got.Error)
+		}
+	}
+}
+
+func TestGetThread(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		root := "r1"
+		switch q := r.URL.Query(); {
+		case q.Get("id") == "eq.r1":
+			writeJSON(w, http.StatusOK, []dbMessage{{ID: "r1", ChannelID: "general", UserID: "bob", Content: "root", CreatedAt: "2026-01-01T00:00:00Z"}})
+		case q.Get("reply_to") == "eq.r1" && q.Get("channel_id") == "eq.general":
+			writeJSON(w, http.StatusOK, []dbMessage{
+				{ID: "a1", ChannelID: "general", UserID: "alice", Content: "first", ReplyTo: &root, CreatedAt: "2026-01-01T00:00:01Z"},
+				{ID: "a2", ChannelID: "general", UserID: "bob", Content: "second", ReplyTo: &root, CreatedAt: "2026-01-01T00:00:02Z"},
+			})
+		default:
+			writeJSON(w, http.StatusOK, []dbMessage{})
+		}
+	})
+	alice := chat.dial(t, "alice")
+
+	// One reply fits the page; the second only shows up as has_more
+	alice.send(WSMessage{Type: "get_thread", ID: "r1", Limit: 1})
+	got := alice.next("thread")
+	if len(got.Messages) != 2 || got.Messages[0].ID != "r1" || got.Messages[1].ID != "a1" || !got.HasMore || got.Channel != "general" {
+		t.Errorf("got thread %+v, want r1 then a1 with has_more", got)
+	}
+
+	alice.send(WSMessage{Type: "get_thread", ID: "gone"})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeMessageNotFound {
+		t.Errorf("thread of a missing root: got %+v, want message_not_found", got.Error)
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	chat := startTestChat(t)
+	alice := chat.dialRaw(t, "alice", url.Values{"protocol": {"2"}})
+	alice.next("hello")
+	alice.join("general")
+	chat.dial(t, "alice") // A second tab
+
+	alice.send(WSMessage{Type: "whoami"})
+	got := alice.next("whoami")
+	if got.UserID != "alice" || got.Username != "alice" || got.Channel != "general" || got.Sessions != 2 || got.Protocol != protocolBatched {
+		t.Errorf("got whoami %+v, want alice in general with 2 sessions on protocol 2", got)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	chat := startTestChat(t)
+	chat.sb.SetUserScoped(true)
+	chat.db.handle("GET", "/auth/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		// Both of alice's tokens are good; anything else is bob's
+		switch r.Header.Get("Authorization") {
+		case "Bearer tok-alice", "Bearer fresh-alice":
+			writeJSON(w, http.StatusOK, authUser{ID: "alice"})
+		default:
+			writeJSON(w, http.StatusOK, authUser{ID: "bob"})
+		}
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+
+	alice.send(WSMessage{Type: "refresh_token", Token: "fresh-alice"})
+	alice.next("token_refreshed")
+	alice.send(WSMessage{Type: "load_history", Channel: "general", Before: "2024-01-01T00:00:00Z"})
+	alice.next("load_history")
+	reqs := chat.db.received("GET", "/rest/v1/messages")
+	if got := reqs[len(reqs)-1].Header.Get("Authorization"); got != "Bearer fresh-alice" {
+		t.Errorf("history fetched with %q, want the refreshed token", got)
+	}
+
+	// Someone else's token ends the session
+	alice.send(WSMessage{Type: "refresh_token", Token: "tok-bob"})
+	if ce := alice.closed(); ce.Code != websocket.ClosePolicyViolation || ce.Text != "reauth_required" {
+		t.Errorf("got close %d %q, want policy violation reauth_required", ce.Code, ce.Text)
+	}
+}
+
+func TestRefreshTokenOffLoop(t *testing.T) {
+	chat := startTestChat(t)
+	release := make(chan struct{})
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	chat.db.handle("GET", "/auth/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer tok-")
+		if r.Header.Get("Authorization") == "Bearer slow-alice" {
+			<-release // Auth is stalled for this token
+			userID = "alice"
+		}
+		writeJSON(w, http.StatusOK, authUser{ID: userID})
+	})
+	alice := chat.dial(t, "alice")
+	bob := chat.dial(t, "bob")
+
+	alice.send(WSMessage{Type: "refresh_token", Token: "slow-alice"})
+	bob.sync() // Answered while alice's validation is still outstanding
+	close(release)
+	alice.next("token_refreshed")
+}
+
+func TestLoadDMHistory(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.respond("GET", "/rest/v1/direct_messages", http.StatusOK, `[{"participant1_id":"alice","participant2_id":"bob"}]`)
+	// Newest first, as the page query orders them: one row more than asked for
+	chat.db.respond("GET", "/rest/v1/dm_messages", http.StatusOK, `[
+		{"id":"d3","dm_id":"dm1","sender_id":"bob","content":"three","created_at":"2026-01-01T00:00:03.123456Z"},
+		{"id":"d2","dm_id":"dm1","sender_id":"alice","content":"two","created_at":"2026-01-01T00:00:02.123456Z"},
+		{"id":"d1","dm_id":"dm1","sender_id":"bob","content":"one","created_at":"2026-01-01T00:00:01.123456Z"}]`)
+	alice := chat.dial(t, "alice")
+	carol := chat.dial(t, "carol")
+
+	alice.send(WSMessage{Type: "load_dm_history", DMConversationID: "dm1", Before: "2026-01-01T00:00:04Z", BeforeID: "d4", Limit: 2})
+	got := alice.next("load_dm_history")
+	if len(got.Messages) != 2 || got.Messages[0].MessageID != "d2" || got.Messages[1].MessageID != "d3" {
+		t.Fatalf("got page %+v, want d2 and d3", got.Messages)
+	}
+	if !got.HasMore || got.Cursor != "2026-01-01T00:00:02.123456Z" || got.CursorID != "d2" {
+		t.Errorf("got has_more %v, cursor %q/%q; want true and d2's raw created_at", got.HasMore, got.Cursor, got.CursorID)
+	}
+	reqs := chat.db.received("GET", "/rest/v1/dm_messages")
+	if q := reqs[len(reqs)-1].Query; q.Get("limit") != "3" || !strings.Contains(q.Get("or"), `id.lt."d4"`) {
+		t.Errorf("page query %v, want one past the page size behind the (created_at, id) cursor", q)
+	}
+
+	// Only the conversation's participants may read it
+	carol.send(WSMessage{Type: "load_dm_history", DMConversationID: "dm1", Before: "2026-01-01T00:00:04Z"})
+	if got := carol.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotAuthorized || got.DMConversationID != "dm1" {
+		t.Errorf("carol got %+v, want not_authorized for dm1", got)
+	}
+	if n := len(chat.db.received("GET", "/rest/v1/dm_messages")); n != len(reqs) {
+		t.Errorf("carol's request fetched DM messages")
+	}
+}
+
+func TestPinWithoutChannel(t *testing.T) {
+	chat := startTestChat(t)
+	alice := chat.dial(t, "alice") // Not in any channel
+
+	alice.send(WSMessage{Type: "pin_message", ID: "m1"})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeInvalidPayload || got.ID != "m1" {
+		t.Errorf("got %+v, want invalid_payload for m1", got)
+	}
+	if n := len(chat.db.received("POST", "/rest/v1/pinned_messages")); n != 0 {
+		t.Errorf("got %d pin writes, want none", n)
+	}
+}
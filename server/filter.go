@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ErrContentFiltered is returned when a message contains a banned word and the
+// filter is set to reject rather than mask
+var ErrContentFiltered = errors.New("content filtered")
+
+// filterMode says what contentFilter does with a banned word
+type filterMode int
+
+const (
+	filterMask   filterMode = iota // Replace each banned word with asterisks
+	filterReject                   // Refuse the whole message
+)
+
+// contentFilter blocks a configured list of words in channel messages.
+// Matching is case-insensitive and by whole word: text is split into runs of
+// letters and digits, so a banned "ass" never touches "class" or "assess".
+type contentFilter struct {
+	mode  filterMode
+	words map[string]bool // Lowercased banned words
+}
+
+// newContentFilter builds a filter from a comma-separated word list and a mode
+// of "mask" or "reject" (empty means mask). An empty list filters nothing.
+func newContentFilter(wordlist, mode string) (*contentFilter, error) {
+	f := &contentFilter{words: make(map[string]bool)}
+	switch mode {
+	case "", "mask":
+		f.mode = filterMask
+	case "reject":
+		f.mode = filterReject
+	default:
+		return nil, fmt.Errorf("unknown filter mode %q", mode)
+	}
+	for _, word := range strings.Split(wordlist, ",") {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			f.words[word] = true
+		}
+	}
+	return f, nil
+}
+
+// Apply returns content with banned words masked, or ErrContentFiltered if
+// one is present and the filter rejects. Content without matches is returned
+// unchanged.
+func (f *contentFilter) Apply(content string) (string, error) {
+	if f == nil || len(f.words) == 0 {
+		return content, nil
+	}
+
+	runes := []rune(content)
+	matched := false
+	for start := 0; start < len(runes); {
+		if !isWordRune(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && isWordRune(runes[end]) {
+			end++
+		}
+		if f.words[strings.ToLower(string(runes[start:end]))] {
+			if f.mode == filterReject {
+				return "", ErrContentFiltered
+			}
+			matched = true
+			for i := start; i < end; i++ {
+				runes[i] = '*'
+			}
+		}
+		start = end
+	}
+	if !matched {
+		return content, nil
+	}
+	return string(runes), nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestContentFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		masked   string
+		rejected bool
+	}{
+		{"clean", "hello there", "hello there", false},
+		{"banned word", "you darn fool", "you **** fool", true},
+		{"any case", "DARN it, Darn", "**** it, ****", true},
+		{"inside a longer word", "the heck's darnedest class", "the ****'s darnedest class", true},
+		{"Scunthorpe", "classic assessment", "classic assessment", false},
+		{"beside punctuation", "(darn!)", "(****!)", true},
+		{"non-ASCII neighbours", "éheck heckö heck", "éheck heckö ****", true},
+		{"empty", "", "", false},
+	}
+	mask, err := newContentFilter(" darn, HECK,ass ,", "mask")
+	if err != nil {
+		t.Fatalf("newContentFilter: %v", err)
+	}
+	reject, err := newContentFilter("darn,heck,ass", "reject")
+	if err != nil {
+		t.Fatalf("newContentFilter: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := mask.Apply(tt.content); err != nil || got != tt.masked {
+				t.Errorf("mask: Apply(%q) = %q, %v; want %q", tt.content, got, err, tt.masked)
+			}
+			got, err := reject.Apply(tt.content)
+			if tt.rejected {
+				if !errors.Is(err, ErrContentFiltered) {
+					t.Errorf("reject: Apply(%q) = %q, %v; want ErrContentFiltered", tt.content, got, err)
+				}
+			} else if err != nil || got != tt.content {
+				t.Errorf("reject: Apply(%q) = %q, %v; want it unchanged", tt.content, got, err)
+			}
+		})
+	}
+}
+
+func TestNewContentFilter(t *testing.T) {
+	for _, mode := range []string{"", "mask", "reject"} {
+		if _, err := newContentFilter("darn", mode); err != nil {
+			t.Errorf("mode %q: %v", mode, err)
+		}
+	}
+	if _, err := newContentFilter("darn", "block"); err == nil {
+		t.Error("mode block: got no error")
+	}
+
+	// No words, or no filter at all, lets everything through
+	for _, f := range []*contentFilter{nil, mustFilter(t, " , ", "reject")} {
+		if got, err := f.Apply("darn"); err != nil || got != "darn" {
+			t.Errorf("empty filter: Apply = %q, %v; want it unchanged", got, err)
+		}
+	}
+}
+
+func mustFilter(t *testing.T, words, mode string) *contentFilter {
+	t.Helper()
+	f, err := newContentFilter(words, mode)
+	if err != nil {
+		t.Fatalf("newContentFilter(%q, %q): %v", words, mode, err)
+	}
+	return f
+}
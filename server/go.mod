@@ -7,4 +7,5 @@ require github.com/gorilla/websocket v1.5.3
 require (
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
+	golang.org/x/text v0.14.0
 )
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakePostgREST stands in for Supabase in tests. Handlers are registered per
+// method and path; anything unregistered answers 200 with an empty array, the
+// PostgREST reply for "no rows". /auth/v1/user accepts "tok-<user ID>".
+type fakePostgREST struct {
+	*httptest.Server
+	mu       sync.Mutex
+	routes   map[string]http.HandlerFunc
+	requests []recordedRequest
+}
+
+// recordedRequest is one request the fake received
+type recordedRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+}
+
+func newFakePostgREST(t *testing.T) *fakePostgREST {
+	t.Helper()
+	f := &fakePostgREST{routes: make(map[string]http.HandlerFunc)}
+	f.handle("GET", "/auth/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer tok-")
+		if !ok {
+			http.Error(w, `{"msg":"invalid JWT"}`, http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, http.StatusOK, authUser{ID: userID})
+	})
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.requests = append(f.requests, recordedRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header.Clone(), Body: string(body)})
+		h := f.routes[r.Method+" "+r.URL.Path]
+		f.mu.Unlock()
+		if h == nil {
+			writeJSON(w, http.StatusOK, []any{})
+			return
+		}
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		h(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// handle routes method and path (without the query) to h, replacing any
+// earlier handler for them
+func (f *fakePostgREST) handle(method, path string, h http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes[method+" "+path] = h
+}
+
+// respond makes method and path always answer status with body
+func (f *fakePostgREST) respond(method, path string, status int, body string) {
+	f.handle(method, path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	})
+}
+
+// received returns the requests made to method and path so far
+func (f *fakePostgREST) received(method, path string) []recordedRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []recordedRequest
+	for _, r := range f.requests {
+		if r.Method == method && r.Path == path {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// client returns a SupabaseClient pointed at the fake, retrying quickly
+func (f *fakePostgREST) client(t *testing.T) *SupabaseClient {
+	t.Helper()
+	sb, err := NewSupabaseClient(f.URL, "service-key", SupabaseOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewSupabaseClient: %v", err)
+	}
+	sb.retry.base = time.Millisecond
+	return sb
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// testChat runs the server loop and the /ws endpoint against a fake Supabase.
+// Every channel exists and every user is a plain member of it unless a test
+// registers its own channels handler or gives roles with channelRoles.
+type testChat struct {
+	db       *fakePostgREST
+	sb       *SupabaseClient
+	messages chan Message
+	srv      *httptest.Server
+}
+
+func startTestChat(t *testing.T) *testChat {
+	t.Helper()
+	db := newFakePostgREST(t)
+	db.handle("GET", "/rest/v1/channels", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Query().Get("id"), "eq.")
+		writeJSON(w, http.StatusOK, []channelInfo{{ID: id, Name: id}})
+	})
+	db.handle("GET", "/rest/v1/profiles", func(w http.ResponseWriter, r *http.Request) {
+		// Users are named after their IDs, looked up one (id=eq.) or many (id=in.) at a time
+		var ids []string
+		filter := r.URL.Query().Get("id")
+		if id, ok := strings.CutPrefix(filter, "eq."); ok {
+			ids = []string{id}
+		} else if list, ok := strings.CutPrefix(filter, "in.("); ok {
+			ids = strings.Split(strings.TrimSuffix(list, ")"), ",")
+		}
+		rows := []map[string]string{}
+		for _, id := range ids {
+			id = strings.Trim(id, `"`)
+			rows = append(rows, map[string]string{"id": id, "username": id})
+		}
+		writeJSON(w, http.StatusOK, rows)
+	})
+	channelRoles(db, nil)
+
+	c := &testChat{db: db, sb: db.client(t), messages: make(chan Message)}
+	go server(c.messages, c.sb, noopPushNotifier{}, newHistoryLimiter(4, time.Second), nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(w, r, c.messages, c.sb)
+	})
+	c.srv = httptest.NewServer(mux)
+	t.Cleanup(c.srv.Close)
+	return c
+}
+
+// channelRoles makes every user a member of every channel, with the role
+// roles gives them or "member"
+func channelRoles(db *fakePostgREST, roles map[string]string) {
+	db.handle("GET", "/rest/v1/channel_members", func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimPrefix(r.URL.Query().Get("user_id"), "eq.")
+		role := roles[userID]
+		if role == "" {
+			role = "member"
+		}
+		writeJSON(w, http.StatusOK, []map[string]string{{"user_id": userID, "role": role}})
+	})
+}
+
+// dial connects as userID and waits for the hello frame
+func (c *testChat) dial(t *testing.T, userID string) *testConn {
+	t.Helper()
+	return c.dialSession(t, userID, "")
+}
+
+// dialSession connects as userID with the given session_id, an empty one
+// leaving it to the server to pick, and waits for the hello frame
+func (c *testChat) dialSession(t *testing.T, userID, sessionID string) *testConn {
+	t.Helper()
+	params := url.Values{}
+	if sessionID != "" {
+		params.Set("session_id", sessionID)
+	}
+	tc := c.dialRaw(t, userID, params)
+	tc.next("hello")
+	return tc
+}
+
+// dialRaw connects as userID with any extra query parameters, without reading
+// anything
+func (c *testChat) dialRaw(t *testing.T, userID string, params url.Values) *testConn {
+	t.Helper()
+	wsURL := "ws" + strings.TrimPrefix(c.srv.URL, "http") + "/ws?token=tok-" + url.QueryEscape(userID)
+	if len(params) > 0 {
+		wsURL += "&" + params.Encode()
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial as %s: %v", userID, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn}
+}
+
+// testConn is one test client's WebSocket connection
+type testConn struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func (tc *testConn) send(msg WSMessage) {
+	tc.t.Helper()
+	if err := tc.conn.WriteJSON(msg); err != nil {
+		tc.t.Fatalf("send %s: %v", msg.Type, err)
+	}
+}
+
+// join joins channelID and waits until the server has handled it. The server
+// loop handles a connection's frames in order, so the reply to a time request
+// sent after the join means the join is done.
+func (tc *testConn) join(channelID string) {
+	tc.t.Helper()
+	tc.send(WSMessage{Type: "join", Channel: channelID})
+	tc.sync()
+}
+
+// sync waits until the server has handled every frame sent so far
+func (tc *testConn) sync() {
+	tc.t.Helper()
+	tc.send(WSMessage{Type: "time"})
+	tc.next("time")
+}
+
+// next reads frames until one of type typ arrives, failing the test after two
+// seconds without one
+func (tc *testConn) next(typ string) WSMessage {
+	tc.t.Helper()
+	tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg WSMessage
+		if err := tc.conn.ReadJSON(&msg); err != nil {
+			tc.t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+// closed reads until the server closes the connection and returns its close
+// frame, failing the test if it doesn't close within two seconds
+func (tc *testConn) closed() *websocket.CloseError {
+	tc.t.Helper()
+	tc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := tc.conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var ce *websocket.CloseError
+		if !errors.As(err, &ce) {
+			tc.t.Fatalf("waiting for close: %v", err)
+		}
+		return ce
+	}
+}
+
+// none fails the test if a frame of type typ arrives within wait. The read
+// deadline it runs into leaves the connection unreadable, so it goes last.
+func (tc *testConn) none(typ string, wait time.Duration) {
+	tc.t.Helper()
+	tc.conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		var msg WSMessage
+		if err := tc.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Type == typ {
+			tc.t.Fatalf("unexpected %s frame: %+v", typ, msg)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// historyLimiter bounds how many history fetches hit Supabase at once so a
+// reconnect storm can't open thousands of concurrent requests
+type historyLimiter struct {
+	slots   chan struct{}
+	wait    time.Duration // How long a fetch may queue before giving up
+	waiting int64         // Fetches currently queued for a slot (atomic)
+}
+
+func newHistoryLimiter(concurrency int, wait time.Duration) *historyLimiter {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &historyLimiter{
+		slots: make(chan struct{}, concurrency),
+		wait:  wait,
+	}
+}
+
+// Acquire takes a slot, queuing for up to l.wait; returns false if none freed up
+func (l *historyLimiter) Acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	atomic.AddInt64(&l.waiting, 1)
+	defer atomic.AddInt64(&l.waiting, -1)
+
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Release returns a slot taken by Acquire
+func (l *historyLimiter) Release() {
+	<-l.slots
+}
+
+// QueueDepth reports how many fetches are waiting for a slot
+func (l *historyLimiter) QueueDepth() int64 {
+	return atomic.LoadInt64(&l.waiting)
+}
+
+// tokenBucket refills at rate tokens/second up to burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a per-user token-bucket limiter. It is not safe for
+// concurrent use; it's owned by the single server goroutine.
+type rateLimiter struct {
+	rate    float64 // Tokens added per second
+	burst   float64 // Bucket capacity
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow consumes a token for key, reporting false if the bucket is empty
+func (l *rateLimiter) Allow(key string, now time.Time) bool {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Forget drops key's bucket once it has refilled, since a full bucket is
+// indistinguishable from a new one; keeps the map from growing unbounded
+func (l *rateLimiter) Forget(key string, now time.Time) {
+	b, ok := l.buckets[key]
+	if !ok {
+		return
+	}
+	if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+		delete(l.buckets, key)
+	}
+}
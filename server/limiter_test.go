@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterFlood(t *testing.T) {
+	l := newRateLimiter(5, 10)
+	now := time.Now()
+
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		if l.Allow("alice", now) {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("flood of 50 allowed %d, want the burst of 10", allowed)
+	}
+	if !l.Allow("bob", now) {
+		t.Error("bob was limited by alice's flood")
+	}
+
+	// 5/s refills one token every 200ms
+	if l.Allow("alice", now.Add(100*time.Millisecond)) {
+		t.Error("allowed before a token refilled")
+	}
+	if !l.Allow("alice", now.Add(300*time.Millisecond)) {
+		t.Error("rejected after a token refilled")
+	}
+}
+
+func TestRateLimiterForget(t *testing.T) {
+	l := newRateLimiter(5, 10)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		l.Allow("alice", now)
+	}
+
+	l.Forget("alice", now)
+	if _, ok := l.buckets["alice"]; !ok {
+		t.Fatal("forgot an empty bucket, which would reset the limit")
+	}
+	l.Forget("alice", now.Add(2*time.Second))
+	if _, ok := l.buckets["alice"]; ok {
+		t.Error("kept a bucket that had refilled")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitOpenConnections waits for the open-connection count to reach n, which
+// lags the client side closing by however long the handler takes to notice
+func waitOpenConnections(t *testing.T, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&metrics.openConnections) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections open, want %d", atomic.LoadInt64(&metrics.openConnections), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	chat := startTestChat(t)
+	waitOpenConnections(t, 0) // Earlier tests' connections may still be winding down
+	maxConnections = 2
+	t.Cleanup(func() { maxConnections = 0 })
+
+	alice := chat.dial(t, "alice")
+	chat.dial(t, "bob")
+
+	full := chat.dialRaw(t, "carol", nil)
+	if got := full.next("reconnect"); got.RetryAfterMs < int(capacityRetryAfter/time.Millisecond) {
+		t.Errorf("got %+v, want a reconnect hint of at least %s", got, capacityRetryAfter)
+	}
+	if ce := full.closed(); ce.Code != websocket.CloseTryAgainLater || ce.Text != "server_full" {
+		t.Errorf("third connection closed with %d %q, want %d server_full", ce.Code, ce.Text, websocket.CloseTryAgainLater)
+	}
+	waitOpenConnections(t, 2)
+
+	// A slot frees up when a connection closes
+	alice.conn.Close()
+	waitOpenConnections(t, 1)
+	chat.dial(t, "carol")
+}
+
+func TestFailedAuthFreesConnection(t *testing.T) {
+	chat := startTestChat(t)
+	waitOpenConnections(t, 0)
+
+	wsURL := "ws" + strings.TrimPrefix(chat.srv.URL, "http") + "/ws?token=forged"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	bad := &testConn{t: t, conn: conn}
+	if ce := bad.closed(); ce.Code != websocket.ClosePolicyViolation || ce.Text != "invalid token" {
+		t.Errorf("closed with %d %q, want %d invalid token", ce.Code, ce.Text, websocket.ClosePolicyViolation)
+	}
+	waitOpenConnections(t, 0)
+}
+
+func TestOversizedFrameCloses(t *testing.T) {
+	chat := startTestChat(t)
+	waitOpenConnections(t, 0)
+	maxFrameBytes = 256
+	t.Cleanup(func() { maxFrameBytes = 64 << 10 })
+
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+
+	// A frame of exactly the limit is still read
+	frame := `{"type":"channel_count","channel":"general"}`
+	frame += strings.Repeat(" ", 256-len(frame))
+	if err := alice.conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	alice.next("channel_count")
+
+	if err := alice.conn.WriteMessage(websocket.TextMessage, []byte(frame+" ")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if ce := alice.closed(); ce.Code != websocket.CloseMessageTooBig || ce.Text != "message_too_large" {
+		t.Errorf("closed with %d %q, want %d message_too_large", ce.Code, ce.Text, websocket.CloseMessageTooBig)
+	}
+	waitOpenConnections(t, 0)
+}
+
+func TestRevokedTokenClosesSession(t *testing.T) {
+	chat := startTestChat(t)
+	waitOpenConnections(t, 0)
+	tokenCheckInterval = 50 * time.Millisecond
+
+	// alice's token is revoked once she's connected; bob's checks only ever
+	// find Supabase unavailable, which says nothing about his token
+	var revoked atomic.Bool
+	chat.db.handle("GET", "/auth/v1/user", func(w http.ResponseWriter, r *http.Request) {
+		switch userID := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer tok-"); {
+		case userID == "alice" && revoked.Load():
+			http.Error(w, `{"msg":"token revoked"}`, http.StatusUnauthorized)
+		case userID == "bob" && len(chat.db.received("GET", "/auth/v1/user")) > 2:
+			http.Error(w, `{"msg":"unavailable"}`, http.StatusServiceUnavailable)
+		default:
+			writeJSON(w, http.StatusOK, authUser{ID: userID})
+		}
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+	revoked.Store(true)
+
+	alice.next("reauth_required")
+	if ce := alice.closed(); ce.Code != websocket.ClosePolicyViolation || ce.Text != "reauth_required" {
+		t.Errorf("closed with %d %q, want %d reauth_required", ce.Code, ce.Text, websocket.ClosePolicyViolation)
+	}
+	if got := bob.next("user_left"); got.Username != "alice" {
+		t.Errorf("got %+v, want alice gone", got)
+	}
+	bob.none("reauth_required", 200*time.Millisecond)
+
+	// The loop reads the interval while bob's checks are scheduled, so restore
+	// it only once he's dropped: a message the loop takes after his disconnect
+	// means it's done with him
+	bob.conn.Close()
+	waitOpenConnections(t, 0)
+	chat.messages <- Message{Type: JoinTimeout}
+	tokenCheckInterval = 10 * time.Minute
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel orders log output by severity; messages below the configured level are dropped
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// levelNames are the level labels of JSON log lines
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// levelPrefixes are the colored labels of text log lines
+var levelPrefixes = map[logLevel]string{
+	levelDebug: "\x1b[33mDEBUG\x1b[0m: ",
+	levelInfo:  "\x1b[32mINFO\x1b[0m: ",
+	levelWarn:  "\x1b[33mWARN\x1b[0m: ",
+	levelError: "\x1b[31mERROR\x1b[0m: ",
+}
+
+// currentLogLevel is set once from LOG_LEVEL at startup. INFO by default so
+// DEBUG output (tokens, emails) never reaches production logs unless asked for.
+var currentLogLevel = levelInfo
+
+// setLogLevel parses a LOG_LEVEL value; empty keeps the INFO default
+func setLogLevel(s string) error {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "DEBUG":
+		currentLogLevel = levelDebug
+	case "", "INFO":
+		currentLogLevel = levelInfo
+	case "WARN", "WARNING":
+		currentLogLevel = levelWarn
+	case "ERROR":
+		currentLogLevel = levelError
+	default:
+		return fmt.Errorf("unknown log level %q (want DEBUG, INFO, WARN or ERROR)", s)
+	}
+	return nil
+}
+
+// logFields are contextual key/value pairs attached to a log line, such as
+// user_id, channel or conn
+type logFields map[string]any
+
+// logger writes log lines either as colored text through the standard log
+// package (the default, for local development) or as one JSON object per line
+// for log aggregators. Safe for concurrent use.
+type logger struct {
+	mu   sync.Mutex
+	json bool
+	out  io.Writer // JSON destination; text goes through the log package
+	now  func() time.Time
+}
+
+var defaultLogger = &logger{out: os.Stderr, now: time.Now}
+
+// setLogFormat parses a LOG_FORMAT value: "text" (or empty) or "json"
+func setLogFormat(s string) error {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "text":
+		defaultLogger.json = false
+	case "json":
+		defaultLogger.json = true
+	default:
+		return fmt.Errorf("unknown log format %q (want text or json)", s)
+	}
+	return nil
+}
+
+func (l *logger) write(level logLevel, fields logFields, msg string) {
+	if level < currentLogLevel {
+		return
+	}
+	msg = strings.TrimRight(msg, "\n") // Many messages still end in a newline from the Printf days
+
+	if !l.json {
+		keys := sortedFieldKeys(fields)
+		for _, k := range keys {
+			msg += fmt.Sprintf(" %s=%v", k, fields[k])
+		}
+		log.Print(levelPrefixes[level] + msg)
+		return
+	}
+
+	entry := make(map[string]any, len(fields)+3)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error() // Errors marshal as {} otherwise
+		}
+		entry[k] = v
+	}
+	entry["level"] = levelNames[level]
+	entry["time"] = l.now().UTC().Format(time.RFC3339Nano)
+	entry["msg"] = msg
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]any{"level": levelNames[level], "time": entry["time"], "msg": msg, "log_error": err.Error()})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+func sortedFieldKeys(fields logFields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func logf(level logLevel, format string, args ...any) {
+	defaultLogger.write(level, nil, fmt.Sprintf(format, args...))
+}
+
+func logDebugf(format string, args ...any) {
+	logf(levelDebug, format, args...)
+}
+
+func logInfof(format string, args ...any) {
+	logf(levelInfo, format, args...)
+}
+
+func logWarnf(format string, args ...any) {
+	logf(levelWarn, format, args...)
+}
+
+func logErrorf(format string, args ...any) {
+	logf(levelError, format, args...)
+}
+
+// fieldLogger logs with a fixed set of contextual fields
+type fieldLogger struct {
+	fields logFields
+}
+
+// withFields returns a logger that adds fields to every line, e.g.
+// withFields(logFields{"user_id": id, "channel": ch}).Infof("joined")
+func withFields(fields logFields) fieldLogger {
+	return fieldLogger{fields: fields}
+}
+
+func (f fieldLogger) Debugf(format string, args ...any) {
+	defaultLogger.write(levelDebug, f.fields, fmt.Sprintf(format, args...))
+}
+
+func (f fieldLogger) Infof(format string, args ...any) {
+	defaultLogger.write(levelInfo, f.fields, fmt.Sprintf(format, args...))
+}
+
+func (f fieldLogger) Warnf(format string, args ...any) {
+	defaultLogger.write(levelWarn, f.fields, fmt.Sprintf(format, args...))
+}
+
+func (f fieldLogger) Errorf(format string, args ...any) {
+	defaultLogger.write(levelError, f.fields, fmt.Sprintf(format, args...))
+}
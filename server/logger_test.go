@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJSONLogLines(t *testing.T) {
+	// Runs at the default INFO level, so the debug line is dropped
+	var buf bytes.Buffer
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	l := &logger{json: true, out: &buf, now: func() time.Time { return at }}
+
+	l.write(levelInfo, logFields{"user_id": "alice", "channel": "general", "conn": 7}, "joined\n")
+	l.write(levelError, logFields{"err": errors.New("boom")}, `quote " and newline
+inside`)
+	l.write(levelDebug, nil, "below the level")
+	l.write(levelWarn, logFields{"bad": func() {}}, "unmarshalable field")
+
+	var lines []map[string]any
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var entry map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			t.Fatalf("line %q isn't JSON: %v", sc.Text(), err)
+		}
+		lines = append(lines, entry)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3 (debug dropped)", len(lines))
+	}
+
+	first := lines[0]
+	if first["level"] != "info" || first["msg"] != "joined" || first["time"] != "2026-01-02T03:04:05Z" {
+		t.Errorf("first line %v, want level, trimmed msg and time", first)
+	}
+	if first["user_id"] != "alice" || first["channel"] != "general" || first["conn"] != float64(7) {
+		t.Errorf("first line %v, want its fields", first)
+	}
+	if lines[1]["err"] != "boom" || lines[1]["msg"] != "quote \" and newline\ninside" {
+		t.Errorf("second line %v, want the error as a string and msg intact", lines[1])
+	}
+	if lines[2]["level"] != "warn" || lines[2]["msg"] != "unmarshalable field" || lines[2]["log_error"] == nil {
+		t.Errorf("third line %v, want the message kept and the marshal error noted", lines[2])
+	}
+}
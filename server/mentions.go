@@ -0,0 +1,40 @@
+package main
+
+// maxMentionsPerMessage caps how many users one message can notify
+const maxMentionsPerMessage = 20
+
+// parseMentions extracts the distinct usernames @-mentioned in content, in
+// order of first appearance. An @ only starts a mention at the beginning of
+// the text or after a character that can't be part of a word, so addresses
+// like email@host don't count, and a backslash (\@name) escapes it.
+func parseMentions(content string) []string {
+	var mentions []string
+	seen := map[string]bool{}
+	for i := 0; i < len(content); i++ {
+		if content[i] != '@' {
+			continue
+		}
+		if i > 0 && (isUsernameByte(content[i-1]) || content[i-1] == '.' || content[i-1] == '\\') {
+			continue
+		}
+		j := i + 1
+		for j < len(content) && isUsernameByte(content[j]) {
+			j++
+		}
+		// Usernames are at least 3 characters (profiles.username_length)
+		if name := content[i+1 : j]; len(name) >= 3 && !seen[name] {
+			seen[name] = true
+			mentions = append(mentions, name)
+			if len(mentions) == maxMentionsPerMessage {
+				break
+			}
+		}
+		i = j - 1
+	}
+	return mentions
+}
+
+// isUsernameByte matches the characters allowed by profiles.username_format
+func isUsernameByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
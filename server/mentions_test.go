@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"none", "hello there", nil},
+		{"at start", "@alice hi", []string{"alice"}},
+		{"after space", "hi @alice", []string{"alice"}},
+		{"after punctuation", "(@alice), @bob!", []string{"alice", "bob"}},
+		{"email address", "mail me at carol@example.com", nil},
+		{"escaped", `not \@alice but @bob`, []string{"bob"}},
+		{"after a dot", "x.@alice", nil},
+		{"too short", "@al hi", nil},
+		{"repeated", "@alice @bob @alice", []string{"alice", "bob"}},
+		{"name ends at a non-username byte", "@alice's turn", []string{"alice"}},
+		{"bare at", "@ @@ @", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMentions(tt.content); !slices.Equal(got, tt.want) {
+				t.Errorf("parseMentions(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+
+	var many strings.Builder
+	for i := 0; i < maxMentionsPerMessage+5; i++ {
+		many.WriteString("@user" + string(rune('a'+i)) + " ")
+	}
+	if got := parseMentions(many.String()); len(got) != maxMentionsPerMessage {
+		t.Errorf("got %d mentions, want the cap of %d", len(got), maxMentionsPerMessage)
+	}
+}
+
+func TestMentionDeliveredOffLoop(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("POST", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice", Content: "hi @bob and @carol", CreatedAt: "2026-01-01T00:00:00Z"}})
+	})
+	// Username lookups wait until released, so the test can show the loop
+	// carries on meanwhile; ID lookups name users after their IDs
+	release := make(chan struct{})
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release) // Don't leave the fake stuck if the test failed early
+		}
+	})
+	chat.db.handle("GET", "/rest/v1/profiles", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("username") {
+			<-release
+			writeJSON(w, http.StatusOK, []map[string]string{{"id": "bob", "username": "bob"}, {"id": "carol", "username": "carol"}})
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Query().Get("id"), "eq.")
+		writeJSON(w, http.StatusOK, []map[string]string{{"id": id, "username": id}})
+	})
+	// Of the two, only bob is in general
+	chat.db.handle("GET", "/rest/v1/channel_members", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Query().Get("user_id"), "in.") {
+			writeJSON(w, http.StatusOK, []map[string]string{{"user_id": "bob"}})
+			return
+		}
+		writeJSON(w, http.StatusOK, []map[string]string{{"user_id": strings.TrimPrefix(r.URL.Query().Get("user_id"), "eq."), "role": "member"}})
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("random")
+	carol := chat.dial(t, "carol")
+	carol.join("random")
+
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: "hi @bob and @carol"})
+	alice.next("ack")
+	alice.sync() // Answered while the lookup is still held up
+	close(release)
+
+	if got := bob.next("mention"); got.ID != "m1" || got.Channel != "general" || got.Username != "alice" {
+		t.Errorf("bob got %+v, want alice's mention in m1", got)
+	}
+	inserts := chat.db.received("POST", "/rest/v1/mentions")
+	if len(inserts) != 1 || !strings.Contains(inserts[0].Body, `"bob"`) || strings.Contains(inserts[0].Body, `"carol"`) {
+		t.Errorf("mention inserts %v, want one for bob only", inserts)
+	}
+	carol.none("mention", 100*time.Millisecond)
+}
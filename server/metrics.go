@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds the process-wide counters served on /metrics in the
+// Prometheus text format. Everything is safe for concurrent use: gauges are
+// set from the server loop, counters and latencies from any goroutine.
+var metrics = &serverMetrics{
+	wsMessages:      newCounterVec(),
+	supabaseLatency: newHistogramVec([]float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}),
+}
+
+type serverMetrics struct {
+	connections        int64 // Live WebSocket sessions (atomic)
+	openConnections    int64 // Upgraded connections, including ones still authenticating (atomic)
+	rejectedAtCapacity int64 // Connections turned away by MAX_CONNECTIONS (atomic)
+	connectedUsers     int64 // Distinct users with at least one session (atomic)
+	messagesPersisted  int64 // Channel messages stored (atomic)
+	persistFailures    int64 // Channel messages that failed to store (atomic)
+	wsMessages         *counterVec
+	supabaseLatency    *histogramVec
+}
+
+// countWSMessage records one received client message of the given type.
+// Types the server doesn't know are counted as "other" so clients can't
+// create unbounded label values.
+func countWSMessage(msgType string) {
+	if _, known := wsRequiredFields[msgType]; !known {
+		msgType = "other"
+	}
+	metrics.wsMessages.Inc(msgType)
+}
+
+// counterVec is a set of counters keyed by a single label value
+type counterVec struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{counts: make(map[string]int64)}
+}
+
+func (c *counterVec) Inc(label string) {
+	c.mu.Lock()
+	c.counts[label]++
+	c.mu.Unlock()
+}
+
+// histogramVec tracks observations in cumulative buckets per label value
+type histogramVec struct {
+	mu      sync.Mutex
+	buckets []float64 // Upper bounds, ascending
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []int64 // Per bucket, non-cumulative; the last entry is +Inf
+	sum    float64
+	count  int64
+}
+
+func newHistogramVec(buckets []float64) *histogramVec {
+	return &histogramVec{buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(label string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[label]
+	if s == nil {
+		s = &histogram{counts: make([]int64, len(h.buckets)+1)}
+		h.series[label] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v) // First bucket with bound >= v
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+// instrumentedTransport records the latency of every Supabase HTTP request by method
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	metrics.supabaseLatency.Observe(req.Method, time.Since(start).Seconds())
+	return resp, err
+}
+
+// handleMetrics serves the metrics in the Prometheus text exposition format
+func handleMetrics(w http.ResponseWriter, r *http.Request, history *historyLimiter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "chat_ws_connections", "gauge", "Live WebSocket sessions.", atomic.LoadInt64(&metrics.connections))
+	writeMetric(w, "chat_ws_open_connections", "gauge", "Upgraded WebSocket connections, including unauthenticated ones.", atomic.LoadInt64(&metrics.openConnections))
+	writeMetric(w, "chat_ws_rejected_at_capacity_total", "counter", "Connections refused because MAX_CONNECTIONS was reached.", atomic.LoadInt64(&metrics.rejectedAtCapacity))
+	writeMetric(w, "chat_connected_users", "gauge", "Distinct users with at least one live session.", atomic.LoadInt64(&metrics.connectedUsers))
+	writeMetric(w, "chat_messages_persisted_total", "counter", "Channel messages stored in Supabase.", atomic.LoadInt64(&metrics.messagesPersisted))
+	writeMetric(w, "chat_message_persist_failures_total", "counter", "Channel messages that failed to store.", atomic.LoadInt64(&metrics.persistFailures))
+	writeMetric(w, "chat_history_queue_depth", "gauge", "History fetches waiting for a slot.", history.QueueDepth())
+
+	fmt.Fprintf(w, "# HELP chat_ws_messages_total WebSocket messages received, by type.\n# TYPE chat_ws_messages_total counter\n")
+	metrics.wsMessages.mu.Lock()
+	for _, label := range sortedKeys(metrics.wsMessages.counts) {
+		fmt.Fprintf(w, "chat_ws_messages_total{type=%s} %d\n", strconv.Quote(label), metrics.wsMessages.counts[label])
+	}
+	metrics.wsMessages.mu.Unlock()
+
+	h := metrics.supabaseLatency
+	fmt.Fprintf(w, "# HELP chat_supabase_request_duration_seconds Supabase HTTP request latency, by method.\n# TYPE chat_supabase_request_duration_seconds histogram\n")
+	h.mu.Lock()
+	for _, label := range sortedKeys(h.series) {
+		s := h.series[label]
+		var cumulative int64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "chat_supabase_request_duration_seconds_bucket{method=%s,le=\"%g\"} %d\n", strconv.Quote(label), bound, cumulative)
+		}
+		fmt.Fprintf(w, "chat_supabase_request_duration_seconds_bucket{method=%s,le=\"+Inf\"} %d\n", strconv.Quote(label), s.count)
+		fmt.Fprintf(w, "chat_supabase_request_duration_seconds_sum{method=%s} %g\n", strconv.Quote(label), s.sum)
+		fmt.Fprintf(w, "chat_supabase_request_duration_seconds_count{method=%s} %d\n", strconv.Quote(label), s.count)
+	}
+	h.mu.Unlock()
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// channelBans serves channel_bans as PostgREST would, starting from the given
+// user IDs banned from every channel; BanUser's inserts add to it
+func channelBans(db *fakePostgREST, banned ...string) {
+	var mu sync.Mutex
+	bans := make(map[string]bool)
+	for _, id := range banned {
+		bans[id] = true
+	}
+	db.handle("GET", "/rest/v1/channel_bans", func(w http.ResponseWriter, r *http.Request) {
+		userID := strings.TrimPrefix(r.URL.Query().Get("user_id"), "eq.")
+		mu.Lock()
+		defer mu.Unlock()
+		if bans[userID] {
+			writeJSON(w, http.StatusOK, []map[string]string{{"user_id": userID}})
+			return
+		}
+		writeJSON(w, http.StatusOK, []any{})
+	})
+	db.handle("POST", "/rest/v1/channel_bans", func(w http.ResponseWriter, r *http.Request) {
+		var ban struct {
+			UserID string `json:"user_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&ban)
+		mu.Lock()
+		bans[ban.UserID] = true
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+func TestBannedUserCannotJoin(t *testing.T) {
+	chat := startTestChat(t)
+	channelBans(chat.db, "bob")
+
+	bob := chat.dial(t, "bob")
+	for _, typ := range []string{"join", "switch_channel"} {
+		bob.send(WSMessage{Type: typ, Channel: "general"})
+		if got := bob.next("error"); got.Error == nil || got.Error.Code != ErrCodeBanned || got.Channel != "general" {
+			t.Errorf("%s: got %+v, want %s error for general", typ, got, ErrCodeBanned)
+		}
+	}
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+}
+
+func TestBanCheckFailsClosed(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.respond("GET", "/rest/v1/channel_bans", http.StatusInternalServerError, `{"message":"down"}`)
+
+	alice := chat.dial(t, "alice")
+	alice.send(WSMessage{Type: "join", Channel: "general"})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeBanned {
+		t.Fatalf("got %+v, want %s error while bans can't be read", got, ErrCodeBanned)
+	}
+}
+
+func TestBanRemovesAndKeepsOut(t *testing.T) {
+	chat := startTestChat(t)
+	channelRoles(chat.db, map[string]string{"mod": "owner"})
+	channelBans(chat.db)
+
+	mod := chat.dial(t, "mod")
+	mod.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+
+	mod.send(WSMessage{Type: "ban", Channel: "general", TargetUserID: "bob"})
+	if got := mod.next("user_banned"); got.TargetUserID != "bob" || got.Channel != "general" {
+		t.Errorf("got %+v, want bob banned from general", got)
+	}
+	if ce := bob.closed(); ce.Code != websocket.ClosePolicyViolation || ce.Text != "banned" {
+		t.Errorf("bob's session closed with %d %q, want %d banned", ce.Code, ce.Text, websocket.ClosePolicyViolation)
+	}
+	if n := len(chat.db.received("DELETE", "/rest/v1/channel_members")); n != 1 {
+		t.Errorf("got %d membership deletes, want 1", n)
+	}
+
+	again := chat.dial(t, "bob")
+	again.send(WSMessage{Type: "join", Channel: "general"})
+	if got := again.next("error"); got.Error == nil || got.Error.Code != ErrCodeBanned {
+		t.Fatalf("rejoin: got %+v, want %s error", got, ErrCodeBanned)
+	}
+}
+
+func TestKick(t *testing.T) {
+	chat := startTestChat(t)
+	channelRoles(chat.db, map[string]string{"mod": "admin", "mod2": "admin"})
+
+	mod := chat.dial(t, "mod")
+	mod.join("general")
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+
+	// Only moderators kick, and not one another
+	alice.send(WSMessage{Type: "kick", Channel: "general", TargetUserID: "bob"})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotAuthorized {
+		t.Errorf("member kicking: got %+v, want %s error", got, ErrCodeNotAuthorized)
+	}
+	mod.send(WSMessage{Type: "kick", Channel: "general", TargetUserID: "mod2"})
+	if got := mod.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotAuthorized {
+		t.Errorf("kicking a moderator: got %+v, want %s error", got, ErrCodeNotAuthorized)
+	}
+
+	mod.send(WSMessage{Type: "kick", Channel: "general", TargetUserID: "bob"})
+	if got := alice.next("user_kicked"); got.TargetUserID != "bob" || got.Username != "bob" {
+		t.Errorf("got %+v, want bob kicked", got)
+	}
+	if ce := bob.closed(); ce.Code != websocket.ClosePolicyViolation || ce.Text != "kicked" {
+		t.Errorf("bob's session closed with %d %q, want %d kicked", ce.Code, ce.Text, websocket.ClosePolicyViolation)
+	}
+
+	// A kick isn't a ban
+	again := chat.dial(t, "bob")
+	again.join("general")
+	if n := len(chat.db.received("POST", "/rest/v1/channel_bans")); n != 0 {
+		t.Errorf("kick wrote %d bans", n)
+	}
+}
+
+func TestSystemMessage(t *testing.T) {
+	chat := startTestChat(t)
+	channelRoles(chat.db, map[string]string{"mod": "admin"})
+	chat.db.respond("POST", "/rest/v1/messages", http.StatusCreated, `[{"id":"s1","channel_id":"general","user_id":"mod","content":"Topic updated","system":true,"created_at":"2026-01-01T00:00:00Z"}]`)
+
+	mod := chat.dial(t, "mod")
+	mod.join("general")
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+
+	alice.send(WSMessage{Type: "system_message", Channel: "general", Content: "Topic updated"})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotAuthorized {
+		t.Errorf("member posting a system message: got %+v, want %s error", got, ErrCodeNotAuthorized)
+	}
+
+	mod.send(WSMessage{Type: "system_message", Channel: "general", Content: " Topic updated "})
+	if got := alice.next("system"); got.ID != "s1" || got.Content != "Topic updated" || got.Username != "mod" {
+		t.Errorf("got %+v, want the system line s1 from mod", got)
+	}
+	reqs := chat.db.received("POST", "/rest/v1/messages")
+	if len(reqs) != 1 || !strings.Contains(reqs[0].Body, `"system":true`) || reqs[0].Header.Get("Authorization") != "Bearer service-key" {
+		t.Errorf("got inserts %+v, want one system row written with the service key", reqs)
+	}
+
+	// Stored system rows render the same way in history
+	if got := messageFromDB(dbMessage{ID: "s1", System: true}, "message", profile{}); got.Type != "system" {
+		t.Errorf("stored system row rendered as %q, want system", got.Type)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// fakeListener is a pgListener whose notifications and ping results the test
+// controls
+type fakeListener struct {
+	mu        sync.Mutex
+	listenErr error // Returned by Listen, to fail a (re)connect
+	pingErr   error // Returned by Ping, to simulate a dropped connection
+	pings     int
+	channels  []string
+	closed    bool
+	notify    chan *pq.Notification
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{notify: make(chan *pq.Notification)}
+}
+
+func (l *fakeListener) Listen(channel string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.listenErr != nil {
+		return l.listenErr
+	}
+	l.channels = append(l.channels, channel)
+	return nil
+}
+
+func (l *fakeListener) NotificationChannel() <-chan *pq.Notification {
+	return l.notify
+}
+
+func (l *fakeListener) Ping() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pings++
+	return l.pingErr
+}
+
+func (l *fakeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.notify)
+	}
+	return nil
+}
+
+func (l *fakeListener) pingCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.pings
+}
+
+func (l *fakeListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// listenWith sets up sb's notification listener on the given fakes, which
+// successive dials (the first connect, then each reconnect) get in turn
+func listenWith(t *testing.T, sb *SupabaseClient, fakes ...*fakeListener) <-chan interface{} {
+	t.Helper()
+	var mu sync.Mutex
+	sb.dialListener = func(string, pq.EventCallbackType) pgListener {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(fakes) == 0 {
+			t.Error("unexpected listener dial")
+			return newFakeListener()
+		}
+		l := fakes[0]
+		fakes = fakes[1:]
+		return l
+	}
+	if err := sb.SetupNotificationListener("postgres://fake"); err != nil {
+		t.Fatalf("SetupNotificationListener: %v", err)
+	}
+	notifications := sb.ListenForNotifications()
+	t.Cleanup(func() {
+		sb.Close()
+		for range notifications {
+			// Wait for the loop to exit before the test's settings are restored
+		}
+	})
+	return notifications
+}
+
+// shortenListenerTimings pings an idle listener every interval and retries
+// reconnects after delay, for the rest of the test
+func shortenListenerTimings(t *testing.T, interval, delay time.Duration) {
+	oldInterval, oldDelay := listenerPingInterval, listenerReconnectDelay
+	listenerPingInterval, listenerReconnectDelay = interval, delay
+	t.Cleanup(func() {
+		listenerPingInterval, listenerReconnectDelay = oldInterval, oldDelay
+	})
+}
+
+func nextNotification(t *testing.T, notifications <-chan interface{}) interface{} {
+	t.Helper()
+	select {
+	case n, ok := <-notifications:
+		if !ok {
+			t.Fatal("notification channel closed")
+		}
+		return n
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a notification")
+		return nil
+	}
+}
+
+func TestListenerReconnectsAfterFailedPings(t *testing.T) {
+	shortenListenerTimings(t, 5*time.Millisecond, time.Millisecond)
+	sb := newFakePostgREST(t).client(t)
+	states := make(chan bool, 8)
+	sb.SetListenerStateHandler(func(connected bool) { states <- connected })
+
+	dropped := newFakeListener()
+	dropped.pingErr = errors.New("connection reset by peer")
+	refused := newFakeListener()
+	refused.listenErr = errors.New("connection refused")
+	recovered := newFakeListener()
+	notifications := listenWith(t, sb, dropped, refused, recovered)
+
+	for _, want := range []bool{true, false, true} {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("listener state %t, want %t", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for listener state %t", want)
+		}
+	}
+	if !sb.ListenerConnected() {
+		t.Error("ListenerConnected is false after the reconnect")
+	}
+	if dropped.pingCount() < listenerMaxPingFailures || !dropped.isClosed() {
+		t.Errorf("dropped listener: %d pings, closed %t; want %d pings and closed", dropped.pingCount(), dropped.isClosed(), listenerMaxPingFailures)
+	}
+	if !refused.isClosed() {
+		t.Error("listener that failed to subscribe was left open")
+	}
+	recovered.mu.Lock()
+	subscribed := len(recovered.channels)
+	recovered.mu.Unlock()
+	if subscribed != len(notificationChannels) {
+		t.Errorf("recovered listener subscribed to %d channels, want %d", subscribed, len(notificationChannels))
+	}
+
+	recovered.notify <- &pq.Notification{Channel: "friend_request", Extra: `{"target_user_id":"bob","notification_id":"n1"}`}
+	if got, ok := nextNotification(t, notifications).(FriendRequestNotification); !ok || got.NotificationID != "n1" {
+		t.Fatalf("got %#v after reconnecting, want the friend_request n1", got)
+	}
+}
+
+func TestListenerStopsOnClose(t *testing.T) {
+	sb := newFakePostgREST(t).client(t)
+	notifications := listenWith(t, sb, newFakeListener())
+	sb.Close()
+	select {
+	case _, ok := <-notifications:
+		if ok {
+			t.Fatal("got a notification after Close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("notification channel still open after Close")
+	}
+}
+
+func TestListenerDecodesFriendRequests(t *testing.T) {
+	sb := newFakePostgREST(t).client(t)
+	l := newFakeListener()
+	notifications := listenWith(t, sb, l)
+
+	// Malformed payloads and unknown channels are skipped, not forwarded
+	l.notify <- &pq.Notification{Channel: "friend_request", Extra: `{not json`}
+	l.notify <- &pq.Notification{Channel: "something_else", Extra: `{}`}
+	l.notify <- &pq.Notification{Channel: "friend_request", Extra: `{"target_user_id":"bob","sender_username":"alice","notification_id":"n1"}`}
+	want := FriendRequestNotification{TargetUserID: "bob", SenderUsername: "alice", NotificationID: "n1"}
+	if got := nextNotification(t, notifications); got != want {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+
+	l.notify <- &pq.Notification{Channel: "friend_request_accepted", Extra: `{"target_user_id":"alice","accepter_username":"bob"}`}
+	wantAccepted := FriendRequestAcceptedNotification{TargetUserID: "alice", AccepterUsername: "bob"}
+	if got := nextNotification(t, notifications); got != wantAccepted {
+		t.Fatalf("got %#v, want %#v", got, wantAccepted)
+	}
+}
+
+func TestListenerInvalidatesProfiles(t *testing.T) {
+	db := newFakePostgREST(t)
+	asked := profilesByID(db)
+	sb := db.client(t)
+	l := newFakeListener()
+	notifications := listenWith(t, sb, l)
+	ctx := context.Background()
+
+	if _, err := sb.GetProfiles(ctx, []string{"alice", "carol"}); err != nil {
+		t.Fatalf("GetProfiles: %v", err)
+	}
+	<-asked
+
+	// A payload without a name only invalidates; one with a name is also
+	// forwarded, and as notifications are handled in order, its arrival means
+	// alice's was handled too
+	l.notify <- &pq.Notification{Channel: "profile_updated", Extra: `{"user_id":"alice"}`}
+	l.notify <- &pq.Notification{Channel: "profile_updated", Extra: `{not json`}
+	l.notify <- &pq.Notification{Channel: "profile_updated", Extra: `{"user_id":"bob","username":"robert","previous_username":"bob","avatar_url":null}`}
+	want := ProfileUpdatedNotification{UserID: "bob", Username: "robert", PreviousUsername: "bob"}
+	if got := nextNotification(t, notifications); got != want {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+
+	if _, err := sb.GetProfiles(ctx, []string{"alice", "carol"}); err != nil {
+		t.Fatalf("GetProfiles: %v", err)
+	}
+	if ids := <-asked; strings.Join(ids, ",") != "alice" {
+		t.Errorf("lookup after profile_updated fetched %v, want only [alice]", ids)
+	}
+}
+
+func TestProfileUpdateReachesChannelPeers(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("GET", "/rest/v1/channel_members", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("select") == "channel_id" {
+			writeJSON(w, http.StatusOK, []map[string]string{{"channel_id": "general"}})
+			return
+		}
+		userID := strings.TrimPrefix(r.URL.Query().Get("user_id"), "eq.")
+		writeJSON(w, http.StatusOK, []map[string]string{{"user_id": userID, "role": "member"}})
+	})
+	chat.db.handle("POST", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice", Content: "hi", CreatedAt: "2026-01-01T00:00:00Z"}})
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	bob := chat.dial(t, "bob")
+	bob.join("general")
+	carol := chat.dial(t, "carol")
+	carol.join("random")
+
+	chat.messages <- Message{Type: DBNotification, Notification: ProfileUpdatedNotification{UserID: "alice", Username: "alicia", PreviousUsername: "alice"}}
+	for name, conn := range map[string]*testConn{"alice": alice, "bob": bob} {
+		if got := conn.next("profile_updated"); got.UserID != "alice" || got.Username != "alicia" || got.PreviousUsername != "alice" {
+			t.Errorf("%s got %+v, want alice renamed to alicia", name, got)
+		}
+	}
+
+	// alice's session speaks under the new name from now on
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: "hi"})
+	if got := bob.next("message"); got.Username != "alicia" {
+		t.Errorf("got message from %q, want alicia", got.Username)
+	}
+	carol.none("profile_updated", 100*time.Millisecond)
+}
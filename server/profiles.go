@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultProfileCacheTTL bounds how stale a cached profile can get when no
+// profile_updated notification arrives (e.g. the listener isn't configured)
+const defaultProfileCacheTTL = 10 * time.Minute
+
+// profileCache remembers user ID -> profile (username and avatar) so history
+// loads only ask PostgREST for authors it hasn't seen recently. Safe for
+// concurrent use.
+type profileCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[string]cachedProfile
+}
+
+type cachedProfile struct {
+	profile profile
+	expires time.Time
+}
+
+func newProfileCache(ttl time.Duration) *profileCache {
+	return &profileCache{ttl: ttl, entries: make(map[string]cachedProfile)}
+}
+
+// Lookup splits userIDs into cached profiles and the IDs that must be fetched
+func (c *profileCache) Lookup(userIDs []string, now time.Time) (map[string]profile, []string) {
+	hits := make(map[string]profile, len(userIDs))
+	var misses []string
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, id := range userIDs {
+		if e, ok := c.entries[id]; ok && now.Before(e.expires) {
+			hits[id] = e.profile
+		} else {
+			misses = append(misses, id)
+		}
+	}
+	return hits, misses
+}
+
+// Store caches freshly fetched profiles
+func (c *profileCache) Store(profiles map[string]profile, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, p := range profiles {
+		c.entries[id] = cachedProfile{profile: p, expires: now.Add(c.ttl)}
+	}
+	// Drop expired entries opportunistically so the map doesn't grow forever
+	for id, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, id)
+		}
+	}
+}
+
+// Invalidate forgets a user's profile, e.g. after they rename themselves or
+// change their avatar
+func (c *profileCache) Invalidate(userID string) {
+	c.mu.Lock()
+	delete(c.entries, userID)
+	c.mu.Unlock()
+}
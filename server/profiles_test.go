@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// profilesByID serves GetProfiles' id=in.(...) lookups, naming each user after
+// their ID, and reports the IDs each request asked for
+func profilesByID(db *fakePostgREST) <-chan []string {
+	asked := make(chan []string, 8)
+	db.handle("GET", "/rest/v1/profiles", func(w http.ResponseWriter, r *http.Request) {
+		list := strings.TrimSuffix(strings.TrimPrefix(r.URL.Query().Get("id"), "in.("), ")")
+		var ids []string
+		var rows []map[string]string
+		for _, id := range strings.Split(list, ",") {
+			id = strings.Trim(id, `"`)
+			ids = append(ids, id)
+			rows = append(rows, map[string]string{"id": id, "username": "user-" + id})
+		}
+		asked <- ids
+		writeJSON(w, http.StatusOK, rows)
+	})
+	return asked
+}
+
+func TestGetProfilesFetchesOnlyCacheMisses(t *testing.T) {
+	db := newFakePostgREST(t)
+	asked := profilesByID(db)
+	sb := db.client(t)
+	ctx := context.Background()
+
+	if _, err := sb.GetProfiles(ctx, []string{"a", "b"}); err != nil {
+		t.Fatalf("GetProfiles: %v", err)
+	}
+	if got := <-asked; strings.Join(got, ",") != "a,b" {
+		t.Fatalf("first lookup fetched %v, want [a b]", got)
+	}
+
+	got, err := sb.GetProfiles(ctx, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("GetProfiles: %v", err)
+	}
+	if ids := <-asked; strings.Join(ids, ",") != "c" {
+		t.Fatalf("second lookup fetched %v, want only [c]", ids)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if got[id].Username != "user-"+id {
+			t.Errorf("profile %s = %+v, want username user-%s", id, got[id], id)
+		}
+	}
+
+	if _, err := sb.GetProfiles(ctx, []string{"a", "c"}); err != nil {
+		t.Fatalf("GetProfiles: %v", err)
+	}
+	select {
+	case ids := <-asked:
+		t.Fatalf("fully cached lookup fetched %v", ids)
+	default:
+	}
+
+	// A profile_updated invalidation makes the next lookup fetch it again
+	sb.profiles.Invalidate("a")
+	if _, err := sb.GetProfiles(ctx, []string{"a", "b"}); err != nil {
+		t.Fatalf("GetProfiles: %v", err)
+	}
+	if ids := <-asked; strings.Join(ids, ",") != "a" {
+		t.Fatalf("lookup after invalidation fetched %v, want only [a]", ids)
+	}
+}
+
+func TestProfileCacheExpires(t *testing.T) {
+	c := newProfileCache(time.Minute)
+	now := time.Now()
+	c.Store(map[string]profile{"a": {Username: "alice"}}, now)
+
+	if hits, misses := c.Lookup([]string{"a"}, now.Add(59*time.Second)); hits["a"].Username != "alice" || len(misses) != 0 {
+		t.Errorf("before expiry: hits %v, misses %v; want a cached", hits, misses)
+	}
+	if hits, misses := c.Lookup([]string{"a"}, now.Add(time.Minute)); len(hits) != 0 || len(misses) != 1 {
+		t.Errorf("at expiry: hits %v, misses %v; want a missed", hits, misses)
+	}
+}
+
+func TestGetProfilesByUsernameQuotesNames(t *testing.T) {
+	db := newFakePostgREST(t)
+	sb := db.client(t)
+
+	if _, err := sb.GetProfilesByUsername(context.Background(), []string{"a,b", `q"uote`, "x.y"}); err != nil {
+		t.Fatalf("GetProfilesByUsername: %v", err)
+	}
+	reqs := db.received("GET", "/rest/v1/profiles")
+	if len(reqs) != 1 {
+		t.Fatalf("got %d lookups, want 1", len(reqs))
+	}
+	if got, want := reqs[0].Query.Get("username"), `in.("a,b","q\"uote","x.y")`; got != want {
+		t.Errorf("username filter = %s, want %s", got, want)
+	}
+}
+
+func TestGetProfileRows(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   error // nil means the profile; errAny any failure
+	}{
+		{"no profile", http.StatusOK, `[]`, ErrNotFound},
+		{"one profile", http.StatusOK, `[{"username":"alice","avatar_url":"https://cdn.example.com/a.png"}]`, nil},
+		{"duplicate rows", http.StatusOK, `[{"username":"alice"},{"username":"alice2"}]`, ErrDuplicateProfile},
+		{"server error", http.StatusInternalServerError, `{"message":"down"}`, errAny},
+		{"not JSON", http.StatusOK, `<html>`, errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakePostgREST(t)
+			db.respond("GET", "/rest/v1/profiles", tt.status, tt.body)
+			p, err := db.client(t).GetProfile(context.Background(), "alice")
+			switch tt.want {
+			case nil:
+				if err != nil || p.Username != "alice" || p.AvatarURL != "https://cdn.example.com/a.png" {
+					t.Errorf("got %+v, %v; want alice's profile", p, err)
+				}
+			case errAny:
+				if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrDuplicateProfile) {
+					t.Errorf("got %+v, %v; want a plain failure", p, err)
+				}
+			default:
+				if !errors.Is(err, tt.want) || p != nil {
+					t.Errorf("got %+v, %v; want %v", p, err, tt.want)
+				}
+			}
+		})
+	}
+
+	if _, err := newFakePostgREST(t).client(t).GetProfile(context.Background(), ""); err == nil {
+		t.Error("empty user ID: got no error")
+	}
+}
+
+// errAny stands for any error in tables where nil means success
+var errAny = errors.New("any error")
+
+func TestConnectWithoutUsableProfile(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("GET", "/rest/v1/profiles", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("id") {
+		case "eq.alice":
+			writeJSON(w, http.StatusOK, []map[string]string{{"username": "alice"}})
+		case "eq.dup":
+			writeJSON(w, http.StatusOK, []map[string]string{{"username": "dup"}, {"username": "dup2"}})
+		default:
+			writeJSON(w, http.StatusOK, []any{})
+		}
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+
+	// Missing and duplicated profiles both still connect, as "unknown"
+	for _, userID := range []string{"ghost", "dup"} {
+		conn := chat.dial(t, userID)
+		conn.join("general")
+		if got := alice.next("user_joined"); got.Username != "unknown" {
+			t.Errorf("%s joined as %q, want unknown", userID, got.Username)
+		}
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	chat := startTestChat(t)
+	alice := chat.dial(t, "alice")
+	other := chat.dial(t, "alice") // A second tab
+
+	chat.db.respond("PATCH", "/rest/v1/profiles", http.StatusOK, `[{"username":"alicia"}]`)
+	alice.send(WSMessage{Type: "update_profile", Username: " alicia "})
+	for _, conn := range []*testConn{alice, other} {
+		if got := conn.next("profile_updated"); got.UserID != "alice" || got.Username != "alicia" || got.PreviousUsername != "alice" {
+			t.Errorf("got %+v, want alice renamed to alicia", got)
+		}
+	}
+	reqs := chat.db.received("PATCH", "/rest/v1/profiles")
+	if len(reqs) != 1 || reqs[0].Body != `{"username":"alicia"}` {
+		t.Fatalf("got updates %+v, want one trimmed username", reqs)
+	}
+
+	chat.db.respond("PATCH", "/rest/v1/profiles", http.StatusConflict, `{"code":"23505"}`)
+	alice.send(WSMessage{Type: "update_profile", Username: "bob"})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeUsernameTaken {
+		t.Errorf("got %+v, want username_taken", got)
+	}
+}
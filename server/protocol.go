@@ -0,0 +1,36 @@
+package main
+
+import "strconv"
+
+// Protocol versions. A client names the newest version it understands in the
+// protocol query parameter; the server speaks the lower of that and its own.
+// Clients that send nothing are treated as version 1, so frontends built
+// before negotiation keep working.
+const (
+	protocolLegacy  = 1 // History arrives as one message frame per row
+	protocolBatched = 2 // History arrives as a single history frame
+
+	serverProtocol = protocolBatched
+)
+
+// negotiateProtocol picks the version to speak with a client that asked for
+// requested (the raw query parameter)
+func negotiateProtocol(requested string) int {
+	v, err := strconv.Atoi(requested)
+	if err != nil || v < protocolLegacy {
+		return protocolLegacy
+	}
+	if v > serverProtocol {
+		return serverProtocol
+	}
+	return v
+}
+
+// protocolFeatures lists what a session on version v gets, for the hello frame
+func protocolFeatures(v int) []string {
+	features := []string{"structured_errors", "client_id"}
+	if v >= protocolBatched {
+		features = append(features, "batched_history")
+	}
+	return features
+}
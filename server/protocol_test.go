@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	tests := []struct {
+		requested string
+		want      int
+	}{
+		{"", protocolLegacy},
+		{"junk", protocolLegacy},
+		{"0", protocolLegacy},
+		{"1", protocolLegacy},
+		{"2", protocolBatched},
+		{"99", serverProtocol},
+	}
+	for _, tt := range tests {
+		if got := negotiateProtocol(tt.requested); got != tt.want {
+			t.Errorf("negotiateProtocol(%q) = %d, want %d", tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestHelloAndHistoryByProtocol(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.respond("GET", "/rest/v1/messages", http.StatusOK, `[{"id":"g1","channel_id":"general","user_id":"bob","content":"first","created_at":"2026-01-01T00:00:01Z"}]`)
+
+	// A legacy client gets version 1 and a frame per history message
+	legacy := chat.dialRaw(t, "alice", nil)
+	if got := legacy.next("hello"); got.Protocol != protocolLegacy || slices.Contains(got.Features, "batched_history") {
+		t.Errorf("legacy hello %+v, want version 1 without batched_history", got)
+	}
+	legacy.send(WSMessage{Type: "join", Channel: "general"})
+	if got := legacy.next("message"); got.ID != "g1" {
+		t.Errorf("legacy history: got %+v, want g1", got)
+	}
+
+	// Version 2 gets batched history without asking for it on join
+	v2 := chat.dialRaw(t, "bob", url.Values{"protocol": {"2"}})
+	if got := v2.next("hello"); got.Protocol != protocolBatched || !slices.Contains(got.Features, "batched_history") {
+		t.Errorf("v2 hello %+v, want version 2 with batched_history", got)
+	}
+	v2.send(WSMessage{Type: "join", Channel: "general"})
+	if got := v2.next("history"); len(got.Messages) != 1 || got.Messages[0].ID != "g1" {
+		t.Errorf("v2 history: got %+v, want g1 in one frame", got)
+	}
+}
+
+func TestJoinHistoryBatched(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.respond("GET", "/rest/v1/messages", http.StatusOK, `[
+		{"id":"g2","channel_id":"general","user_id":"carol","content":"second","created_at":"2026-01-01T00:00:02Z"},
+		{"id":"g1","channel_id":"general","user_id":"bob","content":"first","created_at":"2026-01-01T00:00:01Z"}]`)
+	alice := chat.dial(t, "alice")
+
+	alice.send(WSMessage{Type: "join", Channel: "general", Batch: true})
+	got := alice.next("history")
+	if got.Channel != "general" || len(got.Messages) != 2 || got.Messages[0].ID != "g1" || got.Messages[1].ID != "g2" {
+		t.Fatalf("got history %+v, want g1 then g2 in one frame", got)
+	}
+	if got.Messages[0].Type != "message" || got.Messages[1].Username != "carol" {
+		t.Errorf("history page %+v, want rendered message frames", got.Messages)
+	}
+	alice.next("pins_updated")
+	alice.none("message", 100*time.Millisecond)
+}
+
+// historyPage is a 200-message page of plausible chat traffic
+func historyPage() []WSMessage {
+	page := make([]WSMessage, 200)
+	for i := range page {
+		page[i] = WSMessage{
+			Type:      "message",
+			ID:        fmt.Sprintf("3f2b9c1e-0000-4000-8000-%012d", i),
+			Channel:   "general",
+			Username:  []string{"alice", "bob", "carol"}[i%3],
+			Content:   fmt.Sprintf("message %d: did everyone see the deploy notes for today?", i),
+			Timestamp: time.Date(2026, 1, 1, 12, 0, i, 0, time.UTC).Format(wireTimeFormat),
+		}
+	}
+	return page
+}
+
+// countingConn counts the bytes read from the wire
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// benchmarkHistory sends a history page over a compressed connection, as one
+// history frame or a frame per message, and reports the bytes on the wire
+func benchmarkHistory(b *testing.B, batch bool) {
+	page := historyPage()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Errorf("upgrade: %v", err)
+			return
+		}
+		conn.SetCompressionLevel(wsCompressionLevel)
+		conns <- conn
+	}))
+	defer srv.Close()
+
+	var wire atomic.Int64
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			c, err := net.Dial(network, addr)
+			return countingConn{Conn: c, n: &wire}, err
+		},
+	}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		b.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	conn := <-conns
+	defer conn.Close()
+
+	frames := len(page)
+	if batch {
+		frames = 1
+	}
+	read := make(chan error, 1)
+	go func() {
+		for i := 0; i < b.N*frames; i++ {
+			if _, _, err := client.ReadMessage(); err != nil {
+				read <- err
+				return
+			}
+		}
+		read <- nil
+	}()
+
+	wire.Store(0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batch {
+			err = conn.WriteJSON(WSMessage{Type: "history", Channel: "general", Messages: page})
+		} else {
+			for _, msg := range page {
+				if err = conn.WriteJSON(msg); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			b.Fatalf("write: %v", err)
+		}
+	}
+	if err := <-read; err != nil {
+		b.Fatalf("read: %v", err)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(wire.Load())/float64(b.N), "wire-B/op")
+}
+
+func BenchmarkHistoryBatched(b *testing.B)    { benchmarkHistory(b, true) }
+func BenchmarkHistoryPerMessage(b *testing.B) { benchmarkHistory(b, false) }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// PushPayload describes a notification for a user who has no live connection
+type PushPayload struct {
+	Type             string `json:"type"` // "dm_message", "mention"
+	Title            string `json:"title"`
+	Body             string `json:"body"`
+	SenderID         string `json:"sender_id,omitempty"`
+	SenderUsername   string `json:"sender_username,omitempty"`
+	ChannelID        string `json:"channel_id,omitempty"`
+	DMConversationID string `json:"dm_conversation_id,omitempty"`
+	MessageID        string `json:"message_id,omitempty"`
+}
+
+// PushNotifier delivers notifications to users who are offline. Deployments
+// plug in FCM/APNs/webhooks here without the server knowing the provider.
+type PushNotifier interface {
+	Notify(userID string, payload PushPayload) error
+}
+
+// noopPushNotifier is the default when no push provider is configured
+type noopPushNotifier struct{}
+
+func (noopPushNotifier) Notify(userID string, payload PushPayload) error { return nil }
+
+// webhookPushNotifier POSTs each notification as JSON to a configured URL
+type webhookPushNotifier struct {
+	url  string
+	http *http.Client
+}
+
+func NewWebhookPushNotifier(url string) PushNotifier {
+	return &webhookPushNotifier{
+		url:  url,
+		http: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (w *webhookPushNotifier) Notify(userID string, payload PushPayload) error {
+	b, err := json.Marshal(map[string]any{
+		"user_id": userID,
+		"payload": payload,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal push payload: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("push webhook failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// maxPushInFlight caps how many push deliveries run at once, each holding a
+// goroutine for up to the provider's timeout
+const maxPushInFlight = 16
+
+// pushSlots is the semaphore behind maxPushInFlight
+var pushSlots = make(chan struct{}, maxPushInFlight)
+
+// notifyOffline hands a notification to the push notifier without blocking the
+// server loop on the provider's network call. When maxPushInFlight deliveries
+// are already running, the notification is dropped with a warning rather than
+// queued behind a slow provider.
+func notifyOffline(push PushNotifier, userID string, payload PushPayload) {
+	select {
+	case pushSlots <- struct{}{}:
+	default:
+		logWarnf("dropped push notification to user %s: %d deliveries already in flight", userID, maxPushInFlight)
+		return
+	}
+	go func() {
+		defer func() { <-pushSlots }()
+		if err := push.Notify(userID, payload); err != nil {
+			logWarnf("push notification to user %s failed: %v", userID, err)
+		}
+	}()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingNotifier counts deliveries and holds each until release is closed
+type blockingNotifier struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (n *blockingNotifier) Notify(userID string, payload PushPayload) error {
+	n.calls.Add(1)
+	<-n.release
+	return nil
+}
+
+// waitFor polls cond for up to two seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNotifyOfflineBounded(t *testing.T) {
+	push := &blockingNotifier{release: make(chan struct{})}
+	for i := 0; i < maxPushInFlight+5; i++ {
+		notifyOffline(push, "bob", PushPayload{Type: "mention"})
+	}
+	waitFor(t, "the in-flight deliveries", func() bool { return push.calls.Load() == maxPushInFlight })
+
+	// The extra notifications were dropped, not queued
+	close(push.release)
+	waitFor(t, "the slots to free up", func() bool { return len(pushSlots) == 0 })
+	if got := push.calls.Load(); got != maxPushInFlight {
+		t.Errorf("got %d deliveries, want %d", got, maxPushInFlight)
+	}
+
+	// Freed slots take new notifications again
+	notifyOffline(push, "bob", PushPayload{Type: "mention"})
+	waitFor(t, "a delivery after the slots freed", func() bool { return push.calls.Load() == maxPushInFlight+1 })
+}
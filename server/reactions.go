@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// ErrEmojiNotAllowed is returned when a reaction isn't a single emoji or isn't allowlisted
+	ErrEmojiNotAllowed = errors.New("emoji not allowed")
+	// ErrReactionLimitReached is returned when a message already has the maximum distinct reactions
+	ErrReactionLimitReached = errors.New("reaction limit reached")
+)
+
+// defaultMaxDistinctReactions caps distinct emojis per message when unconfigured
+const defaultMaxDistinctReactions = 20
+
+// reactionPolicy keeps reactions from turning into a second message channel
+type reactionPolicy struct {
+	maxDistinct int             // Distinct emojis allowed per message (0 = unlimited)
+	allowed     map[string]bool // Optional allowlist; nil allows any single emoji
+}
+
+// newReactionPolicy builds a policy from a distinct-emoji cap and an optional
+// comma-separated allowlist (empty allows any single emoji)
+func newReactionPolicy(maxDistinct int, allowlist string) *reactionPolicy {
+	p := &reactionPolicy{maxDistinct: maxDistinct}
+	for _, emoji := range strings.Split(allowlist, ",") {
+		if emoji = strings.TrimSpace(emoji); emoji != "" {
+			if p.allowed == nil {
+				p.allowed = make(map[string]bool)
+			}
+			p.allowed[emoji] = true
+		}
+	}
+	return p
+}
+
+// Check validates adding emoji to a message whose current distinct reactions are existing
+func (p *reactionPolicy) Check(emoji string, existing []string) error {
+	if !isSingleGrapheme(emoji) {
+		return ErrEmojiNotAllowed
+	}
+	if p.allowed != nil && !p.allowed[emoji] {
+		return ErrEmojiNotAllowed
+	}
+	if p.maxDistinct <= 0 {
+		return nil
+	}
+	for _, e := range existing {
+		if e == emoji {
+			return nil // Joining an existing reaction never adds a new distinct emoji
+		}
+	}
+	if len(existing) >= p.maxDistinct {
+		return ErrReactionLimitReached
+	}
+	return nil
+}
+
+// isSingleGrapheme reports whether s is one user-perceived character, covering
+// the emoji sequences clients send: modifiers, variation selectors, keycaps,
+// tag sequences, ZWJ sequences and regional-indicator flag pairs
+func isSingleGrapheme(s string) bool {
+	if s == "" || !utf8.ValidString(s) {
+		return false
+	}
+
+	runes := []rune(s)
+	first := runes[0]
+	// Emoji are symbols; the exception is keycaps like "1️⃣" built on a digit, # or *
+	if !unicode.Is(unicode.So, first) && !isKeycapBase(first, runes) {
+		return false
+	}
+
+	// Flags are exactly two regional indicators
+	if isRegionalIndicator(first) {
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	}
+
+	for i := 1; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case unicode.Is(unicode.M, r), // Combining marks, incl. keycap U+20E3
+			r >= 0xFE00 && r <= 0xFE0F,   // Variation selectors
+			r >= 0x1F3FB && r <= 0x1F3FF, // Skin tone modifiers
+			r >= 0xE0020 && r <= 0xE007F: // Tag sequences (subdivision flags)
+			continue
+		case r == 0x200D: // ZWJ must join to another emoji symbol
+			if i+1 >= len(runes) || !unicode.Is(unicode.So, runes[i+1]) {
+				return false
+			}
+			i++
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isKeycapBase(first rune, runes []rune) bool {
+	if !(first >= '0' && first <= '9') && first != '#' && first != '*' {
+		return false
+	}
+	return runes[len(runes)-1] == 0x20E3
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
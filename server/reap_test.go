@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// connectUnread registers userID's session with the server loop over a
+// connection no read loop watches, so only a failed write can notice it's gone.
+// It returns the server's end and the test's.
+func connectUnread(t *testing.T, chat *testChat, userID string) (*websocket.Conn, *testConn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	conn := <-conns
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	chat.messages <- Message{Type: ClientConnected, Conn: conn, Username: userID, User: &authUser{ID: userID}, SessionID: "s1", Ctx: ctx, Cancel: cancel}
+	tc := &testConn{t: t, conn: peer}
+	tc.next("hello")
+	return conn, tc
+}
+
+func TestFailedWriteReapsClient(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.handle("POST", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice", Content: "hi", CreatedAt: "2026-01-01T00:00:00Z"}})
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+
+	conn, zed := connectUnread(t, chat, "zed")
+	chat.messages <- Message{Type: NewMessage, Text: `{"type":"join","channel":"general"}`, Conn: conn, UserID: "zed", SessionID: "s1"}
+	zed.next("user_list")
+	alice.send(WSMessage{Type: "channel_count", Channel: "general"})
+	if got := alice.next("channel_count"); onlineCount(got) != 2 {
+		t.Fatalf("got %d online, want alice and zed", onlineCount(got))
+	}
+
+	// The connection dies without the server loop hearing of it; the next
+	// broadcast's write fails and that alone has to clean zed up
+	conn.Close()
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: "hi"})
+	if got := alice.next("user_left"); got.Username != "zed" || onlineCount(got) != 1 {
+		t.Errorf("got %+v, want zed gone with 1 left online", got)
+	}
+	alice.send(WSMessage{Type: "channel_count", Channel: "general"})
+	if got := alice.next("channel_count"); onlineCount(got) != 1 {
+		t.Errorf("got %d online after the reap, want 1", onlineCount(got))
+	}
+}
+
+// onlineCount reads a frame's online_count, or -1 without one
+func onlineCount(m WSMessage) int {
+	if m.OnlineCount == nil {
+		return -1
+	}
+	return *m.OnlineCount
+}
@@ -0,0 +1,38 @@
+package main
+
+import "time"
+
+// recentBroadcastTTL is how long a broadcast message ID is remembered; the
+// new_message notification for a row this server inserted arrives well within it
+const recentBroadcastTTL = time.Minute
+
+// recentIDs remembers message IDs for a while, so a message the server has
+// already broadcast isn't sent again when its new_message notification
+// arrives. It's owned by the server loop and not safe for concurrent use.
+type recentIDs struct {
+	seen map[string]time.Time // ID -> when it was recorded
+	ttl  time.Duration
+}
+
+func newRecentIDs(ttl time.Duration) *recentIDs {
+	return &recentIDs{seen: make(map[string]time.Time), ttl: ttl}
+}
+
+// Record remembers id as of now
+func (r *recentIDs) Record(id string, now time.Time) {
+	r.seen[id] = now
+	// Drop expired entries once the map has grown, so it stays bounded
+	if len(r.seen) > 1024 {
+		for k, t := range r.seen {
+			if now.Sub(t) >= r.ttl {
+				delete(r.seen, k)
+			}
+		}
+	}
+}
+
+// Seen reports whether id was recorded within the last ttl
+func (r *recentIDs) Seen(id string, now time.Time) bool {
+	t, ok := r.seen[id]
+	return ok && now.Sub(t) < r.ttl
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// defaultRetentionInterval is how often expired messages are purged when unconfigured
+const defaultRetentionInterval = time.Hour
+
+// runRetention purges messages past their channel's retention window now and
+// then every interval, until ctx is cancelled
+func runRetention(ctx context.Context, sb *SupabaseClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purgeExpiredMessages(ctx, sb, time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// purgeExpiredMessages runs one retention pass over every channel with a
+// retention window. A failing channel is logged and skipped.
+func purgeExpiredMessages(ctx context.Context, sb *SupabaseClient, now time.Time) {
+	settings, err := sb.GetChannelSettings(ctx)
+	if err != nil {
+		logWarnf("retention: failed to load channel settings: %v", err)
+		return
+	}
+	for _, cs := range settings {
+		if cs.RetentionDays == nil || *cs.RetentionDays <= 0 {
+			continue
+		}
+		cutoff := now.AddDate(0, 0, -*cs.RetentionDays)
+		removed, err := sb.DeleteMessagesOlderThan(ctx, cs.ChannelID, cutoff)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logWarnf("retention: failed to purge channel %s: %v", cs.ChannelID, err)
+			continue
+		}
+		logInfof("retention: removed %d message(s) older than %s from channel %s", removed, cutoff.UTC().Format(time.RFC3339), cs.ChannelID)
+	}
+}
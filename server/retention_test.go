@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPurgeExpiredMessages(t *testing.T) {
+	db := newFakePostgREST(t)
+	db.respond("GET", "/rest/v1/channel_settings", http.StatusOK,
+		`[{"channel_id":"general","retention_days":30},{"channel_id":"forever","retention_days":null},{"channel_id":"off","retention_days":0},{"channel_id":"news","retention_days":7}]`)
+	db.handle("GET", "/rest/v1/pinned_messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("channel_id") != "eq.general" {
+			writeJSON(w, http.StatusOK, []map[string]string{})
+			return
+		}
+		writeJSON(w, http.StatusOK, []map[string]string{{"message_id": "p1"}, {"message_id": "p2"}})
+	})
+	db.respond("DELETE", "/rest/v1/messages", http.StatusOK, `[{"id":"m1"}]`)
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	purgeExpiredMessages(context.Background(), db.client(t), now)
+
+	want := map[string]struct{ cutoff, notIn string }{
+		"eq.general": {cutoff: "lt.2026-03-01T12:00:00Z", notIn: `not.in.("p1","p2")`},
+		"eq.news":    {cutoff: "lt.2026-03-24T12:00:00Z"},
+	}
+	deletes := db.received("DELETE", "/rest/v1/messages")
+	if len(deletes) != len(want) {
+		t.Fatalf("got %d deletes, want one each for general and news", len(deletes))
+	}
+	for _, req := range deletes {
+		channel := req.Query.Get("channel_id")
+		w, ok := want[channel]
+		if !ok {
+			t.Errorf("delete for %q, which has no retention window", channel)
+			continue
+		}
+		if got := req.Query.Get("created_at"); got != w.cutoff {
+			t.Errorf("%s: created_at=%q, want %q", channel, got, w.cutoff)
+		}
+		if got := req.Query.Get("id"); got != w.notIn {
+			t.Errorf("%s: id=%q, want %q", channel, got, w.notIn)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryPolicy bounds how hard a Supabase write is retried
+type retryPolicy struct {
+	maxAttempts int           // Total tries, including the first
+	maxElapsed  time.Duration // Give up rather than sleep past this much total time
+	base        time.Duration // Backoff ceiling for the first retry
+	max         time.Duration // Backoff ceiling never grows beyond this
+}
+
+var defaultRetryPolicy = retryPolicy{
+	maxAttempts: 3,
+	maxElapsed:  5 * time.Second,
+	base:        200 * time.Millisecond,
+	max:         2 * time.Second,
+}
+
+// backoff returns a "full jitter" delay for the given retry attempt: uniform
+// in [0, min(max, base*2^attempt)), so clients retrying together spread out
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.max
+	if attempt < 30 {
+		if d := p.base << attempt; d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// retryableStatus reports whether a response is worth retrying: server-side
+// failures and rate limiting may be transient, other client errors won't
+// change on a second try
+func retryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// RateLimitedError reports that Supabase throttled a request (HTTP 429).
+// It matches ErrRateLimited with errors.Is.
+type RateLimitedError struct {
+	RetryAfter time.Duration // Server's Retry-After hint; 0 if it gave none
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%v; retry after %s", ErrRateLimited, e.RetryAfter)
+	}
+	return ErrRateLimited.Error()
+}
+
+func (e *RateLimitedError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// retryAfter parses a Retry-After header given either as delay seconds or an
+// HTTP date. Returns 0 when the header is absent or unparseable.
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// doWithRetry sends the request built by newReq, retrying network errors and
+// retryable statuses under s.retry. A server's Retry-After replaces the
+// jittered backoff when present. The body is read and the response closed;
+// a non-retryable response is returned as-is for the caller to interpret.
+// Retries that would overrun the time budget are skipped; if the last
+// response was a 429 the result is a *RateLimitedError.
+func (s *SupabaseClient) doWithRetry(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, []byte, error) {
+	start := time.Now()
+	var lastErr error
+	var wait time.Duration // Server-requested delay from the last response
+	var throttled bool     // Last response was a 429
+	for attempt := 0; attempt < s.retry.maxAttempts; attempt++ {
+		if attempt > 0 {
+			d := wait
+			if d == 0 {
+				d = s.retry.backoff(attempt - 1)
+			}
+			if time.Since(start)+d > s.retry.maxElapsed {
+				break
+			}
+			if err := sleepCtx(ctx, d); err != nil {
+				return nil, nil, err
+			}
+			wait = 0
+		}
+
+		throttled = false
+		req, err := newReq()
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := s.http.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !retryableStatus(resp.StatusCode) {
+			return resp, body, nil
+		}
+		wait = retryAfter(resp.Header)
+		throttled = resp.StatusCode == http.StatusTooManyRequests
+		lastErr = fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	if throttled {
+		return nil, nil, &RateLimitedError{RetryAfter: wait}
+	}
+	return nil, nil, fmt.Errorf("giving up after retries: %w", lastErr)
+}
+
+// sleepCtx waits for d, returning early with ctx's error if it's cancelled first
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respondInTurn answers successive requests to method and path with the given
+// statuses, repeating the last one; 201s carry an inserted message row
+func respondInTurn(db *fakePostgREST, method, path string, header http.Header, statuses ...int) {
+	var mu sync.Mutex
+	db.handle(method, path, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		mu.Unlock()
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		if status == http.StatusCreated {
+			writeJSON(w, status, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice"}})
+			return
+		}
+		writeJSON(w, status, map[string]string{"message": http.StatusText(status)})
+	})
+}
+
+func TestInsertMessageRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantErr   bool
+		wantTries int
+	}{
+		{"created", []int{201}, false, 1},
+		{"bad request is not retried", []int{400}, true, 1},
+		{"unprocessable is not retried", []int{422}, true, 1},
+		{"unavailable then created", []int{503, 201}, false, 2},
+		{"rate limited then created", []int{429, 201}, false, 2},
+		{"unavailable every time", []int{503}, true, defaultRetryPolicy.maxAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakePostgREST(t)
+			respondInTurn(db, "POST", "/rest/v1/messages", nil, tt.statuses...)
+			sb := db.client(t)
+
+			msg, _, err := sb.InsertMessage(context.Background(), "general", "alice", "hi", nil, "", messageOrigin{}, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InsertMessage: got error %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && msg.ID != "m1" {
+				t.Errorf("got message %+v, want m1", msg)
+			}
+			if n := len(db.received("POST", "/rest/v1/messages")); n != tt.wantTries {
+				t.Errorf("got %d attempts, want %d", n, tt.wantTries)
+			}
+		})
+	}
+}
+
+func TestInsertMessageHonorsRetryAfter(t *testing.T) {
+	db := newFakePostgREST(t)
+	respondInTurn(db, "POST", "/rest/v1/messages", http.Header{"Retry-After": {"30"}}, 429)
+	sb := db.client(t)
+	sb.SetRetryPolicy(3, time.Second)
+
+	// Waiting 30s would overrun the 1s budget, so it gives up without retrying
+	_, _, err := sb.InsertMessage(context.Background(), "general", "alice", "hi", nil, "", messageOrigin{}, "")
+	var rl *RateLimitedError
+	if !errors.As(err, &rl) || rl.RetryAfter != 30*time.Second || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("got %v, want a RateLimitedError asking for 30s", err)
+	}
+	if n := len(db.received("POST", "/rest/v1/messages")); n != 1 {
+		t.Errorf("got %d attempts, want 1", n)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"-3", 0},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.header != "" {
+			h.Set("Retry-After", tt.header)
+		}
+		if got := retryAfter(h); got != tt.want {
+			t.Errorf("retryAfter(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+
+	// An HTTP date in the future counts down to it
+	h := http.Header{"Retry-After": {time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}}
+	if got := retryAfter(h); got <= 50*time.Second || got > time.Minute {
+		t.Errorf("retryAfter for a date a minute out = %s, want about a minute", got)
+	}
+}
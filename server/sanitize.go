@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// sanitizeContent makes client text safe to store, log and render: ANSI escape
+// sequences and control characters (other than newline) are removed, as are
+// invisible characters that can hide or reorder text, and the result is
+// normalized to NFC. Zero-width joiners stay since emoji sequences need them.
+func sanitizeContent(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\x1b':
+			// Skip a CSI sequence (ESC [ params final) whole, not just the ESC
+			if i+1 < len(runes) && runes[i+1] == '[' {
+				i += 2
+				for i < len(runes) && (runes[i] < 0x40 || runes[i] > 0x7E) {
+					i++
+				}
+			}
+		case r == '\n':
+			b.WriteRune(r)
+		case unicode.IsControl(r), isInvisibleFormat(r):
+			// Dropped
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return norm.NFC.String(b.String())
+}
+
+// isInvisibleFormat matches zero-width spaces and bidi overrides that can make
+// displayed text differ from what was sent
+func isInvisibleFormat(r rune) bool {
+	switch {
+	case r == 0x200B, r == 0x2060, r == 0xFEFF: // Zero-width space, word joiner, BOM
+		return true
+	case r >= 0x202A && r <= 0x202E, r >= 0x2066 && r <= 0x2069: // Bidi embeddings/overrides/isolates
+		return true
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestSanitizeContent(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain text", "hello, world", "hello, world"},
+		{"newlines kept", "line one\nline two", "line one\nline two"},
+		{"ANSI color", "\x1b[31mred\x1b[0m text", "red text"},
+		{"ANSI cursor movement", "a\x1b[2Jb\x1b[1;1Hc", "abc"},
+		{"lone ESC", "a\x1bb", "ab"},
+		{"unterminated CSI", "a\x1b[31", "a"},
+		{"NUL bytes", "nul\x00 in\x00side", "nul inside"},
+		{"other control characters", "tab\there\rbell\a", "tabherebell"},
+		{"C1 control", "a\u0085b", "ab"},
+		{"zero-width space", "pay\u200bpal", "paypal"},
+		{"bidi override", "abc\u202etxt.exe", "abctxt.exe"},
+		{"zero-width joiner kept", "\U0001F469\u200d\U0001F4BB", "\U0001F469\u200d\U0001F4BB"},
+		{"decomposed to NFC", "e\u0301", "\u00e9"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeContent(tt.in); got != tt.want {
+				t.Errorf("sanitizeContent(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
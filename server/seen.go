@@ -0,0 +1,85 @@
+package main
+
+import "time"
+
+// seenFlushDelay is how long a channel's seen receipts gather before the new
+// counts are broadcast, so a burst of readers costs the channel one frame
+const seenFlushDelay = 2 * time.Second
+
+// seenCacheTTL is how long a channel's read_receipts setting is trusted before
+// it's re-read, so changes made through another server instance take effect
+const seenCacheTTL = time.Minute
+
+// maxSeenBatch caps the receipts one channel's batch holds; more arriving
+// before the flush are dropped (clients re-send them as they scroll)
+const maxSeenBatch = 1000
+
+// seenReceipts remembers which channels have read receipts on and batches the
+// receipts that arrived since the last flush, which are then written and
+// counted in one go off the server loop. It's owned by the server loop and not
+// safe for concurrent use.
+type seenReceipts struct {
+	enabled map[string]cachedFlag                 // Channel ID -> read_receipts setting
+	pending map[string]map[string]map[string]bool // Channel ID -> message ID -> readers' user IDs
+	size    map[string]int                        // Channel ID -> receipts pending
+	ttl     time.Duration
+}
+
+type cachedFlag struct {
+	on      bool
+	fetched time.Time
+}
+
+func newSeenReceipts(ttl time.Duration) *seenReceipts {
+	return &seenReceipts{
+		enabled: make(map[string]cachedFlag),
+		pending: make(map[string]map[string]map[string]bool),
+		size:    make(map[string]int),
+		ttl:     ttl,
+	}
+}
+
+// Enabled returns the cached read_receipts setting for channelID and whether it's still fresh
+func (r *seenReceipts) Enabled(channelID string, now time.Time) (bool, bool) {
+	f, ok := r.enabled[channelID]
+	return f.on, ok && now.Sub(f.fetched) < r.ttl
+}
+
+// SetEnabled caches channelID's read_receipts setting as of now
+func (r *seenReceipts) SetEnabled(channelID string, on bool, now time.Time) {
+	r.enabled[channelID] = cachedFlag{on: on, fetched: now}
+}
+
+// Add queues userID's receipt for messageID in channelID's next flush. It
+// reports whether this started a new batch, in which case the caller
+// schedules the flush.
+func (r *seenReceipts) Add(channelID, messageID, userID string) bool {
+	batch, ok := r.pending[channelID]
+	if !ok {
+		batch = make(map[string]map[string]bool)
+		r.pending[channelID] = batch
+	}
+	if r.size[channelID] >= maxSeenBatch || batch[messageID][userID] {
+		return !ok
+	}
+	if batch[messageID] == nil {
+		batch[messageID] = make(map[string]bool)
+	}
+	batch[messageID][userID] = true
+	r.size[channelID]++
+	return !ok
+}
+
+// Take ends channelID's batch and returns its receipts: message ID -> readers
+func (r *seenReceipts) Take(channelID string) map[string][]string {
+	batch := r.pending[channelID]
+	delete(r.pending, channelID)
+	delete(r.size, channelID)
+	receipts := make(map[string][]string, len(batch))
+	for messageID, users := range batch {
+		for userID := range users {
+			receipts[messageID] = append(receipts[messageID], userID)
+		}
+	}
+	return receipts
+}
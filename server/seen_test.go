@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeenReceiptsBatch(t *testing.T) {
+	r := newSeenReceipts(time.Minute)
+
+	if !r.Add("general", "m1", "alice") {
+		t.Error("first receipt didn't start a batch")
+	}
+	for _, rc := range [][2]string{{"m1", "alice"}, {"m1", "bob"}, {"m2", "alice"}} {
+		if r.Add("general", rc[0], rc[1]) {
+			t.Errorf("receipt %v started a second batch", rc)
+		}
+	}
+	if !r.Add("random", "m9", "alice") {
+		t.Error("another channel's first receipt didn't start its own batch")
+	}
+
+	got := r.Take("general")
+	for _, users := range got {
+		sort.Strings(users)
+	}
+	want := map[string][]string{"m1": {"alice", "bob"}, "m2": {"alice"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Take = %v, want %v (duplicates dropped)", got, want)
+	}
+	if got := r.Take("general"); len(got) != 0 {
+		t.Errorf("second Take = %v, want nothing", got)
+	}
+	if !r.Add("general", "m3", "alice") {
+		t.Error("receipt after a flush didn't start a new batch")
+	}
+	if got := r.Take("random"); !reflect.DeepEqual(got, map[string][]string{"m9": {"alice"}}) {
+		t.Errorf("Take(random) = %v, want only its own receipt", got)
+	}
+}
+
+func TestSeenReceiptsBatchCap(t *testing.T) {
+	r := newSeenReceipts(time.Minute)
+	for i := 0; i < maxSeenBatch+10; i++ {
+		r.Add("general", fmt.Sprintf("m%d", i), "alice")
+	}
+	if got := len(r.Take("general")); got != maxSeenBatch {
+		t.Errorf("batch held %d receipts, want the cap of %d", got, maxSeenBatch)
+	}
+}
+
+func TestSeenReceiptsEnabled(t *testing.T) {
+	r := newSeenReceipts(time.Minute)
+	now := time.Now()
+	if on, fresh := r.Enabled("general", now); on || fresh {
+		t.Errorf("unknown channel: on %t, fresh %t; want neither", on, fresh)
+	}
+	r.SetEnabled("general", true, now)
+	if on, fresh := r.Enabled("general", now.Add(59*time.Second)); !on || !fresh {
+		t.Errorf("before the TTL: on %t, fresh %t; want both", on, fresh)
+	}
+	// A stale setting is still returned, for use if the re-read fails
+	if on, fresh := r.Enabled("general", now.Add(time.Minute)); !on || fresh {
+		t.Errorf("at the TTL: on %t, fresh %t; want on and stale", on, fresh)
+	}
+}
+
+func TestMarkChannelMessagesSeen(t *testing.T) {
+	db := newFakePostgREST(t)
+	// m3 isn't in general, so the channel-scoped lookup doesn't return it
+	db.respond("GET", "/rest/v1/messages", http.StatusOK, `[{"id":"m1","user_id":"alice"},{"id":"m2","user_id":"bob"}]`)
+	db.respond("POST", "/rest/v1/message_seen", http.StatusCreated, "")
+	sb := db.client(t)
+
+	receipts := map[string][]string{"m1": {"alice", "bob"}, "m2": {"alice"}, "m3": {"bob"}}
+	counted, err := sb.MarkChannelMessagesSeen(context.Background(), "general", receipts)
+	if err != nil {
+		t.Fatalf("MarkChannelMessagesSeen: %v", err)
+	}
+	sort.Strings(counted)
+	if !reflect.DeepEqual(counted, []string{"m1", "m2"}) {
+		t.Errorf("counted %v, want [m1 m2]", counted)
+	}
+	if q := db.received("GET", "/rest/v1/messages")[0].Query; q.Get("channel_id") != "eq.general" {
+		t.Errorf("lookup query %v, want it scoped to general", q)
+	}
+
+	posts := db.received("POST", "/rest/v1/message_seen")
+	if len(posts) != 1 {
+		t.Fatalf("got %d inserts, want one batch", len(posts))
+	}
+	var rows []map[string]string
+	if err := json.Unmarshal([]byte(posts[0].Body), &rows); err != nil {
+		t.Fatalf("insert body %s: %v", posts[0].Body, err)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i]["message_id"] < rows[j]["message_id"] })
+	want := []map[string]string{{"message_id": "m1", "user_id": "bob"}, {"message_id": "m2", "user_id": "alice"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("inserted %v, want %v (authors' own receipts skipped)", rows, want)
+	}
+	if got := posts[0].Header.Get("Prefer"); got != "return=minimal,resolution=ignore-duplicates" {
+		t.Errorf("Prefer = %q, want duplicates ignored", got)
+	}
+
+	// Only an author's own receipt: nothing to write, but the messages found still count
+	counted, err = sb.MarkChannelMessagesSeen(context.Background(), "general", map[string][]string{"m1": {"alice"}})
+	if err != nil || len(counted) != 2 {
+		t.Errorf("got %v, %v; want both messages counted", counted, err)
+	}
+	if n := len(db.received("POST", "/rest/v1/message_seen")); n != 1 {
+		t.Errorf("got %d inserts, want no new one", n)
+	}
+}
+
+func TestGetSeenCounts(t *testing.T) {
+	db := newFakePostgREST(t)
+	db.respond("POST", "/rest/v1/rpc/message_seen_counts", http.StatusOK, `[{"message_id":"m1","seen":1500}]`)
+	sb := db.client(t)
+
+	counts, err := sb.GetSeenCounts(context.Background(), []string{"m1", "m2"})
+	if err != nil {
+		t.Fatalf("GetSeenCounts: %v", err)
+	}
+	// The database did the counting; m2 has no receipts and so no row
+	if want := map[string]int{"m1": 1500, "m2": 0}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got %v, want %v", counts, want)
+	}
+	calls := db.received("POST", "/rest/v1/rpc/message_seen_counts")
+	if len(calls) != 1 {
+		t.Fatalf("got %d count calls, want 1", len(calls))
+	}
+	var args struct {
+		MessageIDs []string `json:"message_ids"`
+	}
+	if err := json.Unmarshal([]byte(calls[0].Body), &args); err != nil || !reflect.DeepEqual(args.MessageIDs, []string{"m1", "m2"}) {
+		t.Errorf("called with %s, want message_ids m1 and m2", calls[0].Body)
+	}
+	if n := len(db.received("GET", "/rest/v1/message_seen")); n != 0 {
+		t.Errorf("fetched receipt rows %d time(s), want none", n)
+	}
+}
+
+func TestMarkChannelMessagesSeenChunksLookups(t *testing.T) {
+	db := newFakePostgREST(t)
+	db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []map[string]string{}) // Nothing found; only the lookups matter
+	})
+	sb := db.client(t)
+
+	receipts := make(map[string][]string)
+	for i := 0; i < maxSeenBatch; i++ {
+		receipts[fmt.Sprintf("m%d", i)] = []string{"alice"}
+	}
+	if _, err := sb.MarkChannelMessagesSeen(context.Background(), "general", receipts); err != nil {
+		t.Fatalf("MarkChannelMessagesSeen: %v", err)
+	}
+	lookups := db.received("GET", "/rest/v1/messages")
+	if want := maxSeenBatch / maxSeenLookupIDs; len(lookups) != want {
+		t.Fatalf("got %d lookups, want %d", len(lookups), want)
+	}
+	seen := make(map[string]bool)
+	for _, req := range lookups {
+		ids := strings.Split(strings.Trim(strings.TrimPrefix(req.Query.Get("id"), "in."), "()"), ",")
+		if len(ids) > maxSeenLookupIDs {
+			t.Errorf("lookup carried %d IDs, want at most %d", len(ids), maxSeenLookupIDs)
+		}
+		for _, id := range ids {
+			seen[strings.Trim(id, `"`)] = true
+		}
+	}
+	if len(seen) != maxSeenBatch {
+		t.Errorf("looked up %d distinct IDs, want all %d", len(seen), maxSeenBatch)
+	}
+}
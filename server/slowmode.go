@@ -0,0 +1,73 @@
+package main
+
+import "time"
+
+// maxSlowModeSeconds caps the cooldown a moderator can set (6 hours)
+const maxSlowModeSeconds = 6 * 60 * 60
+
+// slowModeCacheTTL is how long a channel's cooldown is trusted before it's
+// re-read, so changes made through another server instance take effect
+const slowModeCacheTTL = time.Minute
+
+// slowMode enforces per-channel posting cooldowns. It's owned by the server
+// loop and not safe for concurrent use.
+type slowMode struct {
+	cooldowns map[string]cachedCooldown       // Channel ID -> cooldown
+	lastPost  map[string]map[string]time.Time // User ID -> channel ID -> last post
+	ttl       time.Duration
+}
+
+type cachedCooldown struct {
+	d       time.Duration
+	fetched time.Time
+}
+
+func newSlowMode(ttl time.Duration) *slowMode {
+	return &slowMode{
+		cooldowns: make(map[string]cachedCooldown),
+		lastPost:  make(map[string]map[string]time.Time),
+		ttl:       ttl,
+	}
+}
+
+// Cooldown returns the cached cooldown for channelID and whether it's still fresh
+func (m *slowMode) Cooldown(channelID string, now time.Time) (time.Duration, bool) {
+	c, ok := m.cooldowns[channelID]
+	return c.d, ok && now.Sub(c.fetched) < m.ttl
+}
+
+// SetCooldown caches channelID's cooldown as of now
+func (m *slowMode) SetCooldown(channelID string, d time.Duration, now time.Time) {
+	m.cooldowns[channelID] = cachedCooldown{d: d, fetched: now}
+}
+
+// Remaining reports how long userID must still wait to post in channelID
+func (m *slowMode) Remaining(channelID, userID string, cooldown time.Duration, now time.Time) time.Duration {
+	last, ok := m.lastPost[userID][channelID]
+	if !ok || cooldown <= 0 {
+		return 0
+	}
+	if wait := cooldown - now.Sub(last); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Record notes that userID posted in channelID at now
+func (m *slowMode) Record(channelID, userID string, now time.Time) {
+	if m.lastPost[userID] == nil {
+		m.lastPost[userID] = make(map[string]time.Time)
+	}
+	m.lastPost[userID][channelID] = now
+}
+
+// Forget drops userID's post times, e.g. once their last session disconnects
+func (m *slowMode) Forget(userID string) {
+	delete(m.lastPost, userID)
+}
+
+// retryAfterSeconds is wait in whole seconds, rounded up so a client that
+// honours it never retries early
+func retryAfterSeconds(wait time.Duration) int {
+	return int((wait + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSlowModeRemaining(t *testing.T) {
+	m := newSlowMode(time.Minute)
+	now := time.Now()
+	cooldown := 10 * time.Second
+
+	if got := m.Remaining("general", "alice", cooldown, now); got != 0 {
+		t.Errorf("before any post: got %v, want 0", got)
+	}
+	m.Record("general", "alice", now)
+
+	tests := []struct {
+		name     string
+		channel  string
+		cooldown time.Duration
+		at       time.Duration // Since the post
+		want     time.Duration
+	}{
+		{name: "right after", channel: "general", cooldown: cooldown, want: cooldown},
+		{name: "just inside", channel: "general", cooldown: cooldown, at: cooldown - time.Nanosecond, want: time.Nanosecond},
+		{name: "exactly elapsed", channel: "general", cooldown: cooldown, at: cooldown},
+		{name: "long after", channel: "general", cooldown: cooldown, at: time.Hour},
+		{name: "slow mode off", channel: "general", at: time.Second},
+		{name: "other channel", channel: "random", cooldown: cooldown, at: time.Second},
+	}
+	for _, tt := range tests {
+		if got := m.Remaining(tt.channel, "alice", tt.cooldown, now.Add(tt.at)); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want int
+	}{
+		{time.Nanosecond, 1},
+		{time.Second, 1},
+		{time.Second + time.Nanosecond, 2},
+		{29*time.Second + 500*time.Millisecond, 30},
+	}
+	for _, tt := range tests {
+		if got := retryAfterSeconds(tt.wait); got != tt.want {
+			t.Errorf("retryAfterSeconds(%v) = %d, want %d", tt.wait, got, tt.want)
+		}
+	}
+}
+
+func TestSetSlowModeModeratorsOnly(t *testing.T) {
+	chat := startTestChat(t)
+	channelRoles(chat.db, map[string]string{"mod": "owner"})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+	mod := chat.dial(t, "mod")
+	mod.join("general")
+
+	seconds := 30
+	alice.send(WSMessage{Type: "set_slow_mode", Channel: "general", SlowModeSeconds: &seconds})
+	if got := alice.next("error"); got.Error == nil || got.Error.Code != ErrCodeNotAuthorized {
+		t.Fatalf("got %+v, want not_authorized", got)
+	}
+	if n := len(chat.db.received("POST", "/rest/v1/channel_settings")); n != 0 {
+		t.Fatalf("got %d settings writes from a member, want none", n)
+	}
+
+	mod.send(WSMessage{Type: "set_slow_mode", Channel: "general", SlowModeSeconds: &seconds})
+	if got := alice.next("slow_mode_updated"); got.SlowModeSeconds == nil || *got.SlowModeSeconds != seconds {
+		t.Errorf("got %+v, want slow mode set to %ds", got, seconds)
+	}
+}
+
+func TestSlowModeRejectsInsideWindow(t *testing.T) {
+	chat := startTestChat(t)
+	chat.db.respond("GET", "/rest/v1/channel_settings", http.StatusOK, `[{"channel_id":"general","slow_mode_seconds":30}]`)
+	chat.db.handle("POST", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusCreated, []dbMessage{{ID: "m1", ChannelID: "general", UserID: "alice", Content: "first", CreatedAt: "2026-01-01T00:00:00Z"}})
+	})
+	alice := chat.dial(t, "alice")
+	alice.join("general")
+
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: "first", ClientID: "c1"})
+	if got := alice.next("ack"); got.ClientID != "c1" {
+		t.Fatalf("got ack %+v, want c1", got)
+	}
+	alice.send(WSMessage{Type: "message", Channel: "general", Content: "second", ClientID: "c2"})
+	got := alice.next("error")
+	if got.Error == nil || got.Error.Code != ErrCodeSlowMode || got.ClientID != "c2" {
+		t.Fatalf("got %+v, want slow_mode for c2", got)
+	}
+	if got.RetryAfter != 30 {
+		t.Errorf("got retry_after %d, want 30", got.RetryAfter)
+	}
+	if n := len(chat.db.received("POST", "/rest/v1/messages")); n != 1 {
+		t.Errorf("got %d inserts, want only the first message", n)
+	}
+}
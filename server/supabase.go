@@ -2,22 +2,71 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lib/pq"
 )
 
+var (
+	// ErrNotFound is returned when a requested row does not exist (or is not visible)
+	ErrNotFound = errors.New("not found")
+	// ErrNotAuthorized is returned when a write matched no rows owned by the caller
+	ErrNotAuthorized = errors.New("not authorized")
+	// ErrInvalidAttachment is returned for an unknown DM message type or a missing/bad file URL
+	ErrInvalidAttachment = errors.New("invalid attachment")
+	// ErrEditWindowExpired is returned when editing a message older than the edit window
+	ErrEditWindowExpired = errors.New("edit window expired")
+	// ErrRateLimited is matched by the *RateLimitedError returned when Supabase answers 429
+	ErrRateLimited = errors.New("rate limited by supabase")
+	// ErrInvalidToken is returned when Supabase rejects an access token as expired or revoked
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrDuplicateProfile is returned when one user ID matches several profile rows
+	ErrDuplicateProfile = errors.New("duplicate profile rows")
+	// ErrUsernameTaken is returned when a username change collides with another user's
+	ErrUsernameTaken = errors.New("username taken")
+	// ErrInvalidUsername is returned when a username fails the profiles table's checks
+	ErrInvalidUsername = errors.New("invalid username")
+)
+
+// messageColumns is the column list selected for channel messages
+const messageColumns = "id,channel_id,user_id,content,reply_to,edited,edited_at,deleted,system,created_at"
+
 type SupabaseClient struct {
-	url       string
-	key       string
-	http      *http.Client
-	listener  *pq.Listener
-	dbConnStr string
+	url        string
+	key        string
+	http       *http.Client
+	listener   pgListener
+	dbConnStr  string
+	reactions  *reactionPolicy
+	profiles   *profileCache
+	retry      retryPolicy
+	editWindow time.Duration // How long after posting a message may be edited; 0 is forever
+	userScoped bool          // Send users' own message reads and writes with their token so RLS applies
+
+	dialListener      func(connStr string, eventCallback pq.EventCallbackType) pgListener // Swappable for a fake in tests
+	listenerMu        sync.Mutex // Guards listener and listenerClosed across reconnects
+	listenerClosed    bool
+	listenerConnected atomic.Bool
+	onListenerState   func(connected bool)
+
+	// Optional read replica for read-only queries (history, profiles, DMs).
+	// Replicas lag the primary, so a row written moments ago may not be
+	// visible yet; callers needing read-after-write must use the primary.
+	readURL string
+	readKey string
 }
 
 type FriendRequestNotification struct {
@@ -32,6 +81,21 @@ type FriendRequestAcceptedNotification struct {
 	NotificationID     string `json:"notification_id"`
 }
 
+// NewMessageNotification announces a channel message row inserted by anyone,
+// this server included; the row itself has to be fetched
+type NewMessageNotification struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+}
+
+// ProfileUpdatedNotification announces a changed username or avatar
+type ProfileUpdatedNotification struct {
+	UserID           string `json:"user_id"`
+	Username         string `json:"username"`
+	PreviousUsername string `json:"previous_username"`
+	AvatarURL        string `json:"avatar_url"` // Null (so empty) when the avatar was removed
+}
+
 type dbMessage struct {
 	ID        string  `json:"id"`
 	ChannelID string  `json:"channel_id"`
@@ -40,6 +104,8 @@ type dbMessage struct {
 	ReplyTo   *string `json:"reply_to"`
 	Edited    bool    `json:"edited"`
 	EditedAt  *string `json:"edited_at"`
+	Deleted   bool    `json:"deleted"` // Soft-deleted tombstone; content is blank
+	System    bool    `json:"system"`  // Moderator notice posted with system_message
 	CreatedAt string  `json:"created_at"`
 }
 
@@ -55,22 +121,60 @@ type dmMessage struct {
 	EditedAt         *string `json:"edited_at"`
 	ReadByRecipient  bool    `json:"read_by_recipient"`
 	ReadAt           *string `json:"read_at"`
+	Deleted          bool    `json:"deleted"` // Tombstone left by DeleteDMMessage
 	CreatedAt        string  `json:"created_at"`
 }
 
-// type dmConversation struct {
-// 	DMID                   string `json:"dm_id"`
-// 	User1ID                string `json:"user1_id"`
-// 	User2ID                string `json:"user2_id"`
-// 	LastMessageContent     *string `json:"last_message_content"`
-// 	LastMessageSenderID    *string `json:"last_message_sender_id"`
-// 	LastMessageReadByRecipient *bool `json:"last_message_read_by_recipient"`
-// 	LastMessageAt          string  `json:"last_message_at"`
-// 	CreatedAt              string  `json:"created_at"`
-// }
+// dmConversation is one row of get_user_dm_conversations: a DM thread seen
+// from the calling user, with the other participant already resolved
+type dmConversation struct {
+	DMID                       string  `json:"dm_id"`
+	OtherUserID                string  `json:"other_user_id"`
+	OtherUserUsername          string  `json:"other_user_username"`
+	OtherUserDisplayName       *string `json:"other_user_display_name"`
+	OtherUserAvatarURL         *string `json:"other_user_avatar_url"`
+	OtherUserIsOnline          bool    `json:"other_user_is_online"`
+	LastMessageContent         *string `json:"last_message_content"`
+	LastMessageSenderID        *string `json:"last_message_sender_id"`
+	LastMessageReadByRecipient *bool   `json:"last_message_read_by_recipient"`
+	LastMessageAt              *string `json:"last_message_at"`
+	UnreadCount                int     `json:"unread_count"`
+}
+
+// channelInfo is a channel's metadata, sent to clients on join
+type channelInfo struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Description *string `json:"description"` // The channel's topic; nil when unset
+	IsPrivate   bool    `json:"is_private"`
+	CreatedAt   string  `json:"created_at"`
+}
+
+// userChannel is one channel in a user's channel list
+type userChannel struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	LastActivity string `json:"last_activity,omitempty"` // When the newest message was posted; empty if there's none
+}
+
+// messageOrigin is where a channel message was sent from, stored in
+// message_audit for abuse investigation. It's never sent to clients.
+type messageOrigin struct {
+	IP        string
+	UserAgent string
+}
+
+// channelSettings is one row of channel_settings
+type channelSettings struct {
+	ChannelID       string `json:"channel_id"`
+	RetentionDays   *int   `json:"retention_days"`    // nil keeps messages forever
+	SlowModeSeconds int    `json:"slow_mode_seconds"` // Minimum gap between a user's posts; 0 is off
+	ReadReceipts    bool   `json:"read_receipts"`     // Record and broadcast who has seen each message
+}
 
 type profile struct {
-	Username string `json:"username"`
+	Username  string `json:"username"`
+	AvatarURL string `json:"avatar_url"` // Empty when the user hasn't uploaded one (the column is null)
 }
 
 type authUser struct {
@@ -82,58 +186,339 @@ type validateTokenResponse struct {
 	User authUser `json:"user"`
 }
 
-func NewSupabaseClient(url, key string) *SupabaseClient {
+// SupabaseOptions tunes the HTTP client used for Supabase calls. Zero fields
+// take the defaults in DefaultSupabaseOptions.
+type SupabaseOptions struct {
+	Timeout         time.Duration // Whole-request timeout, including reading the body
+	MaxIdleConns    int           // Keep-alive connections kept open for reuse
+	MaxConnsPerHost int           // Cap on open connections per host; excess requests queue
+}
+
+// DefaultSupabaseOptions suits a single server talking to one Supabase project.
+// Go's default transport keeps only 2 idle connections per host, so a burst of
+// auth/profile calls would otherwise open and tear down a socket per request.
+var DefaultSupabaseOptions = SupabaseOptions{
+	Timeout:         10 * time.Second,
+	MaxIdleConns:    100,
+	MaxConnsPerHost: 256,
+}
+
+// NewSupabaseClient builds a client for the Supabase project at baseURL, an
+// absolute http(s) URL such as "https://xyz.supabase.co" (a trailing slash is
+// dropped), authenticating with the service key. Zero options use defaults.
+func NewSupabaseClient(baseURL, key string, opts SupabaseOptions) (*SupabaseClient, error) {
+	if baseURL == "" || key == "" {
+		return nil, errors.New("supabase url and key are required")
+	}
+	baseURL, err := normalizeBaseURL("supabase url", baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultSupabaseOptions.Timeout
+	}
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = DefaultSupabaseOptions.MaxIdleConns
+	}
+	if opts.MaxConnsPerHost <= 0 {
+		opts.MaxConnsPerHost = DefaultSupabaseOptions.MaxConnsPerHost
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = opts.MaxIdleConns
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConns // Nearly all traffic goes to one or two hosts
+	transport.MaxConnsPerHost = opts.MaxConnsPerHost
+
 	return &SupabaseClient{
-		url:  url, 
-		key:  key, 
-		http: &http.Client{Timeout: 10 * time.Second},
+		url:          baseURL,
+		key:          key,
+		http:         &http.Client{Timeout: opts.Timeout, Transport: instrumentedTransport{next: transport}},
+		reactions:    newReactionPolicy(defaultMaxDistinctReactions, ""),
+		profiles:     newProfileCache(defaultProfileCacheTTL),
+		retry:        defaultRetryPolicy,
+		dialListener: dialPQListener,
+	}, nil
+}
+
+// normalizeBaseURL trims trailing slashes from raw, so paths can be appended
+// as-is, and checks that it's an absolute http(s) URL. name labels the error.
+func normalizeBaseURL(name, raw string) (string, error) {
+	raw = strings.TrimRight(raw, "/")
+	if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%s must be an absolute http(s) URL, got %q", name, raw)
+	}
+	return raw, nil
+}
+
+// SetRetryPolicy bounds write retries by attempt count and total elapsed time.
+// Non-positive values keep the current setting.
+func (s *SupabaseClient) SetRetryPolicy(maxAttempts int, maxElapsed time.Duration) {
+	if maxAttempts > 0 {
+		s.retry.maxAttempts = maxAttempts
+	}
+	if maxElapsed > 0 {
+		s.retry.maxElapsed = maxElapsed
+	}
+}
+
+// SetReadReplica routes read-only queries to a PostgREST replica at baseURL,
+// which is checked and trimmed like the primary's. An empty key reuses the
+// primary key.
+func (s *SupabaseClient) SetReadReplica(baseURL, key string) error {
+	baseURL, err := normalizeBaseURL("read replica url", baseURL)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		key = s.key
+	}
+	s.readURL = baseURL
+	s.readKey = key
+	return nil
+}
+
+// readGet performs a GET for a read-only query, preferring the replica when
+// configured and falling back to the primary if the replica errors
+func (s *SupabaseClient) readGet(ctx context.Context, path string) (*http.Response, []byte, error) {
+	return s.readGetAs(ctx, "", path)
+}
+
+// readGetAs is readGet for a read made on a user's behalf: with user-scoped
+// requests on, it authenticates as userToken so RLS applies
+func (s *SupabaseClient) readGetAs(ctx context.Context, userToken, path string) (*http.Response, []byte, error) {
+	bearer := func(key string) string {
+		if s.userScoped && userToken != "" {
+			return userToken
+		}
+		return key
+	}
+	if s.readURL != "" {
+		resp, body, err := s.getAs(ctx, s.readURL, s.readKey, bearer(s.readKey), path)
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, body, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err() // Caller went away; don't retry on the primary
+		}
+		if err == nil {
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		logWarnf("read replica request failed, falling back to primary: %v", err)
+	}
+	return s.getAs(ctx, s.url, s.key, bearer(s.key), path)
+}
+
+// get performs an authenticated GET and returns the response with its body read
+func (s *SupabaseClient) get(ctx context.Context, baseURL, key, path string) (*http.Response, []byte, error) {
+	return s.getAs(ctx, baseURL, key, key, path)
+}
+
+// getAs is get with a separate bearer token, e.g. a user's access token
+func (s *SupabaseClient) getAs(ctx context.Context, baseURL, key, bearer, path string) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("apikey", key)
+	req.Header.Set("Authorization", "Bearer "+bearer)
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, nil, err
 	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, nil, &RateLimitedError{RetryAfter: retryAfter(resp.Header)}
+	}
+	return resp, body, nil
+}
+
+// SetUserScoped makes channel history reads, message inserts, edits and
+// author deletes run as the user (their access token) instead of the service
+// key, so the messages table's RLS policies back up the server's own
+// membership and ownership checks. Admin paths (moderation, retention,
+// notifications, profile lookups) keep the service key. Off by default: these
+// calls start failing once a session's token expires unless the client sends
+// refresh_token or reconnects.
+func (s *SupabaseClient) SetUserScoped(on bool) {
+	s.userScoped = on
+}
+
+// SetEditWindow limits edits to messages younger than d; 0 removes the limit
+func (s *SupabaseClient) SetEditWindow(d time.Duration) {
+	s.editWindow = d
+}
+
+// SetReactionPolicy replaces the limits enforced when adding reactions
+func (s *SupabaseClient) SetReactionPolicy(maxDistinct int, allowlist string) {
+	s.reactions = newReactionPolicy(maxDistinct, allowlist)
+}
+
+// pgListener is the part of *pq.Listener the notification loop uses, so the
+// loop can run against a fake that pushes synthetic notifications
+type pgListener interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+	Ping() error
+	Close() error
+}
+
+// dialPQListener creates a real pq listener; it's the default dialListener
+func dialPQListener(connStr string, eventCallback pq.EventCallbackType) pgListener {
+	return pq.NewListener(connStr, 10*time.Second, time.Minute, eventCallback)
 }
 
+// notificationChannels are the Postgres NOTIFY channels the listener subscribes to
+var notificationChannels = []string{"friend_request", "friend_request_accepted", "profile_updated", "new_message"}
+
+// listenerMaxPingFailures is how many consecutive failed pings make the
+// listener be torn down and recreated
+const listenerMaxPingFailures = 3
+
+// Listener health checks: how long the listener may sit idle before it's
+// pinged, and the first wait between reconnect attempts (it doubles up to a
+// minute). Variables so tests can shorten them.
+var (
+	listenerPingInterval   = 90 * time.Second
+	listenerReconnectDelay = time.Second
+)
+
 // SetupNotificationListener establishes a PostgreSQL connection for listening to notifications
 func (s *SupabaseClient) SetupNotificationListener(dbConnStr string) error {
 	s.dbConnStr = dbConnStr
-	
-	// Create a new listener
-	listener := pq.NewListener(dbConnStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
-		if err != nil {
-			fmt.Printf("PG Listener error: %v\n", err)
-		}
-	})
 
-	// Listen for friend request notifications
-	if err := listener.Listen("friend_request"); err != nil {
-		return fmt.Errorf("failed to listen to friend_request channel: %v", err)
-	}
-	
-	if err := listener.Listen("friend_request_accepted"); err != nil {
-		return fmt.Errorf("failed to listen to friend_request_accepted channel: %v", err)
+	listener, err := s.newListener()
+	if err != nil {
+		return err
 	}
 
+	s.listenerMu.Lock()
 	s.listener = listener
+	s.listenerMu.Unlock()
 	return nil
 }
 
+// newListener connects a listener subscribed to every notification channel
+func (s *SupabaseClient) newListener() (pgListener, error) {
+	listener := s.dialListener(s.dbConnStr, s.listenerEvent)
+	for _, channel := range notificationChannels {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to listen to %s channel: %v", channel, err)
+		}
+	}
+	s.setListenerConnected(true)
+	return listener, nil
+}
+
+// listenerEvent tracks the connection state pq reports for the listener
+func (s *SupabaseClient) listenerEvent(ev pq.ListenerEventType, err error) {
+	switch ev {
+	case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+		s.setListenerConnected(true)
+	case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+		s.setListenerConnected(false)
+	}
+	if err != nil {
+		logWarnf("PG listener error: %v", err)
+	}
+}
+
+// SetListenerStateHandler registers fn to be called whenever the notification
+// listener connects or loses its connection. Call before SetupNotificationListener.
+func (s *SupabaseClient) SetListenerStateHandler(fn func(connected bool)) {
+	s.onListenerState = fn
+}
+
+// ListenerConnected reports whether the notification listener currently has a connection
+func (s *SupabaseClient) ListenerConnected() bool {
+	return s.listenerConnected.Load()
+}
+
+func (s *SupabaseClient) setListenerConnected(connected bool) {
+	if s.listenerConnected.Swap(connected) != connected && s.onListenerState != nil {
+		s.onListenerState(connected)
+	}
+}
+
+// reconnectListener replaces a listener that stopped answering pings, backing
+// off exponentially between attempts. Returns false if the client was closed.
+func (s *SupabaseClient) reconnectListener(old pgListener) bool {
+	old.Close()
+	s.setListenerConnected(false)
+
+	delay := listenerReconnectDelay
+	for {
+		s.listenerMu.Lock()
+		closed := s.listenerClosed
+		s.listenerMu.Unlock()
+		if closed {
+			return false
+		}
+
+		listener, err := s.newListener()
+		if err == nil {
+			s.listenerMu.Lock()
+			defer s.listenerMu.Unlock()
+			if s.listenerClosed {
+				listener.Close()
+				return false
+			}
+			s.listener = listener
+			return true
+		}
+		logWarnf("PG listener reconnect failed, retrying in %s: %v", delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+}
+
+// Close releases the notification listener, if one was set up
+func (s *SupabaseClient) Close() error {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	s.listenerClosed = true
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
 // ListenForNotifications starts listening for PostgreSQL notifications
 func (s *SupabaseClient) ListenForNotifications() <-chan interface{} {
 	notifications := make(chan interface{})
-	
-	if s.listener == nil {
+
+	s.listenerMu.Lock()
+	listener := s.listener
+	s.listenerMu.Unlock()
+	if listener == nil {
 		close(notifications)
 		return notifications
 	}
-	
+
 	go func() {
 		defer close(notifications)
-		defer s.listener.Close()
-		
+
+		pingFailures := 0
 		for {
 			select {
-			case n := <-s.listener.Notify:
+			case n, ok := <-listener.NotificationChannel():
+				if !ok {
+					return // Listener closed (shutdown)
+				}
 				if n == nil {
-					return
+					// pq re-established the connection; anything sent meanwhile is lost
+					logInfof("PG listener reconnected")
+					continue
 				}
-				
+
 				switch n.Channel {
 				case "friend_request":
 					var notif FriendRequestNotification
@@ -145,23 +530,65 @@ func (s *SupabaseClient) ListenForNotifications() <-chan interface{} {
 					if err := json.Unmarshal([]byte(n.Extra), &notif); err == nil {
 						notifications <- notif
 					}
+				case "new_message":
+					var notif NewMessageNotification
+					if err := json.Unmarshal([]byte(n.Extra), &notif); err == nil {
+						notifications <- notif
+					}
+				case "profile_updated":
+					// Drop the cached copy before anyone hears of the change, so a
+					// lookup prompted by it can't get the old profile
+					var notif ProfileUpdatedNotification
+					if err := json.Unmarshal([]byte(n.Extra), &notif); err == nil {
+						s.profiles.Invalidate(notif.UserID)
+						if notif.Username != "" { // Payloads from before the trigger carried names
+							notifications <- notif
+						}
+					}
 				}
-			case <-time.After(90 * time.Second):
-				go func() {
-					if err := s.listener.Ping(); err != nil {
-						fmt.Printf("PG Listener ping failed: %v\n", err)
+			case <-time.After(listenerPingInterval):
+				if err := listener.Ping(); err != nil {
+					pingFailures++
+					logWarnf("PG listener ping failed (%d/%d): %v", pingFailures, listenerMaxPingFailures, err)
+					if pingFailures < listenerMaxPingFailures {
+						continue
+					}
+					if !s.reconnectListener(listener) {
+						return
 					}
-				}()
+					s.listenerMu.Lock()
+					listener = s.listener
+					s.listenerMu.Unlock()
+				}
+				pingFailures = 0
 			}
 		}
 	}()
-	
+
 	return notifications
 }
 
+// Ping checks that the Supabase REST API is reachable with our key
+func (s *SupabaseClient) Ping(ctx context.Context) error {
+	resp, body, err := s.get(ctx, s.url, s.key, "/rest/v1/")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("supabase ping failed (%d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// ListenerExpected reports whether a notification listener was configured,
+// i.e. whether readiness should depend on ListenerConnected
+func (s *SupabaseClient) ListenerExpected() bool {
+	return s.dbConnStr != ""
+}
+
 // ValidateToken checks the access token by calling the /auth/v1/user endpoint
-func (s *SupabaseClient) ValidateToken(token string) (*authUser, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/auth/v1/user", s.url), nil)
+func (s *SupabaseClient) ValidateToken(ctx context.Context, token string) (*authUser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/auth/v1/user", s.url), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -175,17 +602,23 @@ func (s *SupabaseClient) ValidateToken(token string) (*authUser, error) {
 	
 	// Read response body for debugging
 	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &RateLimitedError{RetryAfter: retryAfter(resp.Header)}
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w: %s, body: %s", ErrInvalidToken, resp.Status, string(body))
+	}
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("token validation failed: %s, body: %s", resp.Status, string(body))
 	}
 	
 	//  **** Debug: log the raw response to see the structure **** 
-	//fmt.Printf("DEBUG: Token validation response: %s\n", string(body))
+	//logDebugf("token validation response: %s", string(body))
 	
 	// Try parsing as direct user response first
 	var directUser authUser
 	if err := json.Unmarshal(body, &directUser); err == nil && directUser.ID != "" {
-		fmt.Printf("DEBUG: Parsed direct user data - ID: '%s', Email: '%s'\n", directUser.ID, directUser.Email)
+		logDebugf("parsed direct user data - ID: '%s', Email: '%s'", directUser.ID, directUser.Email)
 		return &directUser, nil
 	}
 	
@@ -196,13 +629,15 @@ func (s *SupabaseClient) ValidateToken(token string) (*authUser, error) {
 	}
 	
 	// Debug: log the parsed user data
-	fmt.Printf("DEBUG: Parsed wrapped user data - ID: '%s', Email: '%s'\n", data.User.ID, data.User.Email)
+	logDebugf("parsed wrapped user data - ID: '%s', Email: '%s'", data.User.ID, data.User.Email)
 	
 	return &data.User, nil
 }
 
-// InsertMessage inserts a message with optional reply_to field
-func (s *SupabaseClient) InsertMessage(channelID, userID, content string, replyTo *string) (*dbMessage, error) {
+// InsertMessage inserts a message with optional reply_to field. existed reports
+// that clientMessageID had already been stored, by an earlier attempt or a
+// client retry, in which case the returned row is that original.
+func (s *SupabaseClient) InsertMessage(ctx context.Context, channelID, userID, content string, replyTo *string, clientMessageID string, origin messageOrigin, userToken string) (msg *dbMessage, existed bool, err error) {
 	payload := map[string]any{
 		"channel_id": channelID,
 		"user_id":    userID,
@@ -211,236 +646,1429 @@ func (s *SupabaseClient) InsertMessage(channelID, userID, content string, replyT
 	if replyTo != nil && *replyTo != "" {
 		payload["reply_to"] = *replyTo
 	}
-	b, _ := json.Marshal([]map[string]any{payload}) // PostgREST bulk insert format
-	var lastErr error
-	for attempt := 0; attempt < 3; attempt++ {
-		req, err := http.NewRequest("POST", fmt.Sprintf("%s/rest/v1/messages", s.url), bytes.NewReader(b))
-		if err != nil { return nil, err }
-		req.Header.Set("apikey", s.key)
-		req.Header.Set("Authorization", "Bearer "+s.key)
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Prefer", "return=representation")
-		resp, err := s.http.Do(req)
-		if err != nil { lastErr = err; time.Sleep(backoff(attempt)); continue }
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if resp.StatusCode == 201 { // created
-			var rows []dbMessage
-			if err := json.Unmarshal(body, &rows); err != nil { return nil, err }
-			if len(rows) == 1 { return &rows[0], nil }
-			return nil, errors.New("unexpected insert response size")
-		}
-		// 409 unlikely without explicit uniqueness constraint; just retry logic above handles transient
-		lastErr = fmt.Errorf("insert failed (%d): %s", resp.StatusCode, string(body))
-		time.Sleep(backoff(attempt))
+	if clientMessageID != "" {
+		payload["client_message_id"] = clientMessageID
 	}
-	return nil, lastErr
-}
-
-// GetChannelMessages fetches recent messages for a channel
-func (s *SupabaseClient) GetChannelMessages(channelID string, limit int) ([]dbMessage, error) {
-	if limit <= 0 {
-		limit = 50 // Default limit
+	b, _ := json.Marshal([]map[string]any{payload}) // PostgREST bulk insert format
+	resp, body, err := s.doWithRetry(ctx, func() (*http.Request, error) {
+		return s.userWriteRequest(ctx, userToken, "POST", "/rest/v1/messages", b)
+	})
+	if err != nil {
+		return nil, false, err
 	}
-	
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/rest/v1/messages?channel_id=eq.%s&select=id,channel_id,user_id,content,reply_to,edited,edited_at,created_at&order=created_at.desc&limit=%d", s.url, channelID, limit), nil)
-	if err != nil { 
-		return nil, err 
+	if resp.StatusCode == 409 && clientMessageID != "" {
+		// Already stored by an earlier attempt (ours or a client retry); return that row
+		msg, err = s.getMessageByClientMsgID(ctx, userID, clientMessageID)
+		return msg, err == nil, err
 	}
-	req.Header.Set("apikey", s.key)
-	req.Header.Set("Authorization", "Bearer "+s.key)
-	
-	resp, err := s.http.Do(req)
-	if err != nil { 
-		return nil, err 
+	if resp.StatusCode != 201 { // created
+		return nil, false, statusError("insert message", resp.StatusCode, body)
 	}
-	defer resp.Body.Close()
-	
-	body, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != 200 { 
-		return nil, fmt.Errorf("fetch messages failed: %s, body: %s", resp.Status, string(body))
+	var rows []dbMessage
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, false, err
 	}
-	
-	var messages []dbMessage
-	if err := json.Unmarshal(body, &messages); err != nil { 
-		return nil, err 
+	if len(rows) != 1 {
+		return nil, false, errors.New("unexpected insert response size")
 	}
-	
-	// Reverse the order to get chronological order (oldest first)
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+	// The message is stored either way; a lost audit row only costs the investigation
+	if err := s.insertMessageAudit(ctx, rows[0].ID, origin); err != nil {
+		logWarnf("failed to record audit for message %s: %v", rows[0].ID, err)
 	}
-	
-	return messages, nil
+	return &rows[0], false, nil
 }
 
-// UpdateMessage updates an existing message's content and marks it as edited
-func (s *SupabaseClient) UpdateMessage(messageID, userID, newContent string) (*dbMessage, error) {
-	payload := map[string]any{
-		"content":   newContent,
-		"edited":    true,
-		"edited_at": time.Now().Format(time.RFC3339),
+// insertMessageAudit records where messageID was sent from in message_audit,
+// which only the service role can read. An empty origin (auditing off) writes
+// nothing.
+func (s *SupabaseClient) insertMessageAudit(ctx context.Context, messageID string, origin messageOrigin) error {
+	if origin == (messageOrigin{}) {
+		return nil
 	}
-	b, _ := json.Marshal(payload)
-	
-	// Update with RLS check: only message author can edit
-	req, err := http.NewRequest("PATCH", fmt.Sprintf("%s/rest/v1/messages?id=eq.%s&user_id=eq.%s", s.url, messageID, userID), bytes.NewReader(b))
+	row := map[string]any{"message_id": messageID}
+	if origin.IP != "" {
+		row["sender_ip"] = origin.IP
+	}
+	if origin.UserAgent != "" {
+		row["user_agent"] = origin.UserAgent
+	}
+	b, _ := json.Marshal([]map[string]any{row})
+	req, err := s.writeRequest(ctx, "POST", "/rest/v1/message_audit", b)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req.Header.Set("apikey", s.key)
-	req.Header.Set("Authorization", "Bearer "+s.key)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Prefer", "return=representation")
-	
+	req.Header.Set("Prefer", "return=minimal")
 	resp, err := s.http.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
-	
-	body, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("update message failed (%d): %s", resp.StatusCode, string(body))
+	if resp.StatusCode != 201 {
+		body, _ := io.ReadAll(resp.Body)
+		return statusError("insert message audit", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// InsertSystemMessage stores a moderator notice in a channel. It is written
+// with the service role: RLS keeps members from posting system rows, so the
+// caller must have checked that userID moderates the channel.
+func (s *SupabaseClient) InsertSystemMessage(ctx context.Context, channelID, userID, content string) (*dbMessage, error) {
+	b, _ := json.Marshal([]map[string]any{{
+		"channel_id": channelID,
+		"user_id":    userID,
+		"content":    content,
+		"system":     true,
+	}})
+	resp, body, err := s.doWithRetry(ctx, func() (*http.Request, error) {
+		return s.writeRequest(ctx, "POST", "/rest/v1/messages", b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 201 { // created
+		return nil, statusError("insert system message", resp.StatusCode, body)
 	}
-	
 	var rows []dbMessage
 	if err := json.Unmarshal(body, &rows); err != nil {
 		return nil, err
 	}
-	if len(rows) == 1 {
-		return &rows[0], nil
+	if len(rows) != 1 {
+		return nil, errors.New("unexpected insert response size")
 	}
-	return nil, errors.New("message not found or not authorized to edit")
+	return &rows[0], nil
 }
 
-// DeleteMessage deletes a message (only the author can delete their own messages)
-func (s *SupabaseClient) DeleteMessage(messageID, userID string) error {
-	// Delete with RLS check: only message author can delete
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/rest/v1/messages?id=eq.%s&user_id=eq.%s", s.url, messageID, userID), nil)
+// writeRequest builds a service-role write against the primary that asks
+// PostgREST to return the affected rows
+func (s *SupabaseClient) writeRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url+path, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Set("apikey", s.key)
 	req.Header.Set("Authorization", "Bearer "+s.key)
 	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := s.http.Do(req)
+	req.Header.Set("Prefer", "return=representation")
+	return req, nil
+}
+
+// userWriteRequest is writeRequest for a write made on a user's behalf: with
+// user-scoped requests on, it authenticates as userToken so RLS applies
+func (s *SupabaseClient) userWriteRequest(ctx context.Context, userToken, method, path string, body []byte) (*http.Request, error) {
+	req, err := s.writeRequest(ctx, method, path, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-	
-	if resp.StatusCode != 204 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("delete message failed (%d): %s", resp.StatusCode, string(body))
+	if s.userScoped && userToken != "" {
+		req.Header.Set("Authorization", "Bearer "+userToken)
 	}
-	
-	return nil
+	return req, nil
 }
 
-// func (s *SupabaseClient) getMessageByClientMsgID(clientMessageID string) (*dbMessage, error) {
-// 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/rest/v1/messages?client_message_id=eq.%s&select=id,channel_id,user_id,content,created_at", s.url, clientMessageID), nil)
-// 	if err != nil { return nil, err }
-// 	req.Header.Set("apikey", s.key)
-// 	req.Header.Set("Authorization", "Bearer "+s.key)
-// 	resp, err := s.http.Do(req)
-// 	if err != nil { return nil, err }
-// 	defer resp.Body.Close()
-// 	if resp.StatusCode != 200 { return nil, fmt.Errorf("fetch by idempotency failed: %s", resp.Status) }
-// 	var rows []dbMessage
-// 	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil { return nil, err }
-// 	if len(rows) == 1 { return &rows[0], nil }
-// 	return nil, errors.New("not found or multiple rows for client_message_id")
-// }
-
-// GetProfile retrieves a user's profile (currently only username)
-func (s *SupabaseClient) GetProfile(userID string) (*profile, error) {
-	if userID == "" {
-		return nil, fmt.Errorf("empty user ID provided")
+// GetChannelMessages fetches recent messages for a channel. hasMore reports
+// whether older messages exist beyond the page.
+func (s *SupabaseClient) GetChannelMessages(ctx context.Context, channelID string, limit int, userToken string) (messages []dbMessage, hasMore bool, err error) {
+	if limit <= 0 {
+		limit = 50 // Default limit
 	}
 	
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/rest/v1/profiles?id=eq.%s&select=username", s.url, userID), nil)
-	if err != nil { return nil, err }
-	req.Header.Set("apikey", s.key)
-	req.Header.Set("Authorization", "Bearer "+s.key)
-	resp, err := s.http.Do(req)
-	if err != nil { return nil, err }
-	defer resp.Body.Close()
-	
-	// Read response body for debugging
-	body, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != 200 { 
-		return nil, fmt.Errorf("profile fetch failed: %s, body: %s", resp.Status, string(body))
+	messages, err = s.fetchMessagesAs(ctx, userToken, fmt.Sprintf("channel_id=eq.%s&select=%s&order=created_at.desc,id.desc&limit=%d", url.QueryEscape(channelID), messageColumns, limit+1))
+	if err != nil {
+		return nil, false, err
 	}
 	
-	var rows []profile
-	if err := json.Unmarshal(body, &rows); err != nil { return nil, err }
-	if len(rows) == 1 { return &rows[0], nil }
-	return &profile{Username: "unknown"}, nil
+	messages, hasMore = trimPage(messages, limit)
+	reverseMessages(messages)
+	return messages, hasMore, nil
 }
 
-// GetProfiles retrieves multiple user profiles by their IDs
-func (s *SupabaseClient) GetProfiles(userIDs []string) (map[string]string, error) {
-	if len(userIDs) == 0 {
-		return make(map[string]string), nil
+// GetChannelMessagesBefore fetches the page of up to limit messages that sort
+// before the cursor (the created_at and id of the oldest message of an earlier
+// page). Rows are selected newest-first (ties broken by id) so the page sits
+// directly behind the cursor, then returned oldest first like GetChannelMessages.
+// hasMore reports whether still older messages exist.
+func (s *SupabaseClient) GetChannelMessagesBefore(ctx context.Context, channelID, before, beforeID string, limit int, userToken string) (messages []dbMessage, hasMore bool, err error) {
+	if limit <= 0 {
+		limit = 50 // Default limit
 	}
+
+	messages, err = s.fetchMessagesAs(ctx, userToken, fmt.Sprintf("channel_id=eq.%s&%s&select=%s&order=created_at.desc,id.desc&limit=%d", url.QueryEscape(channelID), beforeFilter(before, beforeID), messageColumns, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	messages, hasMore = trimPage(messages, limit)
+	reverseMessages(messages)
+	return messages, hasMore, nil
+}
+
+// beforeFilter is the PostgREST filter for rows sorting before the cursor in
+// created_at, id order. Without beforeID (older clients) it falls back to
+// created_at alone, which skips rows that share the cursor's timestamp.
+func beforeFilter(before, beforeID string) string {
+	if beforeID == "" {
+		return "created_at=lt." + url.QueryEscape(before)
+	}
+	return cursorFilter("lt", before, beforeID)
+}
+
+// trimPage cuts a newest-first page fetched with limit+1 rows back to limit,
+// reporting whether the extra (older) row was there
+func trimPage(messages []dbMessage, limit int) ([]dbMessage, bool) {
+	if len(messages) > limit {
+		return messages[:limit], true
+	}
+	return messages, false
+}
+
+// GetChannelMessagesAfter fetches up to limit of the newest messages created
+// after afterID, oldest first. If more than limit are newer, the oldest of them
+// are left out; clients fill that gap with load_history. Returns ErrNotFound if
+// afterID no longer exists or belongs to another channel.
+func (s *SupabaseClient) GetChannelMessagesAfter(ctx context.Context, channelID, afterID string, limit int, userToken string) ([]dbMessage, error) {
+	if limit <= 0 {
+		limit = 50 // Default limit
+	}
+
+	after, err := s.GetMessage(ctx, afterID)
+	if err != nil {
+		return nil, err
+	}
+	if after.ChannelID != channelID {
+		return nil, ErrNotFound
+	}
+
+	// (created_at, id) > the cursor's, so rows sharing its timestamp aren't skipped
+	messages, err := s.fetchMessagesAs(ctx, userToken, fmt.Sprintf("channel_id=eq.%s&%s&select=%s&order=created_at.desc,id.desc&limit=%d", url.QueryEscape(channelID), cursorFilter("gt", after.CreatedAt, after.ID), messageColumns, limit))
+	if err != nil {
+		return nil, err
+	}
+
+	reverseMessages(messages)
+	return messages, nil
+}
+
+// reverseMessages flips a newest-first page into chronological order (oldest first)
+func reverseMessages(messages []dbMessage) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
+
+// IsChannelMember reports whether userID belongs to channelID. Reads the
+// primary so a user who has just joined isn't rejected because of replica lag.
+func (s *SupabaseClient) IsChannelMember(ctx context.Context, channelID, userID string) (bool, error) {
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/channel_members?channel_id=eq.%s&user_id=eq.%s&select=user_id", url.QueryEscape(channelID), url.QueryEscape(userID)))
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("membership check failed: %s", resp.Status)
+	}
+
+	var rows []struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// GetUserChannelIDs lists the channels userID belongs to. Reads the primary
+// with the service key, since it serves the server rather than the user.
+func (s *SupabaseClient) GetUserChannelIDs(ctx context.Context, userID string) ([]string, error) {
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/channel_members?user_id=eq.%s&select=channel_id", url.QueryEscape(userID)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("channel list failed: %s", resp.Status)
+	}
+
+	var rows []struct {
+		ChannelID string `json:"channel_id"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ChannelID)
+	}
+	return ids, nil
+}
+
+// GetChannel fetches channelID's metadata, or ErrNotFound if there's no such
+// channel. Reads the primary so a channel created a moment ago can be joined.
+func (s *SupabaseClient) GetChannel(ctx context.Context, channelID string) (*channelInfo, error) {
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/channels?id=eq.%s&select=id,name,description,is_private,created_at", url.QueryEscape(channelID)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		if resp.StatusCode == 400 {
+			return nil, ErrNotFound // Not a valid channel ID, so no such channel
+		}
+		return nil, fmt.Errorf("fetch channel failed: %s, body: %s", resp.Status, string(body))
+	}
+
+	var channels []channelInfo
+	if err := json.Unmarshal(body, &channels); err != nil {
+		return nil, err
+	}
+	if len(channels) == 0 {
+		return nil, ErrNotFound
+	}
+	return &channels[0], nil
+}
+
+// GetUserChannels lists the channels userID belongs to, sorted by name, with
+// the time of each one's newest message. Channels and their latest message
+// come embedded in the channel_members rows, so it's a single request.
+func (s *SupabaseClient) GetUserChannels(ctx context.Context, userID, userToken string) ([]userChannel, error) {
+	path := fmt.Sprintf("/rest/v1/channel_members?user_id=eq.%s&select=channel:channels(id,name,messages(created_at))&channel.messages.order=created_at.desc&channel.messages.limit=1", url.QueryEscape(userID))
+	resp, body, err := s.readGetAs(ctx, userToken, path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetch user channels failed: %s, body: %s", resp.Status, string(body))
+	}
+
+	var rows []struct {
+		Channel *struct {
+			ID       string `json:"id"`
+			Name     string `json:"name"`
+			Messages []struct {
+				CreatedAt string `json:"created_at"`
+			} `json:"messages"`
+		} `json:"channel"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
+	}
+
+	channels := make([]userChannel, 0, len(rows))
+	for _, row := range rows {
+		if row.Channel == nil {
+			continue // Hidden from the caller by RLS
+		}
+		ch := userChannel{ID: row.Channel.ID, Name: row.Channel.Name}
+		if len(row.Channel.Messages) > 0 {
+			ch.LastActivity = row.Channel.Messages[0].CreatedAt
+		}
+		channels = append(channels, ch)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return strings.ToLower(channels[i].Name) < strings.ToLower(channels[j].Name)
+	})
+	return channels, nil
+}
+
+// GetMessage fetches a single channel message by ID
+func (s *SupabaseClient) GetMessage(ctx context.Context, messageID string) (*dbMessage, error) {
+	messages, err := s.fetchMessages(ctx, fmt.Sprintf("id=eq.%s&select=%s", url.QueryEscape(messageID), messageColumns))
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, ErrNotFound
+	}
+	return &messages[0], nil
+}
+
+// GetMessagesByIDs fetches the given channel messages in one request; IDs
+// that no longer exist are simply missing from the result
+func (s *SupabaseClient) GetMessagesByIDs(ctx context.Context, messageIDs []string) ([]dbMessage, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	return s.fetchMessages(ctx, fmt.Sprintf("id=in.%s&select=%s", inList(messageIDs), messageColumns))
+}
+
+// GetMessagesAround fetches up to radius messages before and after messageID,
+// returned in chronological order together with the index of the target.
+// Returns ErrNotFound if the target no longer exists (e.g. it was deleted).
+func (s *SupabaseClient) GetMessagesAround(ctx context.Context, channelID, messageID string, radius int, userToken string) ([]dbMessage, int, error) {
+	if radius <= 0 {
+		radius = 25 // Default radius
+	}
+
+	target, err := s.GetMessage(ctx, messageID)
+	if err != nil {
+		return nil, -1, err
+	}
+	if target.ChannelID != channelID {
+		return nil, -1, ErrNotFound
+	}
+
+	before, err := s.fetchMessagesAs(ctx, userToken, fmt.Sprintf("channel_id=eq.%s&%s&select=%s&order=created_at.desc,id.desc&limit=%d", url.QueryEscape(channelID), cursorFilter("lt", target.CreatedAt, target.ID), messageColumns, radius))
+	if err != nil {
+		return nil, -1, err
+	}
+	after, err := s.fetchMessagesAs(ctx, userToken, fmt.Sprintf("channel_id=eq.%s&%s&select=%s&order=created_at.asc,id.asc&limit=%d", url.QueryEscape(channelID), cursorFilter("gt", target.CreatedAt, target.ID), messageColumns, radius))
+	if err != nil {
+		return nil, -1, err
+	}
+
+	// "before" comes back newest first; flip it so the result is chronological
+	messages := make([]dbMessage, 0, len(before)+1+len(after))
+	for i := len(before) - 1; i >= 0; i-- {
+		messages = append(messages, before[i])
+	}
+	messages = append(messages, *target)
+	messages = append(messages, after...)
+
+	return messages, len(before), nil
+}
+
+// GetThread fetches the message rootID followed by up to limit of its direct
+// replies, oldest first. Threads are one level deep: a reply to a reply is not
+// included here but opens a thread of its own. hasMore reports whether further
+// replies exist beyond the page. Returns ErrNotFound if rootID doesn't exist.
+func (s *SupabaseClient) GetThread(ctx context.Context, rootID string, limit int, userToken string) (messages []dbMessage, hasMore bool, err error) {
+	if limit <= 0 {
+		limit = 50 // Default limit
+	}
+
+	root, err := s.GetMessage(ctx, rootID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	replies, err := s.fetchMessagesAs(ctx, userToken, fmt.Sprintf("reply_to=eq.%s&channel_id=eq.%s&select=%s&order=created_at.asc,id.asc&limit=%d", url.QueryEscape(rootID), url.QueryEscape(root.ChannelID), messageColumns, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(replies) > limit {
+		replies, hasMore = replies[:limit], true
+	}
+
+	messages = make([]dbMessage, 0, len(replies)+1)
+	messages = append(messages, *root)
+	messages = append(messages, replies...)
+	return messages, hasMore, nil
+}
+
+// cursorFilter is the PostgREST filter for rows sorting before (op "lt") or
+// after (op "gt") the row at createdAt and id in created_at, id order. Rows that
+// share the cursor's timestamp are split by id rather than dropped.
+func cursorFilter(op, createdAt, id string) string {
+	at, id := quoteValue(createdAt), quoteValue(id)
+	return "or=" + url.QueryEscape(fmt.Sprintf("(created_at.%s.%s,and(created_at.eq.%s,id.%s.%s))", op, at, at, op, id))
+}
+
+// quoteValue double-quotes v for a PostgREST in list or or/and group, where
+// commas, dots, colons and parentheses would otherwise be read as syntax
+func quoteValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
+
+// fetchMessages runs a GET against the messages table with the given query string
+func (s *SupabaseClient) fetchMessages(ctx context.Context, query string) ([]dbMessage, error) {
+	return s.fetchMessagesAs(ctx, "", query)
+}
+
+// fetchMessagesAs is fetchMessages for a read made on a user's behalf, sent
+// with userToken when user-scoped requests are on
+func (s *SupabaseClient) fetchMessagesAs(ctx context.Context, userToken, query string) ([]dbMessage, error) {
+	resp, body, err := s.readGetAs(ctx, userToken, "/rest/v1/messages?" + query)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetch messages failed: %s, body: %s", resp.Status, string(body))
+	}
+
+	var messages []dbMessage
+	if err := json.Unmarshal(body, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// UpdateMessage updates an existing message's content and marks it as edited
+func (s *SupabaseClient) UpdateMessage(ctx context.Context, messageID, userID, newContent, userToken string) (*dbMessage, error) {
+	payload := map[string]any{
+		"content":   newContent,
+		"edited":    true,
+		"edited_at": time.Now().Format(time.RFC3339),
+	}
+	b, _ := json.Marshal(payload)
+	
+	// Update with RLS check: only message author can edit, tombstones stay
+	// blank, and past the edit window messages are frozen. Setting the same
+	// content twice is harmless, so the PATCH is safe to retry.
+	path := fmt.Sprintf("/rest/v1/messages?id=eq.%s&user_id=eq.%s&deleted=is.false", url.QueryEscape(messageID), url.QueryEscape(userID))
+	if s.editWindow > 0 {
+		cutoff := time.Now().Add(-s.editWindow).UTC().Format(time.RFC3339Nano)
+		path += "&created_at=gt." + url.QueryEscape(cutoff)
+	}
+	resp, body, err := s.doWithRetry(ctx, func() (*http.Request, error) {
+		return s.userWriteRequest(ctx, userToken, "PATCH", path, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, statusError("update message", resp.StatusCode, body)
+	}
+	
+	var rows []dbMessage
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 1 {
+		return &rows[0], nil
+	}
+	// The filters matched nothing: work out which one refused the edit
+	return nil, s.uneditableReason(ctx, messageID, userID)
+}
+
+// uneditableReason explains why an edit's filters matched no rows: ErrNotFound
+// if the message is gone (or a tombstone), ErrNotAuthorized if it's someone
+// else's, and otherwise ErrEditWindowExpired. Reads the primary.
+func (s *SupabaseClient) uneditableReason(ctx context.Context, messageID, userID string) error {
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/messages?id=eq.%s&deleted=is.false&select=user_id", url.QueryEscape(messageID)))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return statusError("fetch message", resp.StatusCode, body)
+	}
+	var rows []struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return err
+	}
+	switch {
+	case len(rows) == 0:
+		return ErrNotFound
+	case rows[0].UserID != userID:
+		return ErrNotAuthorized
+	}
+	return ErrEditWindowExpired
+}
+
+// DeleteMessage deletes a message (only the author can delete their own messages)
+// and returns the affected row. A soft delete blanks the content and keeps the
+// row as a tombstone so replies keep their parent; otherwise the row is removed.
+// PostgREST answers a write that matched nothing with success too, so the row
+// is requested back to detect that case.
+func (s *SupabaseClient) DeleteMessage(ctx context.Context, messageID, userID string, soft bool, userToken string) (*dbMessage, error) {
+	// RLS check: only message author can delete
+	path := fmt.Sprintf("/rest/v1/messages?id=eq.%s&user_id=eq.%s", url.QueryEscape(messageID), url.QueryEscape(userID))
+	var req *http.Request
+	var err error
+	if soft {
+		b, _ := json.Marshal(map[string]any{"deleted": true, "content": ""})
+		req, err = s.userWriteRequest(ctx, userToken, "PATCH", path+"&deleted=is.false", b)
+	} else {
+		req, err = s.userWriteRequest(ctx, userToken, "DELETE", path, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.doReturningMessages(req, "delete message")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 1 {
+		return &rows[0], nil
+	}
+	// The user_id filter matched nothing: the message is gone or isn't the caller's
+	return nil, s.missingOrForeign(ctx, messageID)
+}
+
+// HardDeleteMessage removes a message regardless of author, for moderation.
+// Replies to it lose their parent. Returns ErrNotFound if it doesn't exist.
+func (s *SupabaseClient) HardDeleteMessage(ctx context.Context, messageID string) (*dbMessage, error) {
+	req, err := s.writeRequest(ctx, "DELETE", fmt.Sprintf("/rest/v1/messages?id=eq.%s", url.QueryEscape(messageID)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.doReturningMessages(req, "hard delete message")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrNotFound
+	}
+	return &rows[0], nil
+}
+
+// DeleteMessagesByUser removes every message targetUserID posted in channelID,
+// for moderation, and returns the IDs removed (their count is the purge size)
+func (s *SupabaseClient) DeleteMessagesByUser(ctx context.Context, channelID, targetUserID string) ([]string, error) {
+	return s.purgeMessages(ctx, fmt.Sprintf("channel_id=eq.%s&user_id=eq.%s", url.QueryEscape(channelID), url.QueryEscape(targetUserID)))
+}
+
+// DeleteMessagesByIDs removes the given messages, for moderation. Deletes are
+// always scoped to channelID, so IDs from other channels are left alone and
+// simply missing from the returned IDs.
+func (s *SupabaseClient) DeleteMessagesByIDs(ctx context.Context, channelID string, ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return s.purgeMessages(ctx, fmt.Sprintf("channel_id=eq.%s&id=in.%s", url.QueryEscape(channelID), inList(ids)))
+}
+
+// purgeMessages hard-deletes the messages matching filter and returns their IDs
+func (s *SupabaseClient) purgeMessages(ctx context.Context, filter string) ([]string, error) {
+	req, err := s.writeRequest(ctx, "DELETE", "/rest/v1/messages?"+filter+"&select=id", nil)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.doReturningMessages(req, "purge messages")
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+	}
+	return ids, nil
+}
+
+// doReturningMessages sends a write made with writeRequest and decodes the
+// message rows PostgREST returns
+func (s *SupabaseClient) doReturningMessages(req *http.Request, op string) ([]dbMessage, error) {
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return nil, statusError(op, resp.StatusCode, body)
+	}
+
+	var rows []dbMessage
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// statusError turns a failed PostgREST response into an error, wrapping
+// ErrNotAuthorized for 401/403 and ErrNotFound for 404 so callers can branch
+func statusError(op string, status int, body []byte) error {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%s: %w (%d): %s", op, ErrNotAuthorized, status, string(body))
+	case http.StatusNotFound:
+		return fmt.Errorf("%s: %w (%d): %s", op, ErrNotFound, status, string(body))
+	}
+	return fmt.Errorf("%s failed (%d): %s", op, status, string(body))
+}
+
+// missingOrForeign explains why a write filtered by author matched no rows:
+// ErrNotFound if the message doesn't exist (or is a tombstone), ErrNotAuthorized
+// if it belongs to someone else. Reads the primary so a just-created message
+// isn't "missing".
+func (s *SupabaseClient) missingOrForeign(ctx context.Context, messageID string) error {
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/messages?id=eq.%s&deleted=is.false&select=id", url.QueryEscape(messageID)))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return statusError("fetch message", resp.StatusCode, body)
+	}
+	var rows []struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return ErrNotFound
+	}
+	return ErrNotAuthorized
+}
+
+// getMessageByClientMsgID finds the message a user previously sent with the
+// given client-supplied ID. Reads the primary: the row may be too new for the replica.
+func (s *SupabaseClient) getMessageByClientMsgID(ctx context.Context, userID, clientMessageID string) (*dbMessage, error) {
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/messages?user_id=eq.%s&client_message_id=eq.%s&select=%s", url.QueryEscape(userID), url.QueryEscape(clientMessageID), messageColumns))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetch by client_message_id failed: %s", resp.Status)
+	}
+	var rows []dbMessage
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 1 {
+		return &rows[0], nil
+	}
+	return nil, ErrNotFound
+}
+
+// GetProfile retrieves a user's profile (username and avatar). Returns
+// ErrNotFound when the user has no profile and ErrDuplicateProfile when the ID
+// matches more than one row; picking a fallback is up to the caller.
+func (s *SupabaseClient) GetProfile(ctx context.Context, userID string) (*profile, error) {
+	if userID == "" {
+		return nil, fmt.Errorf("empty user ID provided")
+	}
+	
+	resp, body, err := s.readGet(ctx, fmt.Sprintf("/rest/v1/profiles?id=eq.%s&select=username,avatar_url", url.QueryEscape(userID)))
+	if err != nil { return nil, err }
+	if resp.StatusCode != 200 { 
+		return nil, fmt.Errorf("profile fetch failed: %s, body: %s", resp.Status, string(body))
+	}
+	
+	var rows []profile
+	if err := json.Unmarshal(body, &rows); err != nil { return nil, err }
+	switch len(rows) {
+	case 0:
+		return nil, ErrNotFound
+	case 1:
+		return &rows[0], nil
+	default:
+		return nil, fmt.Errorf("%w: %d rows for %s", ErrDuplicateProfile, len(rows), userID)
+	}
+}
+
+// UpdateProfile changes userID's username, acting as the user so RLS applies
+// when user-scoped requests are on. Returns ErrUsernameTaken if another user
+// has it and ErrInvalidUsername if it breaks the table's length or character
+// rules. Other users hear of the change through the profile_updated notification.
+func (s *SupabaseClient) UpdateProfile(ctx context.Context, userID, userToken, username string) (*profile, error) {
+	b, _ := json.Marshal(map[string]any{"username": username})
+	path := fmt.Sprintf("/rest/v1/profiles?id=eq.%s&select=username,avatar_url", url.QueryEscape(userID))
+	resp, body, err := s.doWithRetry(ctx, func() (*http.Request, error) {
+		return s.userWriteRequest(ctx, userToken, "PATCH", path, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict: // unique_violation
+		return nil, ErrUsernameTaken
+	case http.StatusBadRequest: // check_violation on username_length/username_format
+		return nil, fmt.Errorf("%w: %s", ErrInvalidUsername, string(body))
+	default:
+		return nil, statusError("update profile", resp.StatusCode, body)
+	}
+
+	var rows []profile
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrNotFound
+	}
+	s.profiles.Invalidate(userID)
+	return &rows[0], nil
+}
+
+// GetProfilesByUsername maps the given usernames to user IDs; unknown names are
+// left out. Usernames are compared case-sensitively, the same way
+// send_friend_request matches them, so "Alice" does not resolve "alice".
+func (s *SupabaseClient) GetProfilesByUsername(ctx context.Context, usernames []string) (map[string]string, error) {
+	if len(usernames) == 0 {
+		return make(map[string]string), nil
+	}
+
+	resp, body, err := s.readGet(ctx, "/rest/v1/profiles?username=in."+inList(usernames)+"&select=id,username")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("profiles fetch failed: %s, body: %s", resp.Status, string(body))
+	}
+
+	var profiles []struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(body, &profiles); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for _, profile := range profiles {
+		result[profile.Username] = profile.ID
+	}
+	return result, nil
+}
+
+// inList renders values as a PostgREST in.() list, ready to go in a query
+// string. Each value is double-quoted so commas, dots and parentheses in it
+// can't split the list or start a new filter, then the list is URL-encoded.
+func inList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quoteValue(v)
+	}
+	return url.QueryEscape("(" + strings.Join(quoted, ",") + ")")
+}
+
+// FilterChannelMembers returns the subset of userIDs that belong to channelID
+func (s *SupabaseClient) FilterChannelMembers(ctx context.Context, channelID string, userIDs []string) ([]string, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/channel_members?channel_id=eq.%s&user_id=in.%s&select=user_id", url.QueryEscape(channelID), inList(userIDs)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("membership check failed: %s", resp.Status)
+	}
+
+	var rows []struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(rows))
+	for _, row := range rows {
+		members = append(members, row.UserID)
+	}
+	return members, nil
+}
+
+// InsertMentions records that senderID mentioned each of userIDs in a message
+func (s *SupabaseClient) InsertMentions(ctx context.Context, messageID, channelID, senderID string, userIDs []string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	rows := make([]map[string]any, 0, len(userIDs))
+	for _, userID := range userIDs {
+		rows = append(rows, map[string]any{
+			"message_id":        messageID,
+			"channel_id":        channelID,
+			"mentioned_user_id": userID,
+			"sender_id":         senderID,
+		})
+	}
+	b, _ := json.Marshal(rows)
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/rest/v1/mentions", s.url), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("insert mentions failed (%d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// UpdateLastSeen records now as the user's last_seen time
+func (s *SupabaseClient) UpdateLastSeen(ctx context.Context, userID string) error {
+	b, _ := json.Marshal(map[string]any{"last_seen": time.Now().UTC().Format(time.RFC3339)})
+	req, err := http.NewRequestWithContext(ctx, "PATCH", fmt.Sprintf("%s/rest/v1/profiles?id=eq.%s", s.url, url.QueryEscape(userID)), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 && resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("update last_seen failed (%d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// GetProfiles retrieves multiple user profiles by their IDs
+func (s *SupabaseClient) GetProfiles(ctx context.Context, userIDs []string) (map[string]profile, error) {
+	if len(userIDs) == 0 {
+		return make(map[string]profile), nil
+	}
+	
+	// Only authors missing from the cache cost a request
+	now := time.Now()
+	result, misses := s.profiles.Lookup(userIDs, now)
+	if len(misses) == 0 {
+		return result, nil
+	}
+
+	resp, body, err := s.readGet(ctx, fmt.Sprintf("/rest/v1/profiles?id=in.%s&select=id,username,avatar_url", inList(misses)))
+	if err != nil { 
+		return nil, err 
+	}
+	if resp.StatusCode != 200 { 
+		return nil, fmt.Errorf("profiles fetch failed: %s, body: %s", resp.Status, string(body))
+	}
+	
+	var rows []struct {
+		ID string `json:"id"`
+		profile
+	}
+	if err := json.Unmarshal(body, &rows); err != nil { 
+		return nil, err 
+	}
+	
+	// Convert to map for easy lookup
+	fetched := make(map[string]profile, len(rows))
+	for _, row := range rows {
+		fetched[row.ID] = row.profile
+		result[row.ID] = row.profile
+	}
+	s.profiles.Store(fetched, now)
 	
-	// Build the query with multiple user IDs
-	userIDsStr := ""
-	for i, id := range userIDs {
-		if i > 0 {
-			userIDsStr += ","
+	// Add fallback usernames for missing profiles
+	for _, userID := range userIDs {
+		if _, exists := result[userID]; !exists {
+			result[userID] = profile{Username: "unknown"}
+		}
+	}
+	
+	return result, nil
+}
+
+// Reaction-related functions
+
+// AddReaction records userID reacting to messageID with emoji. Reacting twice
+// with the same emoji is a no-op. The reaction policy is enforced first and
+// may return ErrEmojiNotAllowed or ErrReactionLimitReached.
+func (s *SupabaseClient) AddReaction(ctx context.Context, messageID, userID, emoji string) error {
+	reactions, err := s.GetReactions(ctx, []string{messageID})
+	if err != nil {
+		return err
+	}
+	existing := make([]string, 0, len(reactions[messageID]))
+	for e := range reactions[messageID] {
+		existing = append(existing, e)
+	}
+	if err := s.reactions.Check(emoji, existing); err != nil {
+		return err
+	}
+
+	b, _ := json.Marshal(map[string]any{
+		"message_id": messageID,
+		"user_id":    userID,
+		"emoji":      emoji,
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/rest/v1/message_reactions?on_conflict=message_id,user_id,emoji", s.url), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal,resolution=ignore-duplicates")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 409 means the same reaction already exists, which is what the caller wanted
+	if resp.StatusCode != 201 && resp.StatusCode != 200 && resp.StatusCode != 409 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("add reaction failed (%d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// RemoveReaction removes userID's emoji reaction from messageID (no-op if absent)
+func (s *SupabaseClient) RemoveReaction(ctx context.Context, messageID, userID, emoji string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/rest/v1/message_reactions?message_id=eq.%s&user_id=eq.%s&emoji=eq.%s", s.url, url.QueryEscape(messageID), url.QueryEscape(userID), url.QueryEscape(emoji)), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 && resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("remove reaction failed (%d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// GetReactions returns reaction counts per emoji for each of the given messages
+func (s *SupabaseClient) GetReactions(ctx context.Context, messageIDs []string) (map[string]map[string]int, error) {
+	result := make(map[string]map[string]int)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	resp, body, err := s.readGet(ctx, fmt.Sprintf("/rest/v1/message_reactions?message_id=in.%s&select=message_id,emoji", inList(messageIDs)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetch reactions failed: %s, body: %s", resp.Status, string(body))
+	}
+
+	var rows []struct {
+		MessageID string `json:"message_id"`
+		Emoji     string `json:"emoji"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if result[row.MessageID] == nil {
+			result[row.MessageID] = make(map[string]int)
+		}
+		result[row.MessageID][row.Emoji]++
+	}
+	return result, nil
+}
+
+// Pin-related functions
+
+// isChannelModerator reports whether userID may moderate channelID, i.e. holds
+// the owner or admin role there. Reads the primary so a fresh promotion counts.
+func (s *SupabaseClient) isChannelModerator(ctx context.Context, channelID, userID string) (bool, error) {
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/channel_members?channel_id=eq.%s&user_id=eq.%s&select=role", url.QueryEscape(channelID), url.QueryEscape(userID)))
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("role lookup failed: %s", resp.Status)
+	}
+
+	var rows []struct {
+		Role string `json:"role"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return false, err
+	}
+	return len(rows) > 0 && (rows[0].Role == "owner" || rows[0].Role == "admin"), nil
+}
+
+// PinMessage pins messageID in channelID on behalf of userID. Pinning twice is
+// a no-op. Returns ErrNotAuthorized unless userID moderates the channel and
+// ErrNotFound if the message doesn't exist in that channel.
+func (s *SupabaseClient) PinMessage(ctx context.Context, channelID, messageID, userID string) error {
+	ok, err := s.isChannelModerator(ctx, channelID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotAuthorized
+	}
+	target, err := s.GetMessage(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if target.ChannelID != channelID {
+		return ErrNotFound
+	}
+
+	b, _ := json.Marshal(map[string]any{
+		"channel_id": channelID,
+		"message_id": messageID,
+		"pinned_by":  userID,
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/rest/v1/pinned_messages?on_conflict=message_id", s.url), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal,resolution=ignore-duplicates")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 409 means the message is already pinned, which is what the caller wanted
+	if resp.StatusCode != 201 && resp.StatusCode != 200 && resp.StatusCode != 409 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("pin message failed (%d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// UnpinMessage removes messageID from channelID's pins (no-op if it isn't
+// pinned). Returns ErrNotAuthorized unless userID moderates the channel.
+func (s *SupabaseClient) UnpinMessage(ctx context.Context, channelID, messageID, userID string) error {
+	ok, err := s.isChannelModerator(ctx, channelID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotAuthorized
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/rest/v1/pinned_messages?channel_id=eq.%s&message_id=eq.%s", s.url, url.QueryEscape(channelID), url.QueryEscape(messageID)), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 && resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unpin message failed (%d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// GetPinnedMessages returns channelID's pinned messages, most recently pinned
+// first. Reads the primary so the list broadcast right after a pin includes it.
+func (s *SupabaseClient) GetPinnedMessages(ctx context.Context, channelID string) ([]dbMessage, error) {
+	ids, err := s.pinnedMessageIDs(ctx, channelID)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	messages, err := s.GetMessagesByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// Restore pin order; GetMessagesByIDs returns rows in no particular order
+	byID := make(map[string]dbMessage, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+	}
+	pinned := make([]dbMessage, 0, len(messages))
+	for _, id := range ids {
+		if msg, ok := byID[id]; ok {
+			pinned = append(pinned, msg)
+		}
+	}
+	return pinned, nil
+}
+
+// pinnedMessageIDs lists the IDs of channelID's pinned messages, most recently pinned first
+func (s *SupabaseClient) pinnedMessageIDs(ctx context.Context, channelID string) ([]string, error) {
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/pinned_messages?channel_id=eq.%s&select=message_id&order=pinned_at.desc", url.QueryEscape(channelID)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetch pins failed: %s, body: %s", resp.Status, string(body))
+	}
+
+	var rows []struct {
+		MessageID string `json:"message_id"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row.MessageID
+	}
+	return ids, nil
+}
+
+// Ban-related functions
+
+// IsBanned reports whether userID is banned from channelID. Reads the primary
+// so a ban takes effect on the very next join.
+func (s *SupabaseClient) IsBanned(ctx context.Context, channelID, userID string) (bool, error) {
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/channel_bans?channel_id=eq.%s&user_id=eq.%s&select=user_id", url.QueryEscape(channelID), url.QueryEscape(userID)))
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("ban check failed: %s", resp.Status)
+	}
+
+	var rows []struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// BanUser bans userID from channelID on behalf of bannedBy and removes their
+// membership, so every membership check fails from then on. Banning twice is
+// a no-op.
+func (s *SupabaseClient) BanUser(ctx context.Context, channelID, userID, bannedBy string) error {
+	b, _ := json.Marshal(map[string]any{
+		"channel_id": channelID,
+		"user_id":    userID,
+		"banned_by":  bannedBy,
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/rest/v1/channel_bans?on_conflict=channel_id,user_id", s.url), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal,resolution=ignore-duplicates")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 201 && resp.StatusCode != 200 && resp.StatusCode != 409 {
+		return fmt.Errorf("ban user failed: %s", resp.Status)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/rest/v1/channel_members?channel_id=eq.%s&user_id=eq.%s", s.url, url.QueryEscape(channelID), url.QueryEscape(userID)), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+
+	resp, err = s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 204 && resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("remove banned member failed (%d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// Retention-related functions
+
+// GetChannelSettings returns the settings rows of the given channels, or of
+// every channel that has any when none are given. Channels without a row use
+// the defaults (no retention, no slow mode).
+func (s *SupabaseClient) GetChannelSettings(ctx context.Context, channelIDs ...string) ([]channelSettings, error) {
+	path := "/rest/v1/channel_settings?select=channel_id,retention_days,slow_mode_seconds,read_receipts"
+	if len(channelIDs) > 0 {
+		path += "&channel_id=in." + inList(channelIDs)
+	}
+	resp, body, err := s.get(ctx, s.url, s.key, path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("fetch channel settings failed: %s, body: %s", resp.Status, string(body))
+	}
+
+	var settings []channelSettings
+	if err := json.Unmarshal(body, &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// maxSeenLookupIDs caps the message IDs per lookup in MarkChannelMessagesSeen,
+// keeping each in.() filter to a URL length proxies accept
+const maxSeenLookupIDs = 100
+
+// MarkChannelMessagesSeen records a batch of receipts in channelID (message ID
+// -> readers) with one insert and returns the IDs of the messages that belong
+// to the channel. Receipts for other channels' or missing messages are
+// dropped, as are repeats and authors' views of their own messages. Reads the
+// primary, since receipts usually arrive for messages a moment old.
+func (s *SupabaseClient) MarkChannelMessagesSeen(ctx context.Context, channelID string, receipts map[string][]string) ([]string, error) {
+	if len(receipts) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, 0, len(receipts))
+	for id := range receipts {
+		ids = append(ids, id)
+	}
+	type authored struct {
+		ID     string `json:"id"`
+		UserID string `json:"user_id"`
+	}
+	var messages []authored
+	// A full batch's IDs would make too long a URL for one lookup
+	for start := 0; start < len(ids); start += maxSeenLookupIDs {
+		chunk := ids[start:min(start+maxSeenLookupIDs, len(ids))]
+		resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/messages?id=in.%s&channel_id=eq.%s&select=id,user_id", inList(chunk), url.QueryEscape(channelID)))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("seen messages fetch failed: %s, body: %s", resp.Status, string(body))
+		}
+		var found []authored
+		if err := json.Unmarshal(body, &found); err != nil {
+			return nil, err
+		}
+		messages = append(messages, found...)
+	}
+
+	var rows []map[string]any
+	counted := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		counted = append(counted, msg.ID)
+		for _, userID := range receipts[msg.ID] {
+			if userID != msg.UserID { // Authors don't count toward "seen by"
+				rows = append(rows, map[string]any{"message_id": msg.ID, "user_id": userID})
+			}
 		}
-		userIDsStr += id
 	}
-	
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/rest/v1/profiles?id=in.(%s)&select=id,username", s.url, userIDsStr), nil)
-	if err != nil { 
-		return nil, err 
+	if len(rows) == 0 {
+		return counted, nil
+	}
+
+	b, _ := json.Marshal(rows) // PostgREST bulk insert format
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/rest/v1/message_seen?on_conflict=message_id,user_id", s.url), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
 	}
 	req.Header.Set("apikey", s.key)
 	req.Header.Set("Authorization", "Bearer "+s.key)
-	
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal,resolution=ignore-duplicates")
+
 	resp, err := s.http.Do(req)
-	if err != nil { 
-		return nil, err 
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 201 && resp.StatusCode != 200 && resp.StatusCode != 409 {
+		return nil, fmt.Errorf("mark messages seen failed: %s", resp.Status)
+	}
+	return counted, nil
+}
+
+// GetSeenCounts maps each of messageIDs to how many users have seen it.
+// Messages nobody has seen map to 0. The counting happens in the database
+// (message_seen_counts), so it isn't capped by PostgREST's max-rows.
+func (s *SupabaseClient) GetSeenCounts(ctx context.Context, messageIDs []string) (map[string]int, error) {
+	counts := make(map[string]int, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+	for _, id := range messageIDs {
+		counts[id] = 0
+	}
+
+	b, _ := json.Marshal(map[string]any{"message_ids": messageIDs})
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/rest/v1/rpc/message_seen_counts", s.url), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
-	
 	body, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode != 200 { 
-		return nil, fmt.Errorf("profiles fetch failed: %s, body: %s", resp.Status, string(body))
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("seen counts fetch failed: %s, body: %s", resp.Status, string(body))
 	}
-	
-	var profiles []struct {
-		ID       string `json:"id"`
-		Username string `json:"username"`
+
+	var rows []struct {
+		MessageID string `json:"message_id"`
+		Seen      int    `json:"seen"`
 	}
-	if err := json.Unmarshal(body, &profiles); err != nil { 
-		return nil, err 
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
 	}
-	
-	// Convert to map for easy lookup
-	result := make(map[string]string)
-	for _, profile := range profiles {
-		result[profile.ID] = profile.Username
+	for _, row := range rows {
+		counts[row.MessageID] = row.Seen
 	}
-	
-	// Add fallback usernames for missing profiles
-	for _, userID := range userIDs {
-		if _, exists := result[userID]; !exists {
-			result[userID] = "unknown"
-		}
+	return counts, nil
+}
+
+// SetSlowMode sets channelID's slow-mode cooldown in seconds (0 turns it off)
+func (s *SupabaseClient) SetSlowMode(ctx context.Context, channelID string, seconds int) error {
+	b, _ := json.Marshal(map[string]any{
+		"channel_id":        channelID,
+		"slow_mode_seconds": seconds,
+		"updated_at":        time.Now().Format(time.RFC3339),
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/rest/v1/channel_settings?on_conflict=channel_id", s.url), bytes.NewReader(b))
+	if err != nil {
+		return err
 	}
-	
-	return result, nil
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal,resolution=merge-duplicates") // Upsert, keeping other settings
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 && resp.StatusCode != 200 && resp.StatusCode != 204 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("set slow mode failed (%d): %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// DeleteMessagesOlderThan removes channelID's messages created before cutoff,
+// sparing pinned ones, and returns how many were removed
+func (s *SupabaseClient) DeleteMessagesOlderThan(ctx context.Context, channelID string, cutoff time.Time) (int, error) {
+	pinned, err := s.pinnedMessageIDs(ctx, channelID)
+	if err != nil {
+		return 0, err
+	}
+	path := fmt.Sprintf("/rest/v1/messages?channel_id=eq.%s&created_at=lt.%s&select=id", url.QueryEscape(channelID), url.QueryEscape(cutoff.UTC().Format(time.RFC3339)))
+	if len(pinned) > 0 {
+		path += "&id=not.in." + inList(pinned)
+	}
+
+	req, err := s.writeRequest(ctx, "DELETE", path, nil)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := s.doReturningMessages(req, "delete expired messages")
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), nil
 }
 
 // DM-related functions
 
 // CreateOrGetDMConversation creates or gets an existing DM conversation between two users
-func (s *SupabaseClient) CreateOrGetDMConversation(user1ID, user2ID, userToken string) (string, error) {
+func (s *SupabaseClient) CreateOrGetDMConversation(ctx context.Context, user1ID, user2ID, userToken string) (string, error) {
 	requestBody := map[string]interface{}{
 		"target_user_id": user2ID,
 	}
@@ -450,7 +2078,7 @@ func (s *SupabaseClient) CreateOrGetDMConversation(user1ID, user2ID, userToken s
 		return "", fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/rest/v1/rpc/get_or_create_dm", s.url), bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/rest/v1/rpc/get_or_create_dm", s.url), bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
@@ -468,7 +2096,7 @@ func (s *SupabaseClient) CreateOrGetDMConversation(user1ID, user2ID, userToken s
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return "", statusError("get or create DM", resp.StatusCode, bodyBytes)
 	}
 
 	var dmID string
@@ -479,32 +2107,25 @@ func (s *SupabaseClient) CreateOrGetDMConversation(user1ID, user2ID, userToken s
 	return dmID, nil
 }
 
-// InsertDMMessage inserts a new DM message
-func (s *SupabaseClient) InsertDMMessage(dmID, senderID, content string, replyTo *string) (*dmMessage, error) {
-	requestBody := map[string]interface{}{
-		"dm_id":     dmID,
-		"sender_id": senderID,
-		"content":   content,
-	}
-
-	if replyTo != nil {
-		requestBody["reply_to"] = *replyTo
-	}
-
-	jsonBody, err := json.Marshal(requestBody)
+// GetDMConversations lists userID's DM threads, most recently active first,
+// with a preview of the last message and the unread count. It runs as the
+// user (userToken) so the database only ever returns their own threads.
+func (s *SupabaseClient) GetDMConversations(ctx context.Context, userID, userToken string) ([]dmConversation, error) {
+	jsonBody, err := json.Marshal(map[string]interface{}{
+		"user_uuid": userID,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/rest/v1/dm_messages", s.url), bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/rest/v1/rpc/get_user_dm_conversations", s.url), bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+s.key)
+	req.Header.Set("Authorization", "Bearer "+userToken)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("apikey", s.key)
-	req.Header.Set("Prefer", "return=representation")
 
 	resp, err := s.http.Do(req)
 	if err != nil {
@@ -512,13 +2133,159 @@ func (s *SupabaseClient) InsertDMMessage(dmID, senderID, content string, replyTo
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated {
+	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
 		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
 	}
 
+	var conversations []dmConversation
+	if err := json.NewDecoder(resp.Body).Decode(&conversations); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return conversations, nil
+}
+
+// GetUnreadDMCount counts the DMs userID has received and not yet read,
+// across all their conversations. dm_messages only records the sender, so
+// "received" means: in a conversation userID takes part in, sent by the other
+// participant.
+func (s *SupabaseClient) GetUnreadDMCount(ctx context.Context, userID string) (int, error) {
+	uid := url.QueryEscape(userID)
+	resp, body, err := s.readGet(ctx, fmt.Sprintf("/rest/v1/direct_messages?or=(participant1_id.eq.%s,participant2_id.eq.%s)&select=id", uid, uid))
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetch DM conversations failed: %s, body: %s", resp.Status, string(body))
+	}
+	var conversations []struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &conversations); err != nil {
+		return 0, err
+	}
+	if len(conversations) == 0 {
+		return 0, nil
+	}
+	dmIDs := make([]string, len(conversations))
+	for i, c := range conversations {
+		dmIDs[i] = c.ID
+	}
+
+	// Only the count is wanted: PostgREST reports it in Content-Range
+	path := fmt.Sprintf("/rest/v1/dm_messages?dm_id=in.%s&sender_id=neq.%s&read_by_recipient=is.false&deleted=is.false&select=id", inList(dmIDs), uid)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", s.url+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("apikey", s.key)
+	req.Header.Set("Authorization", "Bearer "+s.key)
+	req.Header.Set("Prefer", "count=exact")
+
+	resp, err = s.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("count unread DMs failed: %s", resp.Status)
+	}
+	// Content-Range looks like "0-24/25", or "*/0" when nothing matches
+	contentRange := resp.Header.Get("Content-Range")
+	total := contentRange[strings.LastIndex(contentRange, "/")+1:]
+	n, err := strconv.Atoi(total)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected Content-Range %q", contentRange)
+	}
+	return n, nil
+}
+
+// GetDMParticipants returns the two user IDs of a DM conversation
+func (s *SupabaseClient) GetDMParticipants(ctx context.Context, dmID string) (string, string, error) {
+	resp, body, err := s.readGet(ctx, fmt.Sprintf("/rest/v1/direct_messages?id=eq.%s&select=participant1_id,participant2_id", url.QueryEscape(dmID)))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to execute request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var rows []struct {
+		Participant1ID string `json:"participant1_id"`
+		Participant2ID string `json:"participant2_id"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return "", "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if len(rows) == 0 {
+		return "", "", ErrNotFound
+	}
+
+	return rows[0].Participant1ID, rows[0].Participant2ID, nil
+}
+
+// validateDMAttachment normalizes a DM message type ("" means text) and checks
+// that image/file messages carry an http(s) file URL
+func validateDMAttachment(messageType, fileURL string) (string, error) {
+	switch messageType {
+	case "", "text":
+		return "text", nil
+	case "image", "file":
+		u, err := url.Parse(fileURL)
+		if fileURL == "" || err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return "", ErrInvalidAttachment
+		}
+		return messageType, nil
+	default:
+		return "", ErrInvalidAttachment
+	}
+}
+
+// InsertDMMessage inserts a new DM message. messageType is "text" (or empty),
+// "image" or "file"; the latter two require fileURL.
+func (s *SupabaseClient) InsertDMMessage(ctx context.Context, dmID, senderID, content string, replyTo *string, messageType, fileURL string) (*dmMessage, error) {
+	messageType, err := validateDMAttachment(messageType, fileURL)
+	if err != nil {
+		return nil, err
+	}
+
+	requestBody := map[string]interface{}{
+		"dm_id":        dmID,
+		"sender_id":    senderID,
+		"content":      content,
+		"message_type": messageType,
+	}
+	if messageType != "text" {
+		requestBody["file_url"] = fileURL
+	}
+
+	if replyTo != nil {
+		requestBody["reply_to"] = *replyTo
+	}
+
+	jsonBody, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// DM inserts carry no client id, so a retry after a lost response can
+	// store the message twice; that's preferred over dropping it
+	resp, body, err := s.doWithRetry(ctx, func() (*http.Request, error) {
+		return s.writeRequest(ctx, "POST", "/rest/v1/dm_messages", jsonBody)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, statusError("insert DM message", resp.StatusCode, body)
+	}
+
 	var messages []dmMessage
-	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+	if err := json.Unmarshal(body, &messages); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
@@ -529,8 +2296,41 @@ func (s *SupabaseClient) InsertDMMessage(dmID, senderID, content string, replyTo
 	return &messages[0], nil
 }
 
-// MarkDMMessageAsRead marks a DM message as read
-func (s *SupabaseClient) MarkDMMessageAsRead(messageID, userID string) error {
+// MarkDMMessageAsRead marks a DM message as read on behalf of its recipient and
+// returns the updated row. Returns ErrNotAuthorized unless userID is the other
+// participant of the message's conversation: not its sender (senders can't mark
+// their own messages read), not an outsider, and not for a missing message.
+func (s *SupabaseClient) MarkDMMessageAsRead(ctx context.Context, messageID, userID string) (*dmMessage, error) {
+	// The write runs with the service key, so check the caller's place in the
+	// conversation here rather than relying on RLS
+	resp, body, err := s.get(ctx, s.url, s.key, fmt.Sprintf("/rest/v1/dm_messages?id=eq.%s&select=dm_id,sender_id", url.QueryEscape(messageID)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	var rows []struct {
+		DMConversationID string `json:"dm_id"`
+		SenderID         string `json:"sender_id"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(rows) == 0 || rows[0].SenderID == userID {
+		return nil, ErrNotAuthorized
+	}
+	user1, user2, err := s.GetDMParticipants(ctx, rows[0].DMConversationID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrNotAuthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+	if userID != user1 && userID != user2 {
+		return nil, ErrNotAuthorized
+	}
+
 	requestBody := map[string]interface{}{
 		"read_by_recipient": true,
 		"read_at":          time.Now().Format(time.RFC3339),
@@ -538,61 +2338,147 @@ func (s *SupabaseClient) MarkDMMessageAsRead(messageID, userID string) error {
 
 	jsonBody, err := json.Marshal(requestBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request: %w", err)
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	req, err := http.NewRequest("PATCH", fmt.Sprintf("%s/rest/v1/dm_messages?id=eq.%s", s.url, messageID), bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "PATCH", fmt.Sprintf("%s/rest/v1/dm_messages?id=eq.%s&sender_id=neq.%s", s.url, url.QueryEscape(messageID), url.QueryEscape(userID)), bytes.NewBuffer(jsonBody))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+s.key)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("apikey", s.key)
+	req.Header.Set("Prefer", "return=representation")
 
-	resp, err := s.http.Do(req)
+	resp, err = s.http.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to execute request: %w", err)
+		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
 	}
 
-	return nil
+	var messages []dmMessage
+	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if len(messages) == 0 {
+		return nil, ErrNotAuthorized
+	}
+
+	return &messages[0], nil
 }
 
-// GetDMMessages retrieves messages for a DM conversation
-func (s *SupabaseClient) GetDMMessages(dmID string, limit int) ([]dmMessage, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/rest/v1/dm_messages?dm_id=eq.%s&order=created_at.asc&limit=%d", s.url, dmID, limit), nil)
+// UpdateDMMessage replaces a DM's content and marks it edited, returning the
+// updated row. Only the sender may edit: returns ErrNotAuthorized if the
+// sender filter matches nothing (someone else's message, or no such message).
+// Deleted messages stay blank and can't be edited either.
+func (s *SupabaseClient) UpdateDMMessage(ctx context.Context, messageID, senderID, newContent string) (*dmMessage, error) {
+	b, _ := json.Marshal(map[string]any{
+		"content":   newContent,
+		"edited":    true,
+		"edited_at": time.Now().Format(time.RFC3339),
+	})
+
+	// Setting the same content twice is harmless, so the PATCH is safe to retry
+	path := fmt.Sprintf("/rest/v1/dm_messages?id=eq.%s&sender_id=eq.%s&deleted=is.false", url.QueryEscape(messageID), url.QueryEscape(senderID))
+	resp, body, err := s.doWithRetry(ctx, func() (*http.Request, error) {
+		return s.writeRequest(ctx, "PATCH", path, b)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	req.Header.Set("Authorization", "Bearer "+s.key)
-	req.Header.Set("apikey", s.key)
+	var messages []dmMessage
+	if err := json.Unmarshal(body, &messages); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(messages) == 0 {
+		return nil, ErrNotAuthorized
+	}
+	return &messages[0], nil
+}
 
-	resp, err := s.http.Do(req)
+// DeleteDMMessage soft-deletes a DM: the content and attachment are blanked
+// and the row stays as a tombstone so the conversation keeps its shape.
+// Only the sender may delete; returns ErrNotAuthorized if the sender filter
+// matches nothing (someone else's message, already deleted, or no such message).
+func (s *SupabaseClient) DeleteDMMessage(ctx context.Context, messageID, senderID string) (*dmMessage, error) {
+	b, _ := json.Marshal(map[string]any{"deleted": true, "content": "", "file_url": nil})
+
+	// The deleted=is.false filter makes a repeat a no-op, so this is safe to retry
+	path := fmt.Sprintf("/rest/v1/dm_messages?id=eq.%s&sender_id=eq.%s&deleted=is.false", url.QueryEscape(messageID), url.QueryEscape(senderID))
+	resp, body, err := s.doWithRetry(ctx, func() (*http.Request, error) {
+		return s.writeRequest(ctx, "PATCH", path, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var messages []dmMessage
+	if err := json.Unmarshal(body, &messages); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(messages) == 0 {
+		return nil, ErrNotAuthorized
+	}
+	return &messages[0], nil
+}
+
+// GetDMMessagesBefore fetches the page of up to limit DM messages that sort
+// before the cursor (the created_at and id of the oldest message of an earlier
+// page), oldest first. Like GetChannelMessagesBefore, rows are selected
+// newest-first (ties broken by id) so the page sits directly behind the
+// cursor; hasMore reports whether still older messages exist.
+func (s *SupabaseClient) GetDMMessagesBefore(ctx context.Context, dmID, before, beforeID string, limit int) (messages []dmMessage, hasMore bool, err error) {
+	if limit <= 0 {
+		limit = 50 // Default limit
+	}
+
+	resp, body, err := s.readGet(ctx, fmt.Sprintf("/rest/v1/dm_messages?dm_id=eq.%s&%s&order=created_at.desc,id.desc&limit=%d", url.QueryEscape(dmID), beforeFilter(before, beforeID), limit+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to execute request: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	if err := json.Unmarshal(body, &messages); err != nil {
+		return nil, false, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if len(messages) > limit {
+		messages, hasMore = messages[:limit], true
+	}
+	slices.Reverse(messages)
+	return messages, hasMore, nil
+}
+
+// GetDMMessages retrieves messages for a DM conversation
+func (s *SupabaseClient) GetDMMessages(ctx context.Context, dmID string, limit int) ([]dmMessage, error) {
+	resp, body, err := s.readGet(ctx, fmt.Sprintf("/rest/v1/dm_messages?dm_id=eq.%s&order=created_at.asc&limit=%d", url.QueryEscape(dmID), limit))
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
 	var messages []dmMessage
-	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+	if err := json.Unmarshal(body, &messages); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
 	}
 
 	return messages, nil
 }
-
-func backoff(attempt int) time.Duration {
-	return time.Duration(200*(1<<attempt)) * time.Millisecond
-}
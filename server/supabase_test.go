@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEditAndDeleteErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int    // The write's response status
+		owner  string // Author of the existing message; "" when it doesn't exist
+		want   error  // For both the edit and the delete; nil means a plain failure
+	}{
+		{name: "someone else's message", status: http.StatusOK, owner: "bob", want: ErrNotAuthorized},
+		{name: "missing message", status: http.StatusOK, want: ErrNotFound},
+		{name: "forbidden", status: http.StatusForbidden, want: ErrNotAuthorized},
+		{name: "unauthorized", status: http.StatusUnauthorized, want: ErrNotAuthorized},
+		{name: "not found", status: http.StatusNotFound, want: ErrNotFound},
+		{name: "server error", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakePostgREST(t)
+			db.respond("PATCH", "/rest/v1/messages", tt.status, "[]")
+			db.respond("DELETE", "/rest/v1/messages", tt.status, "[]")
+			existing := "[]"
+			if tt.owner != "" {
+				existing = `[{"id":"m1","user_id":"` + tt.owner + `"}]`
+			}
+			db.respond("GET", "/rest/v1/messages", http.StatusOK, existing)
+			sb := db.client(t)
+			ctx := context.Background()
+
+			_, err := sb.UpdateMessage(ctx, "m1", "alice", "new text", "")
+			checkSentinel(t, "UpdateMessage", err, tt.want)
+			for _, soft := range []bool{true, false} {
+				_, err := sb.DeleteMessage(ctx, "m1", "alice", soft, "")
+				checkSentinel(t, "DeleteMessage", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditWindow(t *testing.T) {
+	db := newFakePostgREST(t)
+	db.respond("PATCH", "/rest/v1/messages", http.StatusOK, "[]")
+	db.respond("GET", "/rest/v1/messages", http.StatusOK, `[{"id":"m1","user_id":"alice"}]`)
+	sb := db.client(t)
+	sb.SetEditWindow(15 * time.Minute)
+
+	_, err := sb.UpdateMessage(context.Background(), "m1", "alice", "new text", "")
+	checkSentinel(t, "UpdateMessage", err, ErrEditWindowExpired)
+
+	// The PATCH only matches messages posted inside the window
+	patches := db.received("PATCH", "/rest/v1/messages")
+	if len(patches) != 1 {
+		t.Fatalf("got %d PATCHes, want 1", len(patches))
+	}
+	filter, ok := strings.CutPrefix(patches[0].Query.Get("created_at"), "gt.")
+	if !ok {
+		t.Fatalf("PATCH created_at filter = %q, want gt.<cutoff>", patches[0].Query.Get("created_at"))
+	}
+	cutoff, err := time.Parse(time.RFC3339Nano, filter)
+	if err != nil {
+		t.Fatalf("parse cutoff %q: %v", filter, err)
+	}
+	if d := time.Since(cutoff); d < 15*time.Minute || d > 16*time.Minute {
+		t.Errorf("cutoff is %s ago, want 15m", d)
+	}
+}
+
+func TestQueryValuesStayEncoded(t *testing.T) {
+	const odd = `a,b.c(d)&limit=1`
+	tests := []struct {
+		name  string
+		path  string
+		param string
+		want  string
+		call  func(ctx context.Context, sb *SupabaseClient) error
+	}{
+		{"GetChannelMessages", "/rest/v1/messages", "channel_id", "eq." + odd, func(ctx context.Context, sb *SupabaseClient) error {
+			_, _, err := sb.GetChannelMessages(ctx, odd, 10, "")
+			return err
+		}},
+		{"GetChannelMessagesBefore", "/rest/v1/messages", "or", `(created_at.lt."2026-01-01T00:00:00Z",and(created_at.eq."2026-01-01T00:00:00Z",id.lt."a,b.c(d)&limit=1"))`, func(ctx context.Context, sb *SupabaseClient) error {
+			_, _, err := sb.GetChannelMessagesBefore(ctx, "general", "2026-01-01T00:00:00Z", odd, 10, "")
+			return err
+		}},
+		{"GetProfile", "/rest/v1/profiles", "id", "eq." + odd, func(ctx context.Context, sb *SupabaseClient) error {
+			_, err := sb.GetProfile(ctx, odd)
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+			return err
+		}},
+		{"GetProfiles", "/rest/v1/profiles", "id", `in.("a,b.c(d)&limit=1","plain")`, func(ctx context.Context, sb *SupabaseClient) error {
+			_, err := sb.GetProfiles(ctx, []string{odd, "plain"})
+			return err
+		}},
+		{"GetDMMessages", "/rest/v1/dm_messages", "dm_id", "eq." + odd, func(ctx context.Context, sb *SupabaseClient) error {
+			_, err := sb.GetDMMessages(ctx, odd, 10)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakePostgREST(t)
+			if err := tt.call(context.Background(), db.client(t)); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			reqs := db.received("GET", tt.path)
+			if len(reqs) != 1 {
+				t.Fatalf("got %d requests to %s, want 1", len(reqs), tt.path)
+			}
+			if got := reqs[0].Query[tt.param]; len(got) != 1 || got[0] != tt.want {
+				t.Errorf("%s = %q, want %q", tt.param, got, tt.want)
+			}
+			for _, limit := range reqs[0].Query["limit"] {
+				if limit == "1" {
+					t.Errorf("the ID injected a limit parameter: %v", reqs[0].Query)
+				}
+			}
+		})
+	}
+}
+
+func TestQuoteValue(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"plain", `"plain"`},
+		{"a,b.c", `"a,b.c"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+	}
+	for _, tt := range tests {
+		if got := quoteValue(tt.in); got != tt.want {
+			t.Errorf("quoteValue(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUserScopedRequestsCarryUserToken(t *testing.T) {
+	row := `[{"id":"m1","channel_id":"general","user_id":"alice","created_at":"2026-01-01T00:00:00Z"}]`
+	tests := []struct {
+		name   string
+		method string
+		admin  bool // Runs with the service key even when user-scoped
+		call   func(ctx context.Context, sb *SupabaseClient) error
+	}{
+		{"InsertMessage", "POST", false, func(ctx context.Context, sb *SupabaseClient) error {
+			_, _, err := sb.InsertMessage(ctx, "general", "alice", "hi", nil, "", messageOrigin{}, "user-token")
+			return err
+		}},
+		{"GetChannelMessages", "GET", false, func(ctx context.Context, sb *SupabaseClient) error {
+			_, _, err := sb.GetChannelMessages(ctx, "general", 10, "user-token")
+			return err
+		}},
+		{"UpdateMessage", "PATCH", false, func(ctx context.Context, sb *SupabaseClient) error {
+			_, err := sb.UpdateMessage(ctx, "m1", "alice", "new text", "user-token")
+			return err
+		}},
+		{"DeleteMessage", "DELETE", false, func(ctx context.Context, sb *SupabaseClient) error {
+			_, err := sb.DeleteMessage(ctx, "m1", "alice", false, "user-token")
+			return err
+		}},
+		{"HardDeleteMessage", "DELETE", true, func(ctx context.Context, sb *SupabaseClient) error {
+			_, err := sb.HardDeleteMessage(ctx, "m1")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		for _, scoped := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/scoped=%t", tt.name, scoped), func(t *testing.T) {
+				db := newFakePostgREST(t)
+				db.respond("POST", "/rest/v1/messages", http.StatusCreated, row)
+				db.respond("PATCH", "/rest/v1/messages", http.StatusOK, row)
+				db.respond("DELETE", "/rest/v1/messages", http.StatusOK, row)
+				sb := db.client(t)
+				sb.SetUserScoped(scoped)
+
+				if err := tt.call(context.Background(), sb); err != nil {
+					t.Fatalf("%s: %v", tt.name, err)
+				}
+				reqs := db.received(tt.method, "/rest/v1/messages")
+				if len(reqs) != 1 {
+					t.Fatalf("got %d %s requests, want 1", len(reqs), tt.method)
+				}
+				want := "Bearer service-key"
+				if scoped && !tt.admin {
+					want = "Bearer user-token"
+				}
+				if got := reqs[0].Header.Get("Authorization"); got != want {
+					t.Errorf("Authorization = %q, want %q", got, want)
+				}
+				// The apikey names the project, so it stays the service key
+				if got := reqs[0].Header.Get("apikey"); got != "service-key" {
+					t.Errorf("apikey = %q, want the service key", got)
+				}
+			})
+		}
+	}
+}
+
+func TestNewSupabaseClient(t *testing.T) {
+	tests := []struct {
+		url, key string
+		wantURL  string // "" means an error
+	}{
+		{"https://proj.supabase.co", "key", "https://proj.supabase.co"},
+		{"https://proj.supabase.co/", "key", "https://proj.supabase.co"},
+		{"http://localhost:54321//", "key", "http://localhost:54321"},
+		{"", "key", ""},
+		{"https://proj.supabase.co", "", ""},
+		{"proj.supabase.co", "key", ""},
+		{"/rest/v1", "key", ""},
+		{"ftp://proj.supabase.co", "key", ""},
+		{"https://", "key", ""},
+		{"https://proj supabase.co\n", "key", ""},
+	}
+	for _, tt := range tests {
+		sb, err := NewSupabaseClient(tt.url, tt.key, SupabaseOptions{})
+		if tt.wantURL == "" {
+			if err == nil {
+				t.Errorf("NewSupabaseClient(%q, %q): got no error", tt.url, tt.key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewSupabaseClient(%q, %q): %v", tt.url, tt.key, err)
+			continue
+		}
+		if sb.url != tt.wantURL {
+			t.Errorf("NewSupabaseClient(%q): url %q, want %q", tt.url, sb.url, tt.wantURL)
+		}
+	}
+}
+
+func TestTrailingSlashKeepsPaths(t *testing.T) {
+	db := newFakePostgREST(t)
+	sb, err := NewSupabaseClient(db.URL+"/", "service-key", SupabaseOptions{})
+	if err != nil {
+		t.Fatalf("NewSupabaseClient: %v", err)
+	}
+	if _, _, err := sb.GetChannelMessages(context.Background(), "general", 50, ""); err != nil {
+		t.Fatalf("GetChannelMessages: %v", err)
+	}
+	if n := len(db.received("GET", "/rest/v1/messages")); n != 1 {
+		t.Errorf("got %d requests to /rest/v1/messages, want 1", n)
+	}
+}
+
+func TestSetReadReplica(t *testing.T) {
+	primary, replica := newFakePostgREST(t), newFakePostgREST(t)
+	sb := primary.client(t)
+	for _, bad := range []string{"replica.internal", "ftp://replica.internal", "https://"} {
+		if err := sb.SetReadReplica(bad, ""); err == nil {
+			t.Errorf("SetReadReplica(%q): got no error", bad)
+		}
+	}
+	if sb.readURL != "" {
+		t.Fatalf("a rejected replica was kept as %q", sb.readURL)
+	}
+
+	if err := sb.SetReadReplica(replica.URL+"/", ""); err != nil {
+		t.Fatalf("SetReadReplica: %v", err)
+	}
+	if _, _, err := sb.GetChannelMessages(context.Background(), "general", 50, ""); err != nil {
+		t.Fatalf("GetChannelMessages: %v", err)
+	}
+	if n := len(replica.received("GET", "/rest/v1/messages")); n != 1 {
+		t.Errorf("got %d replica reads of /rest/v1/messages, want 1", n)
+	}
+}
+
+func TestInsertMessageAudit(t *testing.T) {
+	db := newFakePostgREST(t)
+	db.respond("POST", "/rest/v1/messages", http.StatusCreated, `[{"id":"m1"}]`)
+	db.respond("POST", "/rest/v1/message_audit", http.StatusCreated, "")
+	sb := db.client(t)
+
+	ctx := context.Background()
+	if _, _, err := sb.InsertMessage(ctx, "general", "alice", "hi", nil, "", messageOrigin{}, ""); err != nil {
+		t.Fatalf("InsertMessage without origin: %v", err)
+	}
+	if _, _, err := sb.InsertMessage(ctx, "general", "alice", "hi", nil, "", messageOrigin{IP: "203.0.113.7", UserAgent: "chat-test/1.0"}, "tok-alice"); err != nil {
+		t.Fatalf("InsertMessage with origin: %v", err)
+	}
+	// Members can read messages, so the origin never goes in that row
+	for _, req := range db.received("POST", "/rest/v1/messages") {
+		if strings.Contains(req.Body, "sender_ip") || strings.Contains(req.Body, "user_agent") {
+			t.Errorf("message insert carried audit fields: %s", req.Body)
+		}
+	}
+	audits := db.received("POST", "/rest/v1/message_audit")
+	if len(audits) != 1 {
+		t.Fatalf("got %d audit writes, want only the one with an origin", len(audits))
+	}
+	var rows []map[string]any
+	if err := json.Unmarshal([]byte(audits[0].Body), &rows); err != nil || len(rows) != 1 {
+		t.Fatalf("audit body %s: %v", audits[0].Body, err)
+	}
+	if rows[0]["message_id"] != "m1" || rows[0]["sender_ip"] != "203.0.113.7" || rows[0]["user_agent"] != "chat-test/1.0" {
+		t.Errorf("got audit row %v, want m1 with the origin", rows[0])
+	}
+	if auth := audits[0].Header.Get("Authorization"); auth != "Bearer service-key" {
+		t.Errorf("audit written with %q, want the service role", auth)
+	}
+
+	// A failed audit write doesn't fail the message
+	db.respond("POST", "/rest/v1/message_audit", http.StatusInternalServerError, `{"message":"boom"}`)
+	if _, _, err := sb.InsertMessage(ctx, "general", "alice", "hi", nil, "", messageOrigin{IP: "203.0.113.7"}, ""); err != nil {
+		t.Errorf("InsertMessage with a failing audit: %v", err)
+	}
+}
+
+// checkSentinel fails unless err matches want, or, when want is nil, is an
+// error matching none of the sentinels callers branch on
+func checkSentinel(t *testing.T, op string, err, want error) {
+	t.Helper()
+	if want != nil {
+		if !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", op, err, want)
+		}
+		return
+	}
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("%s: got %v, want a plain failure", op, err)
+	}
+}
+
+func TestDeleteMessageModes(t *testing.T) {
+	row := `[{"id":"m1","channel_id":"general","user_id":"alice"}]`
+	db := newFakePostgREST(t)
+	db.respond("PATCH", "/rest/v1/messages", http.StatusOK, row)
+	db.respond("DELETE", "/rest/v1/messages", http.StatusOK, row)
+	sb := db.client(t)
+	ctx := context.Background()
+
+	if _, err := sb.DeleteMessage(ctx, "m1", "alice", true, ""); err != nil {
+		t.Fatalf("soft DeleteMessage: %v", err)
+	}
+	patches := db.received("PATCH", "/rest/v1/messages")
+	if len(patches) != 1 {
+		t.Fatalf("got %d PATCHes, want 1", len(patches))
+	}
+	var tombstone map[string]any
+	if err := json.Unmarshal([]byte(patches[0].Body), &tombstone); err != nil || tombstone["deleted"] != true || tombstone["content"] != "" {
+		t.Errorf("soft delete body %s, want deleted=true and content cleared", patches[0].Body)
+	}
+	if q := patches[0].Query; q.Get("user_id") != "eq.alice" || q.Get("deleted") != "is.false" {
+		t.Errorf("soft delete query %v, want it scoped to alice's live message", q)
+	}
+	if n := len(db.received("DELETE", "/rest/v1/messages")); n != 0 {
+		t.Errorf("soft delete removed the row")
+	}
+
+	if _, err := sb.DeleteMessage(ctx, "m1", "alice", false, ""); err != nil {
+		t.Fatalf("hard DeleteMessage: %v", err)
+	}
+	if _, err := sb.HardDeleteMessage(ctx, "m1"); err != nil {
+		t.Fatalf("HardDeleteMessage: %v", err)
+	}
+	deletes := db.received("DELETE", "/rest/v1/messages")
+	if len(deletes) != 2 || deletes[0].Query.Get("user_id") != "eq.alice" || deletes[1].Query.Has("user_id") {
+		t.Errorf("deletes %v, want the author's scoped to them and the moderator's not", deletes)
+	}
+	if n := len(db.received("PATCH", "/rest/v1/messages")); n != 1 {
+		t.Errorf("hard deletes made %d PATCHes, want none more", n-1)
+	}
+}
+
+func TestGetChannelMessagesBeforeCursor(t *testing.T) {
+	db := newFakePostgREST(t)
+	sb := db.client(t)
+
+	if _, _, err := sb.GetChannelMessagesBefore(context.Background(), "general", "2026-01-01T00:00:00.5+00:00", "m5", 50, ""); err != nil {
+		t.Fatalf("GetChannelMessagesBefore: %v", err)
+	}
+	if _, _, err := sb.GetChannelMessagesBefore(context.Background(), "general", "2026-01-01T00:00:00.5+00:00", "", 50, ""); err != nil {
+		t.Fatalf("GetChannelMessagesBefore without before_id: %v", err)
+	}
+	reqs := db.received("GET", "/rest/v1/messages")
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(reqs))
+	}
+	// Rows tied with the cursor's timestamp are split by id instead of skipped
+	want := `(created_at.lt."2026-01-01T00:00:00.5+00:00",and(created_at.eq."2026-01-01T00:00:00.5+00:00",id.lt."m5"))`
+	if got := reqs[0].Query.Get("or"); got != want {
+		t.Errorf("or filter = %s, want %s", got, want)
+	}
+	if got := reqs[0].Query.Get("order"); got != "created_at.desc,id.desc" {
+		t.Errorf("order = %s, want created_at.desc,id.desc", got)
+	}
+	if got := reqs[1].Query.Get("created_at"); got != "lt.2026-01-01T00:00:00.5+00:00" || reqs[1].Query.Has("or") {
+		t.Errorf("without before_id got query %v, want created_at=lt. alone", reqs[1].Query)
+	}
+}
+
+func TestGetChannelMessagesAfterCursor(t *testing.T) {
+	db := newFakePostgREST(t)
+	db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") == "eq.m5" {
+			writeJSON(w, http.StatusOK, []dbMessage{{ID: "m5", ChannelID: "general", CreatedAt: "2026-01-01T00:00:00.5+00:00"}})
+			return
+		}
+		writeJSON(w, http.StatusOK, []dbMessage{})
+	})
+	sb := db.client(t)
+
+	if _, err := sb.GetChannelMessagesAfter(context.Background(), "general", "m5", 50, ""); err != nil {
+		t.Fatalf("GetChannelMessagesAfter: %v", err)
+	}
+	if _, err := sb.GetChannelMessagesAfter(context.Background(), "random", "m5", 50, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("resuming from another channel's message: got %v, want ErrNotFound", err)
+	}
+	reqs := db.received("GET", "/rest/v1/messages")
+	if len(reqs) != 3 {
+		t.Fatalf("got %d requests, want 3", len(reqs))
+	}
+	// Rows tied with the cursor's timestamp are split by id instead of skipped
+	want := `(created_at.gt."2026-01-01T00:00:00.5+00:00",and(created_at.eq."2026-01-01T00:00:00.5+00:00",id.gt."m5"))`
+	if got := reqs[1].Query.Get("or"); got != want {
+		t.Errorf("or filter = %s, want %s", got, want)
+	}
+	if reqs[1].Query.Has("created_at") {
+		t.Errorf("query %v also filters on created_at alone", reqs[1].Query)
+	}
+}
+
+func TestCancelAbortsRequest(t *testing.T) {
+	db := newFakePostgREST(t)
+	release := make(chan struct{})
+	defer close(release)
+	db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		<-release // Never answers while the test is waiting
+	})
+	sb := db.client(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := sb.GetChannelMessages(ctx, "general", 50, "")
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request kept running after its context was cancelled")
+	}
+}
+
+func TestMarkDMMessageAsReadOnlyByRecipient(t *testing.T) {
+	db := newFakePostgREST(t)
+	db.handle("GET", "/rest/v1/dm_messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []map[string]string{{"dm_id": "d1", "sender_id": "alice"}})
+	})
+	db.handle("GET", "/rest/v1/direct_messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []map[string]string{{"participant1_id": "alice", "participant2_id": "bob"}})
+	})
+	db.handle("PATCH", "/rest/v1/dm_messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []dmMessage{{ID: "dm1", DMConversationID: "d1", SenderID: "alice", ReadByRecipient: true}})
+	})
+	sb := db.client(t)
+
+	for _, userID := range []string{"alice", "carol"} {
+		if _, err := sb.MarkDMMessageAsRead(context.Background(), "dm1", userID); !errors.Is(err, ErrNotAuthorized) {
+			t.Errorf("%s marking alice's DM to bob read: got %v, want ErrNotAuthorized", userID, err)
+		}
+	}
+	if _, err := sb.MarkDMMessageAsRead(context.Background(), "dm1", "bob"); err != nil {
+		t.Fatalf("bob marking the DM read: %v", err)
+	}
+	if n := len(db.received("PATCH", "/rest/v1/dm_messages")); n != 1 {
+		t.Errorf("got %d updates, want only bob's", n)
+	}
+}
+
+func TestGetUnreadDMCount(t *testing.T) {
+	db := newFakePostgREST(t)
+	db.handle("GET", "/rest/v1/direct_messages", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []map[string]string{{"id": "d1"}, {"id": "d2"}})
+	})
+	db.handle("HEAD", "/rest/v1/dm_messages", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "*/3")
+		w.WriteHeader(http.StatusOK)
+	})
+	sb := db.client(t)
+
+	n, err := sb.GetUnreadDMCount(context.Background(), "bob")
+	if err != nil || n != 3 {
+		t.Fatalf("got %d, %v; want 3 from Content-Range", n, err)
+	}
+	reqs := db.received("HEAD", "/rest/v1/dm_messages")
+	if len(reqs) != 1 {
+		t.Fatalf("got %d count requests, want 1", len(reqs))
+	}
+	q := reqs[0].Query
+	if q.Get("dm_id") != `in.("d1","d2")` || q.Get("sender_id") != "neq.bob" || reqs[0].Header.Get("Prefer") != "count=exact" {
+		t.Errorf("count request %v, want bob's received messages in d1 and d2 counted exactly", q)
+	}
+}
+
+func TestReadRateLimited(t *testing.T) {
+	db := newFakePostgREST(t)
+	db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"message": "slow down"})
+	})
+	sb := db.client(t)
+
+	_, _, err := sb.GetChannelMessages(context.Background(), "general", 50, "")
+	var rl *RateLimitedError
+	if !errors.As(err, &rl) || rl.RetryAfter != 5*time.Second || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("got %v, want a RateLimitedError asking for 5s", err)
+	}
+}
+
+func TestSupabaseOptionsTimeout(t *testing.T) {
+	db := newFakePostgREST(t)
+	release := make(chan struct{})
+	defer close(release)
+	db.handle("GET", "/rest/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	sb, err := NewSupabaseClient(db.URL, "service-key", SupabaseOptions{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewSupabaseClient: %v", err)
+	}
+
+	start := time.Now()
+	if _, _, err := sb.GetChannelMessages(context.Background(), "general", 50, ""); err == nil {
+		t.Fatal("got no error from a request that never answered")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request gave up after %s, want about the 50ms timeout", elapsed)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownMessageType is returned for a client message whose type no handler knows
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+// wsRequiredFields lists, for every client message type the server accepts,
+// the JSON fields that must be non-blank. "a|b" means at least one of a or b.
+var wsRequiredFields = map[string][]string{
+	"message":         {"channel", "content"},
+	"join":            {"channel"},
+	"switch_channel":  {"channel"},
+	"leave":           nil, // channel is optional; it guards against a stale leave
+	"time":            nil,
+	"whoami":          nil,
+	"refresh_token":   {"token"},
+	"update_profile":  {"username"},
+	"channel_count":   {"channel"},
+	"seen":            {"channel", "id"},
+	"set_status":      {"status"},
+	"typing":          {"channel"},
+	"stop_typing":     {"channel"},
+	"edit_message":    {"id", "content"},
+	"delete_message":  {"id"},
+	"add_reaction":    {"id", "emoji"},
+	"remove_reaction": {"id", "emoji"},
+	"pin_message":     {"id"},
+	"unpin_message":   {"id"},
+	"set_slow_mode":   {"channel"}, // slow_mode_seconds is a number; checked by the handler
+	"purge":           {"channel"}, // Plus target_user_id or ids; checked by the handler
+	"kick":            {"channel", "target_user_id"},
+	"ban":             {"channel", "target_user_id"},
+	"system_message":  {"channel", "content"},
+	"load_history":    {"channel", "before"},
+	"jump_to":         {"id", "channel"},
+	"get_thread":      {"id"},
+	"dm_message":      {"content|file_url", "recipient_id|dm_conversation_id"}, // Attachments may go without a caption
+	"dm_typing":       {"recipient_id"},
+	"dm_stop_typing":  {"recipient_id"},
+	"mark_read":       {"message_id"},
+	"dm_message_read": {"message_id"},
+	"dm_edit":         {"message_id", "content"},
+	"dm_delete":       {"message_id"},
+	"load_dm_history": {"dm_conversation_id", "before"},
+	"list_dms":        nil,
+	"dm_unread":       nil,
+	"list_channels":   nil,
+	"get_profile":     nil, // user_id or user_ids; checked by the handler
+}
+
+// validateWSMessage checks a decoded client message against wsRequiredFields
+func validateWSMessage(m *WSMessage) error {
+	required, ok := wsRequiredFields[m.Type]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownMessageType, m.Type)
+	}
+	for _, spec := range required {
+		present := false
+		for _, field := range strings.Split(spec, "|") {
+			if strings.TrimSpace(wsField(m, field)) != "" {
+				present = true
+				break
+			}
+		}
+		if !present {
+			return fmt.Errorf("%s requires %s", m.Type, strings.ReplaceAll(spec, "|", " or "))
+		}
+	}
+	return nil
+}
+
+// wsField returns the WSMessage field with the given JSON name
+func wsField(m *WSMessage, name string) string {
+	switch name {
+	case "channel":
+		return m.Channel
+	case "content":
+		return m.Content
+	case "id":
+		return m.ID
+	case "emoji":
+		return m.Emoji
+	case "before":
+		return m.Before
+	case "status":
+		return m.Status
+	case "file_url":
+		return m.FileURL
+	case "recipient_id":
+		return m.RecipientID
+	case "dm_conversation_id":
+		return m.DMConversationID
+	case "message_id":
+		return m.MessageID
+	case "target_user_id":
+		return m.TargetUserID
+	case "token":
+		return m.Token
+	case "username":
+		return m.Username
+	}
+	panic("wsField: no field " + name) // A typo in wsRequiredFields, not bad input
+}
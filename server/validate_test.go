@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateWSMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     WSMessage
+		wantErr bool
+	}{
+		{"message", WSMessage{Type: "message", Channel: "general", Content: "hi"}, false},
+		{"message without channel", WSMessage{Type: "message", Content: "hi"}, true},
+		{"message without content", WSMessage{Type: "message", Channel: "general"}, true},
+		{"message with blank content", WSMessage{Type: "message", Channel: "general", Content: " \n "}, true},
+		{"join", WSMessage{Type: "join", Channel: "general"}, false},
+		{"leave without channel", WSMessage{Type: "leave"}, false},
+		{"dm_unread", WSMessage{Type: "dm_unread"}, false},
+		{"refresh_token without token", WSMessage{Type: "refresh_token"}, true},
+		{"update_profile without username", WSMessage{Type: "update_profile"}, true},
+		{"get_profile without ids", WSMessage{Type: "get_profile"}, false},
+		{"seen without id", WSMessage{Type: "seen", Channel: "general"}, true},
+		{"switch_channel without channel", WSMessage{Type: "switch_channel"}, true},
+		{"kick", WSMessage{Type: "kick", Channel: "general", TargetUserID: "bob"}, false},
+		{"kick without target", WSMessage{Type: "kick", Channel: "general"}, true},
+		{"system_message without content", WSMessage{Type: "system_message", Channel: "general"}, true},
+		{"edit without id", WSMessage{Type: "edit_message", Content: "fixed"}, true},
+		{"reaction without emoji", WSMessage{Type: "add_reaction", ID: "m1"}, true},
+		{"dm to recipient", WSMessage{Type: "dm_message", Content: "hi", RecipientID: "bob"}, false},
+		{"dm to conversation", WSMessage{Type: "dm_message", Content: "hi", DMConversationID: "dm1"}, false},
+		{"dm attachment without caption", WSMessage{Type: "dm_message", FileURL: "https://files.example.com/a.png", RecipientID: "bob"}, false},
+		{"dm without content or file", WSMessage{Type: "dm_message", RecipientID: "bob"}, true},
+		{"dm without recipient", WSMessage{Type: "dm_message", Content: "hi"}, true},
+		{"load_history without cursor", WSMessage{Type: "load_history", Channel: "general"}, true},
+		{"load_dm_history without cursor", WSMessage{Type: "load_dm_history", DMConversationID: "dm1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateWSMessage(&tt.msg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateWSMessage(%+v) = %v, want error %t", tt.msg, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateWSMessageUnknownType(t *testing.T) {
+	for _, typ := range []string{"", "mesage", "MESSAGE"} {
+		if err := validateWSMessage(&WSMessage{Type: typ}); !errors.Is(err, ErrUnknownMessageType) {
+			t.Errorf("type %q: got %v, want ErrUnknownMessageType", typ, err)
+		}
+	}
+}
+
+// Every field named in wsRequiredFields must be one wsField knows, or
+// validating that type would panic
+func TestRequiredFieldsKnown(t *testing.T) {
+	for typ := range wsRequiredFields {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("validating %s: %v", typ, r)
+				}
+			}()
+			validateWSMessage(&WSMessage{Type: typ})
+		}()
+	}
+}
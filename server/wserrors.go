@@ -0,0 +1,112 @@
+package main
+
+import "fmt"
+
+// ErrorCode is the machine-readable reason in an error frame. Codes are part of
+// the client protocol: add new ones freely, but never rename or reuse one.
+type ErrorCode string
+
+const (
+	ErrCodeInvalidPayload       ErrorCode = "invalid_payload"
+	ErrCodeNotAMember           ErrorCode = "not_a_member"
+	ErrCodeNotAuthorized        ErrorCode = "not_authorized"
+	ErrCodeNotFound             ErrorCode = "not_found"         // Edit/delete target is gone
+	ErrCodeMessageNotFound      ErrorCode = "message_not_found" // Reaction/pin/jump target is gone
+	ErrCodeChannelNotFound      ErrorCode = "channel_not_found"
+	ErrCodeInvalidStatus        ErrorCode = "invalid_status"
+	ErrCodeMessageTooLong       ErrorCode = "message_too_long"
+	ErrCodeRateLimited          ErrorCode = "rate_limited"
+	ErrCodeInvalidReply         ErrorCode = "invalid_reply"
+	ErrCodeInvalidAttachment    ErrorCode = "invalid_attachment"
+	ErrCodeEmojiNotAllowed      ErrorCode = "emoji_not_allowed"
+	ErrCodeReactionLimitReached ErrorCode = "reaction_limit_reached"
+	ErrCodeHistoryUnavailable   ErrorCode = "history_unavailable"
+	ErrCodeFailedToPersist      ErrorCode = "failed_to_persist"
+	ErrCodeFailedToEdit         ErrorCode = "failed_to_edit"
+	ErrCodeFailedToDelete       ErrorCode = "failed_to_delete"
+	ErrCodeFailedToReact        ErrorCode = "failed_to_react"
+	ErrCodeFailedToPin          ErrorCode = "failed_to_pin"
+	ErrCodeFailedToJump         ErrorCode = "failed_to_jump"
+	ErrCodeFailedToLoadThread   ErrorCode = "failed_to_load_thread"
+	ErrCodeFailedToSendDM       ErrorCode = "failed_to_send_dm"
+	ErrCodeFailedToListDMs      ErrorCode = "failed_to_list_dms"
+	ErrCodeFailedToListChannels ErrorCode = "failed_to_list_channels"
+	ErrCodeFailedToCountUnread  ErrorCode = "failed_to_count_unread"
+	ErrCodeFailedToLoadProfiles ErrorCode = "failed_to_load_profiles"
+	ErrCodeFailedToMarkRead     ErrorCode = "failed_to_mark_read"
+	ErrCodeSlowMode             ErrorCode = "slow_mode"
+	ErrCodeFailedToSetSlowMode  ErrorCode = "failed_to_set_slow_mode"
+	ErrCodeEditTooOld           ErrorCode = "edit_too_old"
+	ErrCodeFailedToPurge        ErrorCode = "failed_to_purge"
+	ErrCodeFiltered             ErrorCode = "filtered"
+	ErrCodeBanned               ErrorCode = "banned"
+	ErrCodeFailedToModerate     ErrorCode = "failed_to_moderate"
+	ErrCodeFailedToRefreshToken ErrorCode = "failed_to_refresh_token"
+	ErrCodeUsernameTaken        ErrorCode = "username_taken"
+	ErrCodeInvalidUsername      ErrorCode = "invalid_username"
+	ErrCodeFailedToSaveProfile  ErrorCode = "failed_to_save_profile"
+)
+
+// errorMessages are the human-readable defaults shown when a caller gives none
+var errorMessages = map[ErrorCode]string{
+	ErrCodeInvalidPayload:       "The request was malformed or missing a required field.",
+	ErrCodeNotAMember:           "You are not a member of this channel.",
+	ErrCodeNotAuthorized:        "You are not allowed to do that.",
+	ErrCodeNotFound:             "That message no longer exists.",
+	ErrCodeMessageNotFound:      "That message no longer exists.",
+	ErrCodeChannelNotFound:      "That channel does not exist.",
+	ErrCodeInvalidStatus:        "Status must be online, away or offline.",
+	ErrCodeMessageTooLong:       fmt.Sprintf("Messages are limited to %d characters.", maxMessageLen),
+	ErrCodeRateLimited:          "You are sending messages too quickly.",
+	ErrCodeInvalidReply:         "You can only reply to messages in the same channel.",
+	ErrCodeInvalidAttachment:    "The attachment type or URL is invalid.",
+	ErrCodeEmojiNotAllowed:      "That reaction is not allowed.",
+	ErrCodeReactionLimitReached: "This message has too many different reactions.",
+	ErrCodeHistoryUnavailable:   "Message history is temporarily unavailable.",
+	ErrCodeFailedToPersist:      "Your message could not be sent.",
+	ErrCodeFailedToEdit:         "The message could not be edited.",
+	ErrCodeFailedToDelete:       "The message could not be deleted.",
+	ErrCodeFailedToReact:        "The reaction could not be saved.",
+	ErrCodeFailedToPin:          "The pin could not be updated.",
+	ErrCodeFailedToJump:         "That message could not be loaded.",
+	ErrCodeFailedToLoadThread:   "That thread could not be loaded.",
+	ErrCodeFailedToSendDM:       "Your direct message could not be sent.",
+	ErrCodeFailedToListDMs:      "Your conversations could not be loaded.",
+	ErrCodeFailedToListChannels: "Your channels could not be loaded.",
+	ErrCodeFailedToCountUnread:  "Your unread messages could not be counted.",
+	ErrCodeFailedToLoadProfiles: "Those profiles could not be loaded.",
+	ErrCodeFailedToMarkRead:     "The message could not be marked as read.",
+	ErrCodeSlowMode:             "Slow mode is on in this channel.",
+	ErrCodeFailedToSetSlowMode:  "Slow mode could not be changed.",
+	ErrCodeEditTooOld:           "This message is too old to edit.",
+	ErrCodeFailedToPurge:        "The messages could not be removed.",
+	ErrCodeFiltered:             "Your message contains a blocked word.",
+	ErrCodeBanned:               "You are banned from this channel.",
+	ErrCodeFailedToModerate:     "The user could not be removed.",
+	ErrCodeFailedToRefreshToken: "The token could not be checked right now; try again shortly.",
+	ErrCodeUsernameTaken:        "That username is already taken.",
+	ErrCodeInvalidUsername:      "Usernames need at least 3 characters: letters, digits and underscores.",
+	ErrCodeFailedToSaveProfile:  "Your profile could not be saved.",
+}
+
+// ErrorPayload is the structured body of an error frame
+type ErrorPayload struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// sendError writes an error frame to conn. ref carries whatever identifies the
+// failed request (channel, id, client_id, ...) so the client can match it up;
+// an empty message takes the code's default. The code is also put in content
+// for clients that predate the error object.
+func sendError(conn *lockedConn, code ErrorCode, message string, ref WSMessage) {
+	if message == "" {
+		message = errorMessages[code]
+	}
+	ref.Type = "error"
+	ref.Content = string(code)
+	ref.Error = &ErrorPayload{Code: code, Message: message}
+	if err := conn.WriteJSON(ref); err != nil {
+		logDebugf("failed to send %s error to %s: %v", code, conn.RemoteAddr(), err)
+	}
+}
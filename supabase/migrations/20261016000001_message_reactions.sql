@@ -0,0 +1,40 @@
+-- Add emoji reactions on channel messages
+-- One row per (message, user, emoji); counts are aggregated by the server
+
+CREATE TABLE IF NOT EXISTS public.message_reactions (
+    id UUID DEFAULT gen_random_uuid() PRIMARY KEY,
+    message_id UUID REFERENCES public.messages(id) ON DELETE CASCADE NOT NULL,
+    user_id UUID REFERENCES public.profiles(id) ON DELETE CASCADE NOT NULL,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    CONSTRAINT emoji_length CHECK (char_length(emoji) >= 1 AND char_length(emoji) <= 32),
+    UNIQUE(message_id, user_id, emoji)
+);
+
+-- Create indexes for performance
+CREATE INDEX IF NOT EXISTS idx_message_reactions_message_id ON public.message_reactions(message_id);
+CREATE INDEX IF NOT EXISTS idx_message_reactions_user_id ON public.message_reactions(user_id);
+
+-- Enable RLS
+ALTER TABLE public.message_reactions ENABLE ROW LEVEL SECURITY;
+
+-- RLS policies for message_reactions
+CREATE POLICY "Channel members can view reactions" ON public.message_reactions
+    FOR SELECT USING (EXISTS (
+        SELECT 1 FROM public.messages m
+        JOIN public.channel_members cm ON cm.channel_id = m.channel_id
+        WHERE m.id = message_reactions.message_id AND cm.user_id = auth.uid()
+    ));
+
+CREATE POLICY "Channel members can add their own reactions" ON public.message_reactions
+    FOR INSERT WITH CHECK (
+        user_id = auth.uid() AND EXISTS (
+            SELECT 1 FROM public.messages m
+            JOIN public.channel_members cm ON cm.channel_id = m.channel_id
+            WHERE m.id = message_reactions.message_id AND cm.user_id = auth.uid()
+        )
+    );
+
+CREATE POLICY "Users can remove their own reactions" ON public.message_reactions
+    FOR DELETE USING (user_id = auth.uid());
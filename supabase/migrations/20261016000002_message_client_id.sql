@@ -0,0 +1,12 @@
+-- Idempotent message inserts: clients tag each message with their own ID so a
+-- retried send after a dropped ack resolves to the original row
+
+ALTER TABLE public.messages ADD COLUMN IF NOT EXISTS client_message_id TEXT;
+
+ALTER TABLE public.messages ADD CONSTRAINT client_message_id_length
+    CHECK (client_message_id IS NULL OR char_length(client_message_id) <= 64);
+
+-- Scoped per author so one user's IDs can never collide with another's
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_user_client_message_id
+    ON public.messages(user_id, client_message_id)
+    WHERE client_message_id IS NOT NULL;
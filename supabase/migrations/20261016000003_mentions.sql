@@ -0,0 +1,27 @@
+-- Record @mentions so users who were offline can catch up on them later
+
+CREATE TABLE IF NOT EXISTS public.mentions (
+    id UUID DEFAULT gen_random_uuid() PRIMARY KEY,
+    message_id UUID REFERENCES public.messages(id) ON DELETE CASCADE NOT NULL,
+    channel_id UUID REFERENCES public.channels(id) ON DELETE CASCADE NOT NULL,
+    mentioned_user_id UUID REFERENCES public.profiles(id) ON DELETE CASCADE NOT NULL,
+    sender_id UUID REFERENCES public.profiles(id) ON DELETE CASCADE NOT NULL,
+    read BOOLEAN DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE(message_id, mentioned_user_id)
+);
+
+-- Create indexes for performance
+CREATE INDEX IF NOT EXISTS idx_mentions_mentioned_user_id ON public.mentions(mentioned_user_id);
+CREATE INDEX IF NOT EXISTS idx_mentions_unread ON public.mentions(mentioned_user_id) WHERE read = false;
+
+-- Enable RLS
+ALTER TABLE public.mentions ENABLE ROW LEVEL SECURITY;
+
+-- Rows are written by the server; users can only see and mark their own
+CREATE POLICY "Users can view their mentions" ON public.mentions
+    FOR SELECT USING (mentioned_user_id = auth.uid());
+
+CREATE POLICY "Users can mark their mentions read" ON public.mentions
+    FOR UPDATE USING (mentioned_user_id = auth.uid());
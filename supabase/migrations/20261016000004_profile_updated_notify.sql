@@ -0,0 +1,18 @@
+-- Tell the chat server when a username changes so it can drop its cached copy
+
+CREATE OR REPLACE FUNCTION public.notify_profile_updated()
+RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('profile_updated', json_build_object(
+        'user_id', NEW.id
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER;
+
+DROP TRIGGER IF EXISTS on_profile_username_updated ON public.profiles;
+CREATE TRIGGER on_profile_username_updated
+    AFTER UPDATE OF username ON public.profiles
+    FOR EACH ROW
+    WHEN (OLD.username IS DISTINCT FROM NEW.username)
+    EXECUTE FUNCTION public.notify_profile_updated();
@@ -0,0 +1,39 @@
+-- Pinned messages: channel owners and admins pin messages to the channel header
+-- A message is pinned at most once; pins go away with the message or channel
+
+CREATE TABLE IF NOT EXISTS public.pinned_messages (
+    id UUID DEFAULT gen_random_uuid() PRIMARY KEY,
+    channel_id UUID REFERENCES public.channels(id) ON DELETE CASCADE NOT NULL,
+    message_id UUID REFERENCES public.messages(id) ON DELETE CASCADE NOT NULL,
+    pinned_by UUID REFERENCES public.profiles(id) ON DELETE SET NULL,
+    pinned_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE(message_id)
+);
+
+-- Create indexes for performance
+CREATE INDEX IF NOT EXISTS idx_pinned_messages_channel_id ON public.pinned_messages(channel_id, pinned_at DESC);
+
+-- Enable RLS
+ALTER TABLE public.pinned_messages ENABLE ROW LEVEL SECURITY;
+
+-- RLS policies for pinned_messages
+CREATE POLICY "Channel members can view pins" ON public.pinned_messages
+    FOR SELECT USING (EXISTS (
+        SELECT 1 FROM public.channel_members cm
+        WHERE cm.channel_id = pinned_messages.channel_id AND cm.user_id = auth.uid()
+    ));
+
+CREATE POLICY "Channel moderators can pin messages" ON public.pinned_messages
+    FOR INSERT WITH CHECK (EXISTS (
+        SELECT 1 FROM public.channel_members cm
+        WHERE cm.channel_id = pinned_messages.channel_id AND cm.user_id = auth.uid()
+          AND cm.role IN ('owner', 'admin')
+    ));
+
+CREATE POLICY "Channel moderators can unpin messages" ON public.pinned_messages
+    FOR DELETE USING (EXISTS (
+        SELECT 1 FROM public.channel_members cm
+        WHERE cm.channel_id = pinned_messages.channel_id AND cm.user_id = auth.uid()
+          AND cm.role IN ('owner', 'admin')
+    ));
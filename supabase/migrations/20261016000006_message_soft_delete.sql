@@ -0,0 +1,4 @@
+-- Soft-deleted messages: authors' deletes blank the content and keep the row as
+-- a tombstone so replies to it still have a parent
+
+ALTER TABLE public.messages ADD COLUMN IF NOT EXISTS deleted BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,27 @@
+-- Per-channel settings, starting with message retention
+-- retention_days NULL keeps messages forever; pinned messages are never purged
+
+CREATE TABLE IF NOT EXISTS public.channel_settings (
+    channel_id UUID REFERENCES public.channels(id) ON DELETE CASCADE PRIMARY KEY,
+    retention_days INTEGER,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    CONSTRAINT retention_days_positive CHECK (retention_days IS NULL OR retention_days > 0)
+);
+
+-- Enable RLS
+ALTER TABLE public.channel_settings ENABLE ROW LEVEL SECURITY;
+
+-- RLS policies for channel_settings
+CREATE POLICY "Channel members can view settings" ON public.channel_settings
+    FOR SELECT USING (EXISTS (
+        SELECT 1 FROM public.channel_members cm
+        WHERE cm.channel_id = channel_settings.channel_id AND cm.user_id = auth.uid()
+    ));
+
+CREATE POLICY "Channel moderators can manage settings" ON public.channel_settings
+    FOR ALL USING (EXISTS (
+        SELECT 1 FROM public.channel_members cm
+        WHERE cm.channel_id = channel_settings.channel_id AND cm.user_id = auth.uid()
+          AND cm.role IN ('owner', 'admin')
+    ));
@@ -0,0 +1,6 @@
+-- Slow mode: minimum seconds between a user's posts in a channel (0 = off)
+
+ALTER TABLE public.channel_settings ADD COLUMN IF NOT EXISTS slow_mode_seconds INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE public.channel_settings ADD CONSTRAINT slow_mode_seconds_range
+    CHECK (slow_mode_seconds >= 0 AND slow_mode_seconds <= 21600);
@@ -0,0 +1,9 @@
+-- The chat server caches avatars alongside usernames, so tell it when an
+-- avatar changes too (reuses notify_profile_updated from the username trigger)
+
+DROP TRIGGER IF EXISTS on_profile_avatar_updated ON public.profiles;
+CREATE TRIGGER on_profile_avatar_updated
+    AFTER UPDATE OF avatar_url ON public.profiles
+    FOR EACH ROW
+    WHEN (OLD.avatar_url IS DISTINCT FROM NEW.avatar_url)
+    EXECUTE FUNCTION public.notify_profile_updated();
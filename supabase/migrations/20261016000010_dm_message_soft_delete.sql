@@ -0,0 +1,4 @@
+-- Soft-deleted DMs: senders' deletes blank the content and attachment and keep
+-- the row as a tombstone so the conversation (and replies) stay continuous
+
+ALTER TABLE public.dm_messages ADD COLUMN IF NOT EXISTS deleted BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,21 @@
+-- Tell the chat server about every new channel message, so rows inserted by
+-- other services, bots or REST clients reach connected WebSocket clients too.
+-- Only IDs are sent: NOTIFY payloads are capped at 8000 bytes, less than a
+-- full-length message.
+
+CREATE OR REPLACE FUNCTION public.notify_new_message()
+RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('new_message', json_build_object(
+        'id', NEW.id,
+        'channel_id', NEW.channel_id
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER;
+
+DROP TRIGGER IF EXISTS on_message_inserted ON public.messages;
+CREATE TRIGGER on_message_inserted
+    AFTER INSERT ON public.messages
+    FOR EACH ROW
+    EXECUTE FUNCTION public.notify_new_message();
@@ -0,0 +1,42 @@
+-- Channel bans: channel owners and admins ban users, who then can't rejoin
+-- A ban goes away with the channel; unbanning is deleting the row
+
+CREATE TABLE IF NOT EXISTS public.channel_bans (
+    id UUID DEFAULT gen_random_uuid() PRIMARY KEY,
+    channel_id UUID REFERENCES public.channels(id) ON DELETE CASCADE NOT NULL,
+    user_id UUID REFERENCES public.profiles(id) ON DELETE CASCADE NOT NULL,
+    banned_by UUID REFERENCES public.profiles(id) ON DELETE SET NULL,
+    banned_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE(channel_id, user_id)
+);
+
+-- Create indexes for performance
+CREATE INDEX IF NOT EXISTS idx_channel_bans_user_id ON public.channel_bans(user_id);
+
+-- Enable RLS
+ALTER TABLE public.channel_bans ENABLE ROW LEVEL SECURITY;
+
+-- RLS policies for channel_bans
+CREATE POLICY "Users can see their own bans" ON public.channel_bans
+    FOR SELECT USING (user_id = auth.uid());
+
+CREATE POLICY "Channel moderators can manage bans" ON public.channel_bans
+    FOR ALL USING (EXISTS (
+        SELECT 1 FROM public.channel_members cm
+        WHERE cm.channel_id = channel_bans.channel_id AND cm.user_id = auth.uid()
+          AND cm.role IN ('owner', 'admin')
+    ));
+
+-- Banned users can't join the channel again on their own
+DROP POLICY IF EXISTS "Users can join public channels" ON public.channel_members;
+CREATE POLICY "Users can join public channels" ON public.channel_members
+    FOR INSERT WITH CHECK (
+        user_id = auth.uid() AND EXISTS (
+            SELECT 1 FROM public.channels
+            WHERE id = channel_members.channel_id AND is_private = false
+        ) AND NOT EXISTS (
+            SELECT 1 FROM public.channel_bans cb
+            WHERE cb.channel_id = channel_members.channel_id AND cb.user_id = auth.uid()
+        )
+    );
@@ -0,0 +1,9 @@
+-- Message audit: where each channel message was sent from, for abuse
+-- investigation. The chat server fills these only when MESSAGE_AUDIT is on and
+-- never selects them for clients; both stay NULL otherwise.
+
+ALTER TABLE public.messages ADD COLUMN IF NOT EXISTS sender_ip INET;
+ALTER TABLE public.messages ADD COLUMN IF NOT EXISTS user_agent TEXT;
+
+ALTER TABLE public.messages ADD CONSTRAINT user_agent_length
+    CHECK (user_agent IS NULL OR char_length(user_agent) <= 512);
@@ -0,0 +1,14 @@
+-- System messages: moderator notices ("Channel renamed", "Topic updated") that
+-- live in a channel's history but render as system lines rather than chat.
+-- user_id records the moderator who posted one.
+
+ALTER TABLE public.messages ADD COLUMN IF NOT EXISTS system BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Only the chat server (service role) posts system messages, after checking
+-- the moderator role; members can't insert them directly
+DROP POLICY IF EXISTS "Channel members can insert messages" ON public.messages;
+CREATE POLICY "Channel members can insert messages" ON public.messages
+    FOR INSERT WITH CHECK (EXISTS (
+        SELECT 1 FROM public.channel_members 
+        WHERE channel_id = messages.channel_id AND user_id = auth.uid()
+    ) AND user_id = auth.uid() AND system = false);
@@ -0,0 +1,15 @@
+-- Carry the new username and avatar (and the old username) in profile_updated
+-- so the chat server can tell connected clients what changed without a lookup
+
+CREATE OR REPLACE FUNCTION public.notify_profile_updated()
+RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('profile_updated', json_build_object(
+        'user_id', NEW.id,
+        'username', NEW.username,
+        'previous_username', OLD.username,
+        'avatar_url', NEW.avatar_url
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER;
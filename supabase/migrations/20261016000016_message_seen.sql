@@ -0,0 +1,31 @@
+-- Channel read receipts ("seen by 5"): one row per reader per message. Off by
+-- default; moderators turn them on per channel with channel_settings.read_receipts
+-- since every reader writes a row.
+
+CREATE TABLE IF NOT EXISTS public.message_seen (
+    message_id UUID REFERENCES public.messages(id) ON DELETE CASCADE NOT NULL,
+    user_id UUID REFERENCES public.profiles(id) ON DELETE CASCADE NOT NULL,
+    seen_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    PRIMARY KEY (message_id, user_id)
+);
+
+-- Enable RLS
+ALTER TABLE public.message_seen ENABLE ROW LEVEL SECURITY;
+
+-- RLS policies for message_seen
+CREATE POLICY "Channel members can view receipts" ON public.message_seen
+    FOR SELECT USING (EXISTS (
+        SELECT 1 FROM public.messages m
+        JOIN public.channel_members cm ON cm.channel_id = m.channel_id
+        WHERE m.id = message_seen.message_id AND cm.user_id = auth.uid()
+    ));
+
+CREATE POLICY "Channel members can record their own receipts" ON public.message_seen
+    FOR INSERT WITH CHECK (user_id = auth.uid() AND EXISTS (
+        SELECT 1 FROM public.messages m
+        JOIN public.channel_members cm ON cm.channel_id = m.channel_id
+        WHERE m.id = message_seen.message_id AND cm.user_id = auth.uid()
+    ));
+
+ALTER TABLE public.channel_settings ADD COLUMN IF NOT EXISTS read_receipts BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,24 @@
+-- Message audit, moved off messages: any member who can read a channel could
+-- select sender_ip and user_agent there, and Realtime sent them with every
+-- insert. message_audit has RLS on and no policies, so only the service role
+-- (the chat server) can read or write it.
+
+CREATE TABLE IF NOT EXISTS public.message_audit (
+    message_id UUID PRIMARY KEY REFERENCES public.messages(id) ON DELETE CASCADE,
+    sender_ip INET,
+    user_agent TEXT CHECK (user_agent IS NULL OR char_length(user_agent) <= 512),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+ALTER TABLE public.message_audit ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.message_audit FROM anon, authenticated;
+
+-- Keep what was already recorded
+INSERT INTO public.message_audit (message_id, sender_ip, user_agent)
+    SELECT id, sender_ip, user_agent FROM public.messages
+    WHERE sender_ip IS NOT NULL OR user_agent IS NOT NULL
+    ON CONFLICT (message_id) DO NOTHING;
+
+ALTER TABLE public.messages DROP CONSTRAINT IF EXISTS user_agent_length;
+ALTER TABLE public.messages DROP COLUMN IF EXISTS sender_ip;
+ALTER TABLE public.messages DROP COLUMN IF EXISTS user_agent;
@@ -0,0 +1,8 @@
+-- Authors could PATCH system = true onto their own messages, dressing chat up
+-- as a moderator notice. Edits now only apply to, and can only produce,
+-- ordinary messages; system ones are the chat server's (service role) alone.
+
+DROP POLICY IF EXISTS "Message authors can update their messages" ON public.messages;
+CREATE POLICY "Message authors can update their messages" ON public.messages
+    FOR UPDATE USING (user_id = auth.uid() AND system = false)
+    WITH CHECK (user_id = auth.uid() AND system = false);
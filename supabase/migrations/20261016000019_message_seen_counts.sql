@@ -0,0 +1,15 @@
+-- Seen counts for a batch of messages, counted in the database. Fetching every
+-- receipt row and counting in the chat server was cut short by PostgREST's
+-- max-rows cap once a channel had enough readers. The IDs travel in the
+-- request body, so a large batch doesn't make for an over-long URL either.
+
+CREATE OR REPLACE FUNCTION public.message_seen_counts(message_ids UUID[])
+RETURNS TABLE (
+    message_id UUID,
+    seen BIGINT
+) AS $$
+    SELECT s.message_id, COUNT(*)
+    FROM public.message_seen s
+    WHERE s.message_id = ANY(message_ids)
+    GROUP BY s.message_id;
+$$ LANGUAGE sql STABLE;